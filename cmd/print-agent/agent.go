@@ -4,11 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"queue-system/internal/printer"
@@ -18,6 +21,28 @@ type PrintAgent struct {
 	config  *AgentConfig
 	printer *printer.Printer
 	client  *http.Client
+	spool   *Spool
+
+	mu            sync.Mutex // guards the counters reported to the server
+	printed       int
+	failed        int
+	lastError     string
+	printerStatus string // printer status code of the last report
+}
+
+// AgentStatus is the health report sent to the server on connect and every
+// statusInterval.
+type AgentStatus struct {
+	Version     string `json:"version"`
+	Hostname    string `json:"hostname"`
+	PrinterName string `json:"printer_name"`
+	PaperSize   string `json:"paper_size"`
+	JobsPrinted int    `json:"jobs_printed"`
+	JobsFailed  int    `json:"jobs_failed"`
+	LastError   string `json:"last_error"`
+	// Printer condition from DLE EOT (printer.Status* codes); empty when
+	// the transport cannot read status
+	PrinterStatus string `json:"printer_status"`
 }
 
 type PrintJobResponse struct {
@@ -27,6 +52,7 @@ type PrintJobResponse struct {
 	DateTime     string `json:"date_time"`
 	TemplateJSON string `json:"template_json"`
 	Status       string `json:"status"`
+	ETA          string `json:"eta"`
 }
 
 type SSEEvent struct {
@@ -39,22 +65,30 @@ type PrintJobEvent struct {
 	QueueNumber string `json:"queue_number"`
 }
 
-func NewPrintAgent(cfg *AgentConfig) *PrintAgent {
+func NewPrintAgent(cfg *AgentConfig, spool *Spool) *PrintAgent {
 	return &PrintAgent{
 		config: cfg,
+		spool:  spool,
 		printer: printer.New(printer.PrinterConfig{
 			Enabled:     true,
 			PrinterName: cfg.PrinterName,
+			Transport:   cfg.Transport,
+			Address:     cfg.Address,
+			Device:      cfg.Device,
 		}),
 		client: &http.Client{Timeout: 30 * time.Second},
 	}
 }
 
-
 // Run starts the agent loop: catch up pending jobs, then subscribe to SSE.
 // On disconnection, it waits and retries.
 func (a *PrintAgent) Run(stop <-chan struct{}) {
+	go a.statusLoop(stop)
+
 	for {
+		a.reportStatus()
+		a.replaySpool()
+
 		log.Println("Catching up pending jobs...")
 		a.catchUpPendingJobs()
 
@@ -82,9 +116,92 @@ func (a *PrintAgent) Run(stop <-chan struct{}) {
 	}
 }
 
+// do sends a request to the server authenticated with the agent's API key.
+func (a *PrintAgent) do(client *http.Client, method, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.config.APIKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return client.Do(req)
+}
+
+// statusInterval is how often the agent reports its health to the server.
+const statusInterval = 30 * time.Second
+
+// statusLoop reports the agent's health and retries spooled job reports
+// every statusInterval until stop is closed.
+func (a *PrintAgent) statusLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			a.reportStatus()
+			a.replaySpool()
+		}
+	}
+}
+
+func (a *PrintAgent) reportStatus() {
+	hostname, _ := os.Hostname()
+
+	printerStatus := ""
+	if s, err := a.printer.QueryStatus(); err == nil {
+		printerStatus = s.Code()
+	} else if !errors.Is(err, printer.ErrStatusUnsupported) {
+		log.Printf("Printer status query failed: %v", err)
+	}
+
+	a.mu.Lock()
+	status := AgentStatus{
+		Version:     version,
+		Hostname:    hostname,
+		PrinterName: a.config.PrinterName,
+		PaperSize:   a.config.PaperSize,
+		JobsPrinted: a.printed,
+		JobsFailed:  a.failed,
+		LastError:   a.lastError,
+
+		PrinterStatus: printerStatus,
+	}
+	a.printerStatus = printerStatus
+	a.mu.Unlock()
+
+	url := fmt.Sprintf("%s/api/print-agent/status", a.config.ServerURL)
+	body, _ := json.Marshal(status)
+	resp, err := a.do(a.client, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to report status: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Status report returned status %d", resp.StatusCode)
+	}
+}
+
+// recordResult counts a finished job for the next status report.
+func (a *PrintAgent) recordResult(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		a.failed++
+		a.lastError = err.Error()
+		return
+	}
+	a.printed++
+}
+
 func (a *PrintAgent) catchUpPendingJobs() {
 	url := fmt.Sprintf("%s/api/print-agent/jobs/pending", a.config.ServerURL)
-	resp, err := a.client.Get(url)
+	resp, err := a.do(a.client, http.MethodGet, url, nil)
 	if err != nil {
 		log.Printf("Failed to fetch pending jobs: %v", err)
 		return
@@ -113,12 +230,15 @@ func (a *PrintAgent) subscribeSSE(stop <-chan struct{}) error {
 
 	// Use a client without timeout for SSE (long-lived connection)
 	sseClient := &http.Client{}
-	resp, err := sseClient.Get(url)
+	resp, err := a.do(sseClient, http.MethodGet, url, nil)
 	if err != nil {
 		return fmt.Errorf("failed to connect SSE: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("SSE rejected the API key; check api_key in config")
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("SSE returned status %d", resp.StatusCode)
 	}
@@ -190,6 +310,15 @@ func (a *PrintAgent) handleSSEMessage(data string) {
 }
 
 func (a *PrintAgent) processJob(jobID int64) {
+	// A ticket this agent already printed, or may have printed before it
+	// stopped, is never printed again. The server re-offers it only when
+	// the report was lost or came after the lease expired.
+	if entry, ok := a.spool.Get(jobID); ok && (entry.State == spoolPrinted || entry.State == spoolInterrupted) {
+		log.Printf("Job #%d was already %s; reporting it again", jobID, entry.State)
+		a.reportResult(entry)
+		return
+	}
+
 	// 1. Claim the job
 	claimed, err := a.claimJob(jobID)
 	if err != nil {
@@ -198,12 +327,22 @@ func (a *PrintAgent) processJob(jobID int64) {
 	}
 
 	log.Printf("Claimed job #%d: %s", jobID, claimed.QueueNumber)
+	entry := SpoolEntry{JobID: jobID, QueueNumber: claimed.QueueNumber, State: spoolClaimed}
+	if err := a.spool.Set(entry); err != nil {
+		log.Printf("Failed to spool job #%d: %v", jobID, err)
+	}
+
+	// Keep the lease while the job is in hand so the server does not
+	// requeue it to another agent mid-print
+	done := make(chan struct{})
+	defer close(done)
+	go a.heartbeat(jobID, done)
 
 	// 2. Parse template from JSON
 	var tmpl printer.TicketTemplate
 	if err := json.Unmarshal([]byte(claimed.TemplateJSON), &tmpl); err != nil {
 		log.Printf("Failed to parse template for job #%d: %v", jobID, err)
-		a.failJob(jobID, "failed to parse template: "+err.Error())
+		a.finishJob(entry, fmt.Errorf("failed to parse template: %w", err))
 		return
 	}
 
@@ -217,29 +356,82 @@ func (a *PrintAgent) processJob(jobID int64) {
 		tmpl.FeedLines = a.config.FeedLines
 	}
 
-	// 3. Print the ticket
+	// 3. Print the ticket. The spool must record the attempt first: without
+	// it a crash mid-print could not be told apart from a job never printed.
+	entry.State = spoolPrinting
+	if err := a.spool.Set(entry); err != nil {
+		a.finishJob(entry, fmt.Errorf("not printed, spool unavailable: %w", err))
+		return
+	}
 	err = a.printer.PrintTicket(printer.TicketData{
 		QueueNumber: claimed.QueueNumber,
 		TypeName:    claimed.TypeName,
 		DateTime:    claimed.DateTime,
+		ETA:         claimed.ETA,
 	}, tmpl)
 
+	// 4. Record and report the outcome
+	a.finishJob(entry, err)
 	if err != nil {
 		log.Printf("Print failed for job #%d: %v", jobID, err)
-		a.failJob(jobID, err.Error())
+		// Paper out or cover open: let the server alert staff right away
+		var statusErr *printer.StatusError
+		if errors.As(err, &statusErr) {
+			a.reportStatus()
+		}
 		return
 	}
-
-	// 4. Mark as completed
-	a.completeJob(jobID)
 	log.Printf("Job #%d printed successfully: %s", jobID, claimed.QueueNumber)
+
+	// Paper near end: warn staff now instead of at the next status report
+	if s, err := a.printer.QueryStatus(); err == nil {
+		if warning := s.Warning(); warning != nil {
+			log.Printf("Printer warning: %v", warning)
+			a.mu.Lock()
+			reported := a.printerStatus
+			a.mu.Unlock()
+			if reported != s.Code() {
+				a.reportStatus()
+			}
+		}
+	}
+}
+
+// finishJob spools the outcome of a claimed job, then reports it. A report
+// the server does not receive stays in the spool and is sent again by
+// replaySpool.
+func (a *PrintAgent) finishJob(entry SpoolEntry, printErr error) {
+	a.recordResult(printErr)
+
+	entry.State = spoolPrinted
+	if printErr != nil {
+		entry.State = spoolFailed
+		entry.Error = printErr.Error()
+	}
+	if err := a.spool.Set(entry); err != nil {
+		log.Printf("Failed to spool result of job #%d: %v", entry.JobID, err)
+	}
+	a.reportResult(entry)
+}
+
+// replaySpool sends the reports that did not reach the server, e.g. while
+// it was unreachable or before the agent restarted.
+func (a *PrintAgent) replaySpool() {
+	entries := a.spool.Unreported()
+	if len(entries) == 0 {
+		return
+	}
+	log.Printf("Replaying %d spooled job reports...", len(entries))
+	for _, entry := range entries {
+		a.reportResult(entry)
+	}
 }
 
 func (a *PrintAgent) claimJob(jobID int64) (*PrintJobResponse, error) {
 	url := fmt.Sprintf("%s/api/print-agent/job/%d/claim", a.config.ServerURL, jobID)
 	body, _ := json.Marshal(map[string]string{"agent_id": a.config.AgentID})
 
-	resp, err := a.client.Post(url, "application/json", bytes.NewReader(body))
+	resp, err := a.do(a.client, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
@@ -257,23 +449,94 @@ func (a *PrintAgent) claimJob(jobID int64) (*PrintJobResponse, error) {
 	return &job, nil
 }
 
-func (a *PrintAgent) completeJob(jobID int64) {
-	url := fmt.Sprintf("%s/api/print-agent/job/%d/complete", a.config.ServerURL, jobID)
-	resp, err := a.client.Post(url, "application/json", strings.NewReader("{}"))
+// heartbeatInterval is how often a claimed job's lease is extended. The
+// server lease is at least 30 seconds.
+const heartbeatInterval = 10 * time.Second
+
+// heartbeat extends the lease of a claimed job until done is closed.
+func (a *PrintAgent) heartbeat(jobID int64, done <-chan struct{}) {
+	url := fmt.Sprintf("%s/api/print-agent/job/%d/heartbeat", a.config.ServerURL, jobID)
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			resp, err := a.do(a.client, http.MethodPost, url, strings.NewReader("{}"))
+			if err != nil {
+				log.Printf("Heartbeat for job #%d failed: %v", jobID, err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusConflict {
+				log.Printf("Lost lease on job #%d; the server has requeued it", jobID)
+				return
+			}
+		}
+	}
+}
+
+// reportResult tells the server a spooled job was printed or failed and
+// marks it reported once the server has settled it.
+func (a *PrintAgent) reportResult(entry SpoolEntry) {
+	if a.sendResult(entry) {
+		if err := a.spool.MarkReported(entry.JobID); err != nil {
+			log.Printf("Failed to update spool for job #%d: %v", entry.JobID, err)
+		}
+	}
+}
+
+// sendResult posts a job outcome. It returns false when the report should
+// be retried later: the server is unreachable or failing.
+func (a *PrintAgent) sendResult(entry SpoolEntry) bool {
+	action, body := "complete", []byte("{}")
+	if entry.State == spoolFailed || entry.State == spoolInterrupted {
+		action = "fail"
+		body, _ = json.Marshal(map[string]string{"error": entry.Error})
+	}
+	url := fmt.Sprintf("%s/api/print-agent/job/%d/%s", a.config.ServerURL, entry.JobID, action)
+
+	status, err := a.post(url, body)
 	if err != nil {
-		log.Printf("Failed to mark job #%d complete: %v", jobID, err)
-		return
+		log.Printf("Failed to report job #%d %s: %v (kept in spool)", entry.JobID, action, err)
+		return false
+	}
+
+	// The lease expired while the report was pending and the job went back
+	// to the queue. A ticket that may be on paper is claimed again only to
+	// settle it, so no agent prints it a second time.
+	if status == http.StatusConflict && (entry.State == spoolPrinted || entry.State == spoolInterrupted) {
+		if _, err := a.claimJob(entry.JobID); err == nil {
+			status, err = a.post(url, body)
+			if err != nil {
+				log.Printf("Failed to report job #%d %s: %v (kept in spool)", entry.JobID, action, err)
+				return false
+			}
+		}
+	}
+
+	switch {
+	case status == http.StatusOK:
+		return true
+	case status == http.StatusUnauthorized || status >= 500:
+		log.Printf("Server did not accept report of job #%d: %d (kept in spool)", entry.JobID, status)
+		return false
+	default:
+		// Another agent holds the job or it no longer exists; nothing to retry
+		log.Printf("Server rejected report of job #%d %s: %d", entry.JobID, action, status)
+		return true
 	}
-	resp.Body.Close()
 }
 
-func (a *PrintAgent) failJob(jobID int64, errMsg string) {
-	url := fmt.Sprintf("%s/api/print-agent/job/%d/fail", a.config.ServerURL, jobID)
-	body, _ := json.Marshal(map[string]string{"error": errMsg})
-	resp, err := a.client.Post(url, "application/json", bytes.NewReader(body))
+// post sends a JSON body and returns the response status.
+func (a *PrintAgent) post(url string, body []byte) (int, error) {
+	resp, err := a.do(a.client, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
-		log.Printf("Failed to mark job #%d failed: %v", jobID, err)
-		return
+		return 0, err
 	}
-	resp.Body.Close()
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"queue-system/internal/printer"
+)
+
+// fakeServer answers the print agent API and records the requests.
+type fakeServer struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	f.mu.Unlock()
+
+	if strings.HasSuffix(r.URL.Path, "/claim") {
+		tmpl, _ := json.Marshal(printer.DefaultTemplate())
+		json.NewEncoder(w).Encode(PrintJobResponse{
+			QueueNumber:  "A001",
+			TypeName:     "Umum",
+			DateTime:     "16/10/2026 09:00",
+			TemplateJSON: string(tmpl),
+			Status:       "claimed",
+		})
+		return
+	}
+	w.Write([]byte(`{}`))
+}
+
+func (f *fakeServer) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// newTestAgent returns an agent talking to a fake server that prints to a
+// file, and the path of that file.
+func newTestAgent(t *testing.T, entries ...SpoolEntry) (*PrintAgent, *fakeServer, string) {
+	t.Helper()
+	server := &fakeServer{}
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	for i := range entries {
+		entries[i].UpdatedAt = time.Now()
+	}
+	spool, err := OpenSpool(writeSpool(t, entries...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultAgentConfig()
+	cfg.ServerURL = ts.URL
+	cfg.APIKey = "key"
+	cfg.Transport = printer.TransportFile
+	cfg.Device = filepath.Join(t.TempDir(), "printed.bin")
+	return NewPrintAgent(cfg, spool), server, cfg.Device
+}
+
+func checkRequests(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// A job the agent printed, or may have printed before it stopped, is only
+// reported again when the server re-offers it.
+func TestProcessJobSkipsPrintedAndInterrupted(t *testing.T) {
+	a, server, output := newTestAgent(t,
+		SpoolEntry{JobID: 1, QueueNumber: "A001", State: spoolPrinted, Reported: true},
+		SpoolEntry{JobID: 2, QueueNumber: "A002", State: spoolPrinting},
+	)
+
+	a.processJob(1)
+	a.processJob(2)
+
+	checkRequests(t, server.Requests(),
+		"POST /api/print-agent/job/1/complete",
+		"POST /api/print-agent/job/2/fail",
+	)
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Error("a spooled job was printed again")
+	}
+	if e, _ := a.spool.Get(2); e.State != spoolInterrupted || !e.Reported {
+		t.Errorf("interrupted job: got %+v, want it reported", e)
+	}
+}
+
+func TestProcessJobPrints(t *testing.T) {
+	a, server, output := newTestAgent(t,
+		SpoolEntry{JobID: 1, QueueNumber: "A000", State: spoolFailed, Reported: true},
+	)
+
+	// A failed job may be retried: nothing reached the paper
+	a.processJob(1)
+
+	checkRequests(t, server.Requests(),
+		"POST /api/print-agent/job/1/claim",
+		"POST /api/print-agent/job/1/complete",
+	)
+	if info, err := os.Stat(output); err != nil || info.Size() == 0 {
+		t.Errorf("ticket not printed: %v", err)
+	}
+	if e, _ := a.spool.Get(1); e.State != spoolPrinted || !e.Reported || e.QueueNumber != "A001" {
+		t.Errorf("spool entry: got %+v, want a reported printed A001", e)
+	}
+}
@@ -3,17 +3,23 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"gopkg.in/yaml.v3"
 )
 
 type AgentConfig struct {
 	AgentID     string `yaml:"agent_id"`
+	APIKey      string `yaml:"api_key"` // issued when the agent is registered in the admin panel
 	ServerURL   string `yaml:"server_url"`
 	PrinterName string `yaml:"printer_name"`
 	RetryDelay  int    `yaml:"retry_delay"`
-	PaperSize   string `yaml:"paper_size"`  // "80mm" (default) or "58mm"
-	FeedLines   int    `yaml:"feed_lines"`  // lines to feed before cut (default 1)
+	PaperSize   string `yaml:"paper_size"` // "80mm" (default) or "58mm"
+	FeedLines   int    `yaml:"feed_lines"` // lines to feed before cut (default 1)
+	Transport   string `yaml:"transport"`  // "windows", "tcp", "device", "cups" or "file"
+	Address     string `yaml:"address"`    // tcp: host[:port], port defaults to 9100
+	Device      string `yaml:"device"`     // device: e.g. /dev/usb/lp0; file: output path or "-"
+	SpoolPath   string `yaml:"spool_path"` // local job spool (default: next to the config file)
 }
 
 func DefaultAgentConfig() *AgentConfig {
@@ -45,6 +51,12 @@ func LoadAgentConfig(path string) (*AgentConfig, error) {
 	if cfg.ServerURL == "" {
 		return nil, fmt.Errorf("server_url is required in config")
 	}
+	if cfg.APIKey == "" {
+		return nil, fmt.Errorf("api_key is required in config")
+	}
+	if cfg.SpoolPath == "" {
+		cfg.SpoolPath = filepath.Join(filepath.Dir(path), "print-agent-spool.json")
+	}
 
 	return cfg, nil
 }
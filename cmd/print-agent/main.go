@@ -8,12 +8,16 @@ import (
 	"syscall"
 )
 
+// version is reported to the server; set at build time with
+// -ldflags "-X main.version=1.2.0".
+var version = "dev"
+
 func main() {
 	configPath := flag.String("config", "config.yaml", "Path to agent config file")
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.Println("Starting Print Agent...")
+	log.Printf("Starting Print Agent %s...", version)
 
 	cfg, err := LoadAgentConfig(*configPath)
 	if err != nil {
@@ -23,9 +27,18 @@ func main() {
 	log.Printf("Agent ID:     %s", cfg.AgentID)
 	log.Printf("Server URL:   %s", cfg.ServerURL)
 	log.Printf("Printer Name: %s", cfg.PrinterName)
+	if cfg.Transport != "" {
+		log.Printf("Transport:    %s", cfg.Transport)
+	}
 	log.Printf("Retry Delay:  %ds", cfg.RetryDelay)
+	log.Printf("Spool:        %s", cfg.SpoolPath)
+
+	spool, err := OpenSpool(cfg.SpoolPath)
+	if err != nil {
+		log.Fatalf("Failed to open spool: %v", err)
+	}
 
-	agent := NewPrintAgent(cfg)
+	agent := NewPrintAgent(cfg, spool)
 
 	stop := make(chan struct{})
 
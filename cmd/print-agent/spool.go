@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Spool entry states, in the order a job moves through them
+const (
+	spoolClaimed  = "claimed"  // claimed from the server, nothing sent to the printer yet
+	spoolPrinting = "printing" // being sent to the printer; outcome unknown after a crash
+	spoolPrinted  = "printed"  // on paper; must never be printed again
+	spoolFailed   = "failed"   // not printed
+
+	// The agent stopped while printing: the ticket may be on paper, so it
+	// is reported failed and, like a printed one, never printed again
+	spoolInterrupted = "interrupted"
+)
+
+// spoolRetention is how long reported jobs are remembered, so a job the
+// server re-offers after a lost completion report is not printed twice.
+const spoolRetention = 24 * time.Hour
+
+// SpoolEntry is the local record of a claimed job.
+type SpoolEntry struct {
+	JobID       int64     `json:"job_id"`
+	QueueNumber string    `json:"queue_number"`
+	State       string    `json:"state"`
+	Error       string    `json:"error,omitempty"`
+	Reported    bool      `json:"reported"` // the server accepted the printed/failed report
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Spool is a durable JSON file of claimed jobs and their unsent reports. It
+// survives restarts and lost connections so each job ID is printed at most
+// once by this agent and every outcome eventually reaches the server.
+type Spool struct {
+	path    string
+	mu      sync.Mutex
+	entries map[int64]*SpoolEntry
+}
+
+// OpenSpool loads the spool at path, creating it when missing. Jobs that
+// were being printed when the agent stopped are marked interrupted rather
+// than printed again: the ticket may already be on paper.
+func OpenSpool(path string) (*Spool, error) {
+	s := &Spool{path: path, entries: make(map[int64]*SpoolEntry)}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read spool %s: %w", path, err)
+	}
+	if len(data) > 0 {
+		var entries []*SpoolEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse spool %s: %w", path, err)
+		}
+		for _, e := range entries {
+			s.entries[e.JobID] = e
+		}
+	}
+
+	for id, e := range s.entries {
+		switch e.State {
+		case spoolClaimed:
+			// Nothing was printed; the server requeues it when the lease expires
+			delete(s.entries, id)
+		case spoolPrinting:
+			e.State = spoolInterrupted
+			e.Error = "agent stopped while printing; not printed again to avoid a duplicate ticket"
+			e.Reported = false
+			e.UpdatedAt = time.Now()
+		}
+	}
+	return s, s.save()
+}
+
+// Get returns the entry for a job.
+func (s *Spool) Get(jobID int64) (SpoolEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[jobID]
+	if !ok {
+		return SpoolEntry{}, false
+	}
+	return *e, true
+}
+
+// Set records an entry and writes the spool to disk before returning.
+func (s *Spool) Set(e SpoolEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.UpdatedAt = time.Now()
+	s.entries[e.JobID] = &e
+	return s.save()
+}
+
+// MarkReported records that the server has the outcome of a job.
+func (s *Spool) MarkReported(jobID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[jobID]
+	if !ok {
+		return nil
+	}
+	e.Reported = true
+	e.UpdatedAt = time.Now()
+	return s.save()
+}
+
+// Unreported returns the finished jobs whose outcome has not reached the
+// server, oldest first.
+func (s *Spool) Unreported() []SpoolEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []SpoolEntry
+	for _, e := range s.entries {
+		if !e.Reported && e.State != spoolClaimed && e.State != spoolPrinting {
+			entries = append(entries, *e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].JobID < entries[j].JobID })
+	return entries
+}
+
+// save drops old reported entries and atomically replaces the spool file.
+// The caller holds s.mu.
+func (s *Spool) save() error {
+	cutoff := time.Now().Add(-spoolRetention)
+	entries := make([]*SpoolEntry, 0, len(s.entries))
+	for id, e := range s.entries {
+		if e.Reported && e.UpdatedAt.Before(cutoff) {
+			delete(s.entries, id)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].JobID < entries[j].JobID })
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write spool: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write spool: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write spool: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write spool: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write spool: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSpool writes a spool file as an earlier run of the agent left it.
+func writeSpool(t *testing.T, entries ...SpoolEntry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "spool.json")
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpenSpoolRecovery(t *testing.T) {
+	now := time.Now()
+	path := writeSpool(t,
+		SpoolEntry{JobID: 1, State: spoolClaimed, UpdatedAt: now},
+		SpoolEntry{JobID: 2, State: spoolPrinting, UpdatedAt: now},
+		SpoolEntry{JobID: 3, State: spoolPrinted, UpdatedAt: now},
+		SpoolEntry{JobID: 4, State: spoolFailed, Error: "paper out", Reported: true, UpdatedAt: now},
+	)
+
+	s, err := OpenSpool(path)
+	if err != nil {
+		t.Fatalf("OpenSpool: %v", err)
+	}
+	if _, ok := s.Get(1); ok {
+		t.Error("claimed job kept; nothing was printed, so the lease expiry requeues it")
+	}
+	if e, ok := s.Get(2); !ok || e.State != spoolInterrupted || e.Reported || e.Error == "" {
+		t.Errorf("printing job: got %+v, want an unreported interrupted entry with an error", e)
+	}
+	if e, _ := s.Get(3); e.State != spoolPrinted || e.Reported {
+		t.Errorf("printed job: got %+v", e)
+	}
+	if e, _ := s.Get(4); e.State != spoolFailed || !e.Reported {
+		t.Errorf("failed job: got %+v", e)
+	}
+
+	// The recovered states are on disk
+	s, err = OpenSpool(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if _, ok := s.Get(1); ok {
+		t.Error("reopen: claimed job is back")
+	}
+	if e, _ := s.Get(2); e.State != spoolInterrupted {
+		t.Errorf("reopen: printing job is %q", e.State)
+	}
+}
+
+func TestOpenSpoolMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.json")
+	s, err := OpenSpool(path)
+	if err != nil {
+		t.Fatalf("OpenSpool: %v", err)
+	}
+	if len(s.Unreported()) != 0 {
+		t.Error("new spool has entries")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("spool file not created: %v", err)
+	}
+}
+
+func TestSpoolUnreported(t *testing.T) {
+	s, err := OpenSpool(filepath.Join(t.TempDir(), "spool.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []SpoolEntry{
+		{JobID: 9, State: spoolInterrupted},
+		{JobID: 5, State: spoolPrinted},
+		{JobID: 3, State: spoolClaimed},
+		{JobID: 4, State: spoolPrinting},
+		{JobID: 7, State: spoolPrinted},
+		{JobID: 2, State: spoolFailed},
+	} {
+		if err := s.Set(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.MarkReported(7); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for _, e := range s.Unreported() {
+		ids = append(ids, e.JobID)
+	}
+	want := []int64{2, 5, 9}
+	if len(ids) != len(want) {
+		t.Fatalf("Unreported = %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("Unreported = %v, want %v", ids, want)
+		}
+	}
+}
+
+func TestSpoolRetention(t *testing.T) {
+	old := time.Now().Add(-spoolRetention - time.Hour)
+	recent := time.Now().Add(-time.Hour)
+	path := writeSpool(t,
+		SpoolEntry{JobID: 1, State: spoolPrinted, Reported: true, UpdatedAt: old},
+		SpoolEntry{JobID: 2, State: spoolPrinted, Reported: false, UpdatedAt: old},
+		SpoolEntry{JobID: 3, State: spoolFailed, Reported: true, UpdatedAt: recent},
+	)
+
+	s, err := OpenSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get(1); ok {
+		t.Error("old reported entry not pruned")
+	}
+	if _, ok := s.Get(2); !ok {
+		t.Error("old unreported entry pruned before its report reached the server")
+	}
+	if _, ok := s.Get(3); !ok {
+		t.Error("recent reported entry pruned")
+	}
+}
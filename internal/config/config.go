@@ -17,14 +17,100 @@ type Config struct {
 	Audio    AudioConfig    `yaml:"audio"`
 	Security SecurityConfig `yaml:"security"`
 	Printer  PrinterConfig  `yaml:"printer"`
+	SSE      SSEConfig      `yaml:"sse"`
 }
 
 type PrinterConfig struct {
 	Enabled       bool   `yaml:"enabled"`
 	PrinterName   string `yaml:"printer_name"`
 	RemoteEnabled bool   `yaml:"remote_enabled"`
-	PaperSize     string `yaml:"paper_size"`  // "80mm" (default) or "58mm"
-	FeedLines     int    `yaml:"feed_lines"`  // lines to feed before cut (default 1)
+	PaperSize     string `yaml:"paper_size"`    // "80mm" (default) or "58mm"
+	FeedLines     int    `yaml:"feed_lines"`    // lines to feed before cut (default 1)
+	Transport     string `yaml:"transport"`     // "windows", "tcp", "device", "cups" or "file" (default: windows on Windows, cups elsewhere)
+	Address       string `yaml:"address"`       // tcp: host[:port], port defaults to 9100
+	Device        string `yaml:"device"`        // device: e.g. /dev/usb/lp0; file: output path or "-" for stdout
+	LeaseSeconds  int    `yaml:"lease_seconds"` // a claimed job is requeued if its agent sends no heartbeat for this long (default 60)
+	MaxAttempts   int    `yaml:"max_attempts"`  // claims before a job whose lease keeps expiring is marked failed (default 3)
+	// When a print job's target agent or group is offline: "wait", "group" (default) or "any"
+	TargetFallback string `yaml:"target_fallback"`
+	// A pending job whose target stays offline this long is marked failed (default 300)
+	TargetWaitSeconds int `yaml:"target_wait_seconds"`
+}
+
+// Fallback policies for print jobs whose target agent or printer group has
+// no agent online.
+const (
+	TargetFallbackWait  = "wait"  // keep the job for the target until it reconnects
+	TargetFallbackGroup = "group" // let the target agent's printer group print it
+	TargetFallbackAny   = "any"   // let any online agent print it
+)
+
+// JobLeaseSeconds returns the lease of a claimed print job. It is at least
+// 30 seconds so agents heartbeating every 10 seconds keep their jobs.
+func (p PrinterConfig) JobLeaseSeconds() int {
+	switch {
+	case p.LeaseSeconds <= 0:
+		return 60
+	case p.LeaseSeconds < 30:
+		return 30
+	}
+	return p.LeaseSeconds
+}
+
+// JobTargetWaitSeconds returns how long a pending print job waits for its
+// offline target agent or group before it is marked failed.
+func (p PrinterConfig) JobTargetWaitSeconds() int {
+	if p.TargetWaitSeconds <= 0 {
+		return 300
+	}
+	return p.TargetWaitSeconds
+}
+
+// JobMaxAttempts returns how many times a print job may be claimed before
+// an expired lease marks it failed.
+func (p PrinterConfig) JobMaxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return 3
+	}
+	return p.MaxAttempts
+}
+
+// Slow client policies: what the SSE hub does when a client's event buffer
+// is full.
+const (
+	SlowClientDropOldest = "drop_oldest" // discard the oldest queued event
+	SlowClientDisconnect = "disconnect"  // close the stream; the client reconnects and missed events are replayed
+	SlowClientCoalesce   = "coalesce"    // keep only the newest state event of each type, disconnect if still full
+)
+
+// SSEConfig sets the slow client policy of each SSE client type: "display",
+// "counter", "printer", "status" and "admin".
+type SSEConfig struct {
+	SlowClients map[string]string `yaml:"slow_clients"`
+}
+
+// defaultSlowClients keeps every call and print job: displays and counters
+// only coalesce state refreshes and printers are disconnected to have
+// their jobs replayed, while status and admin pages can miss old updates.
+var defaultSlowClients = map[string]string{
+	"display": SlowClientCoalesce,
+	"counter": SlowClientCoalesce,
+	"printer": SlowClientDisconnect,
+	"status":  SlowClientDropOldest,
+	"admin":   SlowClientDropOldest,
+}
+
+// SlowClientPolicy returns the policy for a client type, the default one
+// when it is not set or not recognised.
+func (c SSEConfig) SlowClientPolicy(clientType string) string {
+	switch policy := c.SlowClients[clientType]; policy {
+	case SlowClientDropOldest, SlowClientDisconnect, SlowClientCoalesce:
+		return policy
+	}
+	if policy, ok := defaultSlowClients[clientType]; ok {
+		return policy
+	}
+	return SlowClientDisconnect
 }
 
 type ServerConfig struct {
@@ -46,11 +132,35 @@ type LoggingConfig struct {
 	FilePath string `yaml:"file_path"`
 }
 
+// Priority policies used by CallNextQueue to choose between the priority
+// lane and the normal lane.
+const (
+	PriorityPolicyStrict     = "strict"     // always serve priority tickets first
+	PriorityPolicyInterleave = "interleave" // serve N priority tickets, then 1 normal
+	PriorityPolicyFIFO       = "fifo"       // ignore priority, oldest ticket first
+)
+
+// Routing policies used by CallNextQueue to choose among the queue types
+// assigned to a counter.
+const (
+	RoutingLongestWait = "longest_wait" // type whose first ticket has waited longest
+	RoutingRoundRobin  = "round_robin"  // rotate through the assigned types
+	RoutingWeighted    = "weighted"     // fewest calls today relative to the type's weight
+)
+
 type QueueConfig struct {
-	Prefix          string `yaml:"prefix"`
-	StartNumber     int    `yaml:"start_number"`
-	ResetDaily      bool   `yaml:"reset_daily"`
-	AutoCancelHours int    `yaml:"auto_cancel_hours"`
+	Prefix           string `yaml:"prefix"`
+	StartNumber      int    `yaml:"start_number"`
+	ResetDaily       bool   `yaml:"reset_daily"`
+	AutoCancelHours  int    `yaml:"auto_cancel_hours"`
+	PriorityPolicy   string `yaml:"priority_policy"`     // "strict" (default), "interleave" or "fifo"
+	PriorityRatio    int    `yaml:"priority_ratio"`      // interleave: priority calls per normal call (default 3)
+	TransferPosition int    `yaml:"transfer_position"`   // position in the target line for transferred queues (1 = head)
+	ParkWindowMins   int    `yaml:"park_window_minutes"` // parked (no-show) queues are cancelled after this many minutes
+	MaxRecalls       int    `yaml:"max_recalls"`         // recalls + reactivations before a no-show is cancelled (0 = unlimited)
+	RoutingPolicy    string `yaml:"routing_policy"`      // "longest_wait" (default), "round_robin" or "weighted"
+	ETASampleSize    int    `yaml:"eta_sample_size"`     // recent completed tickets averaged for the ETA (default 20)
+	ETADefaultMins   int    `yaml:"eta_default_minutes"` // service duration assumed when there is no history yet (default 5)
 }
 
 type AudioConfig struct {
@@ -82,10 +192,18 @@ func DefaultConfig() *Config {
 			FilePath: "./data/logs/app.log",
 		},
 		Queue: QueueConfig{
-			Prefix:          "A",
-			StartNumber:     1,
-			ResetDaily:      true,
-			AutoCancelHours: 24,
+			Prefix:           "A",
+			StartNumber:      1,
+			ResetDaily:       true,
+			AutoCancelHours:  24,
+			PriorityPolicy:   PriorityPolicyStrict,
+			PriorityRatio:    3,
+			TransferPosition: 1,
+			ParkWindowMins:   30,
+			MaxRecalls:       3,
+			RoutingPolicy:    RoutingLongestWait,
+			ETASampleSize:    20,
+			ETADefaultMins:   5,
 		},
 		Audio: AudioConfig{
 			Enabled:  true,
@@ -96,10 +214,14 @@ func DefaultConfig() *Config {
 			SessionTimeout: 3600,
 		},
 		Printer: PrinterConfig{
-			Enabled:     true,
-			PrinterName: "ECO80",
-			PaperSize:   "80mm",
-			FeedLines:   1,
+			Enabled:           true,
+			PrinterName:       "ECO80",
+			PaperSize:         "80mm",
+			FeedLines:         1,
+			LeaseSeconds:      60,
+			MaxAttempts:       3,
+			TargetFallback:    TargetFallbackGroup,
+			TargetWaitSeconds: 300,
 		},
 	}
 }
@@ -2,7 +2,9 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -48,11 +50,18 @@ func (d *DB) migrate() error {
 		queue_number TEXT NOT NULL,
 		queue_type TEXT NOT NULL DEFAULT 'general',
 		status TEXT NOT NULL DEFAULT 'waiting',
+		priority INTEGER NOT NULL DEFAULT 0,
 		counter_id INTEGER,
+		target_counter_id INTEGER,
+		sort_key REAL,
+		recall_count INTEGER NOT NULL DEFAULT 0,
+		parked_at DATETIME,
+		operator_id INTEGER,
 		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		called_at DATETIME,
 		completed_at DATETIME,
-		FOREIGN KEY (counter_id) REFERENCES counters(id)
+		FOREIGN KEY (counter_id) REFERENCES counters(id),
+		FOREIGN KEY (operator_id) REFERENCES users(id)
 	);
 
 	CREATE TABLE IF NOT EXISTS counters (
@@ -62,7 +71,10 @@ func (d *DB) migrate() error {
 		is_active INTEGER NOT NULL DEFAULT 1,
 		current_queue_id INTEGER,
 		last_call_at DATETIME,
-		FOREIGN KEY (current_queue_id) REFERENCES queues(id)
+		operator_id INTEGER,
+		operator_since DATETIME,
+		FOREIGN KEY (current_queue_id) REFERENCES queues(id),
+		FOREIGN KEY (operator_id) REFERENCES users(id)
 	);
 
 	CREATE TABLE IF NOT EXISTS settings (
@@ -75,10 +87,13 @@ func (d *DB) migrate() error {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		queue_id INTEGER NOT NULL,
 		counter_id INTEGER NOT NULL,
+		operator_id INTEGER,
 		action TEXT NOT NULL,
+		lane TEXT NOT NULL DEFAULT '',
 		timestamp DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (queue_id) REFERENCES queues(id),
-		FOREIGN KEY (counter_id) REFERENCES counters(id)
+		FOREIGN KEY (counter_id) REFERENCES counters(id),
+		FOREIGN KEY (operator_id) REFERENCES users(id)
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_queues_status ON queues(status);
@@ -106,10 +121,70 @@ func (d *DB) migrate() error {
 		created_at DATETIME DEFAULT (datetime('now','localtime')),
 		claimed_at DATETIME,
 		completed_at DATETIME,
-		error_message TEXT
+		error_message TEXT,
+		eta TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		lease_expires_at DATETIME,
+		target_agent TEXT NOT NULL DEFAULT '',
+		target_group TEXT NOT NULL DEFAULT ''
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_print_jobs_status ON print_jobs(status);
+
+	CREATE TABLE IF NOT EXISTS counter_services (
+		counter_id INTEGER NOT NULL,
+		queue_type TEXT NOT NULL,
+		weight INTEGER NOT NULL DEFAULT 1,
+		priority INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (counter_id, queue_type),
+		FOREIGN KEY (counter_id) REFERENCES counters(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		full_name TEXT NOT NULL DEFAULT '',
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'operator',
+		is_active INTEGER NOT NULL DEFAULT 1,
+		created_at DATETIME NOT NULL DEFAULT (datetime('now','localtime')),
+		last_login_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		user_id INTEGER NOT NULL,
+		counter_id INTEGER NOT NULL DEFAULT 0,
+		user_agent TEXT NOT NULL DEFAULT '',
+		ip_address TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT (datetime('now','localtime')),
+		last_seen_at DATETIME NOT NULL DEFAULT (datetime('now','localtime')),
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+	CREATE INDEX IF NOT EXISTS idx_sessions_expires ON sessions(expires_at);
+
+	CREATE TABLE IF NOT EXISTS print_agents (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		agent_id TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL DEFAULT '',
+		printer_group TEXT NOT NULL DEFAULT '',
+		key_hash TEXT NOT NULL UNIQUE,
+		is_active INTEGER NOT NULL DEFAULT 1,
+		created_at DATETIME NOT NULL DEFAULT (datetime('now','localtime')),
+		last_seen_at DATETIME,
+		version TEXT NOT NULL DEFAULT '',
+		hostname TEXT NOT NULL DEFAULT '',
+		printer_name TEXT NOT NULL DEFAULT '',
+		paper_size TEXT NOT NULL DEFAULT '',
+		jobs_printed INTEGER NOT NULL DEFAULT 0,
+		jobs_failed INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		printer_status TEXT NOT NULL DEFAULT ''
+	);
 	`
 
 	_, err := d.Exec(schema)
@@ -117,6 +192,40 @@ func (d *DB) migrate() error {
 		return err
 	}
 
+	// Columns added after the first release. CREATE TABLE IF NOT EXISTS
+	// leaves existing tables untouched, so add them explicitly.
+	columns := []struct{ table, column, definition string }{
+		{"queues", "priority", "INTEGER NOT NULL DEFAULT 0"},
+		{"queues", "target_counter_id", "INTEGER"},
+		{"queues", "sort_key", "REAL"},
+		{"queues", "recall_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"queues", "parked_at", "DATETIME"},
+		{"queues", "operator_id", "INTEGER"},
+		{"counters", "operator_id", "INTEGER"},
+		{"counters", "operator_since", "DATETIME"},
+		{"call_history", "lane", "TEXT NOT NULL DEFAULT ''"},
+		{"call_history", "operator_id", "INTEGER"},
+		{"print_jobs", "eta", "TEXT NOT NULL DEFAULT ''"},
+		{"print_jobs", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+		{"print_jobs", "lease_expires_at", "DATETIME"},
+		{"print_jobs", "target_agent", "TEXT NOT NULL DEFAULT ''"},
+		{"print_jobs", "target_group", "TEXT NOT NULL DEFAULT ''"},
+		{"print_agents", "printer_group", "TEXT NOT NULL DEFAULT ''"},
+		{"print_agents", "version", "TEXT NOT NULL DEFAULT ''"},
+		{"print_agents", "hostname", "TEXT NOT NULL DEFAULT ''"},
+		{"print_agents", "printer_name", "TEXT NOT NULL DEFAULT ''"},
+		{"print_agents", "paper_size", "TEXT NOT NULL DEFAULT ''"},
+		{"print_agents", "jobs_printed", "INTEGER NOT NULL DEFAULT 0"},
+		{"print_agents", "jobs_failed", "INTEGER NOT NULL DEFAULT 0"},
+		{"print_agents", "last_error", "TEXT NOT NULL DEFAULT ''"},
+		{"print_agents", "printer_status", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, c := range columns {
+		if err := d.addColumnIfMissing(c.table, c.column, c.definition); err != nil {
+			return fmt.Errorf("failed to add %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
 	// Insert default queue type if none exists
 	var count int
 	d.QueryRow(`SELECT COUNT(*) FROM queue_types`).Scan(&count)
@@ -124,9 +233,44 @@ func (d *DB) migrate() error {
 		d.Exec(`INSERT INTO queue_types (code, name, prefix, is_active, sort_order) VALUES ('A', 'Umum', 'A', 1, 1)`)
 	}
 
+	// Seed the first admin account from the configured admin password
+	// (already bcrypt-hashed by config.HashPasswordIfPlain)
+	d.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count)
+	if count == 0 && strings.HasPrefix(d.config.Security.AdminPassword, "$2") {
+		d.Exec(`INSERT INTO users (username, full_name, password_hash, role) VALUES ('admin', 'Administrator', ?, ?)`,
+			d.config.Security.AdminPassword, models.RoleAdmin)
+	}
+
 	return nil
 }
 
+// addColumnIfMissing adds a column to an existing table unless it is already there.
+func (d *DB) addColumnIfMissing(table, column, definition string) error {
+	rows, err := d.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = d.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
+
 // Queue Type operations
 
 func (d *DB) CreateQueueType(code, name, prefix string) (*models.QueueType, error) {
@@ -195,23 +339,95 @@ func (d *DB) UpdateQueueType(id int64, name, prefix string, isActive bool, sortO
 }
 
 func (d *DB) DeleteQueueType(id int64) error {
-	_, err := d.Exec(`DELETE FROM queue_types WHERE id = ?`, id)
-	return err
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM counter_services WHERE queue_type = (SELECT code FROM queue_types WHERE id = ?)`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM queue_types WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Queue operations
 
-func (d *DB) CreateQueue(queueTypeCode string) (*models.Queue, error) {
+func (d *DB) CreateQueue(queueTypeCode string, priority int) (*models.Queue, error) {
 	tx, err := d.Begin()
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
+	id, _, err := d.createQueueTx(tx, queueTypeCode, priority)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return d.GetQueue(id)
+}
+
+// CreateQueueWithPrintJob creates a queue and the remote print job for its
+// ticket in one transaction, so a number is never issued without a job to
+// print it. job supplies everything but the queue number and the ETA,
+// which etaText formats from the queue's estimated wait before the job
+// becomes claimable.
+func (d *DB) CreateQueueWithPrintJob(queueTypeCode string, priority int, job *models.PrintJob, etaText func(*models.QueueETA) string) (*models.Queue, *models.PrintJob, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	queueID, queueNumber, err := d.createQueueTx(tx, queueTypeCode, priority)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	eta, err := d.estimateQueueWait(tx, queueID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to estimate wait: %w", err)
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO print_jobs (queue_number, type_name, date_time, eta, template_json, status, target_agent, target_group)
+		VALUES (?, ?, ?, ?, ?, 'pending', ?, ?)
+	`, queueNumber, job.TypeName, job.DateTime, etaText(eta), job.TemplateJSON, job.TargetAgent, job.TargetGroup)
+	if err != nil {
+		return nil, nil, err
+	}
+	jobID, _ := result.LastInsertId()
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	queue, err := d.GetQueue(queueID)
+	if err != nil {
+		return nil, nil, err
+	}
+	printJob, err := d.GetPrintJob(jobID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return queue, printJob, nil
+}
+
+// createQueueTx numbers and inserts a waiting queue, returning its ID and
+// number.
+func (d *DB) createQueueTx(tx *sql.Tx, queueTypeCode string, priority int) (int64, string, error) {
 	// Get queue type to find prefix
 	var prefix string
 	var qtID int64
-	err = tx.QueryRow(`SELECT id, prefix FROM queue_types WHERE code = ?`, queueTypeCode).Scan(&qtID, &prefix)
+	err := tx.QueryRow(`SELECT id, prefix FROM queue_types WHERE code = ?`, queueTypeCode).Scan(&qtID, &prefix)
 	if err != nil {
 		// Fallback to config prefix if queue type not found
 		prefix = d.config.Queue.Prefix
@@ -233,26 +449,24 @@ func (d *DB) CreateQueue(queueTypeCode string) (*models.Queue, error) {
 	queueNumber := fmt.Sprintf("%s%03d", prefix, lastNumber+1)
 
 	result, err := tx.Exec(`
-		INSERT INTO queues (queue_number, queue_type, status, created_at)
-		VALUES (?, ?, 'waiting', datetime('now', 'localtime'))
-	`, queueNumber, queueTypeCode)
+		INSERT INTO queues (queue_number, queue_type, status, priority, created_at)
+		VALUES (?, ?, 'waiting', ?, datetime('now', 'localtime'))
+	`, queueNumber, queueTypeCode, priority)
 	if err != nil {
-		return nil, err
+		return 0, "", err
 	}
 
 	id, _ := result.LastInsertId()
-	
-	if err := tx.Commit(); err != nil {
-		return nil, err
-	}
-
-	return d.GetQueue(id)
+	return id, queueNumber, nil
 }
 
-func (d *DB) CallNextQueue(counterID int64, queueType string) (*models.Queue, error) {
+// CallNextQueue finishes the counter's current queue and calls the next one.
+// With parkCurrent the current queue is parked as a no-show instead of
+// completed (see parkQueueTx). callID is the call's call_history row.
+func (d *DB) CallNextQueue(counterID int64, queueType string, parkCurrent bool) (queue *models.Queue, callID int64, err error) {
 	tx, err := d.Begin()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer tx.Rollback()
 
@@ -261,66 +475,58 @@ func (d *DB) CallNextQueue(counterID int64, queueType string) (*models.Queue, er
 	var counterName, counterNumber string
 	err = tx.QueryRow(`SELECT current_queue_id, counter_name, counter_number FROM counters WHERE id = ?`, counterID).Scan(&currentQueueID, &counterName, &counterNumber)
 	if err != nil {
-		return nil, fmt.Errorf("counter not found: %w", err)
+		return nil, 0, fmt.Errorf("counter not found: %w", err)
 	}
 
-	// 2. Complete current queue if exists
-	if currentQueueID.Valid {
+	// 2. Complete (or park) current queue if exists
+	if currentQueueID.Valid && parkCurrent {
+		if _, err := d.parkQueueTx(tx, currentQueueID.Int64, counterID); err != nil {
+			return nil, 0, err
+		}
+	} else if currentQueueID.Valid {
 		_, err = tx.Exec(`
 			UPDATE queues 
 			SET status = 'completed', completed_at = datetime('now', 'localtime') 
 			WHERE id = ?
 		`, currentQueueID.Int64)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 
 		_, err = tx.Exec(`
-			INSERT INTO call_history (queue_id, counter_id, action, timestamp)
-			VALUES (?, ?, ?, datetime('now', 'localtime'))
-		`, currentQueueID.Int64, counterID, models.ActionCompleted)
+			INSERT INTO call_history (queue_id, counter_id, operator_id, action, timestamp)
+			VALUES (?, ?, (SELECT operator_id FROM counters WHERE id = ?), ?, datetime('now', 'localtime'))
+		`, currentQueueID.Int64, counterID, counterID, models.ActionCompleted)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 	}
 
-	// 3. Find next waiting queue (only from today)
-	var nextQueueID int64
-	query := `
-		SELECT id FROM queues
-		WHERE status = 'waiting'
-		AND DATE(created_at) = DATE('now', 'localtime')
-	`
-	args := []interface{}{}
-	if queueType != "" {
-		query += ` AND queue_type = ?`
-		args = append(args, queueType)
-	}
-	query += ` ORDER BY created_at ASC LIMIT 1`
-
-	err = tx.QueryRow(query, args...).Scan(&nextQueueID)
+	// 3. Find next waiting queue (only from today), honouring the priority policy
+	nextQueueID, lane, err := d.selectNextQueue(tx, counterID, queueType)
 	if err == sql.ErrNoRows {
 		// No waiting queues
 		_, err = tx.Exec(`UPDATE counters SET current_queue_id = NULL, last_call_at = NULL WHERE id = ?`, counterID)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		if err := tx.Commit(); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		return nil, sql.ErrNoRows
+		return nil, 0, sql.ErrNoRows
 	} else if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// 4. Update next queue status
 	_, err = tx.Exec(`
 		UPDATE queues 
-		SET status = 'called', counter_id = ?, called_at = datetime('now', 'localtime')
+		SET status = 'called', counter_id = ?, target_counter_id = NULL, called_at = datetime('now', 'localtime'),
+			operator_id = (SELECT operator_id FROM counters WHERE id = ?)
 		WHERE id = ?
-	`, counterID, nextQueueID)
+	`, counterID, counterID, nextQueueID)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// 5. Update counter
@@ -330,175 +536,585 @@ func (d *DB) CallNextQueue(counterID int64, queueType string) (*models.Queue, er
 		WHERE id = ?
 	`, nextQueueID, counterID)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	// 6. Record history
-	_, err = tx.Exec(`
-		INSERT INTO call_history (queue_id, counter_id, action, timestamp)
-		VALUES (?, ?, ?, datetime('now', 'localtime'))
-	`, nextQueueID, counterID, models.ActionCalled)
+	// 6. Record history, including which lane the queue was taken from
+	result, err := tx.Exec(`
+		INSERT INTO call_history (queue_id, counter_id, operator_id, action, lane, timestamp)
+		VALUES (?, ?, (SELECT operator_id FROM counters WHERE id = ?), ?, ?, datetime('now', 'localtime'))
+	`, nextQueueID, counterID, counterID, models.ActionCalled, lane)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
+	callID, _ = result.LastInsertId()
+
 	if err := tx.Commit(); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	return d.GetQueue(nextQueueID)
+	queue, err = d.GetQueue(nextQueueID)
+	return queue, callID, err
 }
 
-func (d *DB) GetQueue(id int64) (*models.Queue, error) {
-	q := &models.Queue{}
-	err := d.QueryRow(`
-		SELECT id, queue_number, queue_type, status, counter_id, created_at, called_at, completed_at
-		FROM queues WHERE id = ?
-	`, id).Scan(&q.ID, &q.QueueNumber, &q.QueueType, &q.Status, &q.CounterID, &q.CreatedAt, &q.CalledAt, &q.CompletedAt)
-	if err != nil {
-		return nil, err
+// queueOrderKey is the position of a waiting queue within its line.
+// sort_key is only set when a queue is moved (e.g. transferred to the head
+// of another line); otherwise the line is ordered by creation time.
+const queueOrderKey = `COALESCE(sort_key, julianday(created_at))`
+
+// inTypeLine matches waiting queues served from the line of their queue
+// type: those not reserved for a counter, and those transferred to a
+// counter that has since been deactivated or removed.
+const inTypeLine = `(target_counter_id IS NULL OR target_counter_id NOT IN (SELECT id FROM counters WHERE is_active = 1))`
+
+// selectNextQueue picks the next waiting queue of today according to
+// Queue.PriorityPolicy and returns its ID and the lane it was taken from.
+// Queues transferred to this counter are served first; queues transferred
+// to another active counter are skipped. The queue type is resolved by
+// routeQueueType. Returns sql.ErrNoRows if nothing is waiting.
+func (d *DB) selectNextQueue(tx *sql.Tx, counterID int64, queueType string) (int64, string, error) {
+	var id int64
+	var priority int
+	err := tx.QueryRow(`
+		SELECT id, priority FROM queues
+		WHERE status = 'waiting' AND target_counter_id = ?
+		AND DATE(created_at) = DATE('now', 'localtime')
+		ORDER BY `+queueOrderKey+` ASC LIMIT 1
+	`, counterID).Scan(&id, &priority)
+	if err == nil {
+		return id, laneFor(priority), nil
+	} else if err != sql.ErrNoRows {
+		return 0, "", err
 	}
-	q.PrepareJSON()
-	return q, nil
-}
 
-func (d *DB) GetQueueByNumber(number string) (*models.Queue, error) {
-	q := &models.Queue{}
-	err := d.QueryRow(`
-		SELECT id, queue_number, queue_type, status, counter_id, created_at, called_at, completed_at
-		FROM queues WHERE queue_number = ?
-	`, number).Scan(&q.ID, &q.QueueNumber, &q.QueueType, &q.Status, &q.CounterID, &q.CreatedAt, &q.CalledAt, &q.CompletedAt)
+	// Without an explicit type, serve the counter's assigned services
+	queueType, err = d.routeQueueType(tx, counterID, queueType)
 	if err != nil {
-		return nil, err
+		return 0, "", err
 	}
-	q.PrepareJSON()
-	return q, nil
-}
 
-func (d *DB) ListQueues(status string, limit int) ([]*models.Queue, error) {
-	query := `SELECT id, queue_number, queue_type, status, counter_id, created_at, called_at, completed_at FROM queues`
+	base := `
+		SELECT id, priority FROM queues
+		WHERE status = 'waiting' AND ` + inTypeLine + `
+		AND DATE(created_at) = DATE('now', 'localtime')
+	`
 	args := []interface{}{}
+	if queueType != "" {
+		base += ` AND queue_type = ?`
+		args = append(args, queueType)
+	}
 
-	if status != "" {
-		query += " WHERE status = ?"
-		args = append(args, status)
+	pick := func(filter, orderBy string) (int64, string, error) {
+		var id int64
+		var priority int
+		err := tx.QueryRow(base+filter+` ORDER BY `+orderBy+` LIMIT 1`, args...).Scan(&id, &priority)
+		if err != nil {
+			return 0, "", err
+		}
+		return id, laneFor(priority), nil
+	}
+	pickPriority := func() (int64, string, error) {
+		return pick(` AND priority > 0`, `priority DESC, `+queueOrderKey+` ASC`)
+	}
+	pickNormal := func() (int64, string, error) {
+		return pick(` AND priority = 0`, queueOrderKey+` ASC`)
 	}
 
-	query += " ORDER BY created_at DESC"
+	switch d.config.Queue.PriorityPolicy {
+	case config.PriorityPolicyFIFO:
+		return pick("", queueOrderKey+` ASC`)
 
-	if limit > 0 {
-		query += " LIMIT ?"
-		args = append(args, limit)
+	case config.PriorityPolicyInterleave:
+		ratio := d.config.Queue.PriorityRatio
+		if ratio < 1 {
+			ratio = 1
+		}
+		streak, err := d.priorityStreak(tx, queueType, ratio)
+		if err != nil {
+			return 0, "", err
+		}
+		first, second := pickPriority, pickNormal
+		if streak >= ratio {
+			first, second = pickNormal, pickPriority
+		}
+		id, lane, err := first()
+		if err == sql.ErrNoRows {
+			return second()
+		}
+		return id, lane, err
+
+	default: // strict
+		return pick("", `priority DESC, `+queueOrderKey+` ASC`)
 	}
+}
 
-	rows, err := d.Query(query, args...)
+// TransferQueue moves the queue currently served at fromCounterID back to
+// waiting, either reserved for toCounterID or in the line of toQueueType
+// (or both), at the given 1-based position of the target line. It returns
+// ErrQueueNotCalled when that queue is no longer being served, e.g. it was
+// cancelled without clearing the counter.
+func (d *DB) TransferQueue(fromCounterID int64, toCounterID *int64, toQueueType string, position int) (*models.Queue, error) {
+	tx, err := d.Begin()
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var queues []*models.Queue
-	for rows.Next() {
-		q := &models.Queue{}
-		if err := rows.Scan(&q.ID, &q.QueueNumber, &q.QueueType, &q.Status, &q.CounterID, &q.CreatedAt, &q.CalledAt, &q.CompletedAt); err != nil {
-			return nil, err
-		}
-		q.PrepareJSON()
-		queues = append(queues, q)
+	var queueID sql.NullInt64
+	err = tx.QueryRow(`SELECT current_queue_id FROM counters WHERE id = ?`, fromCounterID).Scan(&queueID)
+	if err != nil {
+		return nil, fmt.Errorf("counter not found: %w", err)
+	}
+	if !queueID.Valid {
+		return nil, fmt.Errorf("no current queue: %w", sql.ErrNoRows)
 	}
-	return queues, nil
-}
-
-func (d *DB) ListQueuesWithPagination(status, queueType, date string, page, perPage int) (*models.PaginatedQueues, error) {
-	// Build WHERE clause
-	where := []string{}
-	args := []interface{}{}
 
-	if status != "" {
-		where = append(where, "status = ?")
-		args = append(args, status)
+	var queueType string
+	err = tx.QueryRow(`SELECT queue_type FROM queues WHERE id = ? AND status = 'called'`, queueID.Int64).Scan(&queueType)
+	if err == sql.ErrNoRows {
+		return nil, ErrQueueNotCalled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if toQueueType != "" {
+		queueType = toQueueType
 	}
 
-	if queueType != "" {
-		where = append(where, "queue_type = ?")
-		args = append(args, queueType)
+	// Work out the sort key that puts the queue at the requested position
+	lineFilter := inTypeLine + ` AND queue_type = ?`
+	lineArg := interface{}(queueType)
+	if toCounterID != nil {
+		lineFilter = `target_counter_id = ?`
+		lineArg = *toCounterID
+	}
+	sortKey, err := lineSortKey(tx, lineFilter, lineArg, queueID.Int64, position)
+	if err != nil {
+		return nil, err
 	}
 
-	if date != "" {
-		where = append(where, "DATE(created_at) = DATE(?)")
-		args = append(args, date)
+	_, err = tx.Exec(`
+		UPDATE queues
+		SET status = 'waiting', counter_id = NULL, queue_type = ?, target_counter_id = ?, sort_key = ?
+		WHERE id = ?
+	`, queueType, toCounterID, sortKey, queueID.Int64)
+	if err != nil {
+		return nil, err
 	}
 
-	whereClause := ""
-	if len(where) > 0 {
-		whereClause = " WHERE " + strings.Join(where, " AND ")
+	if _, err := tx.Exec(`UPDATE counters SET current_queue_id = NULL WHERE id = ?`, fromCounterID); err != nil {
+		return nil, err
 	}
 
-	// Get total count
-	var total int
-	countQuery := "SELECT COUNT(*) FROM queues" + whereClause
-	if err := d.QueryRow(countQuery, args...).Scan(&total); err != nil {
+	_, err = tx.Exec(`
+		INSERT INTO call_history (queue_id, counter_id, operator_id, action, timestamp)
+		VALUES (?, ?, (SELECT operator_id FROM counters WHERE id = ?), ?, datetime('now', 'localtime'))
+	`, queueID.Int64, fromCounterID, fromCounterID, models.ActionTransferred)
+	if err != nil {
 		return nil, err
 	}
 
-	// Calculate pagination
-	totalPages := (total + perPage - 1) / perPage
-	if page > totalPages && totalPages > 0 {
-		page = totalPages
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
-	offset := (page - 1) * perPage
 
-	// Determine sort order
-	orderBy := "created_at DESC"
-	if status == "called" {
-		orderBy = "called_at DESC"
-	} else if status == "completed" {
-		orderBy = "completed_at DESC"
+	return d.GetQueue(queueID.Int64)
+}
+
+// ErrQueueNotCalled is returned by TransferQueue when the counter's current
+// queue is not in the called state.
+var ErrQueueNotCalled = errors.New("queue is not being served")
+
+// Errors returned by the park/reactivate operations.
+var (
+	ErrQueueNotParked     = errors.New("queue is not parked")
+	ErrParkExpired        = errors.New("park window has expired")
+	ErrServiceNotAssigned = errors.New("queue type is not assigned to this counter")
+)
+
+// parkQueueTx removes a no-show queue from its counter. The queue becomes
+// parked so it can be reactivated later, unless it has already used up
+// Queue.MaxRecalls, in which case it is cancelled. Returns the new status.
+func (d *DB) parkQueueTx(tx *sql.Tx, queueID, counterID int64) (models.QueueStatus, error) {
+	var recallCount int
+	if err := tx.QueryRow(`SELECT recall_count FROM queues WHERE id = ?`, queueID).Scan(&recallCount); err != nil {
+		return "", err
 	}
 
-	// Get queues
-	query := `SELECT id, queue_number, queue_type, status, counter_id, created_at, called_at, completed_at FROM queues` + whereClause + ` ORDER BY ` + orderBy + ` LIMIT ? OFFSET ?`
-	args = append(args, perPage, offset)
+	status, action := models.StatusParked, models.ActionParked
+	maxRecalls := d.config.Queue.MaxRecalls
+	if maxRecalls > 0 && recallCount >= maxRecalls {
+		status, action = models.StatusCancelled, models.ActionCancelled
+	}
 
-	rows, err := d.Query(query, args...)
+	var err error
+	if status == models.StatusParked {
+		_, err = tx.Exec(`
+			UPDATE queues SET status = 'parked', parked_at = datetime('now', 'localtime')
+			WHERE id = ?
+		`, queueID)
+	} else {
+		_, err = tx.Exec(`
+			UPDATE queues SET status = 'cancelled', completed_at = datetime('now', 'localtime')
+			WHERE id = ?
+		`, queueID)
+	}
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	defer rows.Close()
 
-	var queues []*models.Queue
-	for rows.Next() {
-		q := &models.Queue{}
-		if err := rows.Scan(&q.ID, &q.QueueNumber, &q.QueueType, &q.Status, &q.CounterID, &q.CreatedAt, &q.CalledAt, &q.CompletedAt); err != nil {
-			return nil, err
-		}
-		q.PrepareJSON()
-		queues = append(queues, q)
+	if _, err := tx.Exec(`UPDATE counters SET current_queue_id = NULL WHERE id = ? AND current_queue_id = ?`, counterID, queueID); err != nil {
+		return "", err
 	}
 
-	if queues == nil {
-		queues = []*models.Queue{}
+	_, err = tx.Exec(`
+		INSERT INTO call_history (queue_id, counter_id, operator_id, action, timestamp)
+		VALUES (?, ?, (SELECT operator_id FROM counters WHERE id = ?), ?, datetime('now', 'localtime'))
+	`, queueID, counterID, counterID, action)
+	if err != nil {
+		return "", err
 	}
-
-	return &models.PaginatedQueues{
-		Queues:     queues,
-		Total:      total,
-		Page:       page,
-		PerPage:    perPage,
-		TotalPages: totalPages,
-	}, nil
+	return status, nil
 }
 
-func (d *DB) GetNextWaitingQueue() (*models.Queue, error) {
-	q := &models.Queue{}
-	err := d.QueryRow(`
-		SELECT id, queue_number, queue_type, status, counter_id, created_at, called_at, completed_at
-		FROM queues
-		WHERE status = 'waiting'
+// ParkCurrentQueue parks the queue currently served at the counter as a
+// no-show. The returned queue is cancelled instead when it has no recalls left.
+func (d *DB) ParkCurrentQueue(counterID int64) (*models.Queue, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var queueID sql.NullInt64
+	err = tx.QueryRow(`SELECT current_queue_id FROM counters WHERE id = ?`, counterID).Scan(&queueID)
+	if err != nil {
+		return nil, fmt.Errorf("counter not found: %w", err)
+	}
+	if !queueID.Valid {
+		return nil, fmt.Errorf("no current queue: %w", sql.ErrNoRows)
+	}
+
+	if _, err := d.parkQueueTx(tx, queueID.Int64, counterID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return d.GetQueue(queueID.Int64)
+}
+
+// ReactivateQueue puts a parked queue back at the head of its line when the
+// taxpayer shows up again. Reactivation counts as a recall. Queues parked
+// longer than Queue.ParkWindowMins are cancelled and ErrParkExpired is returned.
+func (d *DB) ReactivateQueue(queueID int64) (*models.Queue, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var status models.QueueStatus
+	var queueType string
+	var counterID sql.NullInt64 // the counter it was parked at
+	var expired bool
+	err = tx.QueryRow(`
+		SELECT status, queue_type, counter_id, COALESCE(parked_at < datetime('now', 'localtime', ? || ' minutes'), 0)
+		FROM queues WHERE id = ?
+	`, fmt.Sprintf("-%d", d.config.Queue.ParkWindowMins), queueID).Scan(&status, &queueType, &counterID, &expired)
+	if err != nil {
+		return nil, err
+	}
+	if status != models.StatusParked {
+		return nil, ErrQueueNotParked
+	}
+
+	addHistory := func(action models.CallAction) error {
+		if !counterID.Valid {
+			return nil
+		}
+		_, err := tx.Exec(`
+			INSERT INTO call_history (queue_id, counter_id, operator_id, action, timestamp)
+			VALUES (?, ?, (SELECT operator_id FROM counters WHERE id = ?), ?, datetime('now', 'localtime'))
+		`, queueID, counterID.Int64, counterID.Int64, action)
+		return err
+	}
+
+	if expired && d.config.Queue.ParkWindowMins > 0 {
+		_, err = tx.Exec(`
+			UPDATE queues SET status = 'cancelled', completed_at = datetime('now', 'localtime')
+			WHERE id = ?
+		`, queueID)
+		if err != nil {
+			return nil, err
+		}
+		if err := addHistory(models.ActionCancelled); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrParkExpired
+	}
+
+	sortKey, err := lineSortKey(tx, inTypeLine+` AND queue_type = ?`, queueType, queueID, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE queues
+		SET status = 'waiting', counter_id = NULL, target_counter_id = NULL, parked_at = NULL,
+			sort_key = ?, recall_count = recall_count + 1
+		WHERE id = ?
+	`, sortKey, queueID)
+	if err != nil {
+		return nil, err
+	}
+	if err := addHistory(models.ActionReactivated); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return d.GetQueue(queueID)
+}
+
+// lineSortKey returns a sort key that places a queue at the given 1-based
+// position among today's waiting queues matching filter (excluding the
+// queue itself). Positions past the end of the line go to the tail.
+func lineSortKey(tx *sql.Tx, filter string, filterArg interface{}, queueID int64, position int) (float64, error) {
+	if position < 1 {
+		position = 1
+	}
+
+	rows, err := tx.Query(`
+		SELECT `+queueOrderKey+` FROM queues
+		WHERE status = 'waiting' AND id != ? AND `+filter+`
 		AND DATE(created_at) = DATE('now', 'localtime')
-		ORDER BY created_at ASC
-		LIMIT 1
-	`).Scan(&q.ID, &q.QueueNumber, &q.QueueType, &q.Status, &q.CounterID, &q.CreatedAt, &q.CalledAt, &q.CompletedAt)
+		ORDER BY `+queueOrderKey+` ASC LIMIT ?
+	`, queueID, filterArg, position)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var keys []float64
+	for rows.Next() {
+		var k float64
+		if err := rows.Scan(&k); err != nil {
+			return 0, err
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// A tenth of a second, expressed in julian days
+	const step = 0.1 / 86400
+
+	switch {
+	case len(keys) == 0:
+		var now float64
+		err := tx.QueryRow(`SELECT julianday('now', 'localtime')`).Scan(&now)
+		return now, err
+	case len(keys) < position:
+		return keys[len(keys)-1] + step, nil
+	case position == 1:
+		return keys[0] - step, nil
+	default:
+		return (keys[position-2] + keys[position-1]) / 2, nil
+	}
+}
+
+// routeQueueType resolves which queue type a counter serves next. Counters
+// without assigned services keep the old behaviour (the requested type, or
+// any type). Otherwise an explicit type must be assigned to the counter, and
+// without one the type is chosen among the assigned services that have
+// waiting queues: the highest service priority first, then by
+// Queue.RoutingPolicy. Returns sql.ErrNoRows if none of them has a waiting queue.
+func (d *DB) routeQueueType(tx *sql.Tx, counterID int64, queueType string) (string, error) {
+	rows, err := tx.Query(`
+		SELECT cs.queue_type, cs.weight, cs.priority,
+			(SELECT MIN(`+queueOrderKey+`) FROM queues
+				WHERE queue_type = cs.queue_type AND status = 'waiting' AND `+inTypeLine+`
+				AND DATE(created_at) = DATE('now', 'localtime')),
+			(SELECT COUNT(*) FROM call_history ch JOIN queues q ON q.id = ch.queue_id
+				WHERE ch.counter_id = cs.counter_id AND ch.action = 'called' AND q.queue_type = cs.queue_type
+				AND DATE(ch.timestamp) = DATE('now', 'localtime'))
+		FROM counter_services cs
+		WHERE cs.counter_id = ?
+		ORDER BY cs.priority DESC, cs.queue_type ASC
+	`, counterID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	type candidate struct {
+		queueType string
+		weight    int
+		priority  int
+		head      sql.NullFloat64 // order key of the first waiting queue
+		served    int             // calls of this type at this counter today
+	}
+	var assigned []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.queueType, &c.weight, &c.priority, &c.head, &c.served); err != nil {
+			return "", err
+		}
+		assigned = append(assigned, c)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	rows.Close()
+
+	if len(assigned) == 0 {
+		return queueType, nil
+	}
+	if queueType != "" {
+		for _, c := range assigned {
+			if c.queueType == queueType {
+				return queueType, nil
+			}
+		}
+		return "", ErrServiceNotAssigned
+	}
+
+	// Only types with waiting queues in the highest service priority tier
+	var tier []candidate
+	for _, c := range assigned {
+		if !c.head.Valid {
+			continue
+		}
+		if len(tier) > 0 && c.priority < tier[0].priority {
+			break
+		}
+		tier = append(tier, c)
+	}
+	if len(tier) == 0 {
+		return "", sql.ErrNoRows
+	}
+
+	longestWait := func(cs []candidate) candidate {
+		best := cs[0]
+		for _, c := range cs[1:] {
+			if c.head.Float64 < best.head.Float64 {
+				best = c
+			}
+		}
+		return best
+	}
+
+	switch d.config.Queue.RoutingPolicy {
+	case config.RoutingRoundRobin:
+		var last string
+		err := tx.QueryRow(`
+			SELECT q.queue_type FROM call_history ch
+			JOIN queues q ON q.id = ch.queue_id
+			WHERE ch.counter_id = ? AND ch.action = 'called'
+			AND DATE(ch.timestamp) = DATE('now', 'localtime')
+			ORDER BY ch.id DESC LIMIT 1
+		`, counterID).Scan(&last)
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		for _, c := range tier {
+			if c.queueType > last {
+				return c.queueType, nil
+			}
+		}
+		return tier[0].queueType, nil
+
+	case config.RoutingWeighted:
+		var best []candidate
+		var bestRatio float64
+		for _, c := range tier {
+			weight := c.weight
+			if weight < 1 {
+				weight = 1
+			}
+			ratio := float64(c.served) / float64(weight)
+			if len(best) == 0 || ratio < bestRatio {
+				best, bestRatio = []candidate{c}, ratio
+			} else if ratio == bestRatio {
+				best = append(best, c)
+			}
+		}
+		return longestWait(best).queueType, nil
+
+	default: // longest wait
+		return longestWait(tier).queueType, nil
+	}
+}
+
+func laneFor(priority int) string {
+	if priority > models.PriorityNormal {
+		return models.LanePriority
+	}
+	return models.LaneNormal
+}
+
+// priorityStreak counts how many of today's most recent calls (up to limit)
+// were served from the priority lane without a normal call in between.
+func (d *DB) priorityStreak(q querier, queueType string, limit int) (int, error) {
+	query := `
+		SELECT ch.lane FROM call_history ch
+		JOIN queues q ON q.id = ch.queue_id
+		WHERE ch.action = ?
+		AND DATE(ch.timestamp) = DATE('now', 'localtime')
+	`
+	args := []interface{}{models.ActionCalled}
+	if queueType != "" {
+		query += ` AND q.queue_type = ?`
+		args = append(args, queueType)
+	}
+	query += ` ORDER BY ch.id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	streak := 0
+	for rows.Next() {
+		var lane string
+		if err := rows.Scan(&lane); err != nil {
+			return 0, err
+		}
+		if lane != models.LanePriority {
+			break
+		}
+		streak++
+	}
+	return streak, rows.Err()
+}
+
+// queueColumns is the column list read by scanQueue.
+const queueColumns = `id, queue_number, queue_type, status, priority, counter_id, target_counter_id, created_at, called_at, completed_at, recall_count, parked_at, operator_id`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// querier runs queries on the database or inside a transaction.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func scanQueue(row rowScanner) (*models.Queue, error) {
+	q := &models.Queue{}
+	err := row.Scan(&q.ID, &q.QueueNumber, &q.QueueType, &q.Status, &q.Priority, &q.CounterID, &q.TargetCounterID,
+		&q.CreatedAt, &q.CalledAt, &q.CompletedAt, &q.RecallCount, &q.ParkedAt, &q.OperatorID)
 	if err != nil {
 		return nil, err
 	}
@@ -506,25 +1122,156 @@ func (d *DB) GetNextWaitingQueue() (*models.Queue, error) {
 	return q, nil
 }
 
+func (d *DB) GetQueue(id int64) (*models.Queue, error) {
+	return scanQueue(d.QueryRow(`SELECT `+queueColumns+` FROM queues WHERE id = ?`, id))
+}
+
+// GetQueueByNumber returns the most recent queue with the given number
+// (numbers restart every day).
+func (d *DB) GetQueueByNumber(number string) (*models.Queue, error) {
+	return scanQueue(d.QueryRow(`SELECT `+queueColumns+` FROM queues WHERE queue_number = ? ORDER BY id DESC LIMIT 1`, number))
+}
+
+func (d *DB) ListQueues(status string, limit int) ([]*models.Queue, error) {
+	query := `SELECT ` + queueColumns + ` FROM queues`
+	args := []interface{}{}
+
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+
+	query += " ORDER BY created_at DESC"
+
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := d.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queues []*models.Queue
+	for rows.Next() {
+		q, err := scanQueue(rows)
+		if err != nil {
+			return nil, err
+		}
+		queues = append(queues, q)
+	}
+	return queues, nil
+}
+
+func (d *DB) ListQueuesWithPagination(status, queueType, date string, page, perPage int) (*models.PaginatedQueues, error) {
+	// Build WHERE clause
+	where := []string{}
+	args := []interface{}{}
+
+	if status != "" {
+		where = append(where, "status = ?")
+		args = append(args, status)
+	}
+
+	if queueType != "" {
+		where = append(where, "queue_type = ?")
+		args = append(args, queueType)
+	}
+
+	if date != "" {
+		where = append(where, "DATE(created_at) = DATE(?)")
+		args = append(args, date)
+	}
+
+	whereClause := ""
+	if len(where) > 0 {
+		whereClause = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	// Get total count
+	var total int
+	countQuery := "SELECT COUNT(*) FROM queues" + whereClause
+	if err := d.QueryRow(countQuery, args...).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	// Calculate pagination
+	totalPages := (total + perPage - 1) / perPage
+	if page > totalPages && totalPages > 0 {
+		page = totalPages
+	}
+	offset := (page - 1) * perPage
+
+	// Determine sort order
+	orderBy := "created_at DESC"
+	if status == "called" {
+		orderBy = "called_at DESC"
+	} else if status == "completed" {
+		orderBy = "completed_at DESC"
+	}
+
+	// Get queues
+	query := `SELECT ` + queueColumns + ` FROM queues` + whereClause + ` ORDER BY ` + orderBy + ` LIMIT ? OFFSET ?`
+	args = append(args, perPage, offset)
+
+	rows, err := d.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queues []*models.Queue
+	for rows.Next() {
+		q, err := scanQueue(rows)
+		if err != nil {
+			return nil, err
+		}
+		queues = append(queues, q)
+	}
+
+	if queues == nil {
+		queues = []*models.Queue{}
+	}
+
+	return &models.PaginatedQueues{
+		Queues:     queues,
+		Total:      total,
+		Page:       page,
+		PerPage:    perPage,
+		TotalPages: totalPages,
+	}, nil
+}
+
+func (d *DB) GetNextWaitingQueue() (*models.Queue, error) {
+	return scanQueue(d.QueryRow(`
+		SELECT ` + queueColumns + `
+		FROM queues
+		WHERE status = 'waiting'
+		AND DATE(created_at) = DATE('now', 'localtime')
+		ORDER BY ` + queueOrderKey + ` ASC
+		LIMIT 1
+	`))
+}
+
 func (d *DB) GetNextWaitingQueueByType(queueType string) (*models.Queue, error) {
-	q := &models.Queue{}
-	err := d.QueryRow(`
-		SELECT id, queue_number, queue_type, status, counter_id, created_at, called_at, completed_at
+	return scanQueue(d.QueryRow(`
+		SELECT `+queueColumns+`
 		FROM queues
 		WHERE status = 'waiting' AND queue_type = ?
 		AND DATE(created_at) = DATE('now', 'localtime')
-		ORDER BY created_at ASC
+		ORDER BY `+queueOrderKey+` ASC
 		LIMIT 1
-	`, queueType).Scan(&q.ID, &q.QueueNumber, &q.QueueType, &q.Status, &q.CounterID, &q.CreatedAt, &q.CalledAt, &q.CompletedAt)
-	if err != nil {
-		return nil, err
-	}
-	q.PrepareJSON()
-	return q, nil
+	`, queueType))
 }
 
 func (d *DB) GetWaitingCountByType() (map[string]int, error) {
-	rows, err := d.Query(`
+	return waitingCountByType(d)
+}
+
+func waitingCountByType(q querier) (map[string]int, error) {
+	rows, err := q.Query(`
 		SELECT queue_type, COUNT(*) as count
 		FROM queues
 		WHERE status = 'waiting'
@@ -548,23 +1295,250 @@ func (d *DB) GetWaitingCountByType() (map[string]int, error) {
 	return counts, nil
 }
 
+// UpdateQueueStatus sets the queue status and stamps called_at/completed_at.
+// Timestamps are written by SQLite in the same localtime format as
+// created_at so durations can be computed with julianday().
 func (d *DB) UpdateQueueStatus(id int64, status models.QueueStatus, counterID *int64) error {
-	now := time.Now()
+	called := status == models.StatusCalled
+	finished := status == models.StatusCompleted || status == models.StatusCancelled
+
+	_, err := d.Exec(`
+		UPDATE queues
+		SET status = ?, counter_id = ?,
+			called_at = CASE WHEN ? THEN datetime('now', 'localtime') ELSE called_at END,
+			completed_at = CASE WHEN ? THEN datetime('now', 'localtime') ELSE completed_at END
+		WHERE id = ?
+	`, status, counterID, called, finished, id)
+	return err
+}
+
+// Waiting time estimation
+
+// serviceRate returns the average service duration in seconds of the most
+// recent completed tickets of queueType (ETADefaultMins without history)
+// and the number of active counters serving that type. Counters without
+// assigned services serve every type.
+func (d *DB) serviceRate(db querier, queueType string) (float64, int, error) {
+	sample := d.config.Queue.ETASampleSize
+	if sample < 1 {
+		sample = 20
+	}
+
+	var avg sql.NullFloat64
+	err := db.QueryRow(`
+		SELECT AVG((julianday(completed_at) - julianday(called_at)) * 86400)
+		FROM (
+			SELECT called_at, completed_at FROM queues
+			WHERE queue_type = ? AND status = 'completed'
+			AND called_at IS NOT NULL AND completed_at >= called_at
+			ORDER BY completed_at DESC LIMIT ?
+		)
+	`, queueType, sample).Scan(&avg)
+	if err != nil {
+		return 0, 0, err
+	}
+	avgSeconds := avg.Float64
+	if !avg.Valid || avgSeconds <= 0 {
+		avgSeconds = float64(d.config.Queue.ETADefaultMins * 60)
+	}
+
+	var counters int
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM counters c
+		WHERE c.is_active = 1
+		AND (
+			EXISTS (SELECT 1 FROM counter_services cs WHERE cs.counter_id = c.id AND cs.queue_type = ?)
+			OR NOT EXISTS (SELECT 1 FROM counter_services cs WHERE cs.counter_id = c.id)
+		)
+	`, queueType).Scan(&counters)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return avgSeconds, counters, nil
+}
+
+// waitMinutes estimates how long it takes counters working in parallel to
+// serve the given number of tickets.
+func waitMinutes(ahead, counters int, avgSeconds float64) int {
+	if counters < 1 {
+		counters = 1
+	}
+	return int(math.Ceil(float64(ahead) * avgSeconds / float64(counters) / 60))
+}
+
+// EstimateQueueWait estimates when the queue will be called. Tickets ahead
+// are counted in the order of the priority policy; queues that are no
+// longer waiting have no wait.
+func (d *DB) EstimateQueueWait(queueID int64) (*models.QueueETA, error) {
+	return d.estimateQueueWait(d, queueID)
+}
+
+// estimateQueueWait is EstimateQueueWait reading through db, which may be
+// the transaction that created the queue.
+func (d *DB) estimateQueueWait(db querier, queueID int64) (*models.QueueETA, error) {
+	q, err := scanQueue(db.QueryRow(`SELECT `+queueColumns+` FROM queues WHERE id = ?`, queueID))
+	if err != nil {
+		return nil, err
+	}
+
+	avgSeconds, counters, err := d.serviceRate(db, q.QueueType)
+	if err != nil {
+		return nil, err
+	}
 
-	var calledAt, completedAt interface{}
-	if status == models.StatusCalled {
-		calledAt = now
+	eta := &models.QueueETA{
+		QueueNumber:       q.QueueNumber,
+		QueueType:         q.QueueType,
+		Status:            q.Status,
+		ActiveCounters:    counters,
+		AvgServiceSeconds: int(avgSeconds),
+		EstimatedCallAt:   time.Now(),
 	}
-	if status == models.StatusCompleted || status == models.StatusCancelled {
-		completedAt = now
+	if q.Status != models.StatusWaiting {
+		return eta, nil
+	}
+
+	var key float64
+	if err := db.QueryRow(`SELECT `+queueOrderKey+` FROM queues WHERE id = ?`, queueID).Scan(&key); err != nil {
+		return nil, err
+	}
+
+	// Only the line the ticket is in: tickets reserved for another counter
+	// are not ahead of it, and a reserved ticket waits behind that counter's
+	// reservations only
+	lineFilter := `queue_type = ? AND ` + inTypeLine
+	lineArg := interface{}(q.QueueType)
+	reserved := false
+	if q.TargetCounterID.Valid {
+		var active bool
+		err := db.QueryRow(`SELECT is_active FROM counters WHERE id = ?`, q.TargetCounterID.Int64).Scan(&active)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if active {
+			lineFilter = `target_counter_id = ?`
+			lineArg = q.TargetCounterID.Int64
+			reserved = true
+		}
+	}
+	count := func(filter string, args ...interface{}) (int, error) {
+		var n int
+		err := db.QueryRow(`
+			SELECT COUNT(*) FROM queues
+			WHERE status = 'waiting' AND `+lineFilter+`
+			AND DATE(created_at) = DATE('now', 'localtime')
+			AND `+filter, append([]interface{}{lineArg}, args...)...).Scan(&n)
+		return n, err
+	}
+
+	before := `(` + queueOrderKey + ` < ? OR (` + queueOrderKey + ` = ? AND id < ?))`
+	args := []interface{}{key, key, queueID}
+	if d.config.Queue.PriorityPolicy != config.PriorityPolicyFIFO {
+		before = `(priority > ? OR (priority = ? AND ` + before + `))`
+		args = append([]interface{}{q.Priority, q.Priority}, args...)
+	}
+
+	if d.config.Queue.PriorityPolicy == config.PriorityPolicyInterleave && !reserved {
+		// The lanes take turns: count the ticket's own lane ahead of it and
+		// the calls the other lane gets in between
+		isPriority := q.Priority > models.PriorityNormal
+		lane, otherLane := `priority = 0`, `priority > 0`
+		if isPriority {
+			lane, otherLane = otherLane, lane
+		}
+		sameLane, err := count(lane+` AND `+before, args...)
+		if err != nil {
+			return nil, err
+		}
+		other, err := count(otherLane)
+		if err != nil {
+			return nil, err
+		}
+		ratio := d.config.Queue.PriorityRatio
+		if ratio < 1 {
+			ratio = 1
+		}
+		streak, err := d.priorityStreak(db, q.QueueType, ratio)
+		if err != nil {
+			return nil, err
+		}
+		eta.Ahead = interleavedAhead(isPriority, sameLane, other, streak, ratio)
+	} else if eta.Ahead, err = count(before, args...); err != nil {
+		return nil, err
+	}
+
+	eta.WaitMinutes = waitMinutes(eta.Ahead, counters, avgSeconds)
+	eta.EstimatedCallAt = eta.EstimatedCallAt.Add(time.Duration(eta.WaitMinutes) * time.Minute)
+	return eta, nil
+}
+
+// interleavedAhead counts the tickets called before a ticket under the
+// interleave policy, which calls a normal ticket after every ratio priority
+// tickets. sameLane tickets of the ticket's own lane are ahead of it,
+// otherLane tickets wait in the other lane, and the last streak calls were
+// priority calls in a row.
+func interleavedAhead(isPriority bool, sameLane, otherLane, streak, ratio int) int {
+	// Priority calls until the next normal one
+	untilNormal := ratio - streak
+	if untilNormal < 0 {
+		untilNormal = 0
+	}
+	if isPriority {
+		// Normal tickets come after untilNormal, untilNormal+ratio, ...
+		// priority calls
+		normals := 0
+		if sameLane >= untilNormal {
+			normals = (sameLane-untilNormal)/ratio + 1
+		}
+		return sameLane + min(normals, otherLane)
+	}
+	return sameLane + min(untilNormal+sameLane*ratio, otherLane)
+}
+
+// EstimateServiceWaits estimates the wait for a ticket taken now, for every
+// active queue type.
+func (d *DB) EstimateServiceWaits() ([]*models.ServiceETA, error) {
+	types, err := d.ListQueueTypes(true)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := d.GetWaitingCountByType()
+	if err != nil {
+		return nil, err
+	}
+
+	var etas []*models.ServiceETA
+	for _, qt := range types {
+		avgSeconds, counters, err := d.serviceRate(d, qt.Code)
+		if err != nil {
+			return nil, err
+		}
+		etas = append(etas, &models.ServiceETA{
+			QueueType:         qt.Code,
+			WaitingCount:      counts[qt.Code],
+			ActiveCounters:    counters,
+			AvgServiceSeconds: int(avgSeconds),
+			WaitMinutes:       waitMinutes(counts[qt.Code], counters, avgSeconds),
+		})
+	}
+	return etas, nil
+}
+
+// GetNowServing returns the number most recently called today for the
+// queue type, or "" if none has been called yet.
+func (d *DB) GetNowServing(queueType string) (string, error) {
+	var number string
+	err := d.QueryRow(`
+		SELECT queue_number FROM queues
+		WHERE queue_type = ? AND called_at IS NOT NULL
+		AND DATE(created_at) = DATE('now', 'localtime')
+		ORDER BY called_at DESC LIMIT 1
+	`, queueType).Scan(&number)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
-
-	_, err := d.Exec(`
-		UPDATE queues
-		SET status = ?, counter_id = ?, called_at = COALESCE(?, called_at), completed_at = COALESCE(?, completed_at)
-		WHERE id = ?
-	`, status, counterID, calledAt, completedAt, id)
-	return err
+	return number, err
 }
 
 func (d *DB) GetWaitingCount() (int, error) {
@@ -596,21 +1570,24 @@ func (d *DB) GetCounter(id int64) (*models.Counter, error) {
 	query := `
 		SELECT
 			c.id, c.counter_number, c.counter_name, c.is_active, c.current_queue_id, c.last_call_at,
-			q.id, q.queue_number, q.queue_type, q.status, q.counter_id, q.created_at, q.called_at, q.completed_at
+			c.operator_id, c.operator_since, COALESCE(NULLIF(u.full_name, ''), u.username, ''),
+			q.id, q.queue_number, q.queue_type, q.status, q.priority, q.counter_id, q.created_at, q.called_at, q.completed_at
 		FROM counters c
+		LEFT JOIN users u ON c.operator_id = u.id
 		LEFT JOIN queues q ON c.current_queue_id = q.id
 			AND DATE(q.called_at) = ?
 		WHERE c.id = ?
 	`
 
 	c := &models.Counter{}
-	var qID, qCounterID sql.NullInt64
+	var qID, qCounterID, qPriority sql.NullInt64
 	var qNumber, qType, qStatus sql.NullString
 	var qCreated, qCalled, qCompleted sql.NullTime
 
 	err := d.QueryRow(query, today, id).Scan(
 		&c.ID, &c.CounterNumber, &c.CounterName, &c.IsActive, &c.CurrentQueueID, &c.LastCallAt,
-		&qID, &qNumber, &qType, &qStatus, &qCounterID, &qCreated, &qCalled, &qCompleted,
+		&c.OperatorID, &c.OperatorSince, &c.OperatorName,
+		&qID, &qNumber, &qType, &qStatus, &qPriority, &qCounterID, &qCreated, &qCalled, &qCompleted,
 	)
 	if err != nil {
 		return nil, err
@@ -624,6 +1601,7 @@ func (d *DB) GetCounter(id int64) (*models.Counter, error) {
 			QueueNumber: qNumber.String,
 			QueueType:   qType.String,
 			Status:      models.QueueStatus(qStatus.String),
+			Priority:    int(qPriority.Int64),
 			CounterID:   qCounterID,
 			CreatedAt:   qCreated.Time,
 			CalledAt:    qCalled,
@@ -639,6 +1617,10 @@ func (d *DB) GetCounter(id int64) (*models.Counter, error) {
 }
 
 func (d *DB) ListCounters() ([]*models.Counter, error) {
+	return listCounters(d)
+}
+
+func listCounters(q querier) ([]*models.Counter, error) {
 	// Get today's date from Go (more reliable than SQLite's localtime)
 	today := time.Now().Format("2006-01-02")
 
@@ -646,14 +1628,16 @@ func (d *DB) ListCounters() ([]*models.Counter, error) {
 	query := `
 		SELECT
 			c.id, c.counter_number, c.counter_name, c.is_active, c.current_queue_id, c.last_call_at,
-			q.id, q.queue_number, q.queue_type, q.status, q.counter_id, q.created_at, q.called_at, q.completed_at
+			c.operator_id, c.operator_since, COALESCE(NULLIF(u.full_name, ''), u.username, ''),
+			q.id, q.queue_number, q.queue_type, q.status, q.priority, q.counter_id, q.created_at, q.called_at, q.completed_at
 		FROM counters c
+		LEFT JOIN users u ON c.operator_id = u.id
 		LEFT JOIN queues q ON c.current_queue_id = q.id
 			AND DATE(q.called_at) = ?
 		ORDER BY CAST(c.counter_number AS INTEGER) ASC, c.counter_number ASC
 	`
 
-	rows, err := d.Query(query, today)
+	rows, err := q.Query(query, today)
 	if err != nil {
 		return nil, err
 	}
@@ -662,13 +1646,14 @@ func (d *DB) ListCounters() ([]*models.Counter, error) {
 	var counters []*models.Counter
 	for rows.Next() {
 		c := &models.Counter{}
-		var qID, qCounterID sql.NullInt64
+		var qID, qCounterID, qPriority sql.NullInt64
 		var qNumber, qType, qStatus sql.NullString
 		var qCreated, qCalled, qCompleted sql.NullTime
 
 		err := rows.Scan(
 			&c.ID, &c.CounterNumber, &c.CounterName, &c.IsActive, &c.CurrentQueueID, &c.LastCallAt,
-			&qID, &qNumber, &qType, &qStatus, &qCounterID, &qCreated, &qCalled, &qCompleted,
+			&c.OperatorID, &c.OperatorSince, &c.OperatorName,
+			&qID, &qNumber, &qType, &qStatus, &qPriority, &qCounterID, &qCreated, &qCalled, &qCompleted,
 		)
 		if err != nil {
 			return nil, err
@@ -682,6 +1667,7 @@ func (d *DB) ListCounters() ([]*models.Counter, error) {
 				QueueNumber: qNumber.String,
 				QueueType:   qType.String,
 				Status:      models.QueueStatus(qStatus.String),
+				Priority:    int(qPriority.Int64),
 				CounterID:   qCounterID,
 				CreatedAt:   qCreated.Time,
 				CalledAt:    qCalled,
@@ -735,6 +1721,12 @@ func (d *DB) DeleteCounter(id int64) error {
 		return fmt.Errorf("failed to delete call history: %w", err)
 	}
 
+	// Delete service assignments
+	_, err = tx.Exec(`DELETE FROM counter_services WHERE counter_id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete counter services: %w", err)
+	}
+
 	// Delete the counter
 	_, err = tx.Exec(`DELETE FROM counters WHERE id = ?`, id)
 	if err != nil {
@@ -766,6 +1758,11 @@ func (d *DB) ResetAllCounters() error {
 		return fmt.Errorf("failed to delete call history: %w", err)
 	}
 
+	// Hapus semua penugasan layanan loket
+	if _, err = tx.Exec(`DELETE FROM counter_services`); err != nil {
+		return fmt.Errorf("failed to delete counter services: %w", err)
+	}
+
 	// Hapus semua loket
 	if _, err = tx.Exec(`DELETE FROM counters`); err != nil {
 		return fmt.Errorf("failed to delete counters: %w", err)
@@ -783,19 +1780,416 @@ func (d *DB) ResetAllCounters() error {
 	return nil
 }
 
+// Counter service operations
+
+func (d *DB) ListCounterServices(counterID int64) ([]*models.CounterService, error) {
+	rows, err := d.Query(`
+		SELECT counter_id, queue_type, weight, priority
+		FROM counter_services WHERE counter_id = ?
+		ORDER BY priority DESC, queue_type ASC
+	`, counterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var services []*models.CounterService
+	for rows.Next() {
+		cs := &models.CounterService{}
+		if err := rows.Scan(&cs.CounterID, &cs.QueueType, &cs.Weight, &cs.Priority); err != nil {
+			return nil, err
+		}
+		services = append(services, cs)
+	}
+	return services, rows.Err()
+}
+
+// SetCounterServices replaces all service assignments of a counter.
+// An empty list lets the counter serve any queue type again.
+func (d *DB) SetCounterServices(counterID int64, services []*models.CounterService) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM counter_services WHERE counter_id = ?`, counterID); err != nil {
+		return fmt.Errorf("failed to clear counter services: %w", err)
+	}
+
+	for _, cs := range services {
+		weight := cs.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		_, err := tx.Exec(`
+			INSERT INTO counter_services (counter_id, queue_type, weight, priority)
+			VALUES (?, ?, ?, ?)
+		`, counterID, cs.QueueType, weight, cs.Priority)
+		if err != nil {
+			return fmt.Errorf("failed to assign %s: %w", cs.QueueType, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// User operations
+
+// userColumns is the column list read by scanUser.
+const userColumns = `id, username, full_name, password_hash, role, is_active, created_at, last_login_at`
+
+func scanUser(row rowScanner) (*models.User, error) {
+	u := &models.User{}
+	err := row.Scan(&u.ID, &u.Username, &u.FullName, &u.PasswordHash, &u.Role, &u.IsActive, &u.CreatedAt, &u.LastLoginAt)
+	if err != nil {
+		return nil, err
+	}
+	u.PrepareJSON()
+	return u, nil
+}
+
+func (d *DB) CreateUser(username, fullName, passwordHash string, role models.UserRole) (*models.User, error) {
+	result, err := d.Exec(`
+		INSERT INTO users (username, full_name, password_hash, role)
+		VALUES (?, ?, ?, ?)
+	`, username, fullName, passwordHash, role)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := result.LastInsertId()
+	return d.GetUser(id)
+}
+
+func (d *DB) GetUser(id int64) (*models.User, error) {
+	return scanUser(d.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+}
+
+// GetUserByUsername looks up a user case-insensitively.
+func (d *DB) GetUserByUsername(username string) (*models.User, error) {
+	return scanUser(d.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+}
+
+func (d *DB) ListUsers() ([]*models.User, error) {
+	rows, err := d.Query(`SELECT ` + userColumns + ` FROM users ORDER BY username ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*models.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// UpdateUser changes a user's profile. Deactivating a user also ends any
+// counter shift they hold.
+func (d *DB) UpdateUser(id int64, fullName string, role models.UserRole, isActive bool) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET full_name = ?, role = ?, is_active = ? WHERE id = ?`, fullName, role, isActive, id); err != nil {
+		return err
+	}
+	if !isActive {
+		if _, err := tx.Exec(`UPDATE counters SET operator_id = NULL, operator_since = NULL WHERE operator_id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (d *DB) SetUserPassword(id int64, passwordHash string) error {
+	_, err := d.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, passwordHash, id)
+	return err
+}
+
+func (d *DB) RecordUserLogin(id int64) error {
+	_, err := d.Exec(`UPDATE users SET last_login_at = datetime('now', 'localtime') WHERE id = ?`, id)
+	return err
+}
+
+// DeleteUser removes an account and its sessions. Queues and call history
+// keep the operator ID for reporting.
+func (d *DB) DeleteUser(id int64) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE counters SET operator_id = NULL, operator_since = NULL WHERE operator_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CountActiveAdmins returns the number of active admin accounts, so the last
+// one cannot be removed.
+func (d *DB) CountActiveAdmins() (int, error) {
+	var count int
+	err := d.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ? AND is_active = 1`, models.RoleAdmin).Scan(&count)
+	return count, err
+}
+
+// StartCounterShift binds an operator to a counter until EndCounterShift.
+// An operator works at one counter at a time, so any other counter they
+// were bound to is released; a previous operator at this counter is
+// replaced. Returns sql.ErrNoRows if the counter does not exist.
+func (d *DB) StartCounterShift(counterID, userID int64) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE counters SET operator_id = NULL, operator_since = NULL WHERE operator_id = ? AND id != ?`, userID, counterID); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE counters SET operator_id = ?, operator_since = datetime('now', 'localtime')
+		WHERE id = ?
+	`, userID, counterID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// EndCounterShift releases the counter if userID is still the operator
+// bound to it.
+func (d *DB) EndCounterShift(counterID, userID int64) error {
+	_, err := d.Exec(`
+		UPDATE counters SET operator_id = NULL, operator_since = NULL
+		WHERE id = ? AND operator_id = ?
+	`, counterID, userID)
+	return err
+}
+
+// Session operations
+
+// sessionColumns is the column list read by scanSession, selected from
+// sessionTables.
+const sessionColumns = `s.id, s.user_id, u.username, u.full_name, u.role, s.counter_id, COALESCE(c.counter_name, ''),
+	s.user_agent, s.ip_address, s.created_at, s.last_seen_at, s.expires_at`
+
+const sessionTables = `sessions s
+	JOIN users u ON u.id = s.user_id
+	LEFT JOIN counters c ON c.id = s.counter_id`
+
+func scanSession(row rowScanner) (*models.Session, error) {
+	s := &models.Session{}
+	err := row.Scan(&s.ID, &s.UserID, &s.Username, &s.FullName, &s.Role, &s.CounterID, &s.CounterName,
+		&s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// sessionTTL formats a session lifetime as an SQLite datetime modifier.
+func sessionTTL(seconds int) string {
+	return fmt.Sprintf("+%d seconds", seconds)
+}
+
+// CreateSession stores a login that expires ttlSeconds from now unless it
+// is renewed by TouchSession. counterID is 0 for admin panel logins.
+func (d *DB) CreateSession(tokenHash string, userID, counterID int64, userAgent, ipAddress string, ttlSeconds int) (*models.Session, error) {
+	result, err := d.Exec(`
+		INSERT INTO sessions (token_hash, user_id, counter_id, user_agent, ip_address, expires_at)
+		VALUES (?, ?, ?, ?, ?, datetime('now', 'localtime', ?))
+	`, tokenHash, userID, counterID, userAgent, ipAddress, sessionTTL(ttlSeconds))
+	if err != nil {
+		return nil, err
+	}
+	id, _ := result.LastInsertId()
+	return scanSession(d.QueryRow(`
+		SELECT `+sessionColumns+` FROM `+sessionTables+`
+		WHERE s.id = ?
+	`, id))
+}
+
+// GetSessionByToken returns the unexpired session with the given token
+// hash. Sessions of deactivated users are not returned.
+func (d *DB) GetSessionByToken(tokenHash string) (*models.Session, error) {
+	return scanSession(d.QueryRow(`
+		SELECT `+sessionColumns+` FROM `+sessionTables+`
+		WHERE s.token_hash = ? AND s.expires_at > datetime('now', 'localtime') AND u.is_active = 1
+	`, tokenHash))
+}
+
+// TouchSession records activity on a session and slides its expiry to
+// ttlSeconds from now. To spare a write per request, sessions seen within
+// the last minute are left alone; renewed reports whether it was updated.
+func (d *DB) TouchSession(id int64, ttlSeconds int) (renewed bool, err error) {
+	result, err := d.Exec(`
+		UPDATE sessions
+		SET last_seen_at = datetime('now', 'localtime'), expires_at = datetime('now', 'localtime', ?)
+		WHERE id = ? AND last_seen_at <= datetime('now', 'localtime', '-1 minute')
+	`, sessionTTL(ttlSeconds), id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// ListSessions returns the unexpired sessions, most recently active first.
+// A non-zero userID limits the list to that user's sessions.
+func (d *DB) ListSessions(userID int64) ([]*models.Session, error) {
+	rows, err := d.Query(`
+		SELECT `+sessionColumns+` FROM `+sessionTables+`
+		WHERE s.expires_at > datetime('now', 'localtime') AND (? = 0 OR s.user_id = ?)
+		ORDER BY s.last_seen_at DESC
+	`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*models.Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// deleteSessions removes the sessions matching where (written against the
+// alias s) and ends the counter shifts they held. Returns the IDs of the
+// counters that were released.
+func (d *DB) deleteSessions(where string, args ...interface{}) ([]int64, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT DISTINCT s.counter_id FROM sessions s
+		JOIN counters c ON c.id = s.counter_id AND c.operator_id = s.user_id
+		WHERE (`+where+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var released []int64
+	for rows.Next() {
+		var counterID int64
+		if err := rows.Scan(&counterID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		released = append(released, counterID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, counterID := range released {
+		if _, err := tx.Exec(`UPDATE counters SET operator_id = NULL, operator_since = NULL WHERE id = ?`, counterID); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions AS s WHERE (`+where+`)`, args...); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return released, nil
+}
+
+// DeleteSession revokes one session.
+func (d *DB) DeleteSession(id int64) ([]int64, error) {
+	return d.deleteSessions(`s.id = ?`, id)
+}
+
+// DeleteSessionByToken ends the session with the given token hash (logout).
+func (d *DB) DeleteSessionByToken(tokenHash string) ([]int64, error) {
+	return d.deleteSessions(`s.token_hash = ?`, tokenHash)
+}
+
+// DeleteUserSessions logs a user out everywhere except the session exceptID
+// (0 to keep none).
+func (d *DB) DeleteUserSessions(userID, exceptID int64) ([]int64, error) {
+	return d.deleteSessions(`s.user_id = ? AND s.id != ?`, userID, exceptID)
+}
+
+// DeleteCounterSessions ends the counter sessions that a new shift of
+// userID at counterID replaces: any session at that counter and the user's
+// own sessions at other counters.
+func (d *DB) DeleteCounterSessions(counterID, userID int64) ([]int64, error) {
+	return d.deleteSessions(`s.counter_id = ? OR (s.user_id = ? AND s.counter_id != 0)`, counterID, userID)
+}
+
+// DeleteExpiredSessions sweeps expired sessions and ends their shifts.
+func (d *DB) DeleteExpiredSessions() ([]int64, error) {
+	return d.deleteSessions(`s.expires_at <= datetime('now', 'localtime')`)
+}
+
 // Call history operations
 
 func (d *DB) AddCallHistory(queueID, counterID int64, action models.CallAction) error {
 	_, err := d.Exec(`
-		INSERT INTO call_history (queue_id, counter_id, action, timestamp)
-		VALUES (?, ?, ?, datetime('now', 'localtime'))
-	`, queueID, counterID, action)
+		INSERT INTO call_history (queue_id, counter_id, operator_id, action, timestamp)
+		VALUES (?, ?, (SELECT operator_id FROM counters WHERE id = ?), ?, datetime('now', 'localtime'))
+	`, queueID, counterID, counterID, action)
 	return err
 }
 
+// RecallQueue records a recall of the queue at the counter and counts it
+// towards Queue.MaxRecalls. callID is the recall's call_history row.
+func (d *DB) RecallQueue(queueID, counterID int64) (callID int64, err error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE queues SET recall_count = recall_count + 1 WHERE id = ?`, queueID); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`
+		INSERT INTO call_history (queue_id, counter_id, operator_id, action, timestamp)
+		VALUES (?, ?, (SELECT operator_id FROM counters WHERE id = ?), ?, datetime('now', 'localtime'))
+	`, queueID, counterID, counterID, models.ActionRecalled)
+	if err != nil {
+		return 0, err
+	}
+	callID, _ = result.LastInsertId()
+	return callID, tx.Commit()
+}
+
 func (d *DB) GetCallHistory(limit int) ([]*models.CallHistory, error) {
 	rows, err := d.Query(`
-		SELECT id, queue_id, counter_id, action, timestamp
+		SELECT id, queue_id, counter_id, operator_id, action, lane, timestamp
 		FROM call_history
 		ORDER BY timestamp DESC
 		LIMIT ?
@@ -808,9 +2202,13 @@ func (d *DB) GetCallHistory(limit int) ([]*models.CallHistory, error) {
 	var history []*models.CallHistory
 	for rows.Next() {
 		h := &models.CallHistory{}
-		if err := rows.Scan(&h.ID, &h.QueueID, &h.CounterID, &h.Action, &h.Timestamp); err != nil {
+		var operatorID sql.NullInt64
+		if err := rows.Scan(&h.ID, &h.QueueID, &h.CounterID, &operatorID, &h.Action, &h.Lane, &h.Timestamp); err != nil {
 			return nil, err
 		}
+		if operatorID.Valid {
+			h.OperatorID = &operatorID.Int64
+		}
 		history = append(history, h)
 	}
 	return history, nil
@@ -819,14 +2217,19 @@ func (d *DB) GetCallHistory(limit int) ([]*models.CallHistory, error) {
 // Stats operations
 
 func (d *DB) GetStats() (*models.Stats, error) {
+	return getStats(d)
+}
+
+func getStats(q querier) (*models.Stats, error) {
 	stats := &models.Stats{}
 
-	d.QueryRow(`SELECT COUNT(*) FROM queues WHERE DATE(created_at) = DATE('now', 'localtime')`).Scan(&stats.TotalQueues)
-	d.QueryRow(`SELECT COUNT(*) FROM queues WHERE status = 'waiting' AND DATE(created_at) = DATE('now', 'localtime')`).Scan(&stats.WaitingQueues)
-	d.QueryRow(`SELECT COUNT(*) FROM queues WHERE status = 'called' AND DATE(created_at) = DATE('now', 'localtime')`).Scan(&stats.CalledQueues)
-	d.QueryRow(`SELECT COUNT(*) FROM queues WHERE status = 'completed' AND DATE(created_at) = DATE('now', 'localtime')`).Scan(&stats.CompletedQueues)
-	d.QueryRow(`SELECT COUNT(*) FROM queues WHERE status = 'cancelled' AND DATE(created_at) = DATE('now', 'localtime')`).Scan(&stats.CancelledQueues)
-	d.QueryRow(`SELECT COUNT(*) FROM counters WHERE is_active = 1`).Scan(&stats.ActiveCounters)
+	q.QueryRow(`SELECT COUNT(*) FROM queues WHERE DATE(created_at) = DATE('now', 'localtime')`).Scan(&stats.TotalQueues)
+	q.QueryRow(`SELECT COUNT(*) FROM queues WHERE status = 'waiting' AND DATE(created_at) = DATE('now', 'localtime')`).Scan(&stats.WaitingQueues)
+	q.QueryRow(`SELECT COUNT(*) FROM queues WHERE status = 'called' AND DATE(created_at) = DATE('now', 'localtime')`).Scan(&stats.CalledQueues)
+	q.QueryRow(`SELECT COUNT(*) FROM queues WHERE status = 'completed' AND DATE(created_at) = DATE('now', 'localtime')`).Scan(&stats.CompletedQueues)
+	q.QueryRow(`SELECT COUNT(*) FROM queues WHERE status = 'cancelled' AND DATE(created_at) = DATE('now', 'localtime')`).Scan(&stats.CancelledQueues)
+	q.QueryRow(`SELECT COUNT(*) FROM queues WHERE status = 'parked' AND DATE(created_at) = DATE('now', 'localtime')`).Scan(&stats.ParkedQueues)
+	q.QueryRow(`SELECT COUNT(*) FROM counters WHERE is_active = 1`).Scan(&stats.ActiveCounters)
 
 	return stats, nil
 }
@@ -839,31 +2242,106 @@ func (d *DB) GetSetting(key string) (string, error) {
 	return value, err
 }
 
-func (d *DB) SetSetting(key, value string) error {
-	_, err := d.Exec(`
-		INSERT INTO settings (key, value, updated_at)
-		VALUES (?, ?, datetime('now', 'localtime'))
-		ON CONFLICT(key) DO UPDATE SET value = ?, updated_at = datetime('now', 'localtime')
-	`, key, value, value)
-	return err
+func (d *DB) SetSetting(key, value string) error {
+	_, err := d.Exec(`
+		INSERT INTO settings (key, value, updated_at)
+		VALUES (?, ?, datetime('now', 'localtime'))
+		ON CONFLICT(key) DO UPDATE SET value = ?, updated_at = datetime('now', 'localtime')
+	`, key, value, value)
+	return err
+}
+
+func (d *DB) GetAllSettings() (map[string]string, error) {
+	return allSettings(d)
+}
+
+func allSettings(q querier) (map[string]string, error) {
+	rows, err := q.Query(`SELECT key, value FROM settings`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		settings[key] = value
+	}
+	return settings, nil
+}
+
+// Display snapshot
+
+// GetDisplaySnapshot reads everything a display shows in one transaction,
+// so counters, counts and recent calls agree with each other: the counters
+// with their current queue, today's stats and waiting counts by type, the
+// latest calls and recalls, and the display_* settings.
+func (d *DB) GetDisplaySnapshot(recentCalls int) (*models.DisplaySnapshot, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	snapshot := &models.DisplaySnapshot{}
+	if snapshot.Counters, err = listCounters(tx); err != nil {
+		return nil, err
+	}
+	if snapshot.Counters == nil {
+		snapshot.Counters = []*models.Counter{}
+	}
+	if snapshot.Stats, err = getStats(tx); err != nil {
+		return nil, err
+	}
+	if snapshot.WaitingByType, err = waitingCountByType(tx); err != nil {
+		return nil, err
+	}
+	if snapshot.RecentCalls, err = listRecentCalls(tx, recentCalls); err != nil {
+		return nil, err
+	}
+
+	settings, err := allSettings(tx)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Settings = make(map[string]string)
+	for key, value := range settings {
+		if strings.HasPrefix(key, "display_") {
+			snapshot.Settings[key] = value
+		}
+	}
+	return snapshot, tx.Commit()
 }
 
-func (d *DB) GetAllSettings() (map[string]string, error) {
-	rows, err := d.Query(`SELECT key, value FROM settings`)
+// listRecentCalls returns today's latest calls and recalls, newest first.
+func listRecentCalls(q querier, limit int) ([]*models.RecentCall, error) {
+	rows, err := q.Query(`
+		SELECT h.id, q.queue_number, q.queue_type, c.id, c.counter_number, c.counter_name, h.timestamp
+		FROM call_history h
+		JOIN queues q ON h.queue_id = q.id
+		JOIN counters c ON h.counter_id = c.id
+		WHERE h.action IN (?, ?)
+		AND DATE(h.timestamp) = DATE('now', 'localtime')
+		ORDER BY h.timestamp DESC, h.id DESC
+		LIMIT ?
+	`, models.ActionCalled, models.ActionRecalled, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	settings := make(map[string]string)
+	calls := []*models.RecentCall{}
 	for rows.Next() {
-		var key, value string
-		if err := rows.Scan(&key, &value); err != nil {
+		call := &models.RecentCall{}
+		if err := rows.Scan(&call.CallID, &call.QueueNumber, &call.QueueType, &call.CounterID, &call.CounterNumber, &call.CounterName, &call.Timestamp); err != nil {
 			return nil, err
 		}
-		settings[key] = value
+		calls = append(calls, call)
 	}
-	return settings, nil
+	return calls, rows.Err()
 }
 
 // Report operations
@@ -976,8 +2454,7 @@ func (d *DB) GetReport(startDate, endDate string) (*ReportData, error) {
 
 func (d *DB) GetQueuesForExport(startDate, endDate string) ([]*models.Queue, error) {
 	rows, err := d.Query(`
-		SELECT id, queue_number, queue_type, status, counter_id,
-			created_at, called_at, completed_at
+		SELECT `+queueColumns+`
 		FROM queues
 		WHERE DATE(created_at) BETWEEN ? AND ?
 		ORDER BY created_at
@@ -989,9 +2466,7 @@ func (d *DB) GetQueuesForExport(startDate, endDate string) ([]*models.Queue, err
 
 	var queues []*models.Queue
 	for rows.Next() {
-		q := &models.Queue{}
-		err := rows.Scan(&q.ID, &q.QueueNumber, &q.QueueType, &q.Status, &q.CounterID,
-			&q.CreatedAt, &q.CalledAt, &q.CompletedAt)
+		q, err := scanQueue(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -1006,7 +2481,7 @@ func (d *DB) CancelOldQueues(hours int) (int64, error) {
 	result, err := d.Exec(`
 		UPDATE queues
 		SET status = 'cancelled', completed_at = datetime('now', 'localtime')
-		WHERE status = 'waiting'
+		WHERE status IN ('waiting', 'parked')
 		AND created_at < datetime('now', 'localtime', ? || ' hours')
 	`, fmt.Sprintf("-%d", hours))
 	if err != nil {
@@ -1015,6 +2490,61 @@ func (d *DB) CancelOldQueues(hours int) (int64, error) {
 	return result.RowsAffected()
 }
 
+// CancelExpiredParkedQueues cancels parked (no-show) queues that were not
+// reactivated within the park window and records each in the call history.
+// queueTypes are the types of the cancelled queues.
+func (d *DB) CancelExpiredParkedQueues(windowMinutes int) (cancelled int64, queueTypes []string, err error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	expired := `status = 'parked' AND parked_at < datetime('now', 'localtime', ? || ' minutes')`
+	window := fmt.Sprintf("-%d", windowMinutes)
+
+	_, err = tx.Exec(`
+		INSERT INTO call_history (queue_id, counter_id, operator_id, action, timestamp)
+		SELECT id, counter_id, (SELECT operator_id FROM counters WHERE id = queues.counter_id), ?, datetime('now', 'localtime')
+		FROM queues
+		WHERE `+expired+` AND counter_id IS NOT NULL
+	`, models.ActionCancelled, window)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rows, err := tx.Query(`SELECT DISTINCT queue_type FROM queues WHERE `+expired, window)
+	if err != nil {
+		return 0, nil, err
+	}
+	for rows.Next() {
+		var queueType string
+		if err := rows.Scan(&queueType); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		queueTypes = append(queueTypes, queueType)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE queues
+		SET status = 'cancelled', completed_at = datetime('now', 'localtime')
+		WHERE `+expired, window)
+	if err != nil {
+		return 0, nil, err
+	}
+	cancelled, _ = result.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return cancelled, queueTypes, nil
+}
+
 // ResetQueuesToday menghapus data antrian hari ini berdasarkan jenis antrian
 // queueType: kode jenis antrian (kosong = semua jenis)
 func (d *DB) ResetQueuesToday(queueType string) (int64, error) {
@@ -1088,30 +2618,18 @@ func (d *DB) ResetQueuesToday(queueType string) (int64, error) {
 
 // Print Job operations
 
-func (d *DB) CreatePrintJob(queueNumber, typeName, dateTime, templateJSON string) (*models.PrintJob, error) {
-	result, err := d.Exec(`
-		INSERT INTO print_jobs (queue_number, type_name, date_time, template_json, status)
-		VALUES (?, ?, ?, ?, 'pending')
-	`, queueNumber, typeName, dateTime, templateJSON)
-	if err != nil {
-		return nil, err
-	}
-
-	id, _ := result.LastInsertId()
-	return d.GetPrintJob(id)
-}
+// printJobColumns is the column list read by scanPrintJob.
+const printJobColumns = `id, queue_number, type_name, date_time, template_json, status,
+	agent_id, created_at, claimed_at, completed_at, error_message, eta, attempts, lease_expires_at,
+	target_agent, target_group`
 
-func (d *DB) GetPrintJob(id int64) (*models.PrintJob, error) {
+func scanPrintJob(row rowScanner) (*models.PrintJob, error) {
 	pj := &models.PrintJob{}
-	var agentID sql.NullString
-	var errorMsg sql.NullString
-	err := d.QueryRow(`
-		SELECT id, queue_number, type_name, date_time, template_json, status,
-			agent_id, created_at, claimed_at, completed_at, error_message
-		FROM print_jobs WHERE id = ?
-	`, id).Scan(&pj.ID, &pj.QueueNumber, &pj.TypeName, &pj.DateTime,
+	var agentID, errorMsg sql.NullString
+	err := row.Scan(&pj.ID, &pj.QueueNumber, &pj.TypeName, &pj.DateTime,
 		&pj.TemplateJSON, &pj.Status, &agentID, &pj.CreatedAt,
-		&pj.ClaimedAt, &pj.CompletedAt, &errorMsg)
+		&pj.ClaimedAt, &pj.CompletedAt, &errorMsg, &pj.ETA, &pj.Attempts, &pj.LeaseExpiresAt,
+		&pj.TargetAgent, &pj.TargetGroup)
 	if err != nil {
 		return nil, err
 	}
@@ -1125,14 +2643,40 @@ func (d *DB) GetPrintJob(id int64) (*models.PrintJob, error) {
 	return pj, nil
 }
 
-// ClaimPrintJob atomically claims a pending job for the given agent.
-// Returns the job if successfully claimed, or sql.ErrNoRows if already claimed.
-func (d *DB) ClaimPrintJob(id int64, agentID string) (*models.PrintJob, error) {
+// CreatePrintJob queues a ticket for remote printing. A non-empty
+// targetAgent or targetGroup restricts which agents may claim it.
+func (d *DB) CreatePrintJob(queueNumber, typeName, dateTime, eta, templateJSON, targetAgent, targetGroup string) (*models.PrintJob, error) {
+	result, err := d.Exec(`
+		INSERT INTO print_jobs (queue_number, type_name, date_time, eta, template_json, status, target_agent, target_group)
+		VALUES (?, ?, ?, ?, ?, 'pending', ?, ?)
+	`, queueNumber, typeName, dateTime, eta, templateJSON, targetAgent, targetGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	id, _ := result.LastInsertId()
+	return d.GetPrintJob(id)
+}
+
+func (d *DB) GetPrintJob(id int64) (*models.PrintJob, error) {
+	return scanPrintJob(d.QueryRow(`SELECT `+printJobColumns+` FROM print_jobs WHERE id = ?`, id))
+}
+
+// printJobTargets matches the jobs an agent (agent ID, printer group) may
+// print: untargeted jobs and those aimed at the agent or its group.
+const printJobTargets = `(target_agent = '' OR target_agent = ?) AND (target_group = '' OR target_group = ?)`
+
+// ClaimPrintJob atomically claims a pending job for the given agent and
+// leases it for leaseSeconds; the agent extends the lease with
+// HeartbeatPrintJob while it prints. Returns the job if successfully
+// claimed, or sql.ErrNoRows if already claimed or targeted at other agents.
+func (d *DB) ClaimPrintJob(id int64, agentID, group string, leaseSeconds int) (*models.PrintJob, error) {
 	result, err := d.Exec(`
 		UPDATE print_jobs
-		SET status = 'printing', agent_id = ?, claimed_at = datetime('now','localtime')
-		WHERE id = ? AND status = 'pending'
-	`, agentID, id)
+		SET status = 'printing', agent_id = ?, claimed_at = datetime('now','localtime'),
+			attempts = attempts + 1, lease_expires_at = datetime('now','localtime', ?)
+		WHERE id = ? AND status = 'pending' AND `+printJobTargets+`
+	`, agentID, fmt.Sprintf("+%d seconds", leaseSeconds), id, agentID, group)
 	if err != nil {
 		return nil, err
 	}
@@ -1145,30 +2689,133 @@ func (d *DB) ClaimPrintJob(id int64, agentID string) (*models.PrintJob, error) {
 	return d.GetPrintJob(id)
 }
 
-func (d *DB) CompletePrintJob(id int64) error {
-	_, err := d.Exec(`
-		UPDATE print_jobs
-		SET status = 'completed', completed_at = datetime('now','localtime')
-		WHERE id = ?
-	`, id)
+// SetPrintJobTarget changes which agents may claim a job, e.g. when its
+// target is offline and the fallback policy widens it.
+func (d *DB) SetPrintJobTarget(id int64, targetAgent, targetGroup string) error {
+	_, err := d.Exec(`UPDATE print_jobs SET target_agent = ?, target_group = ? WHERE id = ?`, targetAgent, targetGroup, id)
 	return err
 }
 
-func (d *DB) FailPrintJob(id int64, errorMessage string) error {
-	_, err := d.Exec(`
+// HeartbeatPrintJob extends the lease of a job the agent is still printing.
+// Returns sql.ErrNoRows if the agent no longer holds the job, e.g. because
+// its lease expired and the job was requeued.
+func (d *DB) HeartbeatPrintJob(id int64, agentID string, leaseSeconds int) error {
+	result, err := d.Exec(`
 		UPDATE print_jobs
-		SET status = 'failed', completed_at = datetime('now','localtime'), error_message = ?
-		WHERE id = ?
-	`, errorMessage, id)
-	return err
+		SET lease_expires_at = datetime('now','localtime', ?)
+		WHERE id = ? AND status = 'printing' AND agent_id = ?
+	`, fmt.Sprintf("+%d seconds", leaseSeconds), id, agentID)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CompletePrintJob marks a job printed. Only the agent that claimed the
+// job may finish it; returns sql.ErrNoRows otherwise.
+func (d *DB) CompletePrintJob(id int64, agentID string) error {
+	result, err := d.Exec(`
+		UPDATE print_jobs
+		SET status = 'completed', completed_at = datetime('now','localtime'), lease_expires_at = NULL
+		WHERE id = ? AND status = 'printing' AND agent_id = ?
+	`, id, agentID)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// FailPrintJob marks a job failed. Only the agent that claimed the job may
+// fail it; returns sql.ErrNoRows otherwise.
+func (d *DB) FailPrintJob(id int64, agentID, errorMessage string) error {
+	result, err := d.Exec(`
+		UPDATE print_jobs
+		SET status = 'failed', completed_at = datetime('now','localtime'), error_message = ?, lease_expires_at = NULL
+		WHERE id = ? AND status = 'printing' AND agent_id = ?
+	`, errorMessage, id, agentID)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RequeueExpiredPrintJobs handles jobs whose agent stopped sending
+// heartbeats: they return to pending so another agent can claim them, or
+// are marked failed once they have been claimed maxAttempts times. Returns
+// the requeued jobs and the number that failed.
+func (d *DB) RequeueExpiredPrintJobs(maxAttempts int) ([]*models.PrintJob, int64, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	const expired = `status = 'printing' AND COALESCE(lease_expires_at, claimed_at) <= datetime('now','localtime')`
+
+	result, err := tx.Exec(`
+		UPDATE print_jobs
+		SET status = 'failed', completed_at = datetime('now','localtime'), lease_expires_at = NULL,
+			error_message = 'Agent ' || COALESCE(agent_id, '') || ' stopped responding after ' || attempts || ' attempt(s)'
+		WHERE `+expired+` AND attempts >= ?
+	`, maxAttempts)
+	if err != nil {
+		return nil, 0, err
+	}
+	failed, _ := result.RowsAffected()
+
+	rows, err := tx.Query(`SELECT ` + printJobColumns + ` FROM print_jobs WHERE ` + expired + ` ORDER BY created_at ASC`)
+	if err != nil {
+		return nil, 0, err
+	}
+	var jobs []*models.PrintJob
+	for rows.Next() {
+		pj, err := scanPrintJob(rows)
+		if err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		jobs = append(jobs, pj)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	for _, pj := range jobs {
+		if _, err := tx.Exec(`
+			UPDATE print_jobs SET status = 'pending', agent_id = NULL, claimed_at = NULL, lease_expires_at = NULL
+			WHERE id = ?
+		`, pj.ID); err != nil {
+			return nil, 0, err
+		}
+		pj.Status = models.PrintJobPending
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return jobs, failed, nil
 }
 
-func (d *DB) ListPendingPrintJobs() ([]*models.PrintJob, error) {
+// ListTargetedPendingPrintJobs returns the pending jobs sent to a specific
+// agent or printer group, oldest first.
+func (d *DB) ListTargetedPendingPrintJobs() ([]*models.PrintJob, error) {
 	rows, err := d.Query(`
-		SELECT id, queue_number, type_name, date_time, template_json, status,
-			agent_id, created_at, claimed_at, completed_at, error_message
+		SELECT ` + printJobColumns + `
 		FROM print_jobs
-		WHERE status = 'pending'
+		WHERE status = 'pending' AND (target_agent != '' OR target_group != '')
 		ORDER BY created_at ASC
 	`)
 	if err != nil {
@@ -1178,20 +2825,53 @@ func (d *DB) ListPendingPrintJobs() ([]*models.PrintJob, error) {
 
 	var jobs []*models.PrintJob
 	for rows.Next() {
-		pj := &models.PrintJob{}
-		var agentID, errorMsg sql.NullString
-		if err := rows.Scan(&pj.ID, &pj.QueueNumber, &pj.TypeName, &pj.DateTime,
-			&pj.TemplateJSON, &pj.Status, &agentID, &pj.CreatedAt,
-			&pj.ClaimedAt, &pj.CompletedAt, &errorMsg); err != nil {
+		pj, err := scanPrintJob(rows)
+		if err != nil {
 			return nil, err
 		}
-		if agentID.Valid {
-			pj.AgentID = agentID.String
-		}
-		if errorMsg.Valid {
-			pj.ErrorMessage = errorMsg.String
+		jobs = append(jobs, pj)
+	}
+	return jobs, rows.Err()
+}
+
+// ExpirePendingPrintJob marks a job failed if it is still pending after
+// waitSeconds, e.g. because its target stayed offline. Returns
+// sql.ErrNoRows if it was claimed or is not that old yet.
+func (d *DB) ExpirePendingPrintJob(id int64, waitSeconds int, errorMessage string) error {
+	result, err := d.Exec(`
+		UPDATE print_jobs
+		SET status = 'failed', completed_at = datetime('now','localtime'), error_message = ?
+		WHERE id = ? AND status = 'pending' AND created_at <= datetime('now','localtime', ?)
+	`, errorMessage, id, fmt.Sprintf("-%d seconds", waitSeconds))
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListPendingPrintJobs returns the pending jobs the given agent may print.
+func (d *DB) ListPendingPrintJobs(agentID, group string) ([]*models.PrintJob, error) {
+	rows, err := d.Query(`
+		SELECT `+printJobColumns+`
+		FROM print_jobs
+		WHERE status = 'pending' AND `+printJobTargets+`
+		ORDER BY created_at ASC
+	`, agentID, group)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*models.PrintJob
+	for rows.Next() {
+		pj, err := scanPrintJob(rows)
+		if err != nil {
+			return nil, err
 		}
-		pj.PrepareJSON()
 		jobs = append(jobs, pj)
 	}
 	return jobs, nil
@@ -1222,8 +2902,7 @@ func (d *DB) GetPrintJobSummary() (pending int, failed int, err error) {
 // ListFailedPrintJobs returns all failed print jobs for today.
 func (d *DB) ListFailedPrintJobs() ([]*models.PrintJob, error) {
 	rows, err := d.Query(`
-		SELECT id, queue_number, type_name, date_time, template_json, status,
-			agent_id, created_at, claimed_at, completed_at, error_message
+		SELECT ` + printJobColumns + `
 		FROM print_jobs
 		WHERE status = 'failed'
 		AND DATE(created_at) = DATE('now', 'localtime')
@@ -1236,31 +2915,22 @@ func (d *DB) ListFailedPrintJobs() ([]*models.PrintJob, error) {
 
 	var jobs []*models.PrintJob
 	for rows.Next() {
-		pj := &models.PrintJob{}
-		var agentID, errorMsg sql.NullString
-		if err := rows.Scan(&pj.ID, &pj.QueueNumber, &pj.TypeName, &pj.DateTime,
-			&pj.TemplateJSON, &pj.Status, &agentID, &pj.CreatedAt,
-			&pj.ClaimedAt, &pj.CompletedAt, &errorMsg); err != nil {
+		pj, err := scanPrintJob(rows)
+		if err != nil {
 			return nil, err
 		}
-		if agentID.Valid {
-			pj.AgentID = agentID.String
-		}
-		if errorMsg.Valid {
-			pj.ErrorMessage = errorMsg.String
-		}
-		pj.PrepareJSON()
 		jobs = append(jobs, pj)
 	}
 	return jobs, nil
 }
 
-// RetryPrintJob resets a failed print job back to pending status.
-// Returns sql.ErrNoRows if the job was not in 'failed' state.
+// RetryPrintJob resets a failed print job back to pending status with a
+// fresh attempt count. Returns sql.ErrNoRows if the job was not in 'failed'
+// state.
 func (d *DB) RetryPrintJob(id int64) error {
 	result, err := d.Exec(`
 		UPDATE print_jobs
-		SET status='pending', agent_id=NULL,
+		SET status='pending', agent_id=NULL, attempts=0, lease_expires_at=NULL,
 			claimed_at=NULL, completed_at=NULL, error_message=NULL
 		WHERE id=? AND status='failed'
 	`, id)
@@ -1287,6 +2957,134 @@ func (d *DB) CleanupOldPrintJobs(hours int) (int64, error) {
 	return result.RowsAffected()
 }
 
+// Print agent operations
+
+// printAgentColumns is the column list read by scanPrintAgent.
+const printAgentColumns = `id, agent_id, name, printer_group, is_active, created_at, last_seen_at,
+	version, hostname, printer_name, paper_size, jobs_printed, jobs_failed, last_error, printer_status`
+
+func scanPrintAgent(row rowScanner) (*models.PrintAgent, error) {
+	a := &models.PrintAgent{}
+	err := row.Scan(&a.ID, &a.AgentID, &a.Name, &a.Group, &a.IsActive, &a.CreatedAt, &a.LastSeenAt,
+		&a.Version, &a.Hostname, &a.PrinterName, &a.PaperSize, &a.JobsPrinted, &a.JobsFailed, &a.LastError, &a.PrinterStatus)
+	if err != nil {
+		return nil, err
+	}
+	a.PrepareJSON()
+	return a, nil
+}
+
+// CreatePrintAgent registers an agent with the hash of its API key.
+func (d *DB) CreatePrintAgent(agentID, name, group, keyHash string) (*models.PrintAgent, error) {
+	result, err := d.Exec(`
+		INSERT INTO print_agents (agent_id, name, printer_group, key_hash) VALUES (?, ?, ?, ?)
+	`, agentID, name, group, keyHash)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := result.LastInsertId()
+	return d.GetPrintAgent(id)
+}
+
+func (d *DB) GetPrintAgent(id int64) (*models.PrintAgent, error) {
+	return scanPrintAgent(d.QueryRow(`SELECT `+printAgentColumns+` FROM print_agents WHERE id = ?`, id))
+}
+
+func (d *DB) GetPrintAgentByAgentID(agentID string) (*models.PrintAgent, error) {
+	return scanPrintAgent(d.QueryRow(`SELECT `+printAgentColumns+` FROM print_agents WHERE agent_id = ?`, agentID))
+}
+
+// GetPrintAgentByKey returns the active agent holding the API key with the
+// given hash, or sql.ErrNoRows.
+func (d *DB) GetPrintAgentByKey(keyHash string) (*models.PrintAgent, error) {
+	return scanPrintAgent(d.QueryRow(`
+		SELECT `+printAgentColumns+` FROM print_agents WHERE key_hash = ? AND is_active = 1
+	`, keyHash))
+}
+
+// PrintGroupExists reports whether an active agent belongs to the printer group.
+func (d *DB) PrintGroupExists(group string) (bool, error) {
+	var count int
+	err := d.QueryRow(`SELECT COUNT(*) FROM print_agents WHERE printer_group = ? AND is_active = 1`, group).Scan(&count)
+	return count > 0, err
+}
+
+func (d *DB) ListPrintAgents() ([]*models.PrintAgent, error) {
+	rows, err := d.Query(`SELECT ` + printAgentColumns + ` FROM print_agents ORDER BY agent_id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var agents []*models.PrintAgent
+	for rows.Next() {
+		a, err := scanPrintAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, a)
+	}
+	return agents, rows.Err()
+}
+
+func (d *DB) UpdatePrintAgent(id int64, name, group string, isActive bool) error {
+	_, err := d.Exec(`UPDATE print_agents SET name = ?, printer_group = ?, is_active = ? WHERE id = ?`, name, group, isActive, id)
+	return err
+}
+
+// SetPrintAgentKey replaces an agent's API key; the old key stops working.
+func (d *DB) SetPrintAgentKey(id int64, keyHash string) error {
+	_, err := d.Exec(`UPDATE print_agents SET key_hash = ? WHERE id = ?`, keyHash, id)
+	return err
+}
+
+// TouchPrintAgent records that an agent has just made an authenticated request.
+func (d *DB) TouchPrintAgent(id int64) error {
+	_, err := d.Exec(`UPDATE print_agents SET last_seen_at = datetime('now', 'localtime') WHERE id = ?`, id)
+	return err
+}
+
+// ListStalePrintAgents returns the agent IDs of active agents that made no
+// authenticated request in the last seconds.
+func (d *DB) ListStalePrintAgents(seconds int) ([]string, error) {
+	rows, err := d.Query(`
+		SELECT agent_id FROM print_agents
+		WHERE is_active = 1
+		AND (last_seen_at IS NULL OR last_seen_at < datetime('now', 'localtime', ?))
+	`, fmt.Sprintf("-%d seconds", seconds))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var agentIDs []string
+	for rows.Next() {
+		var agentID string
+		if err := rows.Scan(&agentID); err != nil {
+			return nil, err
+		}
+		agentIDs = append(agentIDs, agentID)
+	}
+	return agentIDs, rows.Err()
+}
+
+// SetPrintAgentStatus stores the health report an agent sends on connect and
+// periodically while it runs.
+func (d *DB) SetPrintAgentStatus(id int64, s models.PrintAgentStatus) error {
+	_, err := d.Exec(`
+		UPDATE print_agents
+		SET version = ?, hostname = ?, printer_name = ?, paper_size = ?,
+		    jobs_printed = ?, jobs_failed = ?, last_error = ?, printer_status = ?
+		WHERE id = ?
+	`, s.Version, s.Hostname, s.PrinterName, s.PaperSize, s.JobsPrinted, s.JobsFailed, s.LastError, s.PrinterStatus, id)
+	return err
+}
+
+func (d *DB) DeletePrintAgent(id int64) error {
+	_, err := d.Exec(`DELETE FROM print_agents WHERE id = ?`, id)
+	return err
+}
+
 func (d *DB) Close() error {
 	return d.DB.Close()
 }
@@ -0,0 +1,614 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"queue-system/internal/config"
+	"queue-system/internal/models"
+)
+
+// newTestDB opens a migrated in-memory database. One connection keeps every
+// query on the same in-memory database.
+func newTestDB(t *testing.T, configure func(cfg *config.Config)) *DB {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.Database.Path = ":memory:"
+	cfg.Database.MaxOpenConns = 1
+	cfg.Security.AdminPassword = ""
+	if configure != nil {
+		configure(cfg)
+	}
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// tickets creates waiting queues, each ten seconds younger than the one
+// created before it, so the line order does not depend on the clock. A
+// label starting with "P" is a priority ticket, anything else a normal
+// one. It returns the queue number per label.
+func tickets(t *testing.T, d *DB, queueType string, labels ...string) map[string]string {
+	t.Helper()
+	numbers := make(map[string]string)
+	for _, label := range labels {
+		priority := models.PriorityNormal
+		if label[0] == 'P' {
+			priority = 1
+		}
+		q, err := d.CreateQueue(queueType, priority)
+		if err != nil {
+			t.Fatalf("CreateQueue: %v", err)
+		}
+		age := fmt.Sprintf("-%d seconds", 1000-10*q.ID)
+		if _, err := d.Exec(`UPDATE queues SET created_at = datetime('now', 'localtime', ?) WHERE id = ?`, age, q.ID); err != nil {
+			t.Fatal(err)
+		}
+		numbers[label] = q.QueueNumber
+	}
+	return numbers
+}
+
+func counter(t *testing.T, d *DB, number string) int64 {
+	t.Helper()
+	c, err := d.CreateCounter(number, "Loket "+number)
+	if err != nil {
+		t.Fatalf("CreateCounter: %v", err)
+	}
+	return c.ID
+}
+
+// callNext calls the next queue at the counter, or returns nil when none
+// is waiting.
+func callNext(t *testing.T, d *DB, counterID int64, queueType string) *models.Queue {
+	t.Helper()
+	q, _, err := d.CallNextQueue(counterID, queueType, false)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("CallNextQueue: %v", err)
+	}
+	return q
+}
+
+// labelsOf maps queue numbers back to the labels given to tickets.
+func labelsOf(numbers map[string]string, queueNumbers []string) []string {
+	byNumber := make(map[string]string)
+	for label, number := range numbers {
+		byNumber[number] = label
+	}
+	labels := make([]string, len(queueNumbers))
+	for i, number := range queueNumbers {
+		labels[i] = byNumber[number]
+	}
+	return labels
+}
+
+// waitingLine returns today's waiting queue numbers in line order.
+func waitingLine(t *testing.T, d *DB) []string {
+	t.Helper()
+	rows, err := d.Query(`
+		SELECT queue_number FROM queues WHERE status = 'waiting'
+		ORDER BY ` + queueOrderKey + ` ASC, id ASC
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var line []string
+	for rows.Next() {
+		var number string
+		if err := rows.Scan(&number); err != nil {
+			t.Fatal(err)
+		}
+		line = append(line, number)
+	}
+	return line
+}
+
+func TestCallNextPriorityPolicies(t *testing.T) {
+	line := []string{"N1", "P1", "N2", "P2", "P3", "N3", "P4"}
+	tests := []struct {
+		name   string
+		policy string
+		ratio  int
+		want   []string
+	}{
+		{"strict", config.PriorityPolicyStrict, 0, []string{"P1", "P2", "P3", "P4", "N1", "N2", "N3"}},
+		{"fifo", config.PriorityPolicyFIFO, 0, []string{"N1", "P1", "N2", "P2", "P3", "N3", "P4"}},
+		{"interleave 2:1", config.PriorityPolicyInterleave, 2, []string{"P1", "P2", "N1", "P3", "P4", "N2", "N3"}},
+		{"interleave 1:1", config.PriorityPolicyInterleave, 1, []string{"P1", "N1", "P2", "N2", "P3", "N3", "P4"}},
+		{"interleave 3:1", config.PriorityPolicyInterleave, 3, []string{"P1", "P2", "P3", "N1", "P4", "N2", "N3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDB(t, func(cfg *config.Config) {
+				cfg.Queue.PriorityPolicy = tt.policy
+				cfg.Queue.PriorityRatio = tt.ratio
+			})
+			numbers := tickets(t, d, "A", line...)
+			counterID := counter(t, d, "1")
+
+			var called []string
+			for q := callNext(t, d, counterID, ""); q != nil; q = callNext(t, d, counterID, "") {
+				called = append(called, q.QueueNumber)
+			}
+			if got := labelsOf(numbers, called); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("called %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallNextHigherPriorityFirst(t *testing.T) {
+	d := newTestDB(t, nil)
+	numbers := tickets(t, d, "A", "P1", "N1")
+	urgent, err := d.CreateQueue("A", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counterID := counter(t, d, "1")
+
+	if q := callNext(t, d, counterID, ""); q.QueueNumber != urgent.QueueNumber {
+		t.Fatalf("called %s, want the priority 2 ticket %s", q.QueueNumber, urgent.QueueNumber)
+	}
+	if q := callNext(t, d, counterID, ""); q.QueueNumber != numbers["P1"] {
+		t.Fatalf("called %s, want P1 %s", q.QueueNumber, numbers["P1"])
+	}
+}
+
+// Reserved tickets are served by their counter before its type line, and
+// go back to the type line when that counter is deactivated.
+func TestCallNextReservedTicket(t *testing.T) {
+	d := newTestDB(t, nil)
+	numbers := tickets(t, d, "A", "N1", "P1", "N2", "N3")
+	from, to := counter(t, d, "1"), counter(t, d, "2")
+
+	if q := callNext(t, d, from, ""); q.QueueNumber != numbers["P1"] {
+		t.Fatalf("called %s, want P1", q.QueueNumber)
+	}
+	transferred, err := d.TransferQueue(from, &to, "", 1)
+	if err != nil {
+		t.Fatalf("TransferQueue: %v", err)
+	}
+	if !transferred.TargetCounterID.Valid || transferred.TargetCounterID.Int64 != to {
+		t.Fatalf("transferred ticket is not reserved for counter %d", to)
+	}
+
+	// Other counters do not take it, even though it is a priority ticket
+	if q := callNext(t, d, from, ""); q.QueueNumber != numbers["N1"] {
+		t.Fatalf("counter 1 called %s, want N1", q.QueueNumber)
+	}
+	// Its counter takes it before older tickets of the line
+	if q := callNext(t, d, to, ""); q.QueueNumber != numbers["P1"] {
+		t.Fatalf("counter 2 called %s, want the reserved P1", q.QueueNumber)
+	}
+	if q, _ := d.GetQueue(transferred.ID); q.TargetCounterID.Valid {
+		t.Fatal("called ticket is still reserved")
+	}
+
+	// Reserve N2 for counter 2, then deactivate it: N2 is in the line again,
+	// placed as of its transfer, behind the older N3
+	if q := callNext(t, d, to, ""); q.QueueNumber != numbers["N2"] {
+		t.Fatalf("counter 2 called %s, want N2", q.QueueNumber)
+	}
+	if _, err := d.TransferQueue(to, &to, "", 1); err != nil {
+		t.Fatalf("TransferQueue: %v", err)
+	}
+	if err := d.UpdateCounter(to, "Loket 2", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, label := range []string{"N3", "N2"} {
+		if q := callNext(t, d, from, ""); q == nil || q.QueueNumber != numbers[label] {
+			t.Fatalf("counter 1 called %v, want %s", q, label)
+		}
+	}
+}
+
+// lineSortKey places a transferred ticket at the requested position of its
+// new line.
+func TestTransferPosition(t *testing.T) {
+	tests := []struct {
+		position int
+		want     []string
+	}{
+		{1, []string{"X", "T1", "T2", "T3"}},
+		{2, []string{"T1", "X", "T2", "T3"}},
+		{3, []string{"T1", "T2", "X", "T3"}},
+		{4, []string{"T1", "T2", "T3", "X"}},
+		{10, []string{"T1", "T2", "T3", "X"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("position %d", tt.position), func(t *testing.T) {
+			d := newTestDB(t, nil)
+			if _, err := d.CreateQueueType("B", "Badan", "B"); err != nil {
+				t.Fatal(err)
+			}
+			numbers := tickets(t, d, "B", "X")
+			for label, number := range tickets(t, d, "A", "T1", "T2", "T3") {
+				numbers[label] = number
+			}
+			counterID := counter(t, d, "1")
+
+			if q := callNext(t, d, counterID, "B"); q.QueueNumber != numbers["X"] {
+				t.Fatalf("called %s, want X", q.QueueNumber)
+			}
+			q, err := d.TransferQueue(counterID, nil, "A", tt.position)
+			if err != nil {
+				t.Fatalf("TransferQueue: %v", err)
+			}
+			if q.QueueType != "A" || q.Status != models.StatusWaiting {
+				t.Fatalf("transferred ticket is %s/%s, want A/waiting", q.QueueType, q.Status)
+			}
+			if got := labelsOf(numbers, waitingLine(t, d)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("line %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransferPositionEmptyLine(t *testing.T) {
+	d := newTestDB(t, nil)
+	numbers := tickets(t, d, "A", "X")
+	counterID := counter(t, d, "1")
+	callNext(t, d, counterID, "")
+
+	if _, err := d.TransferQueue(counterID, nil, "", 3); err != nil {
+		t.Fatalf("TransferQueue: %v", err)
+	}
+	if q := callNext(t, d, counterID, ""); q == nil || q.QueueNumber != numbers["X"] {
+		t.Fatalf("called %v, want X back in its line", q)
+	}
+}
+
+// A ticket cancelled while the counter still points at it is not put back
+// in line by a transfer.
+func TestTransferQueueNotCalled(t *testing.T) {
+	d := newTestDB(t, nil)
+	tickets(t, d, "A", "X")
+	counterID := counter(t, d, "1")
+	q := callNext(t, d, counterID, "")
+	if err := d.UpdateQueueStatus(q.ID, models.StatusCancelled, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.TransferQueue(counterID, nil, "", 1); err != ErrQueueNotCalled {
+		t.Fatalf("TransferQueue: %v, want ErrQueueNotCalled", err)
+	}
+	if q, err := d.GetQueue(q.ID); err != nil || q.Status != models.StatusCancelled {
+		t.Errorf("queue is %v (%v), want it still cancelled", q.Status, err)
+	}
+}
+
+func TestRouteQueueType(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		services []*models.CounterService
+		want     []string // types of successive calls
+	}{
+		{
+			name:     "longest wait",
+			policy:   config.RoutingLongestWait,
+			services: []*models.CounterService{{QueueType: "A"}, {QueueType: "B"}},
+			want:     []string{"B", "A", "B", "A", "A"},
+		},
+		{
+			name:     "service priority first",
+			policy:   config.RoutingLongestWait,
+			services: []*models.CounterService{{QueueType: "A", Priority: 1}, {QueueType: "B"}},
+			want:     []string{"A", "A", "A", "B", "B"},
+		},
+		{
+			name:     "round robin",
+			policy:   config.RoutingRoundRobin,
+			services: []*models.CounterService{{QueueType: "A"}, {QueueType: "B"}},
+			want:     []string{"A", "B", "A", "B", "A"},
+		},
+		{
+			name:     "weighted",
+			policy:   config.RoutingWeighted,
+			services: []*models.CounterService{{QueueType: "A", Weight: 3}, {QueueType: "B", Weight: 1}},
+			want:     []string{"B", "A", "A", "A", "B"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDB(t, func(cfg *config.Config) {
+				cfg.Queue.RoutingPolicy = tt.policy
+			})
+			if _, err := d.CreateQueueType("B", "Badan", "B"); err != nil {
+				t.Fatal(err)
+			}
+			// Interleaved by age, B oldest: B1 A1 B2 A2 A3
+			for _, queueType := range []string{"B", "A", "B", "A", "A"} {
+				tickets(t, d, queueType, queueType)
+			}
+			counterID := counter(t, d, "1")
+			if err := d.SetCounterServices(counterID, tt.services); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for q := callNext(t, d, counterID, ""); q != nil; q = callNext(t, d, counterID, "") {
+				got = append(got, q.QueueType)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("called types %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteQueueTypeNotAssigned(t *testing.T) {
+	d := newTestDB(t, nil)
+	if _, err := d.CreateQueueType("B", "Badan", "B"); err != nil {
+		t.Fatal(err)
+	}
+	tickets(t, d, "B", "B1")
+	counterID := counter(t, d, "1")
+	if err := d.SetCounterServices(counterID, []*models.CounterService{{QueueType: "A"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := d.CallNextQueue(counterID, "B", false); err != ErrServiceNotAssigned {
+		t.Fatalf("got %v, want ErrServiceNotAssigned", err)
+	}
+	if _, _, err := d.CallNextQueue(counterID, "", false); err != sql.ErrNoRows {
+		t.Fatalf("got %v, want sql.ErrNoRows with only other types waiting", err)
+	}
+}
+
+func TestInterleavedAhead(t *testing.T) {
+	tests := []struct {
+		name                                     string
+		isPriority                               bool
+		sameLane, otherLane, streak, ratio, want int
+	}{
+		{"first normal after a fresh streak", false, 0, 5, 0, 3, 3},
+		{"normal with a partial streak", false, 0, 5, 2, 3, 1},
+		{"normal after a full streak", false, 0, 5, 3, 3, 0},
+		{"second normal", false, 1, 5, 0, 3, 1 + 5},
+		{"normal with few priority tickets", false, 2, 1, 0, 3, 3},
+		{"first priority ticket", true, 0, 5, 0, 3, 0},
+		{"priority after a full streak", true, 0, 5, 3, 3, 1},
+		{"fourth priority ticket", true, 3, 5, 0, 3, 4},
+		{"seventh priority ticket", true, 6, 5, 0, 3, 8},
+		{"priority without normal tickets", true, 6, 0, 0, 3, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := interleavedAhead(tt.isPriority, tt.sameLane, tt.otherLane, tt.streak, tt.ratio); got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// The tickets ahead in the ETA are the ones actually called first.
+func TestEstimateQueueWaitMatchesCallOrder(t *testing.T) {
+	line := []string{"N1", "P1", "N2", "P2", "P3", "N3", "P4", "N4"}
+	tests := []struct {
+		name   string
+		policy string
+		ratio  int
+		before int // calls made before estimating, to start mid-streak
+	}{
+		{"strict", config.PriorityPolicyStrict, 0, 0},
+		{"fifo", config.PriorityPolicyFIFO, 0, 1},
+		{"interleave", config.PriorityPolicyInterleave, 2, 0},
+		{"interleave mid-streak", config.PriorityPolicyInterleave, 2, 1},
+		{"interleave after a normal call", config.PriorityPolicyInterleave, 3, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDB(t, func(cfg *config.Config) {
+				cfg.Queue.PriorityPolicy = tt.policy
+				cfg.Queue.PriorityRatio = tt.ratio
+			})
+			tickets(t, d, "A", line...)
+			counterID := counter(t, d, "1")
+			for i := 0; i < tt.before; i++ {
+				callNext(t, d, counterID, "")
+			}
+
+			rows, err := d.Query(`SELECT id, queue_number FROM queues WHERE status = 'waiting'`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make(map[string]int64)
+			for rows.Next() {
+				var id int64
+				var number string
+				if err := rows.Scan(&id, &number); err != nil {
+					t.Fatal(err)
+				}
+				ids[number] = id
+			}
+			rows.Close()
+
+			ahead := make(map[string]int)
+			for number, id := range ids {
+				eta, err := d.EstimateQueueWait(id)
+				if err != nil {
+					t.Fatalf("EstimateQueueWait: %v", err)
+				}
+				ahead[number] = eta.Ahead
+			}
+
+			for position := 0; ; position++ {
+				q := callNext(t, d, counterID, "")
+				if q == nil {
+					break
+				}
+				if ahead[q.QueueNumber] != position {
+					t.Errorf("%s: estimated %d ahead, called after %d", q.QueueNumber, ahead[q.QueueNumber], position)
+				}
+			}
+		})
+	}
+}
+
+func printJob(t *testing.T, d *DB, targetAgent, targetGroup string) *models.PrintJob {
+	t.Helper()
+	job, err := d.CreatePrintJob("A001", "Umum", "16/10/2026 08:00", "", "{}", targetAgent, targetGroup)
+	if err != nil {
+		t.Fatalf("CreatePrintJob: %v", err)
+	}
+	return job
+}
+
+// expireLease makes a claimed job's lease run out, as when its agent stops
+// sending heartbeats.
+func expireLease(t *testing.T, d *DB, id int64) {
+	t.Helper()
+	if _, err := d.Exec(`UPDATE print_jobs SET lease_expires_at = datetime('now', 'localtime', '-1 seconds') WHERE id = ?`, id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaimPrintJobTargets(t *testing.T) {
+	tests := []struct {
+		name                     string
+		targetAgent, targetGroup string
+		agentID, group           string
+		claimed                  bool
+	}{
+		{"untargeted", "", "", "k1", "", true},
+		{"own agent", "k1", "", "k1", "lobby", true},
+		{"other agent", "k2", "", "k1", "", false},
+		{"own group", "", "lobby", "k1", "lobby", true},
+		{"other group", "", "lobby", "k1", "floor2", false},
+		{"agent outside the group", "k1", "floor2", "k1", "lobby", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDB(t, nil)
+			job := printJob(t, d, tt.targetAgent, tt.targetGroup)
+
+			_, err := d.ClaimPrintJob(job.ID, tt.agentID, tt.group, 60)
+			if tt.claimed && err != nil {
+				t.Fatalf("ClaimPrintJob: %v", err)
+			}
+			if !tt.claimed && err != sql.ErrNoRows {
+				t.Fatalf("got %v, want sql.ErrNoRows", err)
+			}
+		})
+	}
+}
+
+func TestClaimPrintJobOnce(t *testing.T) {
+	d := newTestDB(t, nil)
+	job := printJob(t, d, "", "")
+
+	claimed, err := d.ClaimPrintJob(job.ID, "k1", "", 60)
+	if err != nil {
+		t.Fatalf("ClaimPrintJob: %v", err)
+	}
+	if claimed.Status != models.PrintJobPrinting || claimed.AgentID != "k1" || claimed.Attempts != 1 {
+		t.Fatalf("claimed job is %s by %q after %d attempts, want printing by k1 after 1", claimed.Status, claimed.AgentID, claimed.Attempts)
+	}
+	if _, err := d.ClaimPrintJob(job.ID, "k2", "", 60); err != sql.ErrNoRows {
+		t.Fatalf("second claim: got %v, want sql.ErrNoRows", err)
+	}
+}
+
+// Only the agent holding a job may extend, complete or fail it.
+func TestPrintJobClaimerOnly(t *testing.T) {
+	d := newTestDB(t, nil)
+	job := printJob(t, d, "", "")
+	if _, err := d.ClaimPrintJob(job.ID, "k1", "", 60); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.HeartbeatPrintJob(job.ID, "k2", 60); err != sql.ErrNoRows {
+		t.Fatalf("heartbeat by another agent: got %v, want sql.ErrNoRows", err)
+	}
+	if err := d.CompletePrintJob(job.ID, "k2"); err != sql.ErrNoRows {
+		t.Fatalf("complete by another agent: got %v, want sql.ErrNoRows", err)
+	}
+	if err := d.FailPrintJob(job.ID, "k2", "paper out"); err != sql.ErrNoRows {
+		t.Fatalf("fail by another agent: got %v, want sql.ErrNoRows", err)
+	}
+
+	if err := d.CompletePrintJob(job.ID, "k1"); err != nil {
+		t.Fatalf("CompletePrintJob: %v", err)
+	}
+	if err := d.FailPrintJob(job.ID, "k1", "late"); err != sql.ErrNoRows {
+		t.Fatalf("fail after completing: got %v, want sql.ErrNoRows", err)
+	}
+	if got, _ := d.GetPrintJob(job.ID); got.Status != models.PrintJobCompleted {
+		t.Fatalf("job is %s, want completed", got.Status)
+	}
+}
+
+func TestRequeueExpiredPrintJobs(t *testing.T) {
+	d := newTestDB(t, nil)
+	job := printJob(t, d, "", "")
+	const maxAttempts = 2
+
+	// A heartbeat keeps the lease alive
+	if _, err := d.ClaimPrintJob(job.ID, "k1", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.HeartbeatPrintJob(job.ID, "k1", 60); err != nil {
+		t.Fatalf("HeartbeatPrintJob: %v", err)
+	}
+	if requeued, failed, err := d.RequeueExpiredPrintJobs(maxAttempts); err != nil || len(requeued) != 0 || failed != 0 {
+		t.Fatalf("swept %d requeued, %d failed (%v) with a live lease", len(requeued), failed, err)
+	}
+
+	// Once the lease runs out the job is pending again
+	expireLease(t, d, job.ID)
+	requeued, failed, err := d.RequeueExpiredPrintJobs(maxAttempts)
+	if err != nil {
+		t.Fatalf("RequeueExpiredPrintJobs: %v", err)
+	}
+	if len(requeued) != 1 || requeued[0].ID != job.ID || failed != 0 {
+		t.Fatalf("swept %d requeued, %d failed, want the job requeued", len(requeued), failed)
+	}
+	got, _ := d.GetPrintJob(job.ID)
+	if got.Status != models.PrintJobPending || got.AgentID != "" || got.Attempts != 1 {
+		t.Fatalf("requeued job is %s by %q after %d attempts, want pending, unclaimed, 1 attempt", got.Status, got.AgentID, got.Attempts)
+	}
+
+	// The agent that lost it can no longer report on it
+	if err := d.CompletePrintJob(job.ID, "k1"); err != sql.ErrNoRows {
+		t.Fatalf("stale complete: got %v, want sql.ErrNoRows", err)
+	}
+	if err := d.HeartbeatPrintJob(job.ID, "k1", 60); err != sql.ErrNoRows {
+		t.Fatalf("stale heartbeat: got %v, want sql.ErrNoRows", err)
+	}
+
+	// Another agent claims it; when that lease runs out too, the job has
+	// used its attempts and fails
+	claimed, err := d.ClaimPrintJob(job.ID, "k2", "", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.Attempts != maxAttempts {
+		t.Fatalf("attempts %d, want %d", claimed.Attempts, maxAttempts)
+	}
+	expireLease(t, d, job.ID)
+	requeued, failed, err = d.RequeueExpiredPrintJobs(maxAttempts)
+	if err != nil {
+		t.Fatalf("RequeueExpiredPrintJobs: %v", err)
+	}
+	if len(requeued) != 0 || failed != 1 {
+		t.Fatalf("swept %d requeued, %d failed, want the job failed", len(requeued), failed)
+	}
+	got, _ = d.GetPrintJob(job.ID)
+	if got.Status != models.PrintJobFailed || !strings.Contains(got.ErrorMessage, "k2 stopped responding after 2 attempt(s)") {
+		t.Fatalf("job is %s (%q), want failed after 2 attempts", got.Status, got.ErrorMessage)
+	}
+	if err := d.FailPrintJob(job.ID, "k2", "late"); err != sql.ErrNoRows {
+		t.Fatalf("stale fail: got %v, want sql.ErrNoRows", err)
+	}
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"queue-system/internal/models"
+)
+
+// accessLevel is who may use an API route, from least to most privileged.
+type accessLevel int
+
+const (
+	accessPublic       accessLevel = iota // displays, kiosks, status pages
+	accessStaff                           // any logged-in staff user
+	accessCounter                         // the operator logged in at the counter in the path, or a supervisor
+	accessSupervisor                      // supervisors and admins
+	accessAdmin                           // admins only
+	accessAgent                           // registered print agents (API key), not a staff level
+	accessStaffOrAgent                    // a registered print agent or any logged-in staff user
+)
+
+// permissions maps an HTTP method to the access level it requires. Methods
+// that are not listed are rejected before reaching the handler.
+type permissions map[string]accessLevel
+
+// guard wraps an API handler with its route permissions.
+func (h *Handler) guard(perms permissions, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		level, ok := perms[r.Method]
+		if !ok {
+			h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if level == accessPublic {
+			next(w, r)
+			return
+		}
+		if level == accessAgent || level == accessStaffOrAgent {
+			if agent := h.currentAgent(r); agent != nil {
+				next(w, r.WithContext(context.WithValue(r.Context(), agentKey{}, agent)))
+				return
+			}
+			if level == accessAgent {
+				h.jsonError(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		sess := h.currentSession(w, r)
+		if sess == nil {
+			h.jsonError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !sess.allows(level, counterFromPath(r.URL.Path)) {
+			h.jsonError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// agentKey is the request context key of the print agent guard
+// authenticated.
+type agentKey struct{}
+
+// requestAgent returns the print agent authenticated by guard on an agent
+// route, or nil.
+func requestAgent(r *http.Request) *models.PrintAgent {
+	agent, _ := r.Context().Value(agentKey{}).(*models.PrintAgent)
+	return agent
+}
+
+// allows reports whether the session satisfies level for a request on the
+// given counter (0 when the path names none).
+func (s *session) allows(level accessLevel, counterID int64) bool {
+	switch level {
+	case accessPublic, accessStaff, accessStaffOrAgent:
+		return true
+	case accessCounter:
+		return s.canManage() || (counterID != 0 && s.CounterID == counterID)
+	case accessSupervisor:
+		return s.canManage()
+	case accessAdmin:
+		return s.Role == models.RoleAdmin
+	}
+	return false
+}
+
+// counterFromPath returns the ID following "/counter/" in an API path such
+// as /api/counter/3/call-next or /api/sse/counter/3, or 0.
+func counterFromPath(path string) int64 {
+	_, rest, ok := strings.Cut(path, "/counter/")
+	if !ok {
+		return 0
+	}
+	idStr, _, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
@@ -1,20 +1,23 @@
 package handlers
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"embed"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"queue-system/internal/config"
@@ -22,17 +25,17 @@ import (
 	"queue-system/internal/models"
 	"queue-system/internal/printer"
 	"queue-system/internal/sse"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Handler struct {
-	db         *database.DB
-	hub        *sse.Hub
-	config     *config.Config
-	tmpl       *template.Template
-	staticFS   fs.FS
-	printer    *printer.Printer
-	sessions   map[string]time.Time
-	sessionsMu sync.RWMutex
+	db       *database.DB
+	hub      *sse.Hub
+	config   *config.Config
+	tmpl     *template.Template
+	staticFS fs.FS
+	printer  *printer.Printer
 }
 
 func New(db *database.DB, hub *sse.Hub, cfg *config.Config, webFS embed.FS) (*Handler, error) {
@@ -50,90 +53,188 @@ func New(db *database.DB, hub *sse.Hub, cfg *config.Config, webFS embed.FS) (*Ha
 	printerInstance := printer.New(printer.PrinterConfig{
 		Enabled:     cfg.Printer.Enabled,
 		PrinterName: cfg.Printer.PrinterName,
+		Transport:   cfg.Printer.Transport,
+		Address:     cfg.Printer.Address,
+		Device:      cfg.Printer.Device,
 	})
 
-	return &Handler{
+	h := &Handler{
 		db:       db,
 		hub:      hub,
 		config:   cfg,
 		tmpl:     tmpl,
 		staticFS: staticFS,
 		printer:  printerInstance,
-		sessions: make(map[string]time.Time),
-	}, nil
+	}
+	hub.SetSnapshot(sse.TopicDisplay, h.displaySnapshot)
+	return h, nil
 }
 
 // --- Session helpers ---
 
+// sessionCookie names the login cookie shared by the admin panel and
+// counter pages.
+const sessionCookie = "session"
+
+// session is a logged-in staff user. CounterID is set when an operator
+// logged in at a counter; the shift ends with the session.
+type session struct {
+	ID        int64
+	UserID    int64
+	Username  string
+	Name      string
+	Role      models.UserRole
+	CounterID int64
+}
+
+func newSession(s *models.Session) *session {
+	return &session{
+		ID:        s.ID,
+		UserID:    s.UserID,
+		Username:  s.Username,
+		Name:      s.DisplayName(),
+		Role:      s.Role,
+		CounterID: s.CounterID,
+	}
+}
+
+// canManage reports whether the user may use the admin panel.
+func (s *session) canManage() bool {
+	return s.Role == models.RoleAdmin || s.Role == models.RoleSupervisor
+}
+
 func (h *Handler) generateToken() string {
 	b := make([]byte, 32)
 	rand.Read(b)
 	return hex.EncodeToString(b)
 }
 
-func (h *Handler) isAuthenticated(r *http.Request) bool {
-	cookie, err := r.Cookie("admin_session")
-	if err != nil {
-		return false
-	}
-	h.sessionsMu.RLock()
-	expiry, ok := h.sessions[cookie.Value]
-	h.sessionsMu.RUnlock()
-	if !ok {
-		return false
-	}
-	if time.Now().After(expiry) {
-		h.sessionsMu.Lock()
-		delete(h.sessions, cookie.Value)
-		h.sessionsMu.Unlock()
-		return false
-	}
-	return true
+// hashToken returns the form in which a session token is stored, so the
+// sessions table never holds a usable cookie value.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
-func (h *Handler) setAdminSession(w http.ResponseWriter) {
-	token := h.generateToken()
-	timeout := time.Duration(h.config.Security.SessionTimeout) * time.Second
-	if timeout <= 0 {
-		timeout = 3600 * time.Second
+// sessionTimeout returns the idle time in seconds after which a session
+// expires.
+func (h *Handler) sessionTimeout() int {
+	if h.config.Security.SessionTimeout > 0 {
+		return h.config.Security.SessionTimeout
 	}
-	h.sessionsMu.Lock()
-	h.sessions[token] = time.Now().Add(timeout)
-	h.sessionsMu.Unlock()
+	return 3600
+}
+
+func (h *Handler) setSessionCookie(w http.ResponseWriter, token string, maxAge int) {
 	http.SetCookie(w, &http.Cookie{
-		Name:     "admin_session",
+		Name:     sessionCookie,
 		Value:    token,
 		Path:     "/",
-		MaxAge:   int(timeout.Seconds()),
+		MaxAge:   maxAge,
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
 	})
 }
 
-func (h *Handler) clearAdminSession(w http.ResponseWriter, r *http.Request) {
-	if cookie, err := r.Cookie("admin_session"); err == nil {
-		h.sessionsMu.Lock()
-		delete(h.sessions, cookie.Value)
-		h.sessionsMu.Unlock()
+// currentSession returns the session of the request, or nil if the request
+// is not logged in or the session has expired. Each request renews the
+// session for another SessionTimeout.
+func (h *Handler) currentSession(w http.ResponseWriter, r *http.Request) *session {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "admin_session",
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-	})
+	s, err := h.db.GetSessionByToken(hashToken(cookie.Value))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to load session: %v", err)
+		}
+		return nil
+	}
+
+	timeout := h.sessionTimeout()
+	if renewed, err := h.db.TouchSession(s.ID, timeout); err != nil {
+		log.Printf("Failed to renew session %d: %v", s.ID, err)
+	} else if renewed {
+		h.setSessionCookie(w, cookie.Value, timeout)
+	}
+	return newSession(s)
 }
 
-// adminAPIAuth wraps an API handler requiring session authentication.
-func (h *Handler) adminAPIAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if !h.isAuthenticated(r) {
-			h.jsonError(w, "Unauthorized", http.StatusUnauthorized)
-			return
+// isAuthenticated reports whether the request comes from an admin or
+// supervisor.
+func (h *Handler) isAuthenticated(w http.ResponseWriter, r *http.Request) bool {
+	sess := h.currentSession(w, r)
+	return sess != nil && sess.canManage()
+}
+
+// setSession logs user in on this browser, recording the device it came
+// from. counterID is 0 for admin panel logins.
+func (h *Handler) setSession(w http.ResponseWriter, r *http.Request, user *models.User, counterID int64) error {
+	token := h.generateToken()
+	timeout := h.sessionTimeout()
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if _, err := h.db.CreateSession(hashToken(token), user.ID, counterID, r.UserAgent(), ip, timeout); err != nil {
+		return err
+	}
+	h.setSessionCookie(w, token, timeout)
+	return nil
+}
+
+func (h *Handler) clearSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		released, err := h.db.DeleteSessionByToken(hashToken(cookie.Value))
+		if err != nil {
+			log.Printf("Failed to delete session: %v", err)
 		}
-		next(w, r)
+		h.notifyShiftsEnded(released)
+	}
+	h.setSessionCookie(w, "", -1)
+}
+
+// revokeUserSessions logs a user out everywhere, e.g. after their account
+// is deactivated or their role changes.
+func (h *Handler) revokeUserSessions(userID int64) {
+	released, err := h.db.DeleteUserSessions(userID, 0)
+	if err != nil {
+		log.Printf("Failed to revoke sessions of user %d: %v", userID, err)
+	}
+	h.notifyShiftsEnded(released)
+}
+
+// revokeCounterSessions ends the counter sessions that a new shift replaces:
+// the previous operator's at counterID and userID's own at other counters.
+func (h *Handler) revokeCounterSessions(counterID, userID int64) {
+	released, err := h.db.DeleteCounterSessions(counterID, userID)
+	if err != nil {
+		log.Printf("Failed to revoke sessions at counter %d: %v", counterID, err)
+	}
+	h.notifyShiftsEnded(released)
+}
+
+// notifyShiftsEnded tells the counter pages of released counters that their
+// operator has left.
+func (h *Handler) notifyShiftsEnded(counterIDs []int64) {
+	for _, counterID := range counterIDs {
+		h.hub.Publish(sse.CounterTopic(counterID), "operator_changed", nil)
+	}
+}
+
+// authenticateUser checks a username and password against the users table.
+// Returns nil for unknown, inactive or wrong credentials.
+func (h *Handler) authenticateUser(username, password string) *models.User {
+	user, err := h.db.GetUserByUsername(strings.TrimSpace(username))
+	if err != nil || !user.IsActive {
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil
 	}
+	h.db.RecordUserLogin(user.ID)
+	return user
 }
 
 func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
@@ -151,53 +252,90 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/ticket", h.handleTicket)
 	mux.HandleFunc("/counters", h.handleCountersPage)
 	mux.HandleFunc("/counter/", h.handleCounter)
+	mux.HandleFunc("/status", h.handleStatusPage)
+	mux.HandleFunc("/status/", h.handleStatusPage)
 	mux.HandleFunc("/health", h.handleHealth)
 
+	// API routes declare the access level required per method (see
+	// access.go). Displays, kiosks and status pages use the public ones.
+	const (
+		get  = http.MethodGet
+		post = http.MethodPost
+		put  = http.MethodPut
+		del  = http.MethodDelete
+	)
+	api := func(pattern string, perms permissions, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, h.guard(perms, handler))
+	}
+
 	// API - Queues
-	mux.HandleFunc("/api/queues", h.handleQueues)
-	mux.HandleFunc("/api/queues/take", h.handleTakeQueue)
+	api("/api/queues", permissions{get: accessPublic}, h.handleQueues)
+	api("/api/queues/take", permissions{post: accessPublic}, h.handleTakeQueue)
+	api("/api/kiosk/ticket", permissions{post: accessPublic}, h.handleKioskTicket)
+	api("/api/queues/reactivate", permissions{post: accessStaff}, h.handleReactivateQueue)
+	api("/api/queues/", permissions{get: accessPublic}, h.handleQueueAPI)
 
 	// API - Queue Types
-	mux.HandleFunc("/api/queue-types", h.handleQueueTypes)
-	mux.HandleFunc("/api/queue-type/", h.handleQueueTypeAPI)
+	api("/api/queue-types", permissions{get: accessPublic, post: accessAdmin}, h.handleQueueTypes)
+	api("/api/queue-type/", permissions{get: accessPublic, put: accessAdmin, del: accessAdmin}, h.handleQueueTypeAPI)
 
-	// API - Counters
-	mux.HandleFunc("/api/counters", h.handleCounters)
-	mux.HandleFunc("/api/counter/", h.handleCounterAPI)
+	// API - Counters. POST covers the counter actions (call-next, recall,
+	// complete, cancel, transfer, park); PUT covers settings and services.
+	api("/api/counters", permissions{get: accessPublic, post: accessAdmin}, h.handleCounters)
+	api("/api/counter/", permissions{get: accessPublic, post: accessCounter, put: accessSupervisor, del: accessAdmin}, h.handleCounterAPI)
 
 	// API - Stats
-	mux.HandleFunc("/api/stats", h.handleStats)
-	mux.HandleFunc("/api/stats/by-type", h.handleStatsByType)
+	api("/api/stats", permissions{get: accessPublic}, h.handleStats)
+	api("/api/stats/by-type", permissions{get: accessPublic}, h.handleStatsByType)
+	api("/api/stats/eta", permissions{get: accessPublic}, h.handleServiceETA)
 
 	// API - Settings
-	mux.HandleFunc("/api/settings", h.handleSettings)
+	api("/api/settings", permissions{get: accessPublic, post: accessAdmin}, h.handleSettings)
+	api("/api/settings/logo", permissions{post: accessAdmin, del: accessAdmin}, h.handleTicketLogo)
 
 	// API - Audio voices
-	mux.HandleFunc("/api/audio-voices", h.handleAudioVoices)
+	api("/api/audio-voices", permissions{get: accessPublic}, h.handleAudioVoices)
 
-	// API - Admin (requires authentication)
-	mux.HandleFunc("/api/admin/reset-queues", h.adminAPIAuth(h.handleResetQueues))
-	mux.HandleFunc("/api/admin/reset-counters", h.adminAPIAuth(h.handleResetCounters))
+	// API - Staff accounts
+	api("/api/me", permissions{get: accessStaff}, h.handleMe)
+	api("/api/me/sessions", permissions{get: accessStaff, del: accessStaff}, h.handleMySessions)
+	api("/api/users", permissions{get: accessAdmin, post: accessAdmin}, h.handleUsers)
+	api("/api/users/", permissions{put: accessAdmin, del: accessAdmin}, h.handleUserAPI)
+	api("/api/sessions", permissions{get: accessAdmin, del: accessAdmin}, h.handleSessions)
+	api("/api/sessions/", permissions{del: accessAdmin}, h.handleSessionAPI)
 
-	// API - Reports
-	mux.HandleFunc("/api/report", h.handleReport)
-	mux.HandleFunc("/api/report/export", h.handleReportExport)
-
-	// API - Printer
-	mux.HandleFunc("/api/print-ticket", h.handlePrintTicket)
-	mux.HandleFunc("/api/printer/test", h.handlePrinterTest)
-	mux.HandleFunc("/api/printer/status", h.handlePrinterStatus)
+	// API - Admin
+	api("/api/admin/reset-queues", permissions{post: accessSupervisor}, h.handleResetQueues)
+	api("/api/admin/reset-counters", permissions{post: accessAdmin}, h.handleResetCounters)
 
-	// API - Print Agent (remote printing)
-	mux.HandleFunc("/api/print-agent/sse", h.handlePrintAgentSSE)
-	mux.HandleFunc("/api/print-agent/jobs/pending", h.handlePendingPrintJobs)
-	mux.HandleFunc("/api/print-agent/jobs/summary", h.handlePrintJobSummary)
-	mux.HandleFunc("/api/print-agent/jobs/retry-failed", h.handleRetryFailedJobs)
-	mux.HandleFunc("/api/print-agent/job/", h.handlePrintJobAPI)
+	// API - Reports
+	api("/api/report", permissions{get: accessSupervisor}, h.handleReport)
+	api("/api/report/export", permissions{get: accessSupervisor}, h.handleReportExport)
+
+	// API - Printer. The kiosk prints tickets and checks the printer.
+	api("/api/print-ticket", permissions{post: accessPublic}, h.handlePrintTicket)
+	api("/api/printer/test", permissions{post: accessSupervisor}, h.handlePrinterTest)
+	api("/api/printer/status", permissions{get: accessPublic}, h.handlePrinterStatus)
+	api("/api/printer/preview", permissions{get: accessSupervisor, post: accessSupervisor}, h.handlePrinterPreview)
+
+	// API - Print Agent (remote printing). Agents run without a staff login;
+	// the kiosk also reads the job summary, and staff retry failed jobs.
+	api("/api/print-agent/sse", permissions{get: accessAgent}, h.handlePrintAgentSSE)
+	api("/api/print-agent/status", permissions{post: accessAgent}, h.handlePrintAgentStatus)
+	api("/api/print-agent/jobs/pending", permissions{get: accessAgent}, h.handlePendingPrintJobs)
+	api("/api/print-agent/jobs/summary", permissions{get: accessPublic}, h.handlePrintJobSummary)
+	api("/api/print-agent/jobs/retry-failed", permissions{post: accessStaffOrAgent}, h.handleRetryFailedJobs)
+	api("/api/print-agent/job/", permissions{get: accessAgent, post: accessAgent}, h.handlePrintJobAPI)
+	api("/api/print-agents", permissions{get: accessAdmin, post: accessAdmin}, h.handlePrintAgents)
+	api("/api/print-agents/", permissions{get: accessAdmin, put: accessAdmin, del: accessAdmin}, h.handlePrintAgentAPI)
 
 	// SSE
-	mux.HandleFunc("/api/sse/display", h.handleDisplaySSE)
-	mux.HandleFunc("/api/sse/counter/", h.handleCounterSSE)
+	api("/api/sse/display", permissions{get: accessPublic}, h.handleDisplaySSE)
+	api("/api/sse/counter/", permissions{get: accessCounter}, h.handleCounterSSE)
+	api("/api/sse/status/", permissions{get: accessPublic}, h.handleStatusSSE)
+	api("/api/sse/admin", permissions{get: accessAdmin}, h.handleAdminSSE)
+	api("/api/sse/clients", permissions{get: accessAdmin}, h.handleSSEClients)
+	api("/api/ws/counter/", permissions{get: accessCounter}, h.handleCounterWebSocket)
 }
 
 // JSON helpers
@@ -251,7 +389,7 @@ func getServerAddr(port int) string {
 }
 
 func (h *Handler) handleAdmin(w http.ResponseWriter, r *http.Request) {
-	if !h.isAuthenticated(r) {
+	if !h.isAuthenticated(w, r) {
 		http.Redirect(w, r, "/admin/login", http.StatusFound)
 		return
 	}
@@ -261,7 +399,7 @@ func (h *Handler) handleAdmin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) handleSuperCounter(w http.ResponseWriter, r *http.Request) {
-	if !h.isAuthenticated(r) {
+	if !h.isAuthenticated(w, r) {
 		http.Redirect(w, r, "/admin/login", http.StatusFound)
 		return
 	}
@@ -279,7 +417,7 @@ func (h *Handler) handleSuperCounter(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		if h.isAuthenticated(r) {
+		if h.isAuthenticated(w, r) {
 			http.Redirect(w, r, "/admin", http.StatusFound)
 			return
 		}
@@ -290,14 +428,34 @@ func (h *Handler) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
 			h.tmpl.ExecuteTemplate(w, "admin_login.html", map[string]string{"Error": "Request tidak valid"})
 			return
 		}
-		password := r.FormValue("password")
-		if h.config.VerifyAdminPassword(password) {
-			h.setAdminSession(w)
-			http.Redirect(w, r, "/admin", http.StatusFound)
+		username := r.FormValue("username")
+		user := h.authenticateUser(username, r.FormValue("password"))
+		if user == nil {
+			log.Printf("Admin login failed for %q from %s", username, r.RemoteAddr)
+			h.tmpl.ExecuteTemplate(w, "admin_login.html", map[string]string{
+				"Error":    "Username atau password salah. Silakan coba lagi.",
+				"Username": username,
+			})
+			return
+		}
+		if user.Role != models.RoleAdmin && user.Role != models.RoleSupervisor {
+			log.Printf("Admin login refused for operator %s from %s", user.Username, r.RemoteAddr)
+			h.tmpl.ExecuteTemplate(w, "admin_login.html", map[string]string{
+				"Error":    "Akun ini tidak memiliki akses ke panel admin.",
+				"Username": username,
+			})
 			return
 		}
-		log.Printf("Admin login failed: wrong password from %s", r.RemoteAddr)
-		h.tmpl.ExecuteTemplate(w, "admin_login.html", map[string]string{"Error": "Password salah. Silakan coba lagi."})
+		if err := h.setSession(w, r, user, 0); err != nil {
+			log.Printf("Failed to create session: %v", err)
+			h.tmpl.ExecuteTemplate(w, "admin_login.html", map[string]string{
+				"Error":    "Gagal membuat sesi login.",
+				"Username": username,
+			})
+			return
+		}
+		log.Printf("Admin login: %s (%s)", user.Username, user.Role)
+		http.Redirect(w, r, "/admin", http.StatusFound)
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -305,10 +463,315 @@ func (h *Handler) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) handleAdminLogout(w http.ResponseWriter, r *http.Request) {
-	h.clearAdminSession(w, r)
+	h.clearSession(w, r)
 	http.Redirect(w, r, "/admin/login", http.StatusFound)
 }
 
+// Staff account handlers
+
+// minPasswordLength is the shortest password accepted for staff accounts.
+const minPasswordLength = 6
+
+// handleMe returns the logged-in user of the request.
+func (h *Handler) handleMe(w http.ResponseWriter, r *http.Request) {
+	sess := h.currentSession(w, r)
+	if sess == nil {
+		h.jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.jsonResponse(w, map[string]interface{}{
+		"user_id":    sess.UserID,
+		"username":   sess.Username,
+		"name":       sess.Name,
+		"role":       sess.Role,
+		"counter_id": sess.CounterID,
+	})
+}
+
+func (h *Handler) handleUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		users, err := h.db.ListUsers()
+		if err != nil {
+			h.jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if users == nil {
+			users = []*models.User{}
+		}
+		h.jsonResponse(w, users)
+
+	case http.MethodPost:
+		var req struct {
+			Username string          `json:"username"`
+			FullName string          `json:"full_name"`
+			Password string          `json:"password"`
+			Role     models.UserRole `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.jsonError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		req.Username = strings.TrimSpace(req.Username)
+		if req.Username == "" {
+			h.jsonError(w, "Username is required", http.StatusBadRequest)
+			return
+		}
+		if len(req.Password) < minPasswordLength {
+			h.jsonError(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = models.RoleOperator
+		}
+		if !req.Role.Valid() {
+			h.jsonError(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+		if _, err := h.db.GetUserByUsername(req.Username); err == nil {
+			h.jsonError(w, "Username already exists", http.StatusConflict)
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			h.jsonError(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+		user, err := h.db.CreateUser(req.Username, strings.TrimSpace(req.FullName), string(hash), req.Role)
+		if err != nil {
+			log.Printf("Failed to create user: %v", err)
+			h.jsonError(w, "Failed to create user", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("User created: %s (%s)", user.Username, user.Role)
+		h.jsonResponse(w, user)
+
+	default:
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleUserAPI updates (PUT) or deletes (DELETE) /api/users/{id}. The last
+// active admin cannot be demoted, deactivated or deleted.
+func (h *Handler) handleUserAPI(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/users/"), 10, 64)
+	if err != nil {
+		h.jsonError(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.db.GetUser(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			h.jsonError(w, "User not found", http.StatusNotFound)
+			return
+		}
+		h.jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	isLastAdmin := func() bool {
+		if user.Role != models.RoleAdmin || !user.IsActive {
+			return false
+		}
+		count, err := h.db.CountActiveAdmins()
+		return err == nil && count <= 1
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			FullName *string          `json:"full_name,omitempty"`
+			Role     *models.UserRole `json:"role,omitempty"`
+			IsActive *bool            `json:"is_active,omitempty"`
+			Password string           `json:"password,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.jsonError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		fullName, role, isActive := user.FullName, user.Role, user.IsActive
+		if req.FullName != nil {
+			fullName = strings.TrimSpace(*req.FullName)
+		}
+		if req.Role != nil {
+			if !req.Role.Valid() {
+				h.jsonError(w, "Invalid role", http.StatusBadRequest)
+				return
+			}
+			role = *req.Role
+		}
+		if req.IsActive != nil {
+			isActive = *req.IsActive
+		}
+		if (role != models.RoleAdmin || !isActive) && isLastAdmin() {
+			h.jsonError(w, "Cannot demote or deactivate the last admin", http.StatusConflict)
+			return
+		}
+
+		if req.Password != "" {
+			if len(req.Password) < minPasswordLength {
+				h.jsonError(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+				return
+			}
+			hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+			if err != nil {
+				h.jsonError(w, "Failed to hash password", http.StatusInternalServerError)
+				return
+			}
+			if err := h.db.SetUserPassword(id, string(hash)); err != nil {
+				h.jsonError(w, "Failed to update password", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := h.db.UpdateUser(id, fullName, role, isActive); err != nil {
+			log.Printf("Failed to update user: %v", err)
+			h.jsonError(w, "Failed to update user", http.StatusInternalServerError)
+			return
+		}
+
+		if !isActive || role != user.Role || req.Password != "" {
+			h.revokeUserSessions(id)
+		}
+
+		user, err = h.db.GetUser(id)
+		if err != nil {
+			h.jsonError(w, "Failed to get updated user", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User updated: %s (%s, active=%v)", user.Username, user.Role, user.IsActive)
+		h.jsonResponse(w, user)
+
+	case http.MethodDelete:
+		if isLastAdmin() {
+			h.jsonError(w, "Cannot delete the last admin", http.StatusConflict)
+			return
+		}
+		h.revokeUserSessions(id)
+		if err := h.db.DeleteUser(id); err != nil {
+			log.Printf("Failed to delete user: %v", err)
+			h.jsonError(w, "Failed to delete user", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User deleted: %s", user.Username)
+		h.jsonResponse(w, map[string]string{"status": "deleted"})
+
+	default:
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Session handlers
+
+// sessionList marks the caller's own session in a session listing.
+func sessionList(sessions []*models.Session, current *session) []*models.Session {
+	if sessions == nil {
+		return []*models.Session{}
+	}
+	for _, s := range sessions {
+		s.Current = current != nil && s.ID == current.ID
+	}
+	return sessions
+}
+
+// handleSessions lists the active sessions of all staff, optionally of one
+// user (GET ?user_id=), or logs a user out everywhere (DELETE ?user_id=).
+func (h *Handler) handleSessions(w http.ResponseWriter, r *http.Request) {
+	var userID int64
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			h.jsonError(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		userID = id
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := h.db.ListSessions(userID)
+		if err != nil {
+			h.jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		h.jsonResponse(w, sessionList(sessions, h.currentSession(w, r)))
+
+	case http.MethodDelete:
+		if userID == 0 {
+			h.jsonError(w, "user_id is required", http.StatusBadRequest)
+			return
+		}
+		h.revokeUserSessions(userID)
+		log.Printf("All sessions of user %d revoked", userID)
+		h.jsonResponse(w, map[string]string{"status": "revoked"})
+
+	default:
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSessionAPI revokes a single session.
+func (h *Handler) handleSessionAPI(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/sessions/"), 10, 64)
+	if err != nil {
+		h.jsonError(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	released, err := h.db.DeleteSession(id)
+	if err != nil {
+		log.Printf("Failed to revoke session: %v", err)
+		h.jsonError(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	h.notifyShiftsEnded(released)
+	log.Printf("Session %d revoked", id)
+	h.jsonResponse(w, map[string]string{"status": "revoked"})
+}
+
+// handleMySessions lists the caller's own sessions (GET) or logs them out
+// on every other device (DELETE).
+func (h *Handler) handleMySessions(w http.ResponseWriter, r *http.Request) {
+	sess := h.currentSession(w, r)
+	if sess == nil {
+		h.jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := h.db.ListSessions(sess.UserID)
+		if err != nil {
+			h.jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		h.jsonResponse(w, sessionList(sessions, sess))
+
+	case http.MethodDelete:
+		released, err := h.db.DeleteUserSessions(sess.UserID, sess.ID)
+		if err != nil {
+			log.Printf("Failed to revoke sessions: %v", err)
+			h.jsonError(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
+		}
+		h.notifyShiftsEnded(released)
+		log.Printf("%s logged out of all other sessions", sess.Username)
+		h.jsonResponse(w, map[string]string{"status": "revoked"})
+
+	default:
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 func (h *Handler) handleDisplay(w http.ResponseWriter, r *http.Request) {
 	data := map[string]interface{}{
 		"AudioEnabled": h.config.Audio.Enabled,
@@ -325,13 +788,25 @@ func (h *Handler) handleTicket(w http.ResponseWriter, r *http.Request) {
 	h.tmpl.ExecuteTemplate(w, "ticket.html", data)
 }
 
+// handleStatusPage serves the public ticket status page. Without a number
+// it shows a lookup form.
+func (h *Handler) handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	number := strings.Trim(strings.TrimPrefix(r.URL.Path, "/status"), "/")
+	data := map[string]interface{}{
+		"QueueNumber": strings.ToUpper(number),
+	}
+	h.tmpl.ExecuteTemplate(w, "status.html", data)
+}
+
 func (h *Handler) handleCountersPage(w http.ResponseWriter, r *http.Request) {
 	h.tmpl.ExecuteTemplate(w, "counters.html", nil)
 }
 
+// handleCounter serves /counter/{id} and its /login and /logout actions.
+// The counter page requires an operator logged in at that counter.
 func (h *Handler) handleCounter(w http.ResponseWriter, r *http.Request) {
-	idStr := strings.TrimPrefix(r.URL.Path, "/counter/")
-	id, err := strconv.ParseInt(idStr, 10, 64)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/counter/"), "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
 		http.Error(w, "Invalid counter ID", http.StatusBadRequest)
 		return
@@ -347,86 +822,431 @@ func (h *Handler) handleCounter(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	switch action {
+	case "login":
+		h.handleCounterLogin(w, r, counter)
+		return
+	case "logout":
+		h.clearSession(w, r)
+		http.Redirect(w, r, fmt.Sprintf("/counter/%d", id), http.StatusFound)
+		return
+	case "":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	// The session must still hold the counter; another operator logging in
+	// here takes it over.
+	sess := h.currentSession(w, r)
+	if sess == nil || sess.CounterID != id || counter.OperatorID.Int64 != sess.UserID {
+		h.tmpl.ExecuteTemplate(w, "admin_login.html", map[string]interface{}{
+			"Counter": counter,
+		})
+		return
+	}
+
 	queueTypes, _ := h.db.ListQueueTypes(true)
 
+	// Counters with assigned services only show those types and can call
+	// next without choosing a type (routed by the server).
+	services, _ := h.db.ListCounterServices(id)
+	if len(services) > 0 {
+		assigned := make(map[string]bool, len(services))
+		for _, cs := range services {
+			assigned[cs.QueueType] = true
+		}
+		var filtered []*models.QueueType
+		for _, qt := range queueTypes {
+			if assigned[qt.Code] {
+				filtered = append(filtered, qt)
+			}
+		}
+		queueTypes = filtered
+	}
+
 	data := map[string]interface{}{
 		"Counter":    counter,
 		"QueueTypes": queueTypes,
+		"AutoRoute":  len(services) > 0,
+		"Operator":   sess,
+	}
+	h.tmpl.ExecuteTemplate(w, "counter.html", data)
+}
+
+// handleCounterLogin logs a staff user in at a counter and binds them to it
+// as its operator for the shift.
+func (h *Handler) handleCounterLogin(w http.ResponseWriter, r *http.Request, counter *models.Counter) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, fmt.Sprintf("/counter/%d", counter.ID), http.StatusFound)
+		return
+	}
+
+	loginError := func(message string) {
+		h.tmpl.ExecuteTemplate(w, "admin_login.html", map[string]interface{}{
+			"Counter":  counter,
+			"Error":    message,
+			"Username": r.FormValue("username"),
+		})
+	}
+
+	if err := r.ParseForm(); err != nil {
+		loginError("Request tidak valid")
+		return
+	}
+	user := h.authenticateUser(r.FormValue("username"), r.FormValue("password"))
+	if user == nil {
+		log.Printf("Counter login failed for %q at %s from %s", r.FormValue("username"), counter.CounterName, r.RemoteAddr)
+		loginError("Username atau password salah. Silakan coba lagi.")
+		return
+	}
+
+	// Logging in again replaces any earlier session of this browser, and
+	// the sessions the new shift takes over end before it starts
+	h.clearSession(w, r)
+	h.revokeCounterSessions(counter.ID, user.ID)
+	if err := h.db.StartCounterShift(counter.ID, user.ID); err != nil {
+		log.Printf("Failed to start shift: %v", err)
+		loginError("Gagal memulai sesi loket.")
+		return
+	}
+	if err := h.setSession(w, r, user, counter.ID); err != nil {
+		log.Printf("Failed to create session: %v", err)
+		h.db.EndCounterShift(counter.ID, user.ID)
+		loginError("Gagal memulai sesi loket.")
+		return
+	}
+	h.hub.Publish(sse.CounterTopic(counter.ID), "operator_changed", map[string]interface{}{
+		"operator_id":   user.ID,
+		"operator_name": user.DisplayName(),
+	})
+
+	log.Printf("Operator %s logged in at %s", user.Username, counter.CounterName)
+	http.Redirect(w, r, fmt.Sprintf("/counter/%d", counter.ID), http.StatusFound)
+}
+
+func (h *Handler) handleHealth(w http.ResponseWriter, r *http.Request) {
+	stats, _ := h.db.GetStats()
+	h.jsonResponse(w, map[string]interface{}{
+		"status":          "ok",
+		"timestamp":       time.Now(),
+		"display_clients": h.hub.Subscribers(sse.TopicDisplay),
+		"stats":           stats,
+	})
+}
+
+// Queue API handlers
+
+func (h *Handler) handleQueues(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		status := r.URL.Query().Get("status")
+		queueType := r.URL.Query().Get("type")
+		date := r.URL.Query().Get("date")
+
+		page := 1
+		if p := r.URL.Query().Get("page"); p != "" {
+			if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
+				page = parsed
+			}
+		}
+
+		perPage := 20
+		if pp := r.URL.Query().Get("per_page"); pp != "" {
+			if parsed, err := strconv.Atoi(pp); err == nil && parsed > 0 && parsed <= 100 {
+				perPage = parsed
+			}
+		}
+
+		result, err := h.db.ListQueuesWithPagination(status, queueType, date, page, perPage)
+		if err != nil {
+			h.jsonError(w, "Failed to list queues", http.StatusInternalServerError)
+			return
+		}
+
+		h.jsonResponse(w, result)
+
+	default:
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) handleTakeQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	queueType := r.URL.Query().Get("type")
+	if queueType == "" {
+		queueType = "general"
+	}
+
+	// Priority lane (lansia, disabilitas, ibu hamil) — set by a separate kiosk button
+	priority := models.PriorityNormal
+	if p := r.URL.Query().Get("priority"); p != "" {
+		parsed, err := strconv.Atoi(p)
+		if err != nil || parsed < models.PriorityNormal {
+			h.jsonError(w, "Invalid priority", http.StatusBadRequest)
+			return
+		}
+		priority = parsed
+	}
+
+	queue, err := h.db.CreateQueue(queueType, priority)
+	if err != nil {
+		h.jsonError(w, "Failed to create queue", http.StatusInternalServerError)
+		return
+	}
+
+	h.queueTaken(queue)
+	h.jsonResponse(w, queue)
+}
+
+// queueTaken attaches the ETA to a new queue and tells counters, displays
+// and status pages about it.
+func (h *Handler) queueTaken(queue *models.Queue) {
+	if eta, err := h.db.EstimateQueueWait(queue.ID); err == nil {
+		queue.ETA = eta
+	} else {
+		log.Printf("Failed to estimate wait for %s: %v", queue.QueueNumber, err)
+	}
+
+	// Broadcast update to all counters
+	waitingCount, _ := h.db.GetWaitingCount()
+	h.hub.Publish(sse.AllCounters, "queue_added", models.CounterUpdateData{
+		WaitingCount: waitingCount,
+		Timestamp:    time.Now(),
+	})
+	h.broadcastServiceETA()
+	h.notifyStatusPages(queue.QueueType)
+}
+
+// ticketTimeFormat is how the time a ticket was taken is printed on it.
+const ticketTimeFormat = "02/01/2006, 15:04:05"
+
+// handleKioskTicket takes a ticket and prints it in one call. The queue and
+// its remote print job are created in one transaction, so a kiosk that
+// crashes after taking a number cannot leave a ticket that never prints.
+// The type name and time on the ticket are resolved here, not by the kiosk.
+func (h *Handler) handleKioskTicket(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type     string `json:"type"`
+		Priority int    `json:"priority"`
+		// Print overrides the ticket_auto_print setting
+		Print        *bool  `json:"print"`
+		AgentID      string `json:"agent_id"`
+		PrinterGroup string `json:"printer_group"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Type == "" {
+		req.Type = "general"
+	}
+	if req.Priority < models.PriorityNormal {
+		h.jsonError(w, "Invalid priority", http.StatusBadRequest)
+		return
+	}
+
+	wantPrint := req.Print == nil || *req.Print
+	if req.Print == nil {
+		if val, _ := h.db.GetSetting("ticket_auto_print"); val == "false" {
+			wantPrint = false
+		}
+	}
+	req.AgentID, req.PrinterGroup = strings.TrimSpace(req.AgentID), strings.TrimSpace(req.PrinterGroup)
+	if wantPrint && h.config.Printer.RemoteEnabled {
+		if msg := h.checkPrintTarget(req.AgentID, req.PrinterGroup); msg != "" {
+			h.jsonError(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	ticket := printer.TicketData{
+		TypeName: req.Type,
+		DateTime: time.Now().Format(ticketTimeFormat),
+	}
+	if qt, err := h.db.GetQueueTypeByCode(req.Type); err == nil {
+		ticket.TypeName = qt.Name
+	}
+	tmpl := h.loadTicketTemplate()
+
+	var queue *models.Queue
+	var job *models.PrintJob
+	var err error
+	if wantPrint && h.config.Printer.RemoteEnabled {
+		templateJSON, jsonErr := json.Marshal(tmpl)
+		if jsonErr != nil {
+			log.Printf("Failed to marshal template: %v", jsonErr)
+			h.jsonError(w, "Failed to prepare ticket", http.StatusInternalServerError)
+			return
+		}
+		queue, job, err = h.db.CreateQueueWithPrintJob(req.Type, req.Priority, &models.PrintJob{
+			TypeName:     ticket.TypeName,
+			DateTime:     ticket.DateTime,
+			TemplateJSON: string(templateJSON),
+			TargetAgent:  req.AgentID,
+			TargetGroup:  req.PrinterGroup,
+		}, func(eta *models.QueueETA) string {
+			return printer.FormatWait(eta.WaitMinutes)
+		})
+	} else {
+		queue, err = h.db.CreateQueue(req.Type, req.Priority)
+	}
+	if err != nil {
+		log.Printf("Failed to create queue: %v", err)
+		h.jsonError(w, "Failed to create queue", http.StatusInternalServerError)
+		return
+	}
+
+	h.queueTaken(queue)
+	ticket.QueueNumber = queue.QueueNumber
+	if job != nil {
+		// The wait the remote ticket was queued with
+		ticket.ETA = job.ETA
+	} else if queue.ETA != nil {
+		ticket.ETA = printer.FormatWait(queue.ETA.WaitMinutes)
+	}
+
+	// "skipped" (printing off), "queued" (remote job), "printed" (local
+	// printer) or "failed"
+	status := "skipped"
+	localPrinted := false
+	printError := ""
+	if wantPrint {
+		status = "failed"
+		if job != nil {
+			h.dispatchPrintJob(job)
+			status = "queued"
+		}
+		if h.config.Printer.Enabled {
+			if err := h.printer.PrintTicket(ticket, tmpl); err != nil {
+				log.Printf("Local print error: %v", err)
+				printError = err.Error()
+			} else {
+				localPrinted = true
+				status = "printed"
+			}
+		}
 	}
-	h.tmpl.ExecuteTemplate(w, "counter.html", data)
-}
 
-func (h *Handler) handleHealth(w http.ResponseWriter, r *http.Request) {
-	stats, _ := h.db.GetStats()
+	printStatus := map[string]interface{}{
+		"status":        status,
+		"local_printed": localPrinted,
+		"remote_sent":   job != nil,
+	}
+	if job != nil {
+		printStatus["job_id"] = job.ID
+	}
+	if printError != "" {
+		printStatus["error"] = printError
+	}
+
+	log.Printf("Kiosk ticket: %s (%s) print=%s", queue.QueueNumber, ticket.TypeName, status)
 	h.jsonResponse(w, map[string]interface{}{
-		"status":          "ok",
-		"timestamp":       time.Now(),
-		"display_clients": h.hub.GetDisplayClientCount(),
-		"stats":           stats,
+		"queue": queue,
+		"ticket": map[string]string{
+			"queue_number": ticket.QueueNumber,
+			"type_name":    ticket.TypeName,
+			"date_time":    ticket.DateTime,
+			"eta":          ticket.ETA,
+		},
+		"print": printStatus,
 	})
 }
 
-// Queue API handlers
-
-func (h *Handler) handleQueues(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		status := r.URL.Query().Get("status")
-		queueType := r.URL.Query().Get("type")
-		date := r.URL.Query().Get("date")
+// handleQueueAPI serves /api/queues/{number}/eta and /api/queues/{number}/status
+func (h *Handler) handleQueueAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/queues/"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		h.jsonError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-		page := 1
-		if p := r.URL.Query().Get("page"); p != "" {
-			if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
-				page = parsed
-			}
-		}
+	queue, err := h.db.GetQueueByNumber(strings.ToUpper(parts[0]))
+	if err != nil {
+		h.jsonError(w, "Queue not found", http.StatusNotFound)
+		return
+	}
 
-		perPage := 20
-		if pp := r.URL.Query().Get("per_page"); pp != "" {
-			if parsed, err := strconv.Atoi(pp); err == nil && parsed > 0 && parsed <= 100 {
-				perPage = parsed
-			}
+	switch parts[1] {
+	case "eta":
+		eta, err := h.db.EstimateQueueWait(queue.ID)
+		if err != nil {
+			h.jsonError(w, "Failed to estimate waiting time", http.StatusInternalServerError)
+			return
 		}
+		h.jsonResponse(w, eta)
 
-		result, err := h.db.ListQueuesWithPagination(status, queueType, date, page, perPage)
+	case "status":
+		status, err := h.ticketStatus(queue)
 		if err != nil {
-			h.jsonError(w, "Failed to list queues", http.StatusInternalServerError)
+			h.jsonError(w, "Failed to get queue status", http.StatusInternalServerError)
 			return
 		}
-
-		h.jsonResponse(w, result)
+		h.jsonResponse(w, status)
 
 	default:
-		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		h.jsonError(w, "Not found", http.StatusNotFound)
 	}
 }
 
-func (h *Handler) handleTakeQueue(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// ticketStatus builds the public status of a queue: position in line, the
+// number being served for its type and the ETA.
+func (h *Handler) ticketStatus(queue *models.Queue) (*models.TicketStatus, error) {
+	eta, err := h.db.EstimateQueueWait(queue.ID)
+	if err != nil {
+		return nil, err
+	}
+	nowServing, err := h.db.GetNowServing(queue.QueueType)
+	if err != nil {
+		return nil, err
 	}
 
-	queueType := r.URL.Query().Get("type")
-	if queueType == "" {
-		queueType = "general"
+	status := &models.TicketStatus{
+		QueueNumber: queue.QueueNumber,
+		QueueType:   queue.QueueType,
+		TypeName:    queue.QueueType,
+		Status:      queue.Status,
+		NowServing:  nowServing,
+		UpdatedAt:   time.Now(),
+	}
+	if qt, err := h.db.GetQueueTypeByCode(queue.QueueType); err == nil {
+		status.TypeName = qt.Name
 	}
 
-	queue, err := h.db.CreateQueue(queueType)
-	if err != nil {
-		h.jsonError(w, "Failed to create queue", http.StatusInternalServerError)
-		return
+	switch queue.Status {
+	case models.StatusWaiting:
+		status.Position = eta.Ahead + 1
+		status.ETA = eta
+	case models.StatusCalled:
+		if queue.CounterID.Valid {
+			if counter, err := h.db.GetCounter(queue.CounterID.Int64); err == nil {
+				status.CounterName = counter.CounterName
+			}
+		}
 	}
 
-	// Broadcast update to all counters
-	waitingCount, _ := h.db.GetWaitingCount()
-	h.hub.BroadcastAllCounters("queue_added", models.CounterUpdateData{
-		WaitingCount: waitingCount,
-		Timestamp:    time.Now(),
-	})
+	return status, nil
+}
 
-	h.jsonResponse(w, queue)
+// notifyStatusPages tells public status pages watching a ticket of
+// queueType (all pages when empty) that positions may have changed.
+func (h *Handler) notifyStatusPages(queueType string) {
+	h.hub.Publish(sse.TypeTopic(queueType), "status_changed", map[string]interface{}{
+		"queue_type": queueType,
+		"timestamp":  time.Now(),
+	})
 }
 
 // Counter API handlers
@@ -499,6 +1319,12 @@ func (h *Handler) handleCounterAPI(w http.ResponseWriter, r *http.Request) {
 		h.handleComplete(w, r, counterID)
 	case "cancel":
 		h.handleCancel(w, r, counterID)
+	case "transfer":
+		h.handleTransfer(w, r, counterID)
+	case "park":
+		h.handlePark(w, r, counterID)
+	case "services":
+		h.handleCounterServices(w, r, counterID)
 	default:
 		switch r.Method {
 		case http.MethodGet:
@@ -594,13 +1420,39 @@ func (h *Handler) handleCallNext(w http.ResponseWriter, r *http.Request, counter
 	// Get queue type from query parameter
 	queueType := r.URL.Query().Get("type")
 
+	// park=true parks the current queue as a no-show instead of completing it
+	parkCurrent := r.URL.Query().Get("park") == "true"
+
+	// The current queue is completed or parked even when none is waiting
+	before, err := h.db.GetCounter(counterID)
+	if err != nil {
+		h.jsonError(w, "Counter not found", http.StatusNotFound)
+		return
+	}
+
 	// Atomic call next queue
-	queue, err := h.db.CallNextQueue(counterID, queueType)
+	queue, callID, err := h.db.CallNextQueue(counterID, queueType, parkCurrent)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			if before.CurrentQueueID.Valid {
+				waitingCount, _ := h.db.GetWaitingCount()
+				h.hub.Publish(sse.AllCounters, "queue_updated", models.CounterUpdateData{
+					WaitingCount: waitingCount,
+					Timestamp:    time.Now(),
+				})
+				h.hub.Publish(sse.TopicDisplay, "queue_updated", nil)
+				h.broadcastServiceETA()
+				if before.CurrentQueue != nil {
+					h.notifyStatusPages(before.CurrentQueue.QueueType)
+				}
+			}
 			h.jsonError(w, "No waiting queue", http.StatusNotFound)
 			return
 		}
+		if err == database.ErrServiceNotAssigned {
+			h.jsonError(w, "Queue type is not assigned to this counter", http.StatusForbidden)
+			return
+		}
 		h.jsonError(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -613,7 +1465,8 @@ func (h *Handler) handleCallNext(w http.ResponseWriter, r *http.Request, counter
 	}
 
 	// Broadcast to display
-	h.hub.BroadcastDisplay("queue_called", models.QueueCalledData{
+	h.hub.Publish(sse.TopicDisplay, "queue_called", models.QueueCalledData{
+		CallID:        callID,
 		QueueNumber:   queue.QueueNumber,
 		CounterNumber: counter.CounterNumber,
 		CounterName:   counter.CounterName,
@@ -622,11 +1475,13 @@ func (h *Handler) handleCallNext(w http.ResponseWriter, r *http.Request, counter
 
 	// Broadcast to all counters
 	waitingCount, _ := h.db.GetWaitingCount()
-	h.hub.BroadcastAllCounters("queue_updated", models.CounterUpdateData{
+	h.hub.Publish(sse.AllCounters, "queue_updated", models.CounterUpdateData{
 		CurrentQueue: &queue.QueueNumber,
 		WaitingCount: waitingCount,
 		Timestamp:    time.Now(),
 	})
+	h.broadcastServiceETA()
+	h.notifyStatusPages(queue.QueueType)
 
 	h.jsonResponse(w, counter)
 
@@ -656,15 +1511,20 @@ func (h *Handler) handleRecall(w http.ResponseWriter, r *http.Request, counterID
 		return
 	}
 
-	h.db.AddCallHistory(queue.ID, counterID, models.ActionRecalled)
+	callID, err := h.db.RecallQueue(queue.ID, counterID)
+	if err != nil {
+		log.Printf("Failed to record recall: %v", err)
+	}
 
 	// Broadcast to display
-	h.hub.BroadcastDisplay("queue_called", models.QueueCalledData{
+	h.hub.Publish(sse.TopicDisplay, "queue_called", models.QueueCalledData{
+		CallID:        callID,
 		QueueNumber:   queue.QueueNumber,
 		CounterNumber: counter.CounterNumber,
 		CounterName:   counter.CounterName,
 		Timestamp:     time.Now(),
 	})
+	h.notifyStatusPages(queue.QueueType)
 
 	h.jsonResponse(w, counter)
 
@@ -696,10 +1556,14 @@ func (h *Handler) handleComplete(w http.ResponseWriter, r *http.Request, counter
 
 	// Broadcast update
 	waitingCount, _ := h.db.GetWaitingCount()
-	h.hub.BroadcastAllCounters("queue_updated", models.CounterUpdateData{
+	h.hub.Publish(sse.AllCounters, "queue_updated", models.CounterUpdateData{
 		WaitingCount: waitingCount,
 		Timestamp:    time.Now(),
 	})
+	h.broadcastServiceETA()
+	if queue != nil {
+		h.notifyStatusPages(queue.QueueType)
+	}
 
 	counter, _ = h.db.GetCounter(counterID)
 	h.jsonResponse(w, counter)
@@ -734,10 +1598,14 @@ func (h *Handler) handleCancel(w http.ResponseWriter, r *http.Request, counterID
 
 	// Broadcast update
 	waitingCount, _ := h.db.GetWaitingCount()
-	h.hub.BroadcastAllCounters("queue_updated", models.CounterUpdateData{
+	h.hub.Publish(sse.AllCounters, "queue_updated", models.CounterUpdateData{
 		WaitingCount: waitingCount,
 		Timestamp:    time.Now(),
 	})
+	h.broadcastServiceETA()
+	if queue != nil {
+		h.notifyStatusPages(queue.QueueType)
+	}
 
 	counter, _ = h.db.GetCounter(counterID)
 	h.jsonResponse(w, counter)
@@ -747,6 +1615,257 @@ func (h *Handler) handleCancel(w http.ResponseWriter, r *http.Request, counterID
 	}
 }
 
+// handleCounterServices lists (GET) or replaces (PUT) the queue types a
+// counter is assigned to serve.
+func (h *Handler) handleCounterServices(w http.ResponseWriter, r *http.Request, counterID int64) {
+	if _, err := h.db.GetCounter(counterID); err != nil {
+		h.jsonError(w, "Counter not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		services, err := h.db.ListCounterServices(counterID)
+		if err != nil {
+			h.jsonError(w, "Failed to list counter services", http.StatusInternalServerError)
+			return
+		}
+		if services == nil {
+			services = []*models.CounterService{}
+		}
+		h.jsonResponse(w, services)
+
+	case http.MethodPut:
+		var req []*models.CounterService
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.jsonError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		for _, cs := range req {
+			if _, err := h.db.GetQueueTypeByCode(cs.QueueType); err != nil {
+				h.jsonError(w, "Queue type not found: "+cs.QueueType, http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := h.db.SetCounterServices(counterID, req); err != nil {
+			log.Printf("Failed to set counter services: %v", err)
+			h.jsonError(w, "Failed to save counter services", http.StatusInternalServerError)
+			return
+		}
+
+		services, _ := h.db.ListCounterServices(counterID)
+		if services == nil {
+			services = []*models.CounterService{}
+		}
+		log.Printf("Counter %d services updated: %d type(s)", counterID, len(services))
+		h.jsonResponse(w, services)
+
+	default:
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePark removes a no-show from the counter. The queue can be brought
+// back with /api/queues/reactivate within the park window.
+func (h *Handler) handlePark(w http.ResponseWriter, r *http.Request, counterID int64) {
+	if r.Method != http.MethodPost {
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	counter, err := h.db.GetCounter(counterID)
+	if err != nil {
+		h.jsonError(w, "Counter not found", http.StatusNotFound)
+		return
+	}
+
+	if !counter.CurrentQueueID.Valid {
+		h.jsonError(w, "No current queue to park", http.StatusBadRequest)
+		return
+	}
+
+	queue, err := h.db.ParkCurrentQueue(counterID)
+	if err != nil {
+		h.jsonError(w, "Failed to park queue: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Broadcast update
+	waitingCount, _ := h.db.GetWaitingCount()
+	h.hub.Publish(sse.AllCounters, "queue_updated", models.CounterUpdateData{
+		WaitingCount: waitingCount,
+		Timestamp:    time.Now(),
+	})
+	h.hub.Publish(sse.TopicDisplay, "queue_updated", nil)
+	h.broadcastServiceETA()
+	h.notifyStatusPages(queue.QueueType)
+
+	counter, _ = h.db.GetCounter(counterID)
+	h.jsonResponse(w, map[string]interface{}{
+		"counter": counter,
+		"queue":   queue,
+	})
+
+	log.Printf("Queue %s %s at counter %s (recalls: %d)", queue.QueueNumber, queue.Status, counter.CounterName, queue.RecallCount)
+}
+
+// handleReactivateQueue brings a parked queue back to the head of its line
+// when the taxpayer finally shows up.
+func (h *Handler) handleReactivateQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		QueueID int64 `json:"queue_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.QueueID == 0 {
+		h.jsonError(w, "queue_id is required", http.StatusBadRequest)
+		return
+	}
+
+	queue, err := h.db.ReactivateQueue(req.QueueID)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			h.jsonError(w, "Queue not found", http.StatusNotFound)
+		case database.ErrQueueNotParked:
+			h.jsonError(w, "Queue is not parked", http.StatusConflict)
+		case database.ErrParkExpired:
+			h.jsonError(w, "Park window expired, queue has been cancelled", http.StatusGone)
+		default:
+			h.jsonError(w, "Failed to reactivate queue: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Broadcast update
+	waitingCount, _ := h.db.GetWaitingCount()
+	h.hub.Publish(sse.AllCounters, "queue_updated", models.CounterUpdateData{
+		WaitingCount: waitingCount,
+		Timestamp:    time.Now(),
+	})
+	h.hub.Publish(sse.TopicDisplay, "queue_updated", nil)
+	h.broadcastServiceETA()
+	h.notifyStatusPages(queue.QueueType)
+
+	h.jsonResponse(w, queue)
+
+	log.Printf("Queue %s reactivated (recalls: %d)", queue.QueueNumber, queue.RecallCount)
+}
+
+// handleTransfer moves the counter's current queue to another counter and/or
+// queue type instead of cancelling it, so the taxpayer keeps their number.
+func (h *Handler) handleTransfer(w http.ResponseWriter, r *http.Request, counterID int64) {
+	if r.Method != http.MethodPost {
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		CounterID *int64 `json:"counter_id,omitempty"`
+		QueueType string `json:"queue_type"`
+		Position  int    `json:"position"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.CounterID == nil && req.QueueType == "" {
+		h.jsonError(w, "counter_id or queue_type is required", http.StatusBadRequest)
+		return
+	}
+
+	counter, err := h.db.GetCounter(counterID)
+	if err != nil {
+		h.jsonError(w, "Counter not found", http.StatusNotFound)
+		return
+	}
+	if !counter.CurrentQueueID.Valid {
+		h.jsonError(w, "No current queue to transfer", http.StatusBadRequest)
+		return
+	}
+
+	var target *models.Counter
+	if req.CounterID != nil {
+		if *req.CounterID == counterID {
+			h.jsonError(w, "Cannot transfer to the same counter", http.StatusBadRequest)
+			return
+		}
+		target, err = h.db.GetCounter(*req.CounterID)
+		if err != nil {
+			h.jsonError(w, "Target counter not found", http.StatusNotFound)
+			return
+		}
+		if !target.IsActive {
+			h.jsonError(w, "Target counter is not active", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.QueueType != "" {
+		if _, err := h.db.GetQueueTypeByCode(req.QueueType); err != nil {
+			h.jsonError(w, "Queue type not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	position := req.Position
+	if position < 1 {
+		position = h.config.Queue.TransferPosition
+	}
+
+	queue, err := h.db.TransferQueue(counterID, req.CounterID, req.QueueType, position)
+	if err == database.ErrQueueNotCalled {
+		h.jsonError(w, "Current queue is no longer being served", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		h.jsonError(w, "Failed to transfer queue: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := models.QueueTransferredData{
+		QueueNumber:     queue.QueueNumber,
+		QueueType:       queue.QueueType,
+		FromCounterID:   counter.ID,
+		FromCounterName: counter.CounterName,
+		Timestamp:       time.Now(),
+	}
+	if target != nil {
+		data.ToCounterID = &target.ID
+		data.ToCounterName = target.CounterName
+	}
+
+	// Broadcast to display and both counters
+	h.hub.Publish(sse.TopicDisplay, "queue_transferred", data)
+	h.hub.Publish(sse.CounterTopic(counterID), "queue_transferred", data)
+	if target != nil {
+		h.hub.Publish(sse.CounterTopic(target.ID), "queue_transferred", data)
+	}
+
+	waitingCount, _ := h.db.GetWaitingCount()
+	h.hub.Publish(sse.AllCounters, "queue_updated", models.CounterUpdateData{
+		WaitingCount: waitingCount,
+		Timestamp:    time.Now(),
+	})
+	h.broadcastServiceETA()
+	h.notifyStatusPages("")
+	// Status pages of the ticket follow the line of its queue type;
+	// reconnecting subscribes them to the one it was moved to
+	h.hub.Disconnect(sse.TicketTopic(queue.QueueNumber))
+
+	counter, _ = h.db.GetCounter(counterID)
+	h.jsonResponse(w, counter)
+
+	if target != nil {
+		log.Printf("Queue %s transferred from %s to %s (type %s, position %d)", queue.QueueNumber, counter.CounterName, target.CounterName, queue.QueueType, position)
+	} else {
+		log.Printf("Queue %s transferred from %s to type %s (position %d)", queue.QueueNumber, counter.CounterName, queue.QueueType, position)
+	}
+}
+
 // Stats handler
 
 func (h *Handler) handleStats(w http.ResponseWriter, r *http.Request) {
@@ -755,16 +1874,52 @@ func (h *Handler) handleStats(w http.ResponseWriter, r *http.Request) {
 		h.jsonError(w, "Failed to get stats", http.StatusInternalServerError)
 		return
 	}
-	h.jsonResponse(w, stats)
+	h.jsonResponse(w, stats)
+}
+
+func (h *Handler) handleStatsByType(w http.ResponseWriter, r *http.Request) {
+	counts, err := h.db.GetWaitingCountByType()
+	if err != nil {
+		h.jsonError(w, "Failed to get stats by type", http.StatusInternalServerError)
+		return
+	}
+	h.jsonResponse(w, counts)
+}
+
+func (h *Handler) handleServiceETA(w http.ResponseWriter, r *http.Request) {
+	etas, err := h.db.EstimateServiceWaits()
+	if err != nil {
+		h.jsonError(w, "Failed to estimate waiting time", http.StatusInternalServerError)
+		return
+	}
+	if etas == nil {
+		etas = []*models.ServiceETA{}
+	}
+	h.jsonResponse(w, etas)
+}
+
+// displayRecentCalls is how many calls a display snapshot includes, enough
+// for the largest recent calls and history lists.
+const displayRecentCalls = 50
+
+// displaySnapshot is the state a display receives when it connects.
+func (h *Handler) displaySnapshot(version uint64) (interface{}, error) {
+	snapshot, err := h.db.GetDisplaySnapshot(displayRecentCalls)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Version = version
+	return snapshot, nil
 }
 
-func (h *Handler) handleStatsByType(w http.ResponseWriter, r *http.Request) {
-	counts, err := h.db.GetWaitingCountByType()
+// broadcastServiceETA pushes the estimated wait per queue type to displays
+func (h *Handler) broadcastServiceETA() {
+	etas, err := h.db.EstimateServiceWaits()
 	if err != nil {
-		h.jsonError(w, "Failed to get stats by type", http.StatusInternalServerError)
+		log.Printf("Failed to estimate service waits: %v", err)
 		return
 	}
-	h.jsonResponse(w, counts)
+	h.hub.Publish(sse.TopicDisplay, "eta_updated", etas)
 }
 
 // Settings API handler
@@ -781,6 +1936,8 @@ func (h *Handler) handleSettings(w http.ResponseWriter, r *http.Request) {
 				h.jsonError(w, "Failed to get settings", http.StatusInternalServerError)
 				return
 			}
+			// The logo is large and only needed by the admin page (asked by key)
+			delete(allSettings, "ticket_logo")
 			h.jsonResponse(w, allSettings)
 			return
 		}
@@ -810,7 +1967,7 @@ func (h *Handler) handleSettings(w http.ResponseWriter, r *http.Request) {
 		}
 		
 		// Broadcast setting update to display
-		h.hub.BroadcastDisplay("settings_updated", req)
+		h.hub.Publish(sse.TopicDisplay, "settings_updated", req)
 
 		h.jsonResponse(w, map[string]string{"status": "saved"})
 
@@ -838,7 +1995,7 @@ func (h *Handler) handleResetQueues(w http.ResponseWriter, r *http.Request) {
 
 	// Broadcast update ke semua client
 	waitingCount, _ := h.db.GetWaitingCount()
-	h.hub.BroadcastAllCounters("queue_reset", models.CounterUpdateData{
+	h.hub.Publish(sse.AllCounters, "queue_reset", models.CounterUpdateData{
 		WaitingCount: waitingCount,
 		Timestamp:    time.Now(),
 	})
@@ -848,6 +2005,8 @@ func (h *Handler) handleResetQueues(w http.ResponseWriter, r *http.Request) {
 		message = fmt.Sprintf("%d antrian tipe %s hari ini berhasil direset", affected, queueType)
 	}
 
+	h.notifyStatusPages(queueType)
+
 	log.Printf("Reset queues today: type=%s, affected=%d", queueType, affected)
 	h.jsonResponse(w, map[string]interface{}{
 		"status":   "success",
@@ -856,6 +2015,48 @@ func (h *Handler) handleResetQueues(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleTicketLogo uploads (POST, multipart field "logo") or removes
+// (DELETE) the PNG logo printed on top of tickets.
+func (h *Handler) handleTicketLogo(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, 2<<20)
+		file, _, err := r.FormFile("logo")
+		if err != nil {
+			h.jsonError(w, "Logo file is required (max 2 MB)", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		logo, err := printer.PrepareLogo(file)
+		if errors.Is(err, printer.ErrLogoTooLarge) {
+			h.jsonError(w, "Logo image is too large (max 4096x4096 pixels)", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			h.jsonError(w, "Logo must be a PNG image", http.StatusBadRequest)
+			return
+		}
+		if err := h.db.SetSetting("ticket_logo", logo); err != nil {
+			h.jsonError(w, "Failed to save logo", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Ticket logo updated (%d bytes)", len(logo))
+		h.jsonResponse(w, map[string]string{"status": "saved", "logo": logo})
+
+	case http.MethodDelete:
+		if err := h.db.SetSetting("ticket_logo", ""); err != nil {
+			h.jsonError(w, "Failed to remove logo", http.StatusInternalServerError)
+			return
+		}
+		h.jsonResponse(w, map[string]string{"status": "deleted"})
+
+	default:
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // Admin handler - Reset semua loket
 func (h *Handler) handleResetCounters(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -871,7 +2072,7 @@ func (h *Handler) handleResetCounters(w http.ResponseWriter, r *http.Request) {
 
 	// Broadcast update ke semua counter client
 	waitingCount, _ := h.db.GetWaitingCount()
-	h.hub.BroadcastAllCounters("queue_reset", models.CounterUpdateData{
+	h.hub.Publish(sse.AllCounters, "queue_reset", models.CounterUpdateData{
 		WaitingCount: waitingCount,
 		Timestamp:    time.Now(),
 	})
@@ -985,6 +2186,26 @@ func (h *Handler) handleDisplaySSE(w http.ResponseWriter, r *http.Request) {
 	h.hub.ServeDisplaySSE(w, r)
 }
 
+func (h *Handler) handleStatusSSE(w http.ResponseWriter, r *http.Request) {
+	number := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/api/sse/status/"))
+	queue, err := h.db.GetQueueByNumber(number)
+	if err != nil {
+		http.Error(w, "Queue not found", http.StatusNotFound)
+		return
+	}
+	h.hub.ServeStatusSSE(w, r, queue.QueueType, queue.QueueNumber)
+}
+
+func (h *Handler) handleAdminSSE(w http.ResponseWriter, r *http.Request) {
+	h.hub.ServeAdminSSE(w, r)
+}
+
+// handleSSEClients lists the connected SSE clients with their event counters
+// and lag, to find displays or agents on a poor connection.
+func (h *Handler) handleSSEClients(w http.ResponseWriter, r *http.Request) {
+	h.jsonResponse(w, h.hub.Clients())
+}
+
 func (h *Handler) handleCounterSSE(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/api/sse/counter/")
 	id, err := strconv.ParseInt(idStr, 10, 64)
@@ -1007,6 +2228,10 @@ func (h *Handler) handlePrintTicket(w http.ResponseWriter, r *http.Request) {
 		QueueNumber string `json:"queue_number"`
 		TypeName    string `json:"type_name"`
 		DateTime    string `json:"date_time"`
+		// Remote printing target: the agent at this kiosk or a printer
+		// group; empty sends the ticket to any agent
+		AgentID      string `json:"agent_id"`
+		PrinterGroup string `json:"printer_group"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -1024,7 +2249,22 @@ func (h *Handler) handlePrintTicket(w http.ResponseWriter, r *http.Request) {
 		req.TypeName = "Umum"
 	}
 	if req.DateTime == "" {
-		req.DateTime = time.Now().Format("02/01/2006, 15:04:05")
+		req.DateTime = time.Now().Format(ticketTimeFormat)
+	}
+	req.AgentID, req.PrinterGroup = strings.TrimSpace(req.AgentID), strings.TrimSpace(req.PrinterGroup)
+	if h.config.Printer.RemoteEnabled {
+		if msg := h.checkPrintTarget(req.AgentID, req.PrinterGroup); msg != "" {
+			h.jsonError(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The estimated wait is printed for tickets still waiting in line
+	eta := ""
+	if queue, err := h.db.GetQueueByNumber(req.QueueNumber); err == nil {
+		if est, err := h.db.EstimateQueueWait(queue.ID); err == nil && est.Status == models.StatusWaiting {
+			eta = printer.FormatWait(est.WaitMinutes)
+		}
 	}
 
 	// Load ticket template from settings
@@ -1039,6 +2279,7 @@ func (h *Handler) handlePrintTicket(w http.ResponseWriter, r *http.Request) {
 			QueueNumber: req.QueueNumber,
 			TypeName:    req.TypeName,
 			DateTime:    req.DateTime,
+			ETA:         eta,
 		}, tmpl)
 		if err != nil {
 			log.Printf("Local print error: %v", err)
@@ -1053,14 +2294,12 @@ func (h *Handler) handlePrintTicket(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Printf("Failed to marshal template: %v", err)
 		} else {
-			job, err := h.db.CreatePrintJob(req.QueueNumber, req.TypeName, req.DateTime, string(templateJSON))
+			job, err := h.db.CreatePrintJob(req.QueueNumber, req.TypeName, req.DateTime, eta, string(templateJSON),
+				req.AgentID, req.PrinterGroup)
 			if err != nil {
 				log.Printf("Failed to create print job: %v", err)
 			} else {
-				h.hub.BroadcastPrinters("print_job", map[string]interface{}{
-					"job_id":       job.ID,
-					"queue_number": job.QueueNumber,
-				})
+				h.dispatchPrintJob(job)
 				remoteSent = true
 				log.Printf("Print job #%d created for remote agents: %s", job.ID, req.QueueNumber)
 			}
@@ -1121,6 +2360,32 @@ func (h *Handler) loadTicketTemplate() printer.TicketTemplate {
 	if val, _ := h.db.GetSetting("ticket_show_thanks"); val == "false" {
 		template.ShowThanks = false
 	}
+	if val, _ := h.db.GetSetting("ticket_show_eta"); val == "false" {
+		template.ShowETA = false
+	}
+
+	if val, _ := h.db.GetSetting("ticket_show_logo"); val == "false" {
+		template.ShowLogo = false
+	}
+	if template.ShowLogo {
+		template.Logo, _ = h.db.GetSetting("ticket_logo")
+	}
+
+	// QR code / barcode (default off)
+	if val, _ := h.db.GetSetting("ticket_show_qr"); val == "true" {
+		template.ShowQR = true
+	}
+	if val, _ := h.db.GetSetting("ticket_show_barcode"); val == "true" {
+		template.ShowBarcode = true
+	}
+	if val, _ := h.db.GetSetting("ticket_qr_content"); val == printer.QRContentURL || val == printer.QRContentID {
+		template.QRContent = val
+	}
+	// Status URLs point at this server unless another address is configured
+	template.QRBaseURL = "http://" + getServerAddr(h.config.Server.Port)
+	if val, _ := h.db.GetSetting("ticket_qr_base_url"); val != "" {
+		template.QRBaseURL = val
+	}
 
 	// Paper / hardware settings
 	if val, _ := h.db.GetSetting("printer_paper_size"); val == "58mm" || val == "80mm" {
@@ -1155,23 +2420,269 @@ func (h *Handler) handlePrinterTest(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) handlePrinterStatus(w http.ResponseWriter, r *http.Request) {
-	h.jsonResponse(w, map[string]interface{}{
+	resp := map[string]interface{}{
 		"enabled":        h.printer.IsEnabled(),
 		"printer_name":   h.printer.GetPrinterName(),
+		"transport":      h.config.Printer.Transport,
 		"remote_enabled": h.config.Printer.RemoteEnabled,
-		"agents_online":  h.hub.GetPrinterClientCount(),
-	})
+		"agents_online":  h.hub.Subscribers(sse.AllPrinters),
+	}
+	// Hardware status of the local printer on transports that can read it
+	if h.printer.IsEnabled() {
+		if status, err := h.printer.QueryStatus(); err == nil {
+			resp["printer_status"] = status.Code()
+		}
+	}
+	h.jsonResponse(w, resp)
+}
+
+// handlePrinterPreview renders a sample ticket as a PNG exactly as the
+// printer would receive it. GET uses the saved template; POST overlays the
+// template fields in the JSON body so unsaved admin edits can be previewed.
+func (h *Handler) handlePrinterPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tmpl := h.loadTicketTemplate()
+	if r.Method == http.MethodPost && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&tmpl); err != nil {
+			h.jsonError(w, "Invalid template", http.StatusBadRequest)
+			return
+		}
+	}
+	if paper := r.URL.Query().Get("paper_size"); paper == printer.Paper58mm || paper == printer.Paper80mm {
+		tmpl.PaperSize = paper
+	}
+
+	data := printer.TicketData{
+		QueueNumber: "A001",
+		TypeName:    "Umum",
+		DateTime:    time.Now().Format("02/01/2006, 15:04:05"),
+		ETA:         printer.FormatWait(15),
+	}
+	if val := r.URL.Query().Get("queue_number"); val != "" {
+		data.QueueNumber = val
+	}
+	if val := r.URL.Query().Get("type_name"); val != "" {
+		data.TypeName = val
+	}
+
+	var buf bytes.Buffer
+	if err := printer.RenderPNG(&buf, printer.BuildTicket(data, tmpl), tmpl.PaperSize); err != nil {
+		log.Printf("Ticket preview error: %v", err)
+		h.jsonError(w, "Failed to render preview", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
 }
 
 // Print Agent handlers (remote printing)
 
+// currentAgent returns the registered print agent whose API key the request
+// carries as a bearer token, or nil.
+func (h *Handler) currentAgent(r *http.Request) *models.PrintAgent {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || key == "" {
+		return nil
+	}
+	agent, err := h.db.GetPrintAgentByKey(hashToken(key))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to load print agent: %v", err)
+		}
+		return nil
+	}
+	h.db.TouchPrintAgent(agent.ID)
+	return agent
+}
+
+// checkPrintTarget returns why a print target sent by a kiosk cannot be
+// used, or "" when it names registered, active agents (or none).
+func (h *Handler) checkPrintTarget(agentID, group string) string {
+	if agentID != "" {
+		agent, err := h.db.GetPrintAgentByAgentID(agentID)
+		if err != nil || !agent.IsActive {
+			return "Unknown print agent: " + agentID
+		}
+	}
+	if group != "" {
+		if ok, err := h.db.PrintGroupExists(group); err != nil || !ok {
+			return "Unknown printer group: " + group
+		}
+	}
+	return ""
+}
+
+// dispatchPrintJob announces a pending job to the agents that may print it.
+// When its target agent or group has no agent online, the target_fallback
+// policy may widen the job to the target agent's printer group or to any
+// agent; otherwise the job waits and the target picks it up from the
+// pending list when it reconnects. SweepPrintJobs applies the policy again
+// while the job waits.
+func (h *Handler) dispatchPrintJob(job *models.PrintJob) {
+	agentID, group := h.retargetPrintJob(job)
+	h.hub.Publish(sse.PrinterTopic(agentID, group), "print_job", map[string]interface{}{
+		"job_id":       job.ID,
+		"queue_number": job.QueueNumber,
+	})
+}
+
+// retargetPrintJob applies the target_fallback policy to a job whose target
+// is offline and returns the agent ID and group it is now meant for.
+func (h *Handler) retargetPrintJob(job *models.PrintJob) (string, string) {
+	agentID, group := job.TargetAgent, job.TargetGroup
+	policy := h.config.Printer.TargetFallback
+
+	if (agentID != "" || group != "") && !h.hub.PrinterOnline(agentID, group) && policy != config.TargetFallbackWait {
+		// The offline agent's own printer group is the nearest fallback
+		if agentID != "" {
+			agent, err := h.db.GetPrintAgentByAgentID(agentID)
+			if err == nil && agent.Group != "" && h.hub.PrinterOnline("", agent.Group) {
+				agentID, group = "", agent.Group
+			}
+		}
+		if policy == config.TargetFallbackAny && !h.hub.PrinterOnline(agentID, group) {
+			agentID, group = "", ""
+		}
+
+		if agentID != job.TargetAgent || group != job.TargetGroup {
+			if err := h.db.SetPrintJobTarget(job.ID, agentID, group); err != nil {
+				log.Printf("Failed to retarget print job #%d: %v", job.ID, err)
+				agentID, group = job.TargetAgent, job.TargetGroup
+			} else {
+				log.Printf("Print job #%d: target (agent %q, group %q) offline, falling back to (agent %q, group %q)",
+					job.ID, job.TargetAgent, job.TargetGroup, agentID, group)
+			}
+		}
+	}
+	return agentID, group
+}
+
+// printAgentStaleSeconds is how long an agent may go without a request,
+// about two of its 30 second status reports, before its event stream is
+// considered dead.
+const printAgentStaleSeconds = 75
+
+// SweepPrintAgents closes the event streams of agents that stopped
+// reporting, e.g. a half-open connection after a kiosk lost its network,
+// so they show offline and their jobs fall back to other agents. Called
+// periodically from main.
+func (h *Handler) SweepPrintAgents() {
+	agentIDs, err := h.db.ListStalePrintAgents(printAgentStaleSeconds)
+	if err != nil {
+		log.Printf("Failed to list stale print agents: %v", err)
+		return
+	}
+	for _, agentID := range agentIDs {
+		if h.hub.PrinterOnline(agentID, "") {
+			log.Printf("Print agent %s sent no report for %d seconds, closing its stream", agentID, printAgentStaleSeconds)
+			h.hub.Disconnect(sse.PrinterTopic(agentID, ""))
+		}
+	}
+}
+
+// SweepPrintJobs returns jobs whose agent stopped sending heartbeats to the
+// pending list and announces them again; jobs out of attempts are marked
+// failed. Pending jobs whose target is offline are retargeted by the
+// fallback policy, and marked failed once they waited longer than
+// target_wait_seconds. Called periodically from main.
+func (h *Handler) SweepPrintJobs() {
+	maxAttempts := h.config.Printer.JobMaxAttempts()
+	requeued, failed, err := h.db.RequeueExpiredPrintJobs(maxAttempts)
+	if err != nil {
+		log.Printf("Failed to requeue expired print jobs: %v", err)
+		return
+	}
+	for _, job := range requeued {
+		log.Printf("Print job #%d lease expired, requeued (attempt %d)", job.ID, job.Attempts)
+		h.dispatchPrintJob(job)
+	}
+	if failed > 0 {
+		log.Printf("Marked %d print jobs failed after %d attempts", failed, maxAttempts)
+	}
+
+	waiting, err := h.db.ListTargetedPendingPrintJobs()
+	if err != nil {
+		log.Printf("Failed to list targeted print jobs: %v", err)
+		return
+	}
+	maxWait := h.config.Printer.JobTargetWaitSeconds()
+	for _, job := range waiting {
+		if h.hub.PrinterOnline(job.TargetAgent, job.TargetGroup) {
+			continue
+		}
+		agentID, group := h.retargetPrintJob(job)
+		if agentID != job.TargetAgent || group != job.TargetGroup {
+			h.hub.Publish(sse.PrinterTopic(agentID, group), "print_job", map[string]interface{}{
+				"job_id":       job.ID,
+				"queue_number": job.QueueNumber,
+			})
+			continue
+		}
+		msg := fmt.Sprintf("No agent of target (agent %q, group %q) online for %d seconds", agentID, group, maxWait)
+		if err := h.db.ExpirePendingPrintJob(job.ID, maxWait, msg); err == nil {
+			log.Printf("Print job #%d failed: %s", job.ID, msg)
+		}
+	}
+}
+
 func (h *Handler) handlePrintAgentSSE(w http.ResponseWriter, r *http.Request) {
-	agentID := r.URL.Query().Get("agent_id")
-	if agentID == "" {
-		http.Error(w, "agent_id is required", http.StatusBadRequest)
+	agent := requestAgent(r)
+	if agent == nil {
+		h.jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// The agent ID comes from the API key; a different one in the query is
+	// an agent configured with someone else's key
+	if id := r.URL.Query().Get("agent_id"); id != "" && id != agent.AgentID {
+		h.jsonError(w, "agent_id does not match the API key", http.StatusForbidden)
+		return
+	}
+	h.hub.ServePrinterSSE(w, r, agent.AgentID, agent.Group)
+}
+
+// handlePrintAgentStatus stores the health report an agent sends when it
+// connects and periodically while it runs.
+func (h *Handler) handlePrintAgentStatus(w http.ResponseWriter, r *http.Request) {
+	agent := requestAgent(r)
+	if agent == nil {
+		h.jsonError(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	h.hub.ServePrinterSSE(w, r, agentID)
+
+	var status models.PrintAgentStatus
+	if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+		h.jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := h.db.SetPrintAgentStatus(agent.ID, status); err != nil {
+		log.Printf("Failed to store print agent status: %v", err)
+		h.jsonError(w, "Failed to store status", http.StatusInternalServerError)
+		return
+	}
+	if status.LastError != agent.LastError && status.LastError != "" {
+		log.Printf("Print agent %s reports error: %s", agent.AgentID, status.LastError)
+	}
+	// Alert admins once per change, e.g. when paper runs low, so the roll
+	// is replaced before the kiosk stops printing
+	if status.PrinterStatus != agent.PrinterStatus && status.PrinterStatus != "" && status.PrinterStatus != printer.StatusOK {
+		log.Printf("Print agent %s printer status: %s", agent.AgentID, status.PrinterStatus)
+		h.hub.Publish(sse.TopicAdmin, "print_agent_alert", map[string]string{
+			"agent_id":       agent.AgentID,
+			"name":           agent.Name,
+			"printer_status": status.PrinterStatus,
+		})
+	}
+
+	agent.PrintAgentStatus = status
+	agent.Online = h.hub.PrinterOnline(agent.AgentID, "")
+	h.hub.Publish(sse.TopicAdmin, "print_agent_status", agent)
+	h.jsonResponse(w, map[string]string{"status": "ok"})
 }
 
 func (h *Handler) handlePendingPrintJobs(w http.ResponseWriter, r *http.Request) {
@@ -1180,7 +2691,13 @@ func (h *Handler) handlePendingPrintJobs(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	jobs, err := h.db.ListPendingPrintJobs()
+	agent := requestAgent(r)
+	if agent == nil {
+		h.jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	jobs, err := h.db.ListPendingPrintJobs(agent.AgentID, agent.Group)
 	if err != nil {
 		h.jsonError(w, "Failed to list pending jobs", http.StatusInternalServerError)
 		return
@@ -1205,7 +2722,7 @@ func (h *Handler) handlePrintJobSummary(w http.ResponseWriter, r *http.Request)
 	h.jsonResponse(w, map[string]interface{}{
 		"pending":        pending,
 		"failed":         failed,
-		"agents_online":  h.hub.GetPrinterClientCount(),
+		"agents_online":  h.hub.Subscribers(sse.AllPrinters),
 		"remote_enabled": h.config.Printer.RemoteEnabled,
 	})
 }
@@ -1228,10 +2745,7 @@ func (h *Handler) handleRetryFailedJobs(w http.ResponseWriter, r *http.Request)
 			log.Printf("Failed to retry print job #%d: %v", job.ID, err)
 			continue
 		}
-		h.hub.BroadcastPrinters("print_job", map[string]interface{}{
-			"job_id":       job.ID,
-			"queue_number": job.QueueNumber,
-		})
+		h.dispatchPrintJob(job)
 		count++
 	}
 
@@ -1260,38 +2774,70 @@ func (h *Handler) handlePrintJobAPI(w http.ResponseWriter, r *http.Request) {
 		action = parts[1]
 	}
 
+	agent := requestAgent(r)
+	if agent == nil {
+		h.jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	switch action {
 	case "claim":
 		if r.Method != http.MethodPost {
 			h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		// agent_id is optional; the API key identifies the agent
 		var req struct {
 			AgentID string `json:"agent_id"`
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AgentID == "" {
-			h.jsonError(w, "agent_id is required", http.StatusBadRequest)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			h.jsonError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.AgentID != "" && req.AgentID != agent.AgentID {
+			h.jsonError(w, "agent_id does not match the API key", http.StatusForbidden)
 			return
 		}
 
-		job, err := h.db.ClaimPrintJob(jobID, req.AgentID)
+		job, err := h.db.ClaimPrintJob(jobID, agent.AgentID, agent.Group, h.config.Printer.JobLeaseSeconds())
 		if err != nil {
 			h.jsonError(w, "Failed to claim job (already claimed or not found)", http.StatusConflict)
 			return
 		}
-		log.Printf("Print job #%d claimed by agent %s", jobID, req.AgentID)
+		log.Printf("Print job #%d claimed by agent %s", jobID, agent.AgentID)
 		h.jsonResponse(w, job)
 
+	case "heartbeat":
+		// The agent is still printing; extend its lease so the job is not
+		// handed to another agent
+		if r.Method != http.MethodPost {
+			h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := h.db.HeartbeatPrintJob(jobID, agent.AgentID, h.config.Printer.JobLeaseSeconds()); err != nil {
+			if err == sql.ErrNoRows {
+				h.jsonError(w, "Job is not being printed by this agent", http.StatusConflict)
+				return
+			}
+			h.jsonError(w, "Failed to extend lease", http.StatusInternalServerError)
+			return
+		}
+		h.jsonResponse(w, map[string]string{"status": "printing"})
+
 	case "complete":
 		if r.Method != http.MethodPost {
 			h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		if err := h.db.CompletePrintJob(jobID); err != nil {
+		if err := h.db.CompletePrintJob(jobID, agent.AgentID); err != nil {
+			if err == sql.ErrNoRows {
+				h.jsonError(w, "Job is not being printed by this agent", http.StatusConflict)
+				return
+			}
 			h.jsonError(w, "Failed to complete job", http.StatusInternalServerError)
 			return
 		}
-		log.Printf("Print job #%d completed", jobID)
+		log.Printf("Print job #%d completed by agent %s", jobID, agent.AgentID)
 		h.jsonResponse(w, map[string]string{"status": "completed"})
 
 	case "fail":
@@ -1303,11 +2849,15 @@ func (h *Handler) handlePrintJobAPI(w http.ResponseWriter, r *http.Request) {
 			Error string `json:"error"`
 		}
 		json.NewDecoder(r.Body).Decode(&req)
-		if err := h.db.FailPrintJob(jobID, req.Error); err != nil {
+		if err := h.db.FailPrintJob(jobID, agent.AgentID, req.Error); err != nil {
+			if err == sql.ErrNoRows {
+				h.jsonError(w, "Job is not being printed by this agent", http.StatusConflict)
+				return
+			}
 			h.jsonError(w, "Failed to update job", http.StatusInternalServerError)
 			return
 		}
-		log.Printf("Print job #%d failed: %s", jobID, req.Error)
+		log.Printf("Print job #%d failed on agent %s: %s", jobID, agent.AgentID, req.Error)
 		h.jsonResponse(w, map[string]string{"status": "failed"})
 
 	default:
@@ -1325,6 +2875,167 @@ func (h *Handler) handlePrintJobAPI(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Print agent registration (admin)
+
+// handlePrintAgents lists registered print agents (GET) or registers one
+// (POST). The API key is only returned here, at registration.
+func (h *Handler) handlePrintAgents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		agents, err := h.db.ListPrintAgents()
+		if err != nil {
+			h.jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if agents == nil {
+			agents = []*models.PrintAgent{}
+		}
+		for _, agent := range agents {
+			agent.Online = h.hub.PrinterOnline(agent.AgentID, "")
+		}
+		h.jsonResponse(w, agents)
+
+	case http.MethodPost:
+		var req struct {
+			AgentID string `json:"agent_id"`
+			Name    string `json:"name"`
+			Group   string `json:"printer_group"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.jsonError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.AgentID, req.Group = strings.TrimSpace(req.AgentID), strings.TrimSpace(req.Group)
+		// ':' and '*' would let the agent's topic match other agents' jobs
+		if req.AgentID == "" || strings.ContainsAny(req.AgentID, " /?&:*") {
+			h.jsonError(w, "agent_id is required and may not contain spaces, '/', '?', '&', ':' or '*'", http.StatusBadRequest)
+			return
+		}
+		if strings.ContainsAny(req.Group, ":*") {
+			h.jsonError(w, "printer_group may not contain ':' or '*'", http.StatusBadRequest)
+			return
+		}
+		if _, err := h.db.GetPrintAgentByAgentID(req.AgentID); err == nil {
+			h.jsonError(w, "Agent ID already exists", http.StatusConflict)
+			return
+		}
+
+		key := h.generateToken()
+		agent, err := h.db.CreatePrintAgent(req.AgentID, strings.TrimSpace(req.Name), req.Group, hashToken(key))
+		if err != nil {
+			log.Printf("Failed to register print agent: %v", err)
+			h.jsonError(w, "Failed to register print agent", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Print agent registered: %s", agent.AgentID)
+		h.jsonResponse(w, map[string]interface{}{
+			"agent":   agent,
+			"api_key": key,
+		})
+
+	default:
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePrintAgentAPI returns (GET), updates (PUT) or removes (DELETE) a
+// registered agent. PUT with "rotate_key" issues a new API key and
+// invalidates the old one.
+func (h *Handler) handlePrintAgentAPI(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/print-agents/"), 10, 64)
+	if err != nil {
+		h.jsonError(w, "Invalid agent ID", http.StatusBadRequest)
+		return
+	}
+
+	agent, err := h.db.GetPrintAgent(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			h.jsonError(w, "Print agent not found", http.StatusNotFound)
+			return
+		}
+		h.jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		agent.Online = h.hub.PrinterOnline(agent.AgentID, "")
+		h.jsonResponse(w, agent)
+
+	case http.MethodPut:
+		var req struct {
+			Name      *string `json:"name,omitempty"`
+			Group     *string `json:"printer_group,omitempty"`
+			IsActive  *bool   `json:"is_active,omitempty"`
+			RotateKey bool    `json:"rotate_key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.jsonError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		name, group, isActive := agent.Name, agent.Group, agent.IsActive
+		if req.Name != nil {
+			name = strings.TrimSpace(*req.Name)
+		}
+		if req.Group != nil {
+			group = strings.TrimSpace(*req.Group)
+			if strings.ContainsAny(group, ":*") {
+				h.jsonError(w, "printer_group may not contain ':' or '*'", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.IsActive != nil {
+			isActive = *req.IsActive
+		}
+		if err := h.db.UpdatePrintAgent(id, name, group, isActive); err != nil {
+			log.Printf("Failed to update print agent: %v", err)
+			h.jsonError(w, "Failed to update print agent", http.StatusInternalServerError)
+			return
+		}
+
+		resp := map[string]interface{}{}
+		if req.RotateKey {
+			key := h.generateToken()
+			if err := h.db.SetPrintAgentKey(id, hashToken(key)); err != nil {
+				log.Printf("Failed to rotate print agent key: %v", err)
+				h.jsonError(w, "Failed to rotate API key", http.StatusInternalServerError)
+				return
+			}
+			resp["api_key"] = key
+		}
+		// A revoked key must not keep receiving jobs over an open stream,
+		// and a moved agent reconnects to receive its new group's jobs
+		if !isActive || req.RotateKey || group != agent.Group {
+			h.hub.Disconnect(sse.PrinterTopic(agent.AgentID, ""))
+		}
+
+		agent, err = h.db.GetPrintAgent(id)
+		if err != nil {
+			h.jsonError(w, "Failed to get updated print agent", http.StatusInternalServerError)
+			return
+		}
+		resp["agent"] = agent
+		log.Printf("Print agent updated: %s (active=%v, key rotated=%v)", agent.AgentID, agent.IsActive, req.RotateKey)
+		h.jsonResponse(w, resp)
+
+	case http.MethodDelete:
+		if err := h.db.DeletePrintAgent(id); err != nil {
+			log.Printf("Failed to delete print agent: %v", err)
+			h.jsonError(w, "Failed to delete print agent", http.StatusInternalServerError)
+			return
+		}
+		h.hub.Disconnect(sse.PrinterTopic(agent.AgentID, ""))
+		log.Printf("Print agent deleted: %s", agent.AgentID)
+		h.jsonResponse(w, map[string]string{"status": "deleted"})
+
+	default:
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // Audio voices handler — lists available voice subdirectories under web/static/audio/
 func (h *Handler) handleAudioVoices(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
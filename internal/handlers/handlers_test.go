@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"queue-system/internal/config"
+	"queue-system/internal/database"
+	"queue-system/internal/sse"
+)
+
+// newTestHandler serves the API routes over an in-memory database. Pages and
+// static files are not available.
+func newTestHandler(t *testing.T) (*Handler, http.Handler) {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.Database.Path = ":memory:"
+	cfg.Database.MaxOpenConns = 1
+	cfg.Security.AdminPassword = ""
+	db, err := database.New(cfg)
+	if err != nil {
+		t.Fatalf("database.New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	h := &Handler{db: db, hub: sse.NewHub(cfg.SSE), config: cfg}
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+	return h, mux
+}
+
+// registerAgent registers a print agent and returns its API key.
+func registerAgent(t *testing.T, h *Handler, agentID string) string {
+	t.Helper()
+	key := "key-" + agentID
+	if _, err := h.db.CreatePrintAgent(agentID, agentID, "", hashToken(key)); err != nil {
+		t.Fatalf("CreatePrintAgent: %v", err)
+	}
+	return key
+}
+
+// agentPost sends an agent's report on a job and returns the status code.
+func agentPost(t *testing.T, mux http.Handler, key string, jobID int64, action string) int {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/print-agent/job/"+strconv.FormatInt(jobID, 10)+"/"+action, strings.NewReader(`{}`))
+	r.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w.Code
+}
+
+// An agent whose lease expired while it was out of touch gets a conflict
+// when it reports on the job, which by then belongs to another agent.
+func TestStalePrintJobReport(t *testing.T) {
+	h, mux := newTestHandler(t)
+	slow, other := registerAgent(t, h, "k1"), registerAgent(t, h, "k2")
+	job, err := h.db.CreatePrintJob("A001", "Umum", "", "", "{}", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := agentPost(t, mux, slow, job.ID, "claim"); code != http.StatusOK {
+		t.Fatalf("claim: status %d", code)
+	}
+	if code := agentPost(t, mux, other, job.ID, "complete"); code != http.StatusConflict {
+		t.Fatalf("complete by an agent that did not claim the job: status %d, want 409", code)
+	}
+
+	if _, err := h.db.Exec(`UPDATE print_jobs SET lease_expires_at = datetime('now', 'localtime', '-1 seconds') WHERE id = ?`, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	h.SweepPrintJobs()
+
+	if code := agentPost(t, mux, other, job.ID, "claim"); code != http.StatusOK {
+		t.Fatalf("claim of the requeued job: status %d", code)
+	}
+	for _, action := range []string{"heartbeat", "complete", "fail"} {
+		if code := agentPost(t, mux, slow, job.ID, action); code != http.StatusConflict {
+			t.Fatalf("stale %s: status %d, want 409", action, code)
+		}
+	}
+	if code := agentPost(t, mux, other, job.ID, "complete"); code != http.StatusOK {
+		t.Fatalf("complete by the new holder: status %d", code)
+	}
+}
+
+// A remote ticket's job is created with its ETA, before an agent can claim
+// it.
+func TestKioskTicketJobHasETA(t *testing.T) {
+	h, mux := newTestHandler(t)
+	h.config.Printer.RemoteEnabled = true
+	h.config.Printer.Enabled = false
+
+	r := httptest.NewRequest(http.MethodPost, "/api/kiosk/ticket", strings.NewReader(`{"type":"general"}`))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("kiosk ticket: status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Ticket struct {
+			ETA string `json:"eta"`
+		} `json:"ticket"`
+		Print struct {
+			JobID int64 `json:"job_id"`
+		} `json:"print"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := h.db.GetPrintJob(resp.Print.JobID)
+	if err != nil {
+		t.Fatalf("GetPrintJob: %v", err)
+	}
+	if job.Status != "pending" || job.ETA == "" || job.ETA != resp.Ticket.ETA {
+		t.Errorf("job %s with ETA %q, want a pending job with the ticket's ETA %q", job.Status, job.ETA, resp.Ticket.ETA)
+	}
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"queue-system/internal/sse"
+	"queue-system/internal/ws"
+)
+
+// counterCommands are the counter actions accepted over the counter
+// WebSocket; each runs the same handler as POST /api/counter/{id}/{action}.
+var counterCommands = map[string]bool{
+	"call-next": true,
+	"recall":    true,
+	"complete":  true,
+	"cancel":    true,
+	"park":      true,
+	"transfer":  true,
+}
+
+// counterCommand is a message from a counter client, e.g.
+// {"id": "7", "command": "call-next", "query": {"type": "A"}}.
+type counterCommand struct {
+	ID      string            `json:"id"` // echoed in the acknowledgement
+	Command string            `json:"command"`
+	Query   map[string]string `json:"query"` // query parameters of the REST action
+	Data    json.RawMessage   `json:"data"`  // request body of the REST action, e.g. transfer
+}
+
+// commandAck is the result of a counter command: the status and body the
+// REST action would have returned.
+type commandAck struct {
+	Type      string          `json:"type"` // always "ack"
+	RequestID string          `json:"request_id"`
+	OK        bool            `json:"ok"`
+	Status    int             `json:"status"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// handleCounterWebSocket carries a counter's hub events downstream, like
+// /api/sse/counter/{id}, and its commands upstream, each acknowledged with
+// the command's result.
+func (h *Handler) handleCounterWebSocket(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/api/ws/counter/")
+	counterID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid counter ID", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := ws.Upgrade(w, r)
+	if err != nil {
+		log.Printf("Counter %d WebSocket refused: %v", counterID, err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	go func() {
+		defer cancel()
+		for {
+			message, err := conn.ReadMessage()
+			if err != nil {
+				if !errors.Is(err, ws.ErrClosed) && !errors.Is(err, io.EOF) {
+					log.Printf("Counter %d WebSocket read error: %v", counterID, err)
+				}
+				return
+			}
+			ack := h.runCounterCommand(ctx, r, counterID, message)
+			data, _ := json.Marshal(ack)
+			if err := conn.WriteText(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	client := sse.NewClient(r, sse.ClientTypeCounter, sse.CounterTopic(counterID))
+	if err := h.hub.Listen(ctx, client, sse.LastEventID(r), wsWriter{conn}); err != nil {
+		log.Printf("Counter %d WebSocket write error: %v", counterID, err)
+	}
+}
+
+// runCounterCommand runs a command through the route's access check and
+// REST handler, with the session cookie of the WebSocket's upgrade request,
+// so a command behaves exactly like the POST it replaces.
+func (h *Handler) runCounterCommand(ctx context.Context, upgrade *http.Request, counterID int64, message []byte) commandAck {
+	var cmd counterCommand
+	if err := json.Unmarshal(message, &cmd); err != nil {
+		return commandAck{Type: "ack", Status: http.StatusBadRequest, Error: "Invalid command"}
+	}
+	ack := commandAck{Type: "ack", RequestID: cmd.ID}
+	if !counterCommands[cmd.Command] {
+		ack.Status = http.StatusBadRequest
+		ack.Error = "Unknown command: " + cmd.Command
+		return ack
+	}
+
+	query := url.Values{}
+	for key, value := range cmd.Query {
+		query.Set(key, value)
+	}
+	target := fmt.Sprintf("/api/counter/%d/%s?%s", counterID, cmd.Command, query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(cmd.Data))
+	if err != nil {
+		ack.Status = http.StatusBadRequest
+		ack.Error = "Invalid command"
+		return ack
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, cookie := range upgrade.Cookies() {
+		req.AddCookie(cookie)
+	}
+	req.RemoteAddr = upgrade.RemoteAddr
+
+	rec := &commandRecorder{header: http.Header{}, status: http.StatusOK}
+	h.guard(permissions{http.MethodPost: accessCounter}, h.handleCounterAPI)(rec, req)
+
+	ack.Status = rec.status
+	ack.OK = rec.status >= 200 && rec.status < 300
+	if ack.OK {
+		ack.Data = rec.body.Bytes()
+	} else {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(rec.body.Bytes(), &body)
+		ack.Error = body.Error
+	}
+	return ack
+}
+
+// commandRecorder captures the response of a REST handler run for a
+// WebSocket command.
+type commandRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *commandRecorder) Header() http.Header         { return c.header }
+func (c *commandRecorder) Write(b []byte) (int, error) { return c.body.Write(b) }
+func (c *commandRecorder) WriteHeader(code int)        { c.status = code }
+
+// wsWriter sends hub events as WebSocket text messages in the SSE message
+// format plus the event ID: {"id": 12, "type": "...", "data": ...}.
+type wsWriter struct {
+	conn *ws.Conn
+}
+
+func (c wsWriter) Connected(client *sse.Client, id uint64) error {
+	data, _ := json.Marshal(map[string]interface{}{"id": id, "type": "connected", "client_id": client.ID})
+	return c.conn.WriteText(data)
+}
+
+func (c wsWriter) WriteEvents(events []sse.Event) error {
+	for _, event := range events {
+		// event.Data is the {"type": ..., "data": ...} object
+		message := append([]byte(fmt.Sprintf(`{"id":%d,`, event.ID)), event.Data[1:]...)
+		if err := c.conn.WriteText(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c wsWriter) Heartbeat() error {
+	return c.conn.Ping()
+}
@@ -12,32 +12,58 @@ const (
 	StatusCalled    QueueStatus = "called"
 	StatusCompleted QueueStatus = "completed"
 	StatusCancelled QueueStatus = "cancelled"
+	StatusParked    QueueStatus = "parked" // no-show, can be reactivated within the park window
+)
+
+// Queue priority levels. Anything above PriorityNormal is served from the
+// priority lane (lansia, penyandang disabilitas, ibu hamil).
+const (
+	PriorityNormal = 0
+	PriorityHigh   = 1
 )
 
 type Queue struct {
-	ID          int64          `json:"id"`
-	QueueNumber string         `json:"queue_number"`
-	QueueType   string         `json:"queue_type"`
-	Status      QueueStatus    `json:"status"`
-	CounterID   sql.NullInt64  `json:"-"`
-	CounterIDPtr *int64        `json:"counter_id,omitempty"`
-	CreatedAt   time.Time      `json:"created_at"`
-	CalledAt    sql.NullTime   `json:"-"`
-	CalledAtPtr *time.Time     `json:"called_at,omitempty"`
-	CompletedAt sql.NullTime   `json:"-"`
-	CompletedAtPtr *time.Time  `json:"completed_at,omitempty"`
+	ID                 int64         `json:"id"`
+	QueueNumber        string        `json:"queue_number"`
+	QueueType          string        `json:"queue_type"`
+	Status             QueueStatus   `json:"status"`
+	Priority           int           `json:"priority"`
+	CounterID          sql.NullInt64 `json:"-"`
+	CounterIDPtr       *int64        `json:"counter_id,omitempty"`
+	TargetCounterID    sql.NullInt64 `json:"-"`
+	TargetCounterIDPtr *int64        `json:"target_counter_id,omitempty"`
+	CreatedAt          time.Time     `json:"created_at"`
+	CalledAt           sql.NullTime  `json:"-"`
+	CalledAtPtr        *time.Time    `json:"called_at,omitempty"`
+	CompletedAt        sql.NullTime  `json:"-"`
+	CompletedAtPtr     *time.Time    `json:"completed_at,omitempty"`
+	RecallCount        int           `json:"recall_count"`
+	ParkedAt           sql.NullTime  `json:"-"`
+	ParkedAtPtr        *time.Time    `json:"parked_at,omitempty"`
+	OperatorID         sql.NullInt64 `json:"-"`
+	OperatorIDPtr      *int64        `json:"operator_id,omitempty"`
+	ETA                *QueueETA     `json:"eta,omitempty"`
 }
 
 func (q *Queue) PrepareJSON() {
 	if q.CounterID.Valid {
 		q.CounterIDPtr = &q.CounterID.Int64
 	}
+	if q.TargetCounterID.Valid {
+		q.TargetCounterIDPtr = &q.TargetCounterID.Int64
+	}
 	if q.CalledAt.Valid {
 		q.CalledAtPtr = &q.CalledAt.Time
 	}
 	if q.CompletedAt.Valid {
 		q.CompletedAtPtr = &q.CompletedAt.Time
 	}
+	if q.ParkedAt.Valid {
+		q.ParkedAtPtr = &q.ParkedAt.Time
+	}
+	if q.OperatorID.Valid {
+		q.OperatorIDPtr = &q.OperatorID.Int64
+	}
 }
 
 type Counter struct {
@@ -50,6 +76,13 @@ type Counter struct {
 	CurrentQueue   *Queue        `json:"current_queue,omitempty"`
 	LastCallAt     sql.NullTime  `json:"-"`
 	LastCallAtPtr  *time.Time    `json:"last_call_at,omitempty"`
+
+	// Operator logged in at the counter for the current shift
+	OperatorID       sql.NullInt64 `json:"-"`
+	OperatorIDPtr    *int64        `json:"operator_id,omitempty"`
+	OperatorName     string        `json:"operator_name,omitempty"`
+	OperatorSince    sql.NullTime  `json:"-"`
+	OperatorSincePtr *time.Time    `json:"operator_since,omitempty"`
 }
 
 func (c *Counter) PrepareJSON() {
@@ -59,6 +92,90 @@ func (c *Counter) PrepareJSON() {
 	if c.LastCallAt.Valid {
 		c.LastCallAtPtr = &c.LastCallAt.Time
 	}
+	if c.OperatorID.Valid {
+		c.OperatorIDPtr = &c.OperatorID.Int64
+	}
+	if c.OperatorSince.Valid {
+		c.OperatorSincePtr = &c.OperatorSince.Time
+	}
+}
+
+// CounterService assigns a queue type to a counter. Types with a higher
+// Priority are served first; Weight is used by the weighted routing policy.
+type CounterService struct {
+	CounterID int64  `json:"counter_id"`
+	QueueType string `json:"queue_type"`
+	Weight    int    `json:"weight"`
+	Priority  int    `json:"priority"`
+}
+
+// UserRole controls what a staff account may do. Operators serve at
+// counters; supervisors manage the floor; admins also manage settings and
+// accounts.
+type UserRole string
+
+const (
+	RoleAdmin      UserRole = "admin"
+	RoleSupervisor UserRole = "supervisor"
+	RoleOperator   UserRole = "operator"
+)
+
+// Valid reports whether r is a known role.
+func (r UserRole) Valid() bool {
+	return r == RoleAdmin || r == RoleSupervisor || r == RoleOperator
+}
+
+// User is a staff account.
+type User struct {
+	ID             int64        `json:"id"`
+	Username       string       `json:"username"`
+	FullName       string       `json:"full_name"`
+	PasswordHash   string       `json:"-"`
+	Role           UserRole     `json:"role"`
+	IsActive       bool         `json:"is_active"`
+	CreatedAt      time.Time    `json:"created_at"`
+	LastLoginAt    sql.NullTime `json:"-"`
+	LastLoginAtPtr *time.Time   `json:"last_login_at,omitempty"`
+}
+
+func (u *User) PrepareJSON() {
+	if u.LastLoginAt.Valid {
+		u.LastLoginAtPtr = &u.LastLoginAt.Time
+	}
+}
+
+// DisplayName returns the full name, or the username when none is set.
+func (u *User) DisplayName() string {
+	if u.FullName != "" {
+		return u.FullName
+	}
+	return u.Username
+}
+
+// Session is a staff login. The cookie token is only stored hashed; the
+// user fields are read from the users table so role changes apply at once.
+type Session struct {
+	ID          int64     `json:"id"`
+	UserID      int64     `json:"user_id"`
+	Username    string    `json:"username"`
+	FullName    string    `json:"full_name"`
+	Role        UserRole  `json:"role"`
+	CounterID   int64     `json:"counter_id,omitempty"`
+	CounterName string    `json:"counter_name,omitempty"`
+	UserAgent   string    `json:"user_agent"`
+	IPAddress   string    `json:"ip_address"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Current     bool      `json:"current"`
+}
+
+// DisplayName returns the full name, or the username when none is set.
+func (s *Session) DisplayName() string {
+	if s.FullName != "" {
+		return s.FullName
+	}
+	return s.Username
 }
 
 type Setting struct {
@@ -70,17 +187,28 @@ type Setting struct {
 type CallAction string
 
 const (
-	ActionCalled    CallAction = "called"
-	ActionRecalled  CallAction = "recalled"
-	ActionCompleted CallAction = "completed"
-	ActionCancelled CallAction = "cancelled"
+	ActionCalled      CallAction = "called"
+	ActionRecalled    CallAction = "recalled"
+	ActionCompleted   CallAction = "completed"
+	ActionCancelled   CallAction = "cancelled"
+	ActionTransferred CallAction = "transferred"
+	ActionParked      CallAction = "parked"
+	ActionReactivated CallAction = "reactivated"
+)
+
+// Lanes recorded in call_history when CallNextQueue picks a queue.
+const (
+	LaneNormal   = "normal"
+	LanePriority = "priority"
 )
 
 type CallHistory struct {
 	ID        int64      `json:"id"`
 	QueueID   int64      `json:"queue_id"`
-	CounterID int64      `json:"counter_id"`
+	CounterID  int64      `json:"counter_id"`
+	OperatorID *int64     `json:"operator_id,omitempty"`
 	Action    CallAction `json:"action"`
+	Lane      string     `json:"lane,omitempty"`
 	Timestamp time.Time  `json:"timestamp"`
 }
 
@@ -90,15 +218,75 @@ type Stats struct {
 	CalledQueues    int `json:"called_queues"`
 	CompletedQueues int `json:"completed_queues"`
 	CancelledQueues int `json:"cancelled_queues"`
+	ParkedQueues    int `json:"parked_queues"`
 	ActiveCounters  int `json:"active_counters"`
 }
 
+// QueueETA is the estimated waiting time for a single ticket.
+type QueueETA struct {
+	QueueNumber       string      `json:"queue_number"`
+	QueueType         string      `json:"queue_type"`
+	Status            QueueStatus `json:"status"`
+	Ahead             int         `json:"ahead"`
+	ActiveCounters    int         `json:"active_counters"`
+	AvgServiceSeconds int         `json:"avg_service_seconds"`
+	WaitMinutes       int         `json:"wait_minutes"`
+	EstimatedCallAt   time.Time   `json:"estimated_call_at"`
+}
+
+// ServiceETA is the estimated waiting time for a new ticket of a queue type.
+type ServiceETA struct {
+	QueueType         string `json:"queue_type"`
+	WaitingCount      int    `json:"waiting_count"`
+	ActiveCounters    int    `json:"active_counters"`
+	AvgServiceSeconds int    `json:"avg_service_seconds"`
+	WaitMinutes       int    `json:"wait_minutes"`
+}
+
+// TicketStatus is the public view of a ticket shown on the status page.
+type TicketStatus struct {
+	QueueNumber string      `json:"queue_number"`
+	QueueType   string      `json:"queue_type"`
+	TypeName    string      `json:"type_name"`
+	Status      QueueStatus `json:"status"`
+	Position    int         `json:"position"`              // 1 = next in line, 0 when not waiting
+	NowServing  string      `json:"now_serving,omitempty"` // number last called for this type
+	CounterName string      `json:"counter_name,omitempty"`
+	ETA         *QueueETA   `json:"eta,omitempty"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
 type DisplayEvent struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
 }
 
+// DisplaySnapshot is the full state of a display, sent as the "snapshot"
+// event when it connects. Events with an ID above Version are newer than
+// the snapshot; the ones up to it are already reflected in it.
+type DisplaySnapshot struct {
+	Version       uint64            `json:"version"`
+	Counters      []*Counter        `json:"counters"`
+	Stats         *Stats            `json:"stats"`
+	WaitingByType map[string]int    `json:"waiting_by_type"`
+	RecentCalls   []*RecentCall     `json:"recent_calls"`
+	Settings      map[string]string `json:"settings"`
+}
+
+// RecentCall is a call or recall of a ticket to a counter. CallID is its
+// call_history row, the same as in the "queue_called" event.
+type RecentCall struct {
+	CallID        int64     `json:"call_id"`
+	QueueNumber   string    `json:"queue_number"`
+	QueueType     string    `json:"queue_type"`
+	CounterID     int64     `json:"counter_id"`
+	CounterNumber string    `json:"counter_number"`
+	CounterName   string    `json:"counter_name"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
 type QueueCalledData struct {
+	CallID        int64     `json:"call_id,omitempty"`
 	QueueNumber   string    `json:"queue_number"`
 	CounterNumber string    `json:"counter_number"`
 	CounterName   string    `json:"counter_name"`
@@ -111,6 +299,16 @@ type CounterUpdateData struct {
 	Timestamp    time.Time `json:"timestamp"`
 }
 
+type QueueTransferredData struct {
+	QueueNumber     string    `json:"queue_number"`
+	QueueType       string    `json:"queue_type"`
+	FromCounterID   int64     `json:"from_counter_id"`
+	FromCounterName string    `json:"from_counter_name"`
+	ToCounterID     *int64    `json:"to_counter_id,omitempty"`
+	ToCounterName   string    `json:"to_counter_name,omitempty"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
 type QueueType struct {
 	ID        int64     `json:"id"`
 	Code      string    `json:"code"`
@@ -154,6 +352,12 @@ type PrintJob struct {
 	CompletedAt  sql.NullTime   `json:"-"`
 	CompletedAtPtr *time.Time   `json:"completed_at,omitempty"`
 	ErrorMessage string         `json:"error_message,omitempty"`
+	ETA          string         `json:"eta,omitempty"`
+	Attempts     int            `json:"attempts"`
+	LeaseExpiresAt    sql.NullTime `json:"-"`
+	LeaseExpiresAtPtr *time.Time   `json:"lease_expires_at,omitempty"`
+	TargetAgent  string         `json:"target_agent,omitempty"`
+	TargetGroup  string         `json:"target_group,omitempty"`
 }
 
 func (pj *PrintJob) PrepareJSON() {
@@ -163,4 +367,43 @@ func (pj *PrintJob) PrepareJSON() {
 	if pj.CompletedAt.Valid {
 		pj.CompletedAtPtr = &pj.CompletedAt.Time
 	}
+	if pj.LeaseExpiresAt.Valid {
+		pj.LeaseExpiresAtPtr = &pj.LeaseExpiresAt.Time
+	}
+}
+
+// PrintAgent is a registered remote print agent. It authenticates with an
+// API key that is only stored hashed.
+type PrintAgent struct {
+	ID            int64        `json:"id"`
+	AgentID       string       `json:"agent_id"`
+	Name          string       `json:"name"`
+	Group         string       `json:"printer_group"`
+	IsActive      bool         `json:"is_active"`
+	CreatedAt     time.Time    `json:"created_at"`
+	LastSeenAt    sql.NullTime `json:"-"`
+	LastSeenAtPtr *time.Time   `json:"last_seen_at,omitempty"`
+	PrintAgentStatus
+	Online bool `json:"online"` // has an open event stream; set by the handler
+}
+
+// PrintAgentStatus is the health an agent reports about itself. Job counts
+// are since the agent process started.
+type PrintAgentStatus struct {
+	Version     string `json:"version"`
+	Hostname    string `json:"hostname"`
+	PrinterName string `json:"printer_name"`
+	PaperSize   string `json:"paper_size"`
+	JobsPrinted int    `json:"jobs_printed"`
+	JobsFailed  int    `json:"jobs_failed"`
+	LastError   string `json:"last_error"`
+	// Hardware condition such as "paper_out" (printer.Status* codes); empty
+	// when the agent's transport cannot query the printer
+	PrinterStatus string `json:"printer_status"`
+}
+
+func (a *PrintAgent) PrepareJSON() {
+	if a.LastSeenAt.Valid {
+		a.LastSeenAtPtr = &a.LastSeenAt.Time
+	}
 }
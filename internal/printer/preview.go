@@ -0,0 +1,580 @@
+package printer
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// Preview rendering interprets the ESC/POS subset produced by BuildTicket
+// (and the common commands around it) and draws it as the printer would, so
+// ticket designs can be checked without wasting paper. QR codes are drawn as
+// a placeholder symbol with their content underneath.
+
+// Character cells in dots, as on common 80 mm printers
+const (
+	fontACellW, fontACellH = 12, 24
+	fontBCellW, fontBCellH = 9, 17
+	previewMargin          = 16
+	previewLineGap         = 6
+)
+
+// RenderPNG renders an ESC/POS stream on paper of the given size and writes
+// it to w as a PNG image.
+func RenderPNG(w io.Writer, stream []byte, paperSize string) error {
+	_, _, dotWidth := paperLayout(paperSize)
+	r := newRenderer(dotWidth)
+	if err := r.run(stream); err != nil {
+		return err
+	}
+	return png.Encode(w, r.image())
+}
+
+// glyph is one character in the current style, waiting for the line feed.
+type glyph struct {
+	ch     byte
+	fontB  bool
+	bold   bool
+	scaleW int
+	scaleH int
+}
+
+type renderer struct {
+	canvas *image.Gray
+	width  int // printable width in dots
+	y      int // top of the next line
+
+	align  byte
+	bold   bool
+	fontB  bool
+	scaleW int
+	scaleH int
+	line   []glyph
+
+	barcodeHeight int
+	barcodeWidth  int
+	barcodeHRI    byte
+	qrModule      int
+	qrData        []byte
+}
+
+func newRenderer(width int) *renderer {
+	r := &renderer{
+		width:  width,
+		canvas: image.NewGray(image.Rect(0, 0, width+2*previewMargin, 1024)),
+	}
+	r.reset()
+	for i := range r.canvas.Pix {
+		r.canvas.Pix[i] = 0xff
+	}
+	r.y = previewMargin
+	return r
+}
+
+// reset restores the power-on state (ESC @).
+func (r *renderer) reset() {
+	r.align = 0
+	r.bold = false
+	r.fontB = false
+	r.scaleW, r.scaleH = 1, 1
+	r.barcodeHeight = 162
+	r.barcodeWidth = 3
+	r.barcodeHRI = 0
+	r.qrModule = 3
+	r.qrData = nil
+}
+
+// image returns the canvas cropped to the printed length.
+func (r *renderer) image() image.Image {
+	r.flush(false)
+	return r.canvas.SubImage(image.Rect(0, 0, r.canvas.Bounds().Dx(), r.y+previewMargin))
+}
+
+func (r *renderer) run(b []byte) error {
+	arg := func(i, n int) ([]byte, error) {
+		if i+n > len(b) {
+			return nil, fmt.Errorf("truncated ESC/POS command at byte %d", i)
+		}
+		return b[i : i+n], nil
+	}
+
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c == '\n':
+			r.flush(true)
+			i++
+
+		case c == ESC:
+			p, err := arg(i+1, 1)
+			if err != nil {
+				return err
+			}
+			switch p[0] {
+			case '@':
+				r.flush(false)
+				r.reset()
+				i += 2
+			case 'a', 'E', 'M', 'd', '!':
+				v, err := arg(i+2, 1)
+				if err != nil {
+					return err
+				}
+				switch p[0] {
+				case 'a':
+					r.align = v[0] % 48 // accepts 0–2 and '0'–'2'
+				case 'E':
+					r.bold = v[0]&1 == 1
+				case 'M':
+					r.fontB = v[0]%48 == 1
+				case 'd':
+					r.feed(int(v[0]))
+				case '!':
+					r.fontB = v[0]&0x01 != 0
+					r.bold = v[0]&0x08 != 0
+					r.scaleH = 1 + int(v[0]>>4&1)
+					r.scaleW = 1 + int(v[0]>>5&1)
+				}
+				i += 3
+			default:
+				i += 2 // unsupported, no arguments assumed
+			}
+
+		case c == GS:
+			p, err := arg(i+1, 1)
+			if err != nil {
+				return err
+			}
+			n, err := r.runGS(b, i, p[0])
+			if err != nil {
+				return err
+			}
+			i += n
+
+		case c >= 0x20 && c < 0x7f:
+			r.line = append(r.line, glyph{ch: c, fontB: r.fontB, bold: r.bold, scaleW: r.scaleW, scaleH: r.scaleH})
+			i++
+
+		default:
+			i++ // other control bytes are ignored
+		}
+	}
+	return nil
+}
+
+// runGS interprets the GS command at b[i] and returns its length.
+func (r *renderer) runGS(b []byte, i int, cmd byte) (int, error) {
+	need := func(n int) error {
+		if i+n > len(b) {
+			return fmt.Errorf("truncated GS %q command at byte %d", cmd, i)
+		}
+		return nil
+	}
+
+	switch cmd {
+	case '!':
+		if err := need(3); err != nil {
+			return 0, err
+		}
+		r.scaleW = 1 + int(b[i+2]>>4&7)
+		r.scaleH = 1 + int(b[i+2]&7)
+		return 3, nil
+
+	case 'h', 'w', 'H':
+		if err := need(3); err != nil {
+			return 0, err
+		}
+		switch cmd {
+		case 'h':
+			r.barcodeHeight = int(b[i+2])
+		case 'w':
+			r.barcodeWidth = int(b[i+2])
+		case 'H':
+			r.barcodeHRI = b[i+2] % 48
+		}
+		return 3, nil
+
+	case 'V': // cut, optionally feeding n lines first (m = 65/66)
+		if err := need(3); err != nil {
+			return 0, err
+		}
+		m := b[i+2]
+		if m == 65 || m == 66 {
+			if err := need(4); err != nil {
+				return 0, err
+			}
+			r.feed(int(b[i+3]))
+			r.cut()
+			return 4, nil
+		}
+		r.cut()
+		return 3, nil
+
+	case 'k': // barcode
+		if err := need(4); err != nil {
+			return 0, err
+		}
+		m := b[i+2]
+		if m >= 65 {
+			n := int(b[i+3])
+			if err := need(4 + n); err != nil {
+				return 0, err
+			}
+			r.barcode(b[i+4 : i+4+n])
+			return 4 + n, nil
+		}
+		end := i + 3
+		for end < len(b) && b[end] != 0 {
+			end++
+		}
+		if end == len(b) {
+			return 0, need(end - i + 1)
+		}
+		r.barcode(b[i+3 : end])
+		return end - i + 1, nil
+
+	case '(': // GS ( k — QR code
+		if err := need(5); err != nil {
+			return 0, err
+		}
+		n := int(b[i+3]) + int(b[i+4])<<8
+		if err := need(5 + n); err != nil {
+			return 0, err
+		}
+		if b[i+2] == 'k' && n >= 3 {
+			fn, params := b[i+6], b[i+7:i+5+n]
+			switch fn {
+			case 67: // module size
+				if len(params) > 0 {
+					r.qrModule = int(params[0])
+				}
+			case 80: // store data (first param byte is m = 48)
+				if len(params) > 0 {
+					r.qrData = append([]byte(nil), params[1:]...)
+				}
+			case 81: // print
+				r.qr()
+			}
+		}
+		return 5 + n, nil
+
+	case 'v': // GS v 0 raster image
+		if err := need(8); err != nil {
+			return 0, err
+		}
+		rowBytes := int(b[i+4]) + int(b[i+5])<<8
+		rows := int(b[i+6]) + int(b[i+7])<<8
+		if err := need(8 + rowBytes*rows); err != nil {
+			return 0, err
+		}
+		r.raster(b[i+8:i+8+rowBytes*rows], rowBytes, rows)
+		return 8 + rowBytes*rows, nil
+
+	default:
+		return 2, nil // unsupported, no arguments assumed
+	}
+}
+
+func cellSize(g glyph) (int, int) {
+	if g.fontB {
+		return fontBCellW * g.scaleW, fontBCellH * g.scaleH
+	}
+	return fontACellW * g.scaleW, fontACellH * g.scaleH
+}
+
+// flush prints the buffered line. An empty line advances one Font A line
+// only when advance is set (a bare LF).
+func (r *renderer) flush(advance bool) {
+	if len(r.line) == 0 {
+		if advance {
+			r.y += fontACellH + previewLineGap
+		}
+		return
+	}
+
+	lineW, lineH := 0, 0
+	for _, g := range r.line {
+		w, h := cellSize(g)
+		lineW += w
+		lineH = max(lineH, h)
+	}
+
+	r.grow(r.y + lineH + previewLineGap)
+	x := r.alignedX(lineW)
+	for _, g := range r.line {
+		w, h := cellSize(g)
+		r.drawGlyph(x, r.y+lineH-h, w, h, g)
+		x += w
+	}
+	r.y += lineH + previewLineGap
+	r.line = r.line[:0]
+}
+
+func (r *renderer) feed(lines int) {
+	r.flush(false)
+	r.y += lines * (fontACellH + previewLineGap)
+}
+
+// cut marks the cut with a dashed line across the paper.
+func (r *renderer) cut() {
+	r.flush(false)
+	r.grow(r.y + previewMargin)
+	for x := 0; x < r.canvas.Bounds().Dx(); x++ {
+		if x/6%2 == 0 {
+			r.canvas.SetGray(x, r.y+previewMargin/2, color.Gray{Y: 0x80})
+		}
+	}
+	r.y += previewMargin
+}
+
+// alignedX returns the left edge of content of the given width.
+func (r *renderer) alignedX(contentW int) int {
+	offset := 0
+	switch r.align {
+	case 1:
+		offset = (r.width - contentW) / 2
+	case 2:
+		offset = r.width - contentW
+	}
+	return previewMargin + max(offset, 0)
+}
+
+// grow extends the canvas so that rows up to height are available.
+func (r *renderer) grow(height int) {
+	b := r.canvas.Bounds()
+	if height+previewMargin <= b.Dy() {
+		return
+	}
+	newH := max(b.Dy()*2, height+previewMargin)
+	canvas := image.NewGray(image.Rect(0, 0, b.Dx(), newH))
+	for i := range canvas.Pix {
+		canvas.Pix[i] = 0xff
+	}
+	copy(canvas.Pix, r.canvas.Pix)
+	r.canvas = canvas
+}
+
+func (r *renderer) fill(x0, y0, x1, y1 int) {
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			r.canvas.SetGray(x, y, color.Gray{Y: 0})
+		}
+	}
+}
+
+// drawGlyph draws a 5×7 glyph scaled into a w×h character cell.
+func (r *renderer) drawGlyph(x, y, w, h int, g glyph) {
+	if g.ch < 0x20 || g.ch > 0x7e {
+		return
+	}
+	columns := font5x7[g.ch-0x20]
+
+	// Leave a one-column and one-row gap (scaled) around the glyph
+	gw, gh := w*5/6, h*7/8
+	for col := 0; col < 5; col++ {
+		for row := 0; row < 7; row++ {
+			if columns[col]>>row&1 == 0 {
+				continue
+			}
+			x0, x1 := x+col*gw/5, x+(col+1)*gw/5
+			y0, y1 := y+row*gh/7, y+(row+1)*gh/7
+			if g.bold {
+				x1++
+			}
+			r.fill(x0, y0, x1, y1)
+		}
+	}
+}
+
+// barcode draws deterministic bars for the data (not a scannable symbol)
+// with the human-readable text when enabled.
+func (r *renderer) barcode(data []byte) {
+	r.flush(false)
+	text := data
+	if len(text) >= 2 && text[0] == '{' {
+		text = text[2:] // CODE128 code set prefix
+	}
+
+	module := max(r.barcodeWidth, 1)
+	modules := 11*(len(data)+2) + 2 // CODE128: start, data, check, stop
+	width := min(modules*module, r.width)
+
+	if r.barcodeHRI == 1 || r.barcodeHRI == 3 {
+		r.text(text)
+	}
+	r.grow(r.y + r.barcodeHeight + previewLineGap)
+	x0 := r.alignedX(width)
+	seed := uint32(2166136261)
+	for _, c := range data {
+		seed = (seed ^ uint32(c)) * 16777619
+	}
+	for m := 0; m < width/module; m++ {
+		seed = seed*1103515245 + 12345
+		if m < 2 || m >= width/module-2 || seed>>16&1 == 1 {
+			r.fill(x0+m*module, r.y, x0+(m+1)*module, r.y+r.barcodeHeight)
+		}
+	}
+	r.y += r.barcodeHeight + previewLineGap
+	if r.barcodeHRI == 2 || r.barcodeHRI == 3 {
+		r.text(text)
+	}
+}
+
+// qr draws a placeholder QR symbol (finder patterns and frame) sized like a
+// version 3 code, followed by its content in Font B.
+func (r *renderer) qr() {
+	r.flush(false)
+	module := max(r.qrModule, 1)
+	size := 29 * module
+	r.grow(r.y + size + previewLineGap)
+
+	x0 := r.alignedX(size)
+	finder := func(fx, fy int) {
+		r.fill(fx, fy, fx+7*module, fy+7*module)
+		for y := fy + module; y < fy+6*module; y++ {
+			for x := fx + module; x < fx+6*module; x++ {
+				r.canvas.SetGray(x, y, color.Gray{Y: 0xff})
+			}
+		}
+		r.fill(fx+2*module, fy+2*module, fx+5*module, fy+5*module)
+	}
+	finder(x0, r.y)
+	finder(x0+size-7*module, r.y)
+	finder(x0, r.y+size-7*module)
+	for m := 8; m < 21; m += 2 {
+		r.fill(x0+m*module, r.y+6*module, x0+(m+1)*module, r.y+7*module)
+		r.fill(x0+6*module, r.y+m*module, x0+7*module, r.y+(m+1)*module)
+	}
+	r.y += size + previewLineGap
+
+	if len(r.qrData) > 0 {
+		saved := r.fontB
+		r.fontB = true
+		r.text(r.qrData)
+		r.fontB = saved
+	}
+}
+
+// text prints a line in the current style.
+func (r *renderer) text(s []byte) {
+	for _, c := range s {
+		r.line = append(r.line, glyph{ch: c, fontB: r.fontB, scaleW: 1, scaleH: 1})
+	}
+	r.flush(true)
+}
+
+// raster draws GS v 0 bit-image data.
+func (r *renderer) raster(bits []byte, rowBytes, rows int) {
+	r.flush(false)
+	r.grow(r.y + rows)
+	x0 := r.alignedX(rowBytes * 8)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < rowBytes*8; x++ {
+			if bits[y*rowBytes+x/8]&(0x80>>(x%8)) != 0 {
+				r.canvas.SetGray(x0+x, r.y+y, color.Gray{Y: 0})
+			}
+		}
+	}
+	r.y += rows
+}
+
+// font5x7 holds ASCII 0x20–0x7E as five columns of seven bits (bit 0 = top).
+var font5x7 = [95][5]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00}, // ' '
+	{0x00, 0x00, 0x5F, 0x00, 0x00}, // !
+	{0x00, 0x07, 0x00, 0x07, 0x00}, // "
+	{0x14, 0x7F, 0x14, 0x7F, 0x14}, // #
+	{0x24, 0x2A, 0x7F, 0x2A, 0x12}, // $
+	{0x23, 0x13, 0x08, 0x64, 0x62}, // %
+	{0x36, 0x49, 0x55, 0x22, 0x50}, // &
+	{0x00, 0x05, 0x03, 0x00, 0x00}, // '
+	{0x00, 0x1C, 0x22, 0x41, 0x00}, // (
+	{0x00, 0x41, 0x22, 0x1C, 0x00}, // )
+	{0x14, 0x08, 0x3E, 0x08, 0x14}, // *
+	{0x08, 0x08, 0x3E, 0x08, 0x08}, // +
+	{0x00, 0x50, 0x30, 0x00, 0x00}, // ,
+	{0x08, 0x08, 0x08, 0x08, 0x08}, // -
+	{0x00, 0x60, 0x60, 0x00, 0x00}, // .
+	{0x20, 0x10, 0x08, 0x04, 0x02}, // /
+	{0x3E, 0x51, 0x49, 0x45, 0x3E}, // 0
+	{0x00, 0x42, 0x7F, 0x40, 0x00}, // 1
+	{0x42, 0x61, 0x51, 0x49, 0x46}, // 2
+	{0x21, 0x41, 0x45, 0x4B, 0x31}, // 3
+	{0x18, 0x14, 0x12, 0x7F, 0x10}, // 4
+	{0x27, 0x45, 0x45, 0x45, 0x39}, // 5
+	{0x3C, 0x4A, 0x49, 0x49, 0x30}, // 6
+	{0x01, 0x71, 0x09, 0x05, 0x03}, // 7
+	{0x36, 0x49, 0x49, 0x49, 0x36}, // 8
+	{0x06, 0x49, 0x49, 0x29, 0x1E}, // 9
+	{0x00, 0x36, 0x36, 0x00, 0x00}, // :
+	{0x00, 0x56, 0x36, 0x00, 0x00}, // ;
+	{0x08, 0x14, 0x22, 0x41, 0x00}, // <
+	{0x14, 0x14, 0x14, 0x14, 0x14}, // =
+	{0x00, 0x41, 0x22, 0x14, 0x08}, // >
+	{0x02, 0x01, 0x51, 0x09, 0x06}, // ?
+	{0x32, 0x49, 0x79, 0x41, 0x3E}, // @
+	{0x7E, 0x11, 0x11, 0x11, 0x7E}, // A
+	{0x7F, 0x49, 0x49, 0x49, 0x36}, // B
+	{0x3E, 0x41, 0x41, 0x41, 0x22}, // C
+	{0x7F, 0x41, 0x41, 0x22, 0x1C}, // D
+	{0x7F, 0x49, 0x49, 0x49, 0x41}, // E
+	{0x7F, 0x09, 0x09, 0x09, 0x01}, // F
+	{0x3E, 0x41, 0x49, 0x49, 0x7A}, // G
+	{0x7F, 0x08, 0x08, 0x08, 0x7F}, // H
+	{0x00, 0x41, 0x7F, 0x41, 0x00}, // I
+	{0x20, 0x40, 0x41, 0x3F, 0x01}, // J
+	{0x7F, 0x08, 0x14, 0x22, 0x41}, // K
+	{0x7F, 0x40, 0x40, 0x40, 0x40}, // L
+	{0x7F, 0x02, 0x0C, 0x02, 0x7F}, // M
+	{0x7F, 0x04, 0x08, 0x10, 0x7F}, // N
+	{0x3E, 0x41, 0x41, 0x41, 0x3E}, // O
+	{0x7F, 0x09, 0x09, 0x09, 0x06}, // P
+	{0x3E, 0x41, 0x51, 0x21, 0x5E}, // Q
+	{0x7F, 0x09, 0x19, 0x29, 0x46}, // R
+	{0x46, 0x49, 0x49, 0x49, 0x31}, // S
+	{0x01, 0x01, 0x7F, 0x01, 0x01}, // T
+	{0x3F, 0x40, 0x40, 0x40, 0x3F}, // U
+	{0x1F, 0x20, 0x40, 0x20, 0x1F}, // V
+	{0x3F, 0x40, 0x38, 0x40, 0x3F}, // W
+	{0x63, 0x14, 0x08, 0x14, 0x63}, // X
+	{0x07, 0x08, 0x70, 0x08, 0x07}, // Y
+	{0x61, 0x51, 0x49, 0x45, 0x43}, // Z
+	{0x00, 0x7F, 0x41, 0x41, 0x00}, // [
+	{0x02, 0x04, 0x08, 0x10, 0x20}, // backslash
+	{0x00, 0x41, 0x41, 0x7F, 0x00}, // ]
+	{0x04, 0x02, 0x01, 0x02, 0x04}, // ^
+	{0x40, 0x40, 0x40, 0x40, 0x40}, // _
+	{0x00, 0x01, 0x02, 0x04, 0x00}, // `
+	{0x20, 0x54, 0x54, 0x54, 0x78}, // a
+	{0x7F, 0x48, 0x44, 0x44, 0x38}, // b
+	{0x38, 0x44, 0x44, 0x44, 0x20}, // c
+	{0x38, 0x44, 0x44, 0x48, 0x7F}, // d
+	{0x38, 0x54, 0x54, 0x54, 0x18}, // e
+	{0x08, 0x7E, 0x09, 0x01, 0x02}, // f
+	{0x0C, 0x52, 0x52, 0x52, 0x3E}, // g
+	{0x7F, 0x08, 0x04, 0x04, 0x78}, // h
+	{0x00, 0x44, 0x7D, 0x40, 0x00}, // i
+	{0x20, 0x40, 0x44, 0x3D, 0x00}, // j
+	{0x7F, 0x10, 0x28, 0x44, 0x00}, // k
+	{0x00, 0x41, 0x7F, 0x40, 0x00}, // l
+	{0x7C, 0x04, 0x18, 0x04, 0x78}, // m
+	{0x7C, 0x08, 0x04, 0x04, 0x78}, // n
+	{0x38, 0x44, 0x44, 0x44, 0x38}, // o
+	{0x7C, 0x14, 0x14, 0x14, 0x08}, // p
+	{0x08, 0x14, 0x14, 0x18, 0x7C}, // q
+	{0x7C, 0x08, 0x04, 0x04, 0x08}, // r
+	{0x48, 0x54, 0x54, 0x54, 0x20}, // s
+	{0x04, 0x3F, 0x44, 0x40, 0x20}, // t
+	{0x3C, 0x40, 0x40, 0x20, 0x7C}, // u
+	{0x1C, 0x20, 0x40, 0x20, 0x1C}, // v
+	{0x3C, 0x40, 0x30, 0x40, 0x3C}, // w
+	{0x44, 0x28, 0x10, 0x28, 0x44}, // x
+	{0x0C, 0x50, 0x50, 0x50, 0x3C}, // y
+	{0x44, 0x64, 0x54, 0x4C, 0x44}, // z
+	{0x00, 0x08, 0x36, 0x41, 0x00}, // {
+	{0x00, 0x00, 0x7F, 0x00, 0x00}, // |
+	{0x00, 0x41, 0x36, 0x08, 0x00}, // }
+	{0x08, 0x04, 0x08, 0x10, 0x08}, // ~
+}
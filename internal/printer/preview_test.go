@@ -0,0 +1,100 @@
+package printer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+var previewData = TicketData{
+	QueueNumber: "A001",
+	TypeName:    "Umum",
+	DateTime:    "16/10/2026 09:00",
+	ETA:         FormatWait(12),
+}
+
+// fullTemplate is the default template with every optional part enabled.
+func fullTemplate(t *testing.T, paperSize string) TicketTemplate {
+	t.Helper()
+	logo := image.NewGray(image.Rect(0, 0, 64, 32))
+	for x := 0; x < 64; x += 2 {
+		logo.SetGray(x, x/2, color.Gray{})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, logo); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := PrepareLogo(&buf)
+	if err != nil {
+		t.Fatalf("PrepareLogo: %v", err)
+	}
+
+	tmpl := DefaultTemplate()
+	tmpl.PaperSize = paperSize
+	tmpl.ShowQR = true
+	tmpl.ShowBarcode = true
+	tmpl.Logo = encoded
+	tmpl.QRBaseURL = "http://192.168.1.10:8080"
+	return tmpl
+}
+
+func TestRenderPNG(t *testing.T) {
+	for _, paperSize := range []string{Paper58mm, Paper80mm} {
+		_, _, dotWidth := paperLayout(paperSize)
+		plain := DefaultTemplate()
+		plain.PaperSize = paperSize
+		for name, tmpl := range map[string]TicketTemplate{
+			"default": plain,
+			"full":    fullTemplate(t, paperSize),
+		} {
+			var out bytes.Buffer
+			if err := RenderPNG(&out, BuildTicket(previewData, tmpl), paperSize); err != nil {
+				t.Errorf("%s %s: %v", paperSize, name, err)
+				continue
+			}
+			img, err := png.Decode(&out)
+			if err != nil {
+				t.Fatalf("%s %s: invalid PNG: %v", paperSize, name, err)
+			}
+			if w := img.Bounds().Dx(); w != dotWidth+2*previewMargin {
+				t.Errorf("%s %s: width %d, want %d", paperSize, name, w, dotWidth+2*previewMargin)
+			}
+			if h := img.Bounds().Dy(); h < 200 {
+				t.Errorf("%s %s: height %d, the ticket is missing", paperSize, name, h)
+			}
+		}
+	}
+}
+
+// A stream cut off anywhere renders or fails, but never panics.
+func TestRenderTruncatedStream(t *testing.T) {
+	stream := BuildTicket(previewData, fullTemplate(t, Paper80mm))
+	for n := 0; n < len(stream); n++ {
+		func() {
+			defer func() {
+				if p := recover(); p != nil {
+					t.Fatalf("stream cut at byte %d of %d: panic: %v", n, len(stream), p)
+				}
+			}()
+			newRenderer(576).run(stream[:n])
+		}()
+	}
+
+	for _, b := range [][]byte{
+		{ESC},
+		{ESC, 'a'},
+		{GS},
+		{GS, '!'},
+		{GS, 'V', 66},
+		{GS, 'k', 73, 5, '{', 'B'},
+		{GS, 'k', 4, '1', '2', '3'},
+		{GS, '(', 'k', 20, 0, 49, 80, 48},
+		{GS, 'v', '0', 0, 10, 0, 10, 0, 0xff},
+	} {
+		if err := newRenderer(576).run(b); err == nil {
+			t.Errorf("% x: no error", b)
+		}
+	}
+}
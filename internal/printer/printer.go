@@ -3,10 +3,8 @@ package printer
 import (
 	"bytes"
 	"fmt"
-	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -33,10 +31,19 @@ const (
 	Paper58mm = "58mm"
 )
 
+// QR code content modes
+const (
+	QRContentURL = "url" // ticket status page URL
+	QRContentID  = "id"  // queue number only
+)
+
 // PrinterConfig holds printer configuration
 type PrinterConfig struct {
 	PrinterName string
 	Enabled     bool
+	Transport   string // see NewTransport; empty = platform default
+	Address     string // tcp: host[:port], port defaults to 9100
+	Device      string // device: device path; file: output path ("-" = stdout)
 }
 
 // TicketTemplate holds the ticket design template
@@ -53,6 +60,19 @@ type TicketTemplate struct {
 	ShowDatetime  bool `json:"show_datetime"`
 	ShowFooter    bool `json:"show_footer"`
 	ShowThanks    bool `json:"show_thanks"`
+	ShowETA       bool `json:"show_eta"`
+	ShowQR        bool `json:"show_qr"`
+	ShowBarcode   bool `json:"show_barcode"`
+	ShowLogo      bool `json:"show_logo"`
+
+	// Logo printed above the header — base64 PNG prepared by PrepareLogo.
+	// Rasterised at print time so agents with other paper sizes scale it.
+	Logo string `json:"logo,omitempty"`
+
+	// QR code content — the status page URL (QRBaseURL + "/status/" + number)
+	// or just the queue number. See qrPayload.
+	QRContent string `json:"qr_content"`  // "url" (default) or "id"
+	QRBaseURL string `json:"qr_base_url"` // e.g. "http://192.168.1.10:8080"
 
 	// Paper / hardware settings — set per machine, serialised into print jobs
 	// so remote agents receive the value set in admin. Agents may override
@@ -75,6 +95,9 @@ func DefaultTemplate() TicketTemplate {
 		ShowDatetime:  true,
 		ShowFooter:    true,
 		ShowThanks:    true,
+		ShowETA:       true,
+		ShowLogo:      true,
+		QRContent:     QRContentURL,
 		PaperSize:     Paper80mm,
 		FeedLines:     1,
 	}
@@ -82,12 +105,21 @@ func DefaultTemplate() TicketTemplate {
 
 // Printer handles thermal printing
 type Printer struct {
-	config PrinterConfig
+	config    PrinterConfig
+	transport Transport
+
+	mu             sync.Mutex
+	statusFailedAt time.Time // last status query the printer did not answer
 }
 
-// New creates a new printer instance
+// New creates a new printer instance. An invalid transport configuration is
+// reported when printing.
 func New(config PrinterConfig) *Printer {
-	return &Printer{config: config}
+	transport, err := NewTransport(config)
+	if err != nil {
+		transport = &brokenTransport{err: err}
+	}
+	return &Printer{config: config, transport: transport}
 }
 
 // TicketData holds the data for printing a ticket
@@ -95,31 +127,94 @@ type TicketData struct {
 	QueueNumber string
 	TypeName    string
 	DateTime    string
+	ETA         string // estimated wait, see FormatWait (empty = not printed)
+}
+
+// FormatWait formats an estimated wait in minutes for the ticket.
+func FormatWait(minutes int) string {
+	if minutes < 1 {
+		return "< 1 menit"
+	}
+	return fmt.Sprintf("%d menit", minutes)
+}
+
+// qrPayload returns what the ticket QR code encodes. Without a base URL the
+// status URL cannot be built, so the queue number is used instead.
+func qrPayload(tmpl TicketTemplate, queueNumber string) string {
+	if tmpl.QRContent == QRContentID || tmpl.QRBaseURL == "" {
+		return queueNumber
+	}
+	return strings.TrimRight(tmpl.QRBaseURL, "/") + "/status/" + queueNumber
+}
+
+// qrCode returns the GS ( k commands that store and print data as a model 2
+// QR code with error correction level M.
+func qrCode(data string, moduleSize byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{GS, '(', 'k', 4, 0, 49, 65, 50, 0})      // fn 165: select model 2
+	buf.Write([]byte{GS, '(', 'k', 3, 0, 49, 67, moduleSize}) // fn 167: module size (dots)
+	buf.Write([]byte{GS, '(', 'k', 3, 0, 49, 69, 49})         // fn 169: error correction M
+
+	// fn 180: store data — length counts the 3 function bytes
+	n := len(data) + 3
+	buf.Write([]byte{GS, '(', 'k', byte(n % 256), byte(n / 256), 49, 80, 48})
+	buf.WriteString(data)
+
+	buf.Write([]byte{GS, '(', 'k', 3, 0, 49, 81, 48}) // fn 181: print symbol
+	return buf.Bytes()
+}
+
+// barcode returns the GS k commands that print data as a CODE128 barcode
+// with the human-readable text below it.
+func barcode(data string) []byte {
+	payload := "{B" + data // code set B (printable ASCII)
+	if len(payload) > 255 {
+		payload = payload[:255]
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{GS, 'h', 80}) // height in dots
+	buf.Write([]byte{GS, 'w', 2})  // module width
+	buf.Write([]byte{GS, 'H', 2})  // HRI text below
+	buf.Write([]byte{GS, 'k', 73, byte(len(payload))})
+	buf.WriteString(payload)
+	return buf.Bytes()
 }
 
 // paperLayout returns layout constants derived from paper size.
 //
 //	charWidth  – printable characters per line (used for separator length)
 //	numberSize – ESC/POS command for the large queue-number font
-func paperLayout(paperSize string) (charWidth int, numberSize []byte) {
+//	dotWidth   – printable width in dots (used for raster images)
+func paperLayout(paperSize string) (charWidth int, numberSize []byte, dotWidth int) {
 	if paperSize == Paper58mm {
-		return 24, SIZE_4X // 4× fits comfortably on 58 mm
+		return 24, SIZE_4X, 384 // 4× fits comfortably on 58 mm
 	}
-	return 32, SIZE_6X // 6× looks great on 80 mm
+	return 32, SIZE_6X, 576 // 6× looks great on 80 mm
 }
 
-// PrintTicket prints a queue ticket to the thermal printer
+// PrintTicket prints a queue ticket to the thermal printer. On transports
+// that can read status it first checks the printer, returning a
+// *StatusError such as ErrPaperOut instead of printing into the void.
 func (p *Printer) PrintTicket(data TicketData, tmpl TicketTemplate) error {
 	if !p.config.Enabled {
 		return fmt.Errorf("printer is disabled")
 	}
+	if err := p.checkReady(); err != nil {
+		return err
+	}
+	return p.sendToPrinter(BuildTicket(data, tmpl))
+}
 
+// BuildTicket returns the ESC/POS byte stream for a ticket without sending
+// it anywhere, so it can be previewed (see RenderPNG) or spooled.
+func BuildTicket(data TicketData, tmpl TicketTemplate) []byte {
 	// Resolve paper size (fallback to 80 mm)
 	paperSize := tmpl.PaperSize
 	if paperSize != Paper80mm && paperSize != Paper58mm {
 		paperSize = Paper80mm
 	}
-	charWidth, numberSize := paperLayout(paperSize)
+	charWidth, numberSize, dotWidth := paperLayout(paperSize)
 	separator := strings.Repeat("-", charWidth) + "\n"
 
 	// Feed lines before cut — clamp to sensible range
@@ -133,9 +228,17 @@ func (p *Printer) PrintTicket(data TicketData, tmpl TicketTemplate) error {
 
 	var buf bytes.Buffer
 	buf.Write(INIT)
+	buf.Write(ALIGN_CENTER)
+
+	// ── Logo (optional) ──────────────────────────────────────────────────────
+	// A logo that fails to decode is skipped rather than blocking the ticket.
+	if tmpl.ShowLogo && tmpl.Logo != "" {
+		if img, err := decodeLogo(tmpl.Logo); err == nil {
+			buf.Write(rasterImage(img, dotWidth, logoMaxHeight))
+		}
+	}
 
 	// ── Header ───────────────────────────────────────────────────────────────
-	buf.Write(ALIGN_CENTER)
 	buf.Write(BOLD_ON)
 	header := tmpl.Header
 	if header == "" {
@@ -184,6 +287,27 @@ func (p *Printer) PrintTicket(data TicketData, tmpl TicketTemplate) error {
 		buf.Write(FONT_A)
 	}
 
+	// ── Estimated wait (optional) ────────────────────────────────────────────
+	if tmpl.ShowETA && data.ETA != "" {
+		buf.Write(FONT_B)
+		buf.WriteString("Perkiraan tunggu: " + data.ETA + "\n")
+		buf.Write(FONT_A)
+	}
+
+	// ── QR code / barcode (optional) ─────────────────────────────────────────
+	if tmpl.ShowQR {
+		moduleSize := byte(6)
+		if paperSize == Paper58mm {
+			moduleSize = 4
+		}
+		buf.Write(FEED_LINE)
+		buf.Write(qrCode(qrPayload(tmpl, data.QueueNumber), moduleSize))
+	}
+	if tmpl.ShowBarcode {
+		buf.Write(FEED_LINE)
+		buf.Write(barcode(data.QueueNumber))
+	}
+
 	// ── Footer (optional) ────────────────────────────────────────────────────
 	if tmpl.ShowFooter {
 		buf.WriteString(separator)
@@ -217,7 +341,7 @@ func (p *Printer) PrintTicket(data TicketData, tmpl TicketTemplate) error {
 	// GS V 0x42 n  →  feed n lines then partial cut
 	buf.Write([]byte{GS, 'V', 0x42, byte(feedLines)})
 
-	return p.sendToPrinter(buf.Bytes())
+	return buf.Bytes()
 }
 
 // PrintTicketSimple prints a ticket with default template (for backward compatibility)
@@ -225,158 +349,9 @@ func (p *Printer) PrintTicketSimple(data TicketData) error {
 	return p.PrintTicket(data, DefaultTemplate())
 }
 
-// sendToPrinter sends raw data to the Windows printer using PowerShell
+// sendToPrinter sends raw data through the configured transport
 func (p *Printer) sendToPrinter(data []byte) error {
-	printerName := p.config.PrinterName
-	if printerName == "" {
-		printerName = "ECO80"
-	}
-
-	// Create temp file with raw print data
-	tempDir := os.TempDir()
-	tempFile := filepath.Join(tempDir, fmt.Sprintf("ticket_%d.bin", time.Now().UnixNano()))
-
-	if err := os.WriteFile(tempFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write temp file: %w", err)
-	}
-	defer os.Remove(tempFile)
-
-	// Use PowerShell to send raw data to printer
-	// This is the most reliable method for Windows
-	psScript := fmt.Sprintf(`
-$printerName = '%s'
-$filePath = '%s'
-
-# Get printer
-$printer = Get-WmiObject -Query "SELECT * FROM Win32_Printer WHERE Name='$printerName'" -ErrorAction SilentlyContinue
-
-if ($printer -eq $null) {
-    # Try without exact match
-    $printer = Get-WmiObject -Query "SELECT * FROM Win32_Printer WHERE Name LIKE '%%$printerName%%'" -ErrorAction SilentlyContinue
-}
-
-if ($printer -eq $null) {
-    Write-Error "Printer '$printerName' not found"
-    exit 1
-}
-
-# Get printer port
-$portName = $printer.PortName
-
-# Read file content as bytes
-$bytes = [System.IO.File]::ReadAllBytes($filePath)
-
-# Try direct port write first (works for USB printers)
-try {
-    $port = [System.IO.Ports.SerialPort]::GetPortNames() | Where-Object { $_ -eq $portName }
-    if ($port) {
-        $serialPort = New-Object System.IO.Ports.SerialPort $portName, 9600
-        $serialPort.Open()
-        $serialPort.Write($bytes, 0, $bytes.Length)
-        $serialPort.Close()
-        exit 0
-    }
-} catch {}
-
-# Fallback: Use raw print job via .NET
-Add-Type -AssemblyName System.Drawing
-
-$doc = New-Object System.Drawing.Printing.PrintDocument
-$doc.PrinterSettings.PrinterName = $printerName
-
-# For raw printing, we use RawPrinterHelper
-$helper = @"
-using System;
-using System.Runtime.InteropServices;
-
-public class RawPrinterHelper
-{
-    [StructLayout(LayoutKind.Sequential, CharSet = CharSet.Ansi)]
-    public class DOCINFOA
-    {
-        [MarshalAs(UnmanagedType.LPStr)] public string pDocName;
-        [MarshalAs(UnmanagedType.LPStr)] public string pOutputFile;
-        [MarshalAs(UnmanagedType.LPStr)] public string pDataType;
-    }
-
-    [DllImport("winspool.Drv", EntryPoint = "OpenPrinterA", CharSet = CharSet.Ansi, SetLastError = true)]
-    public static extern bool OpenPrinter([MarshalAs(UnmanagedType.LPStr)] string szPrinter, out IntPtr hPrinter, IntPtr pd);
-
-    [DllImport("winspool.Drv", EntryPoint = "ClosePrinter", SetLastError = true)]
-    public static extern bool ClosePrinter(IntPtr hPrinter);
-
-    [DllImport("winspool.Drv", EntryPoint = "StartDocPrinterA", CharSet = CharSet.Ansi, SetLastError = true)]
-    public static extern bool StartDocPrinter(IntPtr hPrinter, Int32 level, [In, MarshalAs(UnmanagedType.LPStruct)] DOCINFOA di);
-
-    [DllImport("winspool.Drv", EntryPoint = "EndDocPrinter", SetLastError = true)]
-    public static extern bool EndDocPrinter(IntPtr hPrinter);
-
-    [DllImport("winspool.Drv", EntryPoint = "StartPagePrinter", SetLastError = true)]
-    public static extern bool StartPagePrinter(IntPtr hPrinter);
-
-    [DllImport("winspool.Drv", EntryPoint = "EndPagePrinter", SetLastError = true)]
-    public static extern bool EndPagePrinter(IntPtr hPrinter);
-
-    [DllImport("winspool.Drv", EntryPoint = "WritePrinter", SetLastError = true)]
-    public static extern bool WritePrinter(IntPtr hPrinter, IntPtr pBytes, Int32 dwCount, out Int32 dwWritten);
-
-    public static bool SendBytesToPrinter(string szPrinterName, byte[] bytes)
-    {
-        IntPtr hPrinter = IntPtr.Zero;
-        DOCINFOA di = new DOCINFOA();
-        di.pDocName = "Queue Ticket";
-        di.pDataType = "RAW";
-
-        if (OpenPrinter(szPrinterName.Normalize(), out hPrinter, IntPtr.Zero))
-        {
-            if (StartDocPrinter(hPrinter, 1, di))
-            {
-                if (StartPagePrinter(hPrinter))
-                {
-                    IntPtr pUnmanagedBytes = Marshal.AllocCoTaskMem(bytes.Length);
-                    Marshal.Copy(bytes, 0, pUnmanagedBytes, bytes.Length);
-                    int dwWritten;
-                    WritePrinter(hPrinter, pUnmanagedBytes, bytes.Length, out dwWritten);
-                    Marshal.FreeCoTaskMem(pUnmanagedBytes);
-                    EndPagePrinter(hPrinter);
-                }
-                EndDocPrinter(hPrinter);
-            }
-            ClosePrinter(hPrinter);
-            return true;
-        }
-        return false;
-    }
-}
-"@
-
-Add-Type -TypeDefinition $helper -Language CSharp -ErrorAction SilentlyContinue
-
-[RawPrinterHelper]::SendBytesToPrinter($printerName, $bytes)
-`, printerName, escapeForPS(tempFile))
-
-	cmd := exec.Command("powershell", "-NoProfile", "-ExecutionPolicy", "Bypass", "-Command", psScript)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("print failed: %v, output: %s", err, string(output))
-	}
-
-	return nil
-}
-
-// escapeForPS escapes a string for use in PowerShell
-func escapeForPS(s string) string {
-	result := ""
-	for _, c := range s {
-		if c == '\\' {
-			result += "\\\\"
-		} else if c == '\'' {
-			result += "''"
-		} else {
-			result += string(c)
-		}
-	}
-	return result
+	return p.transport.Send(data)
 }
 
 // TestPrint sends a test print to verify printer connection
@@ -0,0 +1,166 @@
+package printer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// Logos are stored no wider than 80 mm paper and no taller than ~30 mm, then
+// scaled again at print time to the paper actually loaded (see paperLayout).
+const logoMaxHeight = 240
+
+// logoMaxPixels bounds the decoded size of an uploaded logo; a small PNG
+// file can otherwise expand to gigabytes of pixels.
+const logoMaxPixels = 4096 * 4096
+
+// ErrLogoTooLarge is returned by PrepareLogo for images over logoMaxPixels.
+var ErrLogoTooLarge = errors.New("logo image is too large")
+
+// PrepareLogo decodes an uploaded PNG and returns it as a base64 grayscale
+// PNG sized for 80 mm paper, ready to be stored in settings and carried in
+// TicketTemplate.Logo. Transparent pixels become white.
+func PrepareLogo(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	img, err := decodePNG(data)
+	if err != nil {
+		return "", err
+	}
+
+	_, _, dotWidth := paperLayout(Paper80mm)
+	gray := scaleGray(img, dotWidth, logoMaxHeight)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, gray); err != nil {
+		return "", fmt.Errorf("failed to encode logo: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeLogo decodes a logo stored by PrepareLogo.
+func decodeLogo(logo string) (image.Image, error) {
+	data, err := base64.StdEncoding.DecodeString(logo)
+	if err != nil {
+		return nil, err
+	}
+	return decodePNG(data)
+}
+
+// decodePNG decodes a PNG after checking from its header that the image is
+// no larger than logoMaxPixels.
+func decodePNG(data []byte) (image.Image, error) {
+	cfg, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PNG: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > logoMaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrLogoTooLarge, cfg.Width, cfg.Height)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PNG: %w", err)
+	}
+	return img, nil
+}
+
+// rasterImage returns the GS v 0 commands that print img as a 1-bit raster
+// image, scaled down to fit maxWidth × maxHeight dots and Floyd–Steinberg
+// dithered.
+func rasterImage(img image.Image, maxWidth, maxHeight int) []byte {
+	gray := scaleGray(img, maxWidth, maxHeight)
+	w, h := gray.Bounds().Dx(), gray.Bounds().Dy()
+
+	levels := make([]float32, w*h)
+	for i := range levels {
+		levels[i] = float32(gray.Pix[(i/w)*gray.Stride+i%w])
+	}
+
+	rowBytes := (w + 7) / 8
+	bits := make([]byte, rowBytes*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			old := levels[y*w+x]
+			value := float32(255)
+			if old < 128 {
+				value = 0
+				bits[y*rowBytes+x/8] |= 0x80 >> (x % 8)
+			}
+			diff := old - value
+			if x+1 < w {
+				levels[y*w+x+1] += diff * 7 / 16
+			}
+			if y+1 < h {
+				if x > 0 {
+					levels[(y+1)*w+x-1] += diff * 3 / 16
+				}
+				levels[(y+1)*w+x] += diff * 5 / 16
+				if x+1 < w {
+					levels[(y+1)*w+x+1] += diff * 1 / 16
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	// GS v 0 m xL xH yL yH — m=0 normal density, x in bytes, y in dots
+	buf.Write([]byte{GS, 'v', '0', 0,
+		byte(rowBytes % 256), byte(rowBytes / 256),
+		byte(h % 256), byte(h / 256)})
+	buf.Write(bits)
+	return buf.Bytes()
+}
+
+// scaleGray converts img to grayscale over a white background, shrinking it
+// (never enlarging) with area averaging to fit maxWidth × maxHeight.
+func scaleGray(img image.Image, maxWidth, maxHeight int) *image.Gray {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	dw, dh := sw, sh
+	if dw > maxWidth {
+		dh = dh * maxWidth / dw
+		dw = maxWidth
+	}
+	if dh > maxHeight {
+		dw = dw * maxHeight / dh
+		dh = maxHeight
+	}
+	dw, dh = max(dw, 1), max(dh, 1)
+
+	dst := image.NewGray(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+
+			var sum, n int
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					sum += luminance(img.At(b.Min.X+sx, b.Min.Y+sy))
+					n++
+				}
+			}
+			dst.SetGray(x, y, color.Gray{Y: uint8(sum / n)})
+		}
+	}
+	return dst
+}
+
+// luminance returns the 0–255 brightness of c composited over white.
+func luminance(c color.Color) int {
+	r, g, b, a := c.RGBA() // premultiplied, 0–0xffff
+	y := (299*r + 587*g + 114*b) / 1000
+	y += 0xffff - a
+	if y > 0xffff {
+		y = 0xffff
+	}
+	return int(y >> 8)
+}
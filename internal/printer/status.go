@@ -0,0 +1,221 @@
+package printer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Real-time status requests (DLE EOT n). The printer answers each with one
+// status byte, even while it is offline.
+const (
+	DLE = byte(0x10)
+	EOT = byte(0x04)
+
+	statusPrinter = 1 // printer status: online/offline
+	statusOffline = 2 // offline cause: cover open, paper end
+	statusError   = 3 // error cause: mechanical, autocutter, unrecoverable
+	statusPaper   = 4 // roll paper sensor: near end, end
+)
+
+// statusTimeout bounds a status query; printers answer within milliseconds.
+const statusTimeout = 2 * time.Second
+
+// statusRetryInterval is how long tickets are printed without a status
+// check after a query failed, so a printer that never answers does not
+// delay every ticket by statusTimeout.
+const statusRetryInterval = time.Minute
+
+// Printer status codes reported by agents (see Status.Code)
+const (
+	StatusOK           = "ok"
+	StatusPaperNearEnd = "paper_near_end"
+	StatusPaperOut     = "paper_out"
+	StatusCoverOpen    = "cover_open"
+	StatusHardware     = "hardware_error"
+	StatusOffline      = "offline"
+)
+
+// StatusError is a printer condition found by a status query.
+type StatusError struct {
+	Code    string // one of the Status* codes
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// Conditions returned by Status.Err, Status.Warning and PrintTicket; compare
+// with errors.Is.
+var (
+	ErrPaperNearEnd = &StatusError{Code: StatusPaperNearEnd, Message: "printer paper is nearly out"}
+	ErrPaperOut     = &StatusError{Code: StatusPaperOut, Message: "printer is out of paper"}
+	ErrCoverOpen    = &StatusError{Code: StatusCoverOpen, Message: "printer cover is open"}
+	ErrHardware     = &StatusError{Code: StatusHardware, Message: "printer reports a mechanical or cutter error"}
+	ErrOffline      = &StatusError{Code: StatusOffline, Message: "printer is offline"}
+)
+
+// ErrStatusUnsupported is returned by QueryStatus for transports that cannot
+// read from the printer (Windows spooler, CUPS, file).
+var ErrStatusUnsupported = errors.New("printer transport does not support status queries")
+
+// StatusReader is implemented by transports that can read the printer's
+// replies.
+type StatusReader interface {
+	QueryStatus() (*Status, error)
+}
+
+// Status is the printer state decoded from DLE EOT 1–4.
+type Status struct {
+	Online       bool `json:"online"`
+	CoverOpen    bool `json:"cover_open"`
+	PaperOut     bool `json:"paper_out"`
+	PaperNearEnd bool `json:"paper_near_end"`
+	Hardware     bool `json:"hardware_error"` // mechanical, autocutter or unrecoverable error
+}
+
+// Err returns the condition that prevents printing, or nil. Paper near end
+// is only a warning and does not block printing.
+func (s *Status) Err() error {
+	switch {
+	case s.CoverOpen:
+		return ErrCoverOpen
+	case s.PaperOut:
+		return ErrPaperOut
+	case s.Hardware:
+		return ErrHardware
+	case !s.Online:
+		return ErrOffline
+	}
+	return nil
+}
+
+// Warning returns ErrPaperNearEnd when the roll needs replacing soon but
+// the printer can still print, or nil.
+func (s *Status) Warning() error {
+	if s.Err() == nil && s.PaperNearEnd {
+		return ErrPaperNearEnd
+	}
+	return nil
+}
+
+// Code returns the most severe condition as a status code, StatusOK when
+// the printer is ready.
+func (s *Status) Code() string {
+	if err := s.Err(); err != nil {
+		return err.(*StatusError).Code
+	}
+	if err := s.Warning(); err != nil {
+		return err.(*StatusError).Code
+	}
+	return StatusOK
+}
+
+// QueryStatus reads the printer's real-time status. It returns
+// ErrStatusUnsupported when the transport cannot read from the printer.
+func (p *Printer) QueryStatus() (*Status, error) {
+	reader, ok := p.transport.(StatusReader)
+	if !ok {
+		return nil, ErrStatusUnsupported
+	}
+	status, err := reader.QueryStatus()
+
+	p.mu.Lock()
+	if err != nil {
+		p.statusFailedAt = time.Now()
+	} else {
+		p.statusFailedAt = time.Time{}
+	}
+	p.mu.Unlock()
+	return status, err
+}
+
+// checkReady refuses to print into a printer that reports a blocking
+// condition. Printers that cannot be queried, or do not answer, are
+// printed to as before; after a failed query the check is skipped for
+// statusRetryInterval or until QueryStatus succeeds again.
+func (p *Printer) checkReady() error {
+	p.mu.Lock()
+	skip := !p.statusFailedAt.IsZero() && time.Since(p.statusFailedAt) < statusRetryInterval
+	p.mu.Unlock()
+	if skip {
+		return nil
+	}
+
+	status, err := p.QueryStatus()
+	if err != nil {
+		return nil
+	}
+	return status.Err()
+}
+
+// queryStatus sends DLE EOT 1–4 over rw and decodes the replies.
+func queryStatus(rw io.ReadWriter) (*Status, error) {
+	var replies [5]byte
+	for n := byte(statusPrinter); n <= statusPaper; n++ {
+		if _, err := rw.Write([]byte{DLE, EOT, n}); err != nil {
+			return nil, fmt.Errorf("failed to send status request: %w", err)
+		}
+		reply := make([]byte, 1)
+		if _, err := io.ReadFull(rw, reply); err != nil {
+			return nil, fmt.Errorf("printer did not answer status request %d: %w", n, err)
+		}
+		// Bits 1 and 4 are always set and bits 0 and 7 always clear
+		if reply[0]&0x93 != 0x12 {
+			return nil, fmt.Errorf("invalid status reply 0x%02x to request %d", reply[0], n)
+		}
+		replies[n] = reply[0]
+	}
+
+	return &Status{
+		Online:       replies[statusPrinter]&0x08 == 0,
+		CoverOpen:    replies[statusOffline]&0x04 != 0,
+		PaperOut:     replies[statusOffline]&0x20 != 0 || replies[statusPaper]&0x60 != 0,
+		PaperNearEnd: replies[statusPaper]&0x0C != 0,
+		Hardware:     replies[statusError]&0x2C != 0,
+	}, nil
+}
+
+func (t *tcpTransport) QueryStatus() (*Status, error) {
+	conn, err := net.DialTimeout("tcp", t.address, statusTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to printer %s: %w", t.address, err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(statusTimeout))
+	return queryStatus(conn)
+}
+
+func (t *deviceTransport) QueryStatus() (*Status, error) {
+	f, err := os.OpenFile(t.path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open printer device %s: %w", t.path, err)
+	}
+
+	// Not every device supports deadlines; a printer that never answers
+	// must not hang the caller, so the query runs on its own goroutine.
+	f.SetDeadline(time.Now().Add(statusTimeout))
+	type result struct {
+		status *Status
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		status, err := queryStatus(f)
+		done <- result{status, err}
+	}()
+
+	select {
+	case res := <-done:
+		f.Close()
+		return res.status, res.err
+	case <-time.After(statusTimeout):
+		f.Close()
+		return nil, fmt.Errorf("printer device %s did not answer status request", t.path)
+	}
+}
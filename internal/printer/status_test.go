@@ -0,0 +1,128 @@
+package printer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakePrinter answers each DLE EOT n request with replies[n].
+type fakePrinter struct {
+	replies map[byte]byte
+	pending bytes.Buffer
+}
+
+func (f *fakePrinter) Write(p []byte) (int, error) {
+	if len(p) != 3 || p[0] != DLE || p[1] != EOT {
+		return 0, errors.New("unexpected request")
+	}
+	reply, ok := f.replies[p[2]]
+	if ok {
+		f.pending.WriteByte(reply)
+	}
+	return len(p), nil
+}
+
+func (f *fakePrinter) Read(p []byte) (int, error) {
+	if f.pending.Len() == 0 {
+		return 0, io.EOF
+	}
+	return f.pending.Read(p)
+}
+
+// Replies of a ready printer: the fixed bits only
+const ready = 0x12
+
+func TestQueryStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies map[byte]byte
+		code    string
+		err     error
+		warning error
+	}{
+		{"ready", map[byte]byte{1: ready, 2: ready, 3: ready, 4: ready}, StatusOK, nil, nil},
+		{"paper out", map[byte]byte{1: ready | 0x08, 2: ready | 0x20, 3: ready, 4: ready | 0x6C}, StatusPaperOut, ErrPaperOut, nil},
+		{"paper near end", map[byte]byte{1: ready, 2: ready, 3: ready, 4: ready | 0x0C}, StatusPaperNearEnd, nil, ErrPaperNearEnd},
+		{"cover open", map[byte]byte{1: ready | 0x08, 2: ready | 0x04, 3: ready, 4: ready}, StatusCoverOpen, ErrCoverOpen, nil},
+		{"cutter error", map[byte]byte{1: ready | 0x08, 2: ready | 0x40, 3: ready | 0x08, 4: ready}, StatusHardware, ErrHardware, nil},
+		{"offline", map[byte]byte{1: ready | 0x08, 2: ready, 3: ready, 4: ready}, StatusOffline, ErrOffline, nil},
+	}
+	for _, tt := range tests {
+		status, err := queryStatus(&fakePrinter{replies: tt.replies})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if status.Code() != tt.code || status.Err() != tt.err || status.Warning() != tt.warning {
+			t.Errorf("%s: got %s (%v, warning %v), want %s", tt.name, status.Code(), status.Err(), status.Warning(), tt.code)
+		}
+	}
+}
+
+func TestQueryStatusBadReply(t *testing.T) {
+	if _, err := queryStatus(&fakePrinter{replies: map[byte]byte{1: ready, 2: ready}}); err == nil {
+		t.Error("no reply to DLE EOT 3: got a status")
+	}
+	if _, err := queryStatus(&fakePrinter{replies: map[byte]byte{1: 0xFF, 2: ready, 3: ready, 4: ready}}); err == nil {
+		t.Error("invalid reply byte: got a status")
+	}
+}
+
+// statusTransport counts the status queries and answers them with err or
+// a ready printer.
+type statusTransport struct {
+	queries int
+	err     error
+	sent    int
+}
+
+func (s *statusTransport) Send(data []byte) error {
+	s.sent++
+	return nil
+}
+
+func (s *statusTransport) QueryStatus() (*Status, error) {
+	s.queries++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &Status{Online: true}, nil
+}
+
+// A printer that does not answer status queries is queried once, not
+// before every ticket.
+func TestCheckReadySkipsAfterFailedQuery(t *testing.T) {
+	transport := &statusTransport{err: errors.New("timeout")}
+	p := &Printer{config: PrinterConfig{Enabled: true}, transport: transport}
+	data := TicketData{QueueNumber: "A001", TypeName: "Umum"}
+
+	for i := 0; i < 3; i++ {
+		if err := p.PrintTicket(data, DefaultTemplate()); err != nil {
+			t.Fatalf("PrintTicket: %v", err)
+		}
+	}
+	if transport.queries != 1 || transport.sent != 3 {
+		t.Fatalf("%d queries for %d tickets, want 1 for 3", transport.queries, transport.sent)
+	}
+
+	// The retry interval passed
+	p.statusFailedAt = time.Now().Add(-statusRetryInterval)
+	p.PrintTicket(data, DefaultTemplate())
+	if transport.queries != 2 {
+		t.Fatalf("%d queries after the retry interval, want 2", transport.queries)
+	}
+
+	// A status report that gets an answer turns the checks back on
+	transport.err = nil
+	if _, err := p.QueryStatus(); err != nil {
+		t.Fatal(err)
+	}
+	p.PrintTicket(data, DefaultTemplate())
+	p.PrintTicket(data, DefaultTemplate())
+	if transport.queries != 5 {
+		t.Fatalf("%d queries after the printer answered again, want 5", transport.queries)
+	}
+}
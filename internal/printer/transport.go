@@ -0,0 +1,318 @@
+package printer
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// Transport delivers raw ESC/POS bytes to a printer.
+type Transport interface {
+	Send(data []byte) error
+}
+
+// Transports selectable with PrinterConfig.Transport
+const (
+	TransportWindows = "windows" // Windows spooler via PowerShell (default on Windows)
+	TransportTCP     = "tcp"     // raw TCP to an Ethernet printer, e.g. 192.168.1.50:9100
+	TransportDevice  = "device"  // device file, e.g. /dev/usb/lp0
+	TransportCUPS    = "cups"    // lp -o raw (default elsewhere)
+	TransportFile    = "file"    // append to a file, "-" = stdout (for testing)
+)
+
+// DefaultTCPPort is the raw printing port of most Ethernet thermal printers.
+const DefaultTCPPort = "9100"
+
+// NewTransport returns the transport selected by cfg.Transport.
+func NewTransport(cfg PrinterConfig) (Transport, error) {
+	name := cfg.Transport
+	if name == "" {
+		name = TransportCUPS
+		if runtime.GOOS == "windows" {
+			name = TransportWindows
+		}
+	}
+
+	switch name {
+	case TransportWindows:
+		return &windowsTransport{printerName: cfg.PrinterName}, nil
+	case TransportTCP:
+		if cfg.Address == "" {
+			return nil, fmt.Errorf("printer address is required for the tcp transport")
+		}
+		address := cfg.Address
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, DefaultTCPPort)
+		}
+		return &tcpTransport{address: address}, nil
+	case TransportDevice:
+		if cfg.Device == "" {
+			return nil, fmt.Errorf("printer device is required for the device transport")
+		}
+		return &deviceTransport{path: cfg.Device}, nil
+	case TransportCUPS:
+		return &cupsTransport{printerName: cfg.PrinterName}, nil
+	case TransportFile:
+		path := cfg.Device
+		if path == "" {
+			path = "-"
+		}
+		return &fileTransport{path: path}, nil
+	default:
+		return nil, fmt.Errorf("unknown printer transport %q", name)
+	}
+}
+
+// brokenTransport reports a configuration error on every print.
+type brokenTransport struct {
+	err error
+}
+
+func (t *brokenTransport) Send(data []byte) error {
+	return t.err
+}
+
+// tcpTransport sends raw data to a network printer (JetDirect / port 9100).
+type tcpTransport struct {
+	address string
+}
+
+func (t *tcpTransport) Send(data []byte) error {
+	conn, err := net.DialTimeout("tcp", t.address, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to printer %s: %w", t.address, err)
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(data); err != nil {
+		return fmt.Errorf("failed to send to printer %s: %w", t.address, err)
+	}
+	return nil
+}
+
+// deviceTransport writes to a printer device file such as /dev/usb/lp0.
+type deviceTransport struct {
+	path string
+}
+
+func (t *deviceTransport) Send(data []byte) error {
+	f, err := os.OpenFile(t.path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open printer device %s: %w", t.path, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to write to printer device %s: %w", t.path, err)
+	}
+	return nil
+}
+
+// cupsTransport submits a raw job with lp; an empty printer name uses the
+// CUPS default printer.
+type cupsTransport struct {
+	printerName string
+}
+
+func (t *cupsTransport) Send(data []byte) error {
+	args := []string{"-o", "raw"}
+	if t.printerName != "" {
+		args = append([]string{"-d", t.printerName}, args...)
+	}
+
+	cmd := exec.Command("lp", args...)
+	cmd.Stdin = bytes.NewReader(data)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("lp failed: %v, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// fileTransport appends raw data to a file, or writes it to stdout for "-".
+// Useful to inspect tickets without a printer.
+type fileTransport struct {
+	path string
+}
+
+func (t *fileTransport) Send(data []byte) error {
+	if t.path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	f, err := os.OpenFile(t.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", t.path, err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+	return err
+}
+
+// windowsTransport prints through the Windows spooler (winspool) using
+// PowerShell, so any printer installed in Windows can be used.
+type windowsTransport struct {
+	printerName string
+}
+
+// Send writes raw data to the Windows printer using PowerShell
+func (t *windowsTransport) Send(data []byte) error {
+	printerName := t.printerName
+	if printerName == "" {
+		printerName = "ECO80"
+	}
+
+	// Create temp file with raw print data
+	tempDir := os.TempDir()
+	tempFile := filepath.Join(tempDir, fmt.Sprintf("ticket_%d.bin", time.Now().UnixNano()))
+
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	defer os.Remove(tempFile)
+
+	// Use PowerShell to send raw data to printer
+	// This is the most reliable method for Windows
+	psScript := fmt.Sprintf(`
+$printerName = '%s'
+$filePath = '%s'
+
+# Get printer
+$printer = Get-WmiObject -Query "SELECT * FROM Win32_Printer WHERE Name='$printerName'" -ErrorAction SilentlyContinue
+
+if ($printer -eq $null) {
+    # Try without exact match
+    $printer = Get-WmiObject -Query "SELECT * FROM Win32_Printer WHERE Name LIKE '%%$printerName%%'" -ErrorAction SilentlyContinue
+}
+
+if ($printer -eq $null) {
+    Write-Error "Printer '$printerName' not found"
+    exit 1
+}
+
+# Get printer port
+$portName = $printer.PortName
+
+# Read file content as bytes
+$bytes = [System.IO.File]::ReadAllBytes($filePath)
+
+# Try direct port write first (works for USB printers)
+try {
+    $port = [System.IO.Ports.SerialPort]::GetPortNames() | Where-Object { $_ -eq $portName }
+    if ($port) {
+        $serialPort = New-Object System.IO.Ports.SerialPort $portName, 9600
+        $serialPort.Open()
+        $serialPort.Write($bytes, 0, $bytes.Length)
+        $serialPort.Close()
+        exit 0
+    }
+} catch {}
+
+# Fallback: Use raw print job via .NET
+Add-Type -AssemblyName System.Drawing
+
+$doc = New-Object System.Drawing.Printing.PrintDocument
+$doc.PrinterSettings.PrinterName = $printerName
+
+# For raw printing, we use RawPrinterHelper
+$helper = @"
+using System;
+using System.Runtime.InteropServices;
+
+public class RawPrinterHelper
+{
+    [StructLayout(LayoutKind.Sequential, CharSet = CharSet.Ansi)]
+    public class DOCINFOA
+    {
+        [MarshalAs(UnmanagedType.LPStr)] public string pDocName;
+        [MarshalAs(UnmanagedType.LPStr)] public string pOutputFile;
+        [MarshalAs(UnmanagedType.LPStr)] public string pDataType;
+    }
+
+    [DllImport("winspool.Drv", EntryPoint = "OpenPrinterA", CharSet = CharSet.Ansi, SetLastError = true)]
+    public static extern bool OpenPrinter([MarshalAs(UnmanagedType.LPStr)] string szPrinter, out IntPtr hPrinter, IntPtr pd);
+
+    [DllImport("winspool.Drv", EntryPoint = "ClosePrinter", SetLastError = true)]
+    public static extern bool ClosePrinter(IntPtr hPrinter);
+
+    [DllImport("winspool.Drv", EntryPoint = "StartDocPrinterA", CharSet = CharSet.Ansi, SetLastError = true)]
+    public static extern bool StartDocPrinter(IntPtr hPrinter, Int32 level, [In, MarshalAs(UnmanagedType.LPStruct)] DOCINFOA di);
+
+    [DllImport("winspool.Drv", EntryPoint = "EndDocPrinter", SetLastError = true)]
+    public static extern bool EndDocPrinter(IntPtr hPrinter);
+
+    [DllImport("winspool.Drv", EntryPoint = "StartPagePrinter", SetLastError = true)]
+    public static extern bool StartPagePrinter(IntPtr hPrinter);
+
+    [DllImport("winspool.Drv", EntryPoint = "EndPagePrinter", SetLastError = true)]
+    public static extern bool EndPagePrinter(IntPtr hPrinter);
+
+    [DllImport("winspool.Drv", EntryPoint = "WritePrinter", SetLastError = true)]
+    public static extern bool WritePrinter(IntPtr hPrinter, IntPtr pBytes, Int32 dwCount, out Int32 dwWritten);
+
+    public static bool SendBytesToPrinter(string szPrinterName, byte[] bytes)
+    {
+        IntPtr hPrinter = IntPtr.Zero;
+        DOCINFOA di = new DOCINFOA();
+        di.pDocName = "Queue Ticket";
+        di.pDataType = "RAW";
+
+        if (OpenPrinter(szPrinterName.Normalize(), out hPrinter, IntPtr.Zero))
+        {
+            if (StartDocPrinter(hPrinter, 1, di))
+            {
+                if (StartPagePrinter(hPrinter))
+                {
+                    IntPtr pUnmanagedBytes = Marshal.AllocCoTaskMem(bytes.Length);
+                    Marshal.Copy(bytes, 0, pUnmanagedBytes, bytes.Length);
+                    int dwWritten;
+                    WritePrinter(hPrinter, pUnmanagedBytes, bytes.Length, out dwWritten);
+                    Marshal.FreeCoTaskMem(pUnmanagedBytes);
+                    EndPagePrinter(hPrinter);
+                }
+                EndDocPrinter(hPrinter);
+            }
+            ClosePrinter(hPrinter);
+            return true;
+        }
+        return false;
+    }
+}
+"@
+
+Add-Type -TypeDefinition $helper -Language CSharp -ErrorAction SilentlyContinue
+
+[RawPrinterHelper]::SendBytesToPrinter($printerName, $bytes)
+`, printerName, escapeForPS(tempFile))
+
+	cmd := exec.Command("powershell", "-NoProfile", "-ExecutionPolicy", "Bypass", "-Command", psScript)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("print failed: %v, output: %s", err, string(output))
+	}
+
+	return nil
+}
+
+// escapeForPS escapes a string for use in PowerShell
+func escapeForPS(s string) string {
+	result := ""
+	for _, c := range s {
+		if c == '\\' {
+			result += "\\\\"
+		} else if c == '\'' {
+			result += "''"
+		} else {
+			result += string(c)
+		}
+	}
+	return result
+}
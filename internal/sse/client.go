@@ -0,0 +1,203 @@
+package sse
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"queue-system/internal/config"
+)
+
+type ClientType int
+
+const (
+	ClientTypeDisplay ClientType = iota
+	ClientTypeCounter
+	ClientTypePrinter
+	ClientTypeStatus
+	ClientTypeAdmin
+)
+
+// String returns the name used for the client type in the sse config and
+// the client list.
+func (t ClientType) String() string {
+	switch t {
+	case ClientTypeCounter:
+		return "counter"
+	case ClientTypePrinter:
+		return "printer"
+	case ClientTypeStatus:
+		return "status"
+	case ClientTypeAdmin:
+		return "admin"
+	}
+	return "display"
+}
+
+// stateEvents are messages that only tell a page to refresh its state, so a
+// newer one makes queued ones of the same type redundant. Calls, transfers
+// of a ticket and print jobs are not: each of them must arrive.
+var stateEvents = map[string]bool{
+	"queue_added":        true,
+	"queue_updated":      true,
+	"queue_reset":        true,
+	"eta_updated":        true,
+	"settings_updated":   true,
+	"operator_changed":   true,
+	"status_changed":     true,
+	"print_agent_status": true,
+}
+
+type Client struct {
+	ID          string
+	ClientType  ClientType
+	Topics      []string // subscriptions, may contain "*" segments
+	AgentID     string   // printer clients: the print agent
+	RemoteAddr  string
+	ConnectedAt time.Time
+
+	closing bool // being disconnected as too slow; guarded by Hub.mu
+
+	size   int           // events queued before the policy applies
+	policy string        // config.SlowClient* policy when the queue is full
+	wake   chan struct{} // signalled when events are queued
+	done   chan struct{} // closed when the client is unregistered
+
+	mu        sync.Mutex
+	queue     []Event
+	lastID    uint64 // last event written to the client
+	sent      uint64
+	dropped   uint64
+	coalesced uint64
+}
+
+// newClient creates a client for the stream of request r that queues up to
+// size events. The hub sets its policy when it is registered.
+func newClient(r *http.Request, id string, clientType ClientType, size int, topics ...string) *Client {
+	return &Client{
+		ID:          id,
+		ClientType:  clientType,
+		Topics:      topics,
+		RemoteAddr:  r.RemoteAddr,
+		ConnectedAt: time.Now(),
+		size:        size,
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+// subscribed reports whether the client receives events published to topic.
+func (c *Client) subscribed(topic string) bool {
+	for _, t := range c.Topics {
+		if topicMatch(t, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribedRoot reports whether any of the client's topics is under root.
+func (c *Client) subscribedRoot(root string) bool {
+	for _, t := range c.Topics {
+		if r := topicRoot(t); r == root || r == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// push queues an event, applying the client's policy when the queue is
+// full. It returns false when the client has to be disconnected instead.
+func (c *Client) push(event Event) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.policy == config.SlowClientCoalesce && stateEvents[event.typ] {
+		kept := c.queue[:0]
+		for _, queued := range c.queue {
+			if queued.typ == event.typ {
+				c.coalesced++
+				continue
+			}
+			kept = append(kept, queued)
+		}
+		c.queue = kept
+	}
+
+	if len(c.queue) >= c.size {
+		if c.policy != config.SlowClientDropOldest {
+			return false
+		}
+		c.queue = c.queue[1:]
+		c.dropped++
+	}
+	c.queue = append(c.queue, event)
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// take removes and returns the queued events.
+func (c *Client) take() []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	events := c.queue
+	c.queue = nil
+	return events
+}
+
+// markSent records events written to the client.
+func (c *Client) markSent(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent += uint64(len(events))
+	c.lastID = events[len(events)-1].ID
+}
+
+// ClientInfo describes a connected client for the admin client list.
+type ClientInfo struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Topics      []string  `json:"topics"`
+	AgentID     string    `json:"agent_id,omitempty"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Policy      string    `json:"policy"`
+	Sent        uint64    `json:"sent"`
+	Dropped     uint64    `json:"dropped"`
+	Coalesced   uint64    `json:"coalesced"`
+	Queued      int       `json:"queued"`
+	LastEventID uint64    `json:"last_event_id"`
+	// Age of the oldest event not yet written to the client
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+func (c *Client) info() ClientInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := ClientInfo{
+		ID:          c.ID,
+		Type:        c.ClientType.String(),
+		Topics:      c.Topics,
+		AgentID:     c.AgentID,
+		RemoteAddr:  c.RemoteAddr,
+		ConnectedAt: c.ConnectedAt,
+		Policy:      c.policy,
+		Sent:        c.sent,
+		Dropped:     c.dropped,
+		Coalesced:   c.coalesced,
+		Queued:      len(c.queue),
+		LastEventID: c.lastID,
+	}
+	if len(c.queue) > 0 {
+		info.LagSeconds = time.Since(c.queue[0].at).Seconds()
+	}
+	return info
+}
@@ -0,0 +1,49 @@
+package sse
+
+import "time"
+
+// historySize is how many events each topic root (display, counter,
+// printer, ...) keeps for replay to clients that reconnect with
+// Last-Event-ID.
+const historySize = 256
+
+// Event is a message with its position in the hub's event stream.
+type Event struct {
+	ID   uint64
+	Data []byte
+
+	topic string    // topic the event was published to
+	typ   string    // message type, for coalescing state events
+	at    time.Time // when the event was published
+}
+
+// history is a fixed-size ring of the latest events of a topic root.
+type history struct {
+	events  [historySize]Event
+	start   int    // index of the oldest event
+	count   int    // number of events held
+	dropped uint64 // ID of the newest event pushed out of the ring
+}
+
+func (r *history) add(e Event) {
+	if r.count == historySize {
+		r.dropped = r.events[r.start].ID
+		r.events[r.start] = e
+		r.start = (r.start + 1) % historySize
+		return
+	}
+	r.events[(r.start+r.count)%historySize] = e
+	r.count++
+}
+
+// since returns the events after lastID for client. complete is false when
+// some of them were already dropped from the ring.
+func (r *history) since(lastID uint64, client *Client) (events []Event, complete bool) {
+	for i := 0; i < r.count; i++ {
+		e := r.events[(r.start+i)%historySize]
+		if e.ID > lastID && client.subscribed(e.topic) {
+			events = append(events, e)
+		}
+	}
+	return events, lastID >= r.dropped
+}
@@ -1,275 +1,442 @@
 package sse
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
+
+	"queue-system/internal/config"
 )
 
-type ClientType int
+// Hub delivers published events to the clients subscribed to their topic
+// (see topic.go).
+type Hub struct {
+	clients    map[string]*Client
+	mu         sync.RWMutex
+	unregister chan *Client
 
-const (
-	ClientTypeDisplay ClientType = iota
-	ClientTypeCounter
-	ClientTypePrinter
-)
+	// Event IDs start from the hub's start time in milliseconds, so they
+	// keep increasing across server restarts and a client's Last-Event-ID
+	// from an earlier run is recognised as such.
+	firstID uint64
+	lastID  uint64
+	history map[string]*history // by topic root
 
-type Client struct {
-	ID         string
-	Channel    chan []byte
-	CounterID  int64
-	ClientType ClientType
-	AgentID    string
-}
+	snapshots map[string]SnapshotFunc // by topic; guarded by mu
 
-type Hub struct {
-	displayClients  map[string]*Client
-	counterClients  map[int64]map[string]*Client
-	printerClients  map[string]*Client
-	mu              sync.RWMutex
-	register        chan *Client
-	unregister      chan *Client
+	cfg             config.SSEConfig
+	slowDisconnects uint64 // clients disconnected for a full buffer; guarded by mu
 }
 
-func NewHub() *Hub {
+func NewHub(cfg config.SSEConfig) *Hub {
+	firstID := uint64(time.Now().UnixMilli())
 	h := &Hub{
-		displayClients: make(map[string]*Client),
-		counterClients: make(map[int64]map[string]*Client),
-		printerClients: make(map[string]*Client),
-		register:       make(chan *Client),
-		unregister:     make(chan *Client),
+		clients:    make(map[string]*Client),
+		unregister: make(chan *Client),
+		firstID:    firstID,
+		lastID:     firstID,
+		history:    make(map[string]*history),
+		snapshots:  make(map[string]SnapshotFunc),
+		cfg:        cfg,
 	}
 	go h.run()
 	return h
 }
 
 func (h *Hub) run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.mu.Lock()
-			switch client.ClientType {
-			case ClientTypePrinter:
-				h.printerClients[client.ID] = client
-			case ClientTypeCounter:
-				if h.counterClients[client.CounterID] == nil {
-					h.counterClients[client.CounterID] = make(map[string]*Client)
-				}
-				h.counterClients[client.CounterID][client.ID] = client
-			default:
-				h.displayClients[client.ID] = client
-			}
-			h.mu.Unlock()
-			log.Printf("SSE client connected: %s (type: %d, agent: %s)", client.ID, client.ClientType, client.AgentID)
-
-		case client := <-h.unregister:
-			h.mu.Lock()
-			switch client.ClientType {
-			case ClientTypePrinter:
-				if _, ok := h.printerClients[client.ID]; ok {
-					delete(h.printerClients, client.ID)
-					close(client.Channel)
-				}
-			case ClientTypeCounter:
-				if clients, ok := h.counterClients[client.CounterID]; ok {
-					if _, ok := clients[client.ID]; ok {
-						delete(clients, client.ID)
-						close(client.Channel)
-					}
-				}
-			default:
-				if _, ok := h.displayClients[client.ID]; ok {
-					delete(h.displayClients, client.ID)
-					close(client.Channel)
-				}
-			}
-			h.mu.Unlock()
-			log.Printf("SSE client disconnected: %s", client.ID)
+	for client := range h.unregister {
+		h.mu.Lock()
+		_, removed := h.clients[client.ID]
+		delete(h.clients, client.ID)
+		agentOffline := removed && client.ClientType == ClientTypePrinter && !h.printerConnected(client.AgentID)
+		h.mu.Unlock()
+		if !removed {
+			continue
+		}
+
+		close(client.done)
+		log.Printf("SSE client disconnected: %s", client.ID)
+		if agentOffline {
+			log.Printf("Print agent offline: %s", client.AgentID)
+			h.Publish(TopicAdmin, "print_agent_offline", map[string]string{"agent_id": client.AgentID})
 		}
 	}
 }
 
-func (h *Hub) BroadcastDisplay(eventType string, data interface{}) {
-	event := map[string]interface{}{
-		"type": eventType,
-		"data": data,
+// register adds a client and returns the events it missed since
+// lastEventID (0 for a fresh connection). Registering and reading the
+// history under one lock means no event is both replayed and delivered, or
+// neither. resync is true when the missed events are no longer all known:
+// the client should reload its state; current is the ID to resume from.
+func (h *Hub) register(client *Client, lastEventID uint64) (missed []Event, resync bool, current uint64) {
+	client.policy = h.cfg.SlowClientPolicy(client.ClientType.String())
+
+	h.mu.Lock()
+	agentOnline := client.ClientType == ClientTypePrinter && !h.printerConnected(client.AgentID)
+	h.clients[client.ID] = client
+
+	if lastEventID > 0 {
+		if lastEventID < h.firstID || lastEventID > h.lastID {
+			// The ID is from before a server restart
+			resync = true
+		} else {
+			for root, hist := range h.history {
+				if !client.subscribedRoot(root) {
+					continue
+				}
+				events, complete := hist.since(lastEventID, client)
+				missed = append(missed, events...)
+				resync = resync || !complete
+			}
+			sort.Slice(missed, func(i, j int) bool { return missed[i].ID < missed[j].ID })
+		}
 	}
+	current = h.lastID
+	h.mu.Unlock()
 
-	jsonData, err := json.Marshal(event)
-	if err != nil {
-		log.Printf("Error marshaling SSE data: %v", err)
-		return
+	log.Printf("SSE client connected: %s (type: %s, topics: %v, from: %s, replay: %d)", client.ID, client.ClientType, client.Topics, client.RemoteAddr, len(missed))
+	if agentOnline {
+		h.Publish(TopicAdmin, "print_agent_online", map[string]string{"agent_id": client.AgentID})
 	}
+	return missed, resync, current
+}
 
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
-	for _, client := range h.displayClients {
-		select {
-		case client.Channel <- jsonData:
-		default:
-			log.Printf("SSE client buffer full: %s", client.ID)
+// printerConnected reports whether an agent has an open stream. The caller
+// holds h.mu.
+func (h *Hub) printerConnected(agentID string) bool {
+	for _, client := range h.clients {
+		if client.ClientType == ClientTypePrinter && client.AgentID == agentID {
+			return true
 		}
 	}
+	return false
 }
 
-func (h *Hub) BroadcastCounter(counterID int64, eventType string, data interface{}) {
-	event := map[string]interface{}{
+// Publish sends an event to the clients subscribed to topic and keeps it
+// for replay.
+func (h *Hub) Publish(topic string, eventType string, data interface{}) {
+	jsonData, err := json.Marshal(map[string]interface{}{
 		"type": eventType,
 		"data": data,
-	}
-
-	jsonData, err := json.Marshal(event)
+	})
 	if err != nil {
-		log.Printf("Error marshaling SSE data: %v", err)
+		log.Printf("Error marshaling SSE %s data: %v", topic, err)
 		return
 	}
 
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	if clients, ok := h.counterClients[counterID]; ok {
-		for _, client := range clients {
-			select {
-			case client.Channel <- jsonData:
-			default:
-				log.Printf("SSE client buffer full: %s", client.ID)
-			}
-		}
+	h.lastID++
+	event := Event{ID: h.lastID, Data: jsonData, topic: topic, typ: eventType, at: time.Now()}
+	root := topicRoot(topic)
+	hist, ok := h.history[root]
+	if !ok {
+		hist = &history{dropped: h.firstID}
+		h.history[root] = hist
 	}
-}
+	hist.add(event)
 
-func (h *Hub) BroadcastAllCounters(eventType string, data interface{}) {
-	event := map[string]interface{}{
-		"type": eventType,
-		"data": data,
+	for _, client := range h.clients {
+		if client.subscribed(topic) {
+			h.deliver(client, event)
+		}
 	}
+}
 
-	jsonData, err := json.Marshal(event)
-	if err != nil {
-		log.Printf("Error marshaling SSE data: %v", err)
+// deliver queues an event for a client. The caller holds h.mu for writing.
+func (h *Hub) deliver(client *Client, event Event) {
+	if client.closing {
 		return
 	}
+	if !client.push(event) {
+		// Drop the connection rather than the event: the client reconnects
+		// with its Last-Event-ID and the missed events are replayed.
+		log.Printf("SSE client buffer full, disconnecting: %s (%s)", client.ID, client.policy)
+		client.closing = true
+		h.slowDisconnects++
+		go func() { h.unregister <- client }()
+	}
+}
 
+// Subscribers returns the number of clients that receive events published
+// to topic.
+func (h *Hub) Subscribers(topic string) int {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	n := 0
+	for _, client := range h.clients {
+		if client.subscribed(topic) {
+			n++
+		}
+	}
+	return n
+}
 
-	for _, clients := range h.counterClients {
-		for _, client := range clients {
-			select {
-			case client.Channel <- jsonData:
-			default:
-				log.Printf("SSE client buffer full: %s", client.ID)
-			}
+// PrinterOnline reports whether an agent with the given agent ID and/or
+// printer group is connected.
+func (h *Hub) PrinterOnline(agentID, group string) bool {
+	return h.Subscribers(PrinterTopic(agentID, group)) > 0
+}
+
+// Disconnect closes the streams of the clients subscribed to topic, e.g. a
+// print agent after its API key was revoked.
+func (h *Hub) Disconnect(topic string) {
+	h.mu.RLock()
+	var clients []*Client
+	for _, client := range h.clients {
+		if client.subscribed(topic) {
+			clients = append(clients, client)
 		}
 	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		h.unregister <- client
+	}
+}
+
+// Subscribe serves an SSE stream of the events published to topics, which
+// may contain "*" segments, until the request ends.
+func (h *Hub) Subscribe(w http.ResponseWriter, r *http.Request, clientType ClientType, topics ...string) {
+	h.stream(w, r, NewClient(r, clientType, topics...))
+}
+
+// NewClient creates a client for request r subscribed to topics, for
+// transports other than SSE to serve with Listen.
+func NewClient(r *http.Request, clientType ClientType, topics ...string) *Client {
+	return newClient(r, fmt.Sprintf("%s-%d", clientType, time.Now().UnixNano()), clientType, 100, topics...)
 }
 
 func (h *Hub) ServeDisplaySSE(w http.ResponseWriter, r *http.Request) {
-	h.serveSSE(w, r, 0)
+	h.Subscribe(w, r, ClientTypeDisplay, TopicDisplay)
 }
 
 func (h *Hub) ServeCounterSSE(w http.ResponseWriter, r *http.Request, counterID int64) {
-	h.serveSSE(w, r, counterID)
+	h.Subscribe(w, r, ClientTypeCounter, CounterTopic(counterID))
 }
 
-func (h *Hub) serveSSE(w http.ResponseWriter, r *http.Request, counterID int64) {
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "SSE not supported", http.StatusInternalServerError)
-		return
+// ServePrinterSSE serves SSE connection for print agent clients
+func (h *Hub) ServePrinterSSE(w http.ResponseWriter, r *http.Request, agentID, group string) {
+	client := newClient(r, fmt.Sprintf("printer-%s-%d", agentID, time.Now().UnixNano()), ClientTypePrinter, 100,
+		"printer:"+group+":"+agentID)
+	client.AgentID = agentID
+	h.stream(w, r, client)
+}
+
+// ServeStatusSSE serves SSE connection for the public status page of a ticket
+func (h *Hub) ServeStatusSSE(w http.ResponseWriter, r *http.Request, queueType, queueNumber string) {
+	client := newClient(r, fmt.Sprintf("status-%s-%d", queueNumber, time.Now().UnixNano()), ClientTypeStatus, 20,
+		TypeTopic(queueType), TicketTopic(queueNumber))
+	h.stream(w, r, client)
+}
+
+// ServeAdminSSE serves SSE connection for the admin page
+func (h *Hub) ServeAdminSSE(w http.ResponseWriter, r *http.Request) {
+	client := newClient(r, fmt.Sprintf("admin-%d", time.Now().UnixNano()), ClientTypeAdmin, 20, TopicAdmin)
+	h.stream(w, r, client)
+}
+
+// ClientList is the admin view of the connected clients.
+type ClientList struct {
+	Clients []ClientInfo `json:"clients"`
+	// Clients disconnected since startup because they fell behind
+	SlowDisconnects uint64 `json:"slow_disconnects"`
+}
+
+// Clients lists the connected clients of every type with their counters,
+// oldest connection first.
+func (h *Hub) Clients() ClientList {
+	h.mu.RLock()
+	list := ClientList{Clients: []ClientInfo{}, SlowDisconnects: h.slowDisconnects}
+	clients := make([]*Client, 0, len(h.clients))
+	for _, client := range h.clients {
+		clients = append(clients, client)
 	}
+	h.mu.RUnlock()
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	for _, client := range clients {
+		list.Clients = append(list.Clients, client.info())
+	}
+	sort.Slice(list.Clients, func(i, j int) bool {
+		return list.Clients[i].ConnectedAt.Before(list.Clients[j].ConnectedAt)
+	})
+	return list
+}
 
-	clientID := fmt.Sprintf("%d-%d", time.Now().UnixNano(), counterID)
-	clientType := ClientTypeDisplay
-	if counterID > 0 {
-		clientType = ClientTypeCounter
+// LastEventID returns the ID of the last event a reconnecting client saw:
+// the Last-Event-ID header sent by EventSource when it reconnects by
+// itself, or the last_event_id query parameter for pages that open a new
+// connection.
+func LastEventID(r *http.Request) uint64 {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
 	}
-	client := &Client{
-		ID:         clientID,
-		Channel:    make(chan []byte, 100),
-		CounterID:  counterID,
-		ClientType: clientType,
+	id, _ := strconv.ParseUint(value, 10, 64)
+	return id
+}
+
+// Writer carries a client's events over a transport: an SSE response or a
+// WebSocket. Connected gets the ID to resume from, so a client that
+// reconnects before any event arrives still has its missed events replayed.
+type Writer interface {
+	Connected(client *Client, id uint64) error
+	WriteEvents(events []Event) error
+	Heartbeat() error
+}
+
+// SnapshotFunc returns the current state of a topic for a client that just
+// connected. version is the ID of the last event published before the
+// state is read, so every event up to it is reflected in the state.
+type SnapshotFunc func(version uint64) (interface{}, error)
+
+// SetSnapshot makes clients subscribed to topic receive a "snapshot" event
+// with the state build returns right after connecting, instead of having
+// to load it with separate requests that race against new events. The
+// event's ID is the version: events with a higher ID are newer.
+func (h *Hub) SetSnapshot(topic string, build SnapshotFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.snapshots[topic] = build
+}
+
+// snapshotEvents builds the snapshots of the client's topics. ok is false
+// when one of them failed.
+func (h *Hub) snapshotEvents(client *Client, version uint64) (events []Event, ok bool) {
+	h.mu.RLock()
+	var builders []SnapshotFunc
+	for topic, build := range h.snapshots {
+		if client.subscribed(topic) {
+			builders = append(builders, build)
+		}
 	}
+	h.mu.RUnlock()
+
+	ok = true
+	for _, build := range builders {
+		state, err := build(version)
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(map[string]interface{}{
+				"type": "snapshot",
+				"data": state,
+			})
+			if err == nil {
+				events = append(events, Event{ID: version, Data: data, typ: "snapshot", at: time.Now()})
+				continue
+			}
+		}
+		log.Printf("Failed to build snapshot for SSE client %s: %v", client.ID, err)
+		ok = false
+	}
+	return events, ok
+}
 
-	h.register <- client
+// heartbeatInterval keeps idle connections open through proxies.
+const heartbeatInterval = 30 * time.Second
 
+// resyncData tells a client to reload its state; see Listen.
+var resyncData = []byte(`{"type":"resync","data":null}`)
+
+// Listen registers client and writes its events to w until ctx ends, a
+// write fails or the client is unregistered. The snapshots of its topics
+// come first, then the events the client missed since lastEventID. When
+// there is no snapshot and the missed events are no longer all known, the
+// client gets a "resync" message telling it to reload its state instead.
+func (h *Hub) Listen(ctx context.Context, client *Client, lastEventID uint64, w Writer) error {
+	missed, resync, current := h.register(client, lastEventID)
 	defer func() {
 		h.unregister <- client
 	}()
 
-	// Send initial connection event
-	fmt.Fprintf(w, "event: connected\ndata: {\"client_id\":\"%s\"}\n\n", clientID)
-	flusher.Flush()
+	if err := w.Connected(client, current); err != nil {
+		return err
+	}
+	initial, ok := h.snapshotEvents(client, current)
+	if resync && len(initial) > 0 && ok {
+		// The snapshot already has the state the missed events changed
+		resync = false
+	}
+	if resync || !ok {
+		initial = append(initial, Event{ID: current, Data: resyncData, typ: "resync"})
+	}
+	initial = append(initial, missed...)
+	if len(initial) > 0 {
+		if err := w.WriteEvents(initial); err != nil {
+			return err
+		}
+		client.markSent(initial)
+	}
 
-	// Heartbeat ticker
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(heartbeatInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-r.Context().Done():
-			return
+		case <-ctx.Done():
+			return nil
 		case <-ticker.C:
-			fmt.Fprintf(w, ": heartbeat\n\n")
-			flusher.Flush()
-		case data := <-client.Channel:
-			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
-			flusher.Flush()
+			if err := w.Heartbeat(); err != nil {
+				return err
+			}
+		case <-client.done:
+			// Unregistered: Disconnect or a full buffer
+			return nil
+		case <-client.wake:
+			events := client.take()
+			if err := w.WriteEvents(events); err != nil {
+				return err
+			}
+			client.markSent(events)
 		}
 	}
 }
 
-func (h *Hub) GetDisplayClientCount() int {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return len(h.displayClients)
+// sseWriter writes events as a text/event-stream response.
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
 }
 
-func (h *Hub) GetCounterClientCount(counterID int64) int {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	if clients, ok := h.counterClients[counterID]; ok {
-		return len(clients)
+func (s sseWriter) Connected(client *Client, id uint64) error {
+	connected := map[string]string{"client_id": client.ID}
+	if client.AgentID != "" {
+		connected["agent_id"] = client.AgentID
 	}
-	return 0
+	data, _ := json.Marshal(connected)
+	fmt.Fprintf(s.w, "id: %d\nevent: connected\ndata: %s\n\n", id, data)
+	s.flusher.Flush()
+	return nil
 }
 
-// BroadcastPrinters sends an event to all connected printer agents
-func (h *Hub) BroadcastPrinters(eventType string, data interface{}) {
-	event := map[string]interface{}{
-		"type": eventType,
-		"data": data,
-	}
-
-	jsonData, err := json.Marshal(event)
-	if err != nil {
-		log.Printf("Error marshaling SSE printer data: %v", err)
-		return
+func (s sseWriter) WriteEvents(events []Event) error {
+	for _, event := range events {
+		if _, err := fmt.Fprintf(s.w, "id: %d\nevent: message\ndata: %s\n\n", event.ID, event.Data); err != nil {
+			return err
+		}
 	}
+	s.flusher.Flush()
+	return nil
+}
 
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
-	for _, client := range h.printerClients {
-		select {
-		case client.Channel <- jsonData:
-		default:
-			log.Printf("SSE printer client buffer full: %s", client.ID)
-		}
+func (s sseWriter) Heartbeat() error {
+	if _, err := fmt.Fprintf(s.w, ": heartbeat\n\n"); err != nil {
+		return err
 	}
+	s.flusher.Flush()
+	return nil
 }
 
-// ServePrinterSSE serves SSE connection for print agent clients
-func (h *Hub) ServePrinterSSE(w http.ResponseWriter, r *http.Request, agentID string) {
+// stream serves client as an SSE response until the request ends or the
+// client is unregistered.
+func (h *Hub) stream(w http.ResponseWriter, r *http.Request, client *Client) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "SSE not supported", http.StatusInternalServerError)
@@ -281,42 +448,5 @@ func (h *Hub) ServePrinterSSE(w http.ResponseWriter, r *http.Request, agentID st
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	clientID := fmt.Sprintf("printer-%s-%d", agentID, time.Now().UnixNano())
-	client := &Client{
-		ID:         clientID,
-		Channel:    make(chan []byte, 100),
-		ClientType: ClientTypePrinter,
-		AgentID:    agentID,
-	}
-
-	h.register <- client
-
-	defer func() {
-		h.unregister <- client
-	}()
-
-	fmt.Fprintf(w, "event: connected\ndata: {\"client_id\":\"%s\",\"agent_id\":\"%s\"}\n\n", clientID, agentID)
-	flusher.Flush()
-
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-r.Context().Done():
-			return
-		case <-ticker.C:
-			fmt.Fprintf(w, ": heartbeat\n\n")
-			flusher.Flush()
-		case data := <-client.Channel:
-			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
-			flusher.Flush()
-		}
-	}
-}
-
-func (h *Hub) GetPrinterClientCount() int {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return len(h.printerClients)
+	h.Listen(r.Context(), client, LastEventID(r), sseWriter{w: w, flusher: flusher})
 }
@@ -0,0 +1,207 @@
+package sse
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"queue-system/internal/config"
+)
+
+func testClient(id string, clientType ClientType, topics ...string) *Client {
+	return newClient(httptest.NewRequest("GET", "/", nil), id, clientType, 100, topics...)
+}
+
+// publishN publishes n events to topic and returns the ID of the last one.
+func publishN(h *Hub, topic string, n int) uint64 {
+	for i := 0; i < n; i++ {
+		h.Publish(topic, "queue_called", i)
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.lastID
+}
+
+func eventIDs(events []Event) []uint64 {
+	ids := make([]uint64, len(events))
+	for i, e := range events {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+// checkRange fails unless events are exactly the IDs from first to last.
+func checkRange(t *testing.T, events []Event, first, last uint64) {
+	t.Helper()
+	if uint64(len(events)) != last-first+1 {
+		t.Fatalf("got %d events, want %d (%d..%d)", len(events), last-first+1, first, last)
+	}
+	for i, e := range events {
+		if e.ID != first+uint64(i) {
+			t.Fatalf("event %d has ID %d, want %d", i, e.ID, first+uint64(i))
+		}
+	}
+}
+
+func TestHistoryWraparound(t *testing.T) {
+	r := &history{dropped: 100}
+	client := testClient("c", ClientTypeCounter, "counter:1")
+	for id := uint64(101); id <= 100+historySize+10; id++ {
+		r.add(Event{ID: id, topic: "counter:1"})
+	}
+	if r.count != historySize || r.dropped != 110 {
+		t.Fatalf("count %d, dropped %d; want %d, 110", r.count, r.dropped, historySize)
+	}
+
+	events, complete := r.since(110, client)
+	if !complete {
+		t.Error("since the last dropped event: incomplete")
+	}
+	checkRange(t, events, 111, 100+historySize+10)
+
+	events, complete = r.since(300, client)
+	if !complete {
+		t.Error("since an event in the ring: incomplete")
+	}
+	checkRange(t, events, 301, 100+historySize+10)
+
+	events, complete = r.since(105, client)
+	if complete {
+		t.Error("since a dropped event: complete")
+	}
+	checkRange(t, events, 111, 100+historySize+10)
+
+	if events, _ := r.since(110, testClient("o", ClientTypeCounter, "counter:2")); len(events) != 0 {
+		t.Errorf("other counter got %v", eventIDs(events))
+	}
+}
+
+// A client reconnecting after the ring wrapped gets the missed events of
+// its topics in ID order across topic roots.
+func TestRegisterReplayAcrossWrappedRing(t *testing.T) {
+	h := NewHub(config.SSEConfig{})
+	publishN(h, "counter:1", historySize)
+	lastSeen := publishN(h, "counter:2", 5)
+	publishN(h, "counter:1", 10) // wraps the counter ring
+	publishN(h, TopicDisplay, 3)
+	last := publishN(h, "counter:2", 2)
+
+	client := testClient("c", ClientTypeCounter, "counter:2", TopicDisplay)
+	missed, resync, current := h.register(client, lastSeen)
+	h.unregister <- client
+	if resync {
+		t.Error("resync although no event after lastSeen was dropped")
+	}
+	if current != last {
+		t.Errorf("current %d, want %d", current, last)
+	}
+	ids := eventIDs(missed)
+	want := []uint64{last - 4, last - 3, last - 2, last - 1, last}
+	if len(ids) != len(want) {
+		t.Fatalf("missed %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("missed %v, want %v", ids, want)
+		}
+	}
+
+	all := testClient("a", ClientTypeCounter, AllCounters)
+	missed, resync, _ = h.register(all, lastSeen)
+	h.unregister <- all
+	if resync {
+		t.Error("all counters: resync")
+	}
+	if len(missed) != 12 {
+		t.Errorf("all counters missed %v, want 12 events", eventIDs(missed))
+	}
+}
+
+func TestRegisterResync(t *testing.T) {
+	h := NewHub(config.SSEConfig{})
+	first := h.firstID
+	last := publishN(h, "counter:1", historySize+10)
+
+	tests := []struct {
+		name        string
+		lastEventID uint64
+		resync      bool
+		missed      int
+	}{
+		{"fresh connection", 0, false, 0},
+		{"up to date", last, false, 0},
+		{"in the ring", last - 5, false, 5},
+		{"last dropped event", first + 10, false, historySize},
+		{"dropped events", first + 5, true, historySize},
+		{"before a restart", first - 1, true, 0},
+		{"ahead of the hub", last + 1, true, 0},
+	}
+	for _, tt := range tests {
+		client := testClient(tt.name, ClientTypeCounter, "counter:1")
+		missed, resync, _ := h.register(client, tt.lastEventID)
+		h.unregister <- client
+		if resync != tt.resync || len(missed) != tt.missed {
+			t.Errorf("%s: resync %v with %d events, want %v with %d", tt.name, resync, len(missed), tt.resync, tt.missed)
+		}
+	}
+}
+
+// recorder is a Writer that hands the written events to the test.
+type recorder struct {
+	events chan []Event
+}
+
+func (r recorder) Connected(*Client, uint64) error { return nil }
+func (r recorder) Heartbeat() error                { return nil }
+
+func (r recorder) WriteEvents(events []Event) error {
+	r.events <- append([]Event(nil), events...)
+	return nil
+}
+
+// listenOnce runs Listen for a client and returns its first write.
+func listenOnce(t *testing.T, h *Hub, client *Client, lastEventID uint64) []Event {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	w := recorder{events: make(chan []Event, 1)}
+	done := make(chan error, 1)
+	go func() { done <- h.Listen(ctx, client, lastEventID, w) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case events := <-w.events:
+		return events
+	case <-time.After(time.Second):
+		t.Fatal("no events written")
+		return nil
+	}
+}
+
+func TestListenResync(t *testing.T) {
+	h := NewHub(config.SSEConfig{})
+	first := h.firstID
+	last := publishN(h, "counter:1", historySize+10)
+
+	events := listenOnce(t, h, testClient("dropped", ClientTypeCounter, "counter:1"), first+1)
+	if len(events) != historySize+1 || events[0].typ != "resync" || string(events[0].Data) != string(resyncData) {
+		t.Fatalf("got %d events starting with %q, want a resync and %d events", len(events), events[0].typ, historySize)
+	}
+	checkRange(t, events[1:], last-historySize+1, last)
+
+	events = listenOnce(t, h, testClient("restart", ClientTypeCounter, "counter:1"), first-1)
+	if len(events) != 1 || events[0].typ != "resync" || events[0].ID != last {
+		t.Fatalf("before a restart: got %d events, want only a resync at %d", len(events), last)
+	}
+
+	h.SetSnapshot("counter:*", func(version uint64) (interface{}, error) {
+		return map[string]uint64{"version": version}, nil
+	})
+	events = listenOnce(t, h, testClient("snapshot", ClientTypeCounter, "counter:1"), first-1)
+	if len(events) != 1 || events[0].typ != "snapshot" || events[0].ID != last {
+		t.Fatalf("with a snapshot: got %d events starting with %q, want only the snapshot", len(events), events[0].typ)
+	}
+}
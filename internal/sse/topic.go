@@ -0,0 +1,70 @@
+package sse
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Topics are names made of ':'-separated segments, e.g. "counter:3". A "*"
+// segment, in a subscription or in a published topic, matches any one
+// segment: a client subscribed to "counter:*" receives the events of every
+// counter, and an event published to "counter:*" reaches every counter.
+const (
+	TopicDisplay = "display" // display screens
+	TopicAdmin   = "admin"   // admin pages
+	AllCounters  = "counter:*"
+	AllPrinters  = "printer:*:*"
+)
+
+// CounterTopic is the topic of the counter pages of one counter.
+func CounterTopic(counterID int64) string {
+	return "counter:" + strconv.FormatInt(counterID, 10)
+}
+
+// TypeTopic is the topic of status pages watching a ticket of a queue type;
+// an empty queue type addresses all of them.
+func TypeTopic(queueType string) string {
+	if queueType == "" {
+		return "type:*"
+	}
+	return "type:" + queueType
+}
+
+// TicketTopic is the topic of the status pages of one ticket.
+func TicketTopic(queueNumber string) string {
+	return "ticket:" + queueNumber
+}
+
+// PrinterTopic is the topic to publish print jobs to: the agent with the
+// given agent ID and/or printer group; empty values match any agent. Each
+// agent subscribes to "printer:<group>:<agent_id>".
+func PrinterTopic(agentID, group string) string {
+	if agentID == "" {
+		agentID = "*"
+	}
+	if group == "" {
+		group = "*"
+	}
+	return "printer:" + group + ":" + agentID
+}
+
+// topicMatch reports whether two topics match segment by segment.
+func topicMatch(a, b string) bool {
+	as, bs := strings.Split(a, ":"), strings.Split(b, ":")
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		if as[i] != bs[i] && as[i] != "*" && bs[i] != "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// topicRoot returns the first segment of a topic, which names its replay
+// history.
+func topicRoot(topic string) string {
+	root, _, _ := strings.Cut(topic, ":")
+	return root
+}
@@ -0,0 +1,100 @@
+package sse
+
+import "testing"
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		subscription, published string
+		match                   bool
+	}{
+		{"display", "display", true},
+		{"counter:3", "counter:3", true},
+		{"counter:3", "counter:4", false},
+		{"counter:3", "counter", false},
+		{"counter", "counter:3", false},
+		{"counter:3", "display", false},
+
+		// Subscription side
+		{AllCounters, "counter:3", true},
+		{AllCounters, "counter", false},
+		{AllCounters, "type:Umum", false},
+		{AllPrinters, "printer:lobby:k1", true},
+		{AllPrinters, "printer:lobby", false},
+		{"type:*", "type:Umum", true},
+		{"type:*", "ticket:A001", false},
+
+		// Publish side
+		{"counter:3", AllCounters, true},
+		{"printer:lobby:k1", AllPrinters, true},
+		{"printer:lobby:k1", PrinterTopic("", "lobby"), true},
+		{"printer:lobby:k1", PrinterTopic("k1", ""), true},
+		{"printer:lobby:k1", PrinterTopic("k2", ""), false},
+		{"printer:lobby:k1", PrinterTopic("", "kasir"), false},
+		{"printer:lobby:k1", PrinterTopic("k1", "kasir"), false},
+		{"type:Umum", TypeTopic(""), true},
+		{"type:Umum", TypeTopic("Umum"), true},
+		{"type:Umum", TypeTopic("Bayar"), false},
+		{"ticket:A001", TypeTopic(""), false},
+
+		// Both sides
+		{AllPrinters, PrinterTopic("k1", ""), true},
+		{"*", "display", true},
+		{"*", "counter:3", false},
+	}
+	for _, tt := range tests {
+		if got := topicMatch(tt.subscription, tt.published); got != tt.match {
+			t.Errorf("topicMatch(%q, %q) = %v, want %v", tt.subscription, tt.published, got, tt.match)
+		}
+	}
+}
+
+func TestClientSubscribed(t *testing.T) {
+	status := testClient("s", ClientTypeStatus, TypeTopic("Umum"), TicketTopic("A001"))
+	printer := testClient("p", ClientTypePrinter, "printer:lobby:k1")
+	admin := testClient("a", ClientTypeAdmin, "*:*")
+
+	tests := []struct {
+		client *Client
+		topic  string
+		match  bool
+	}{
+		{status, "type:Umum", true},
+		{status, TypeTopic(""), true},
+		{status, "type:Bayar", false},
+		{status, "ticket:A001", true},
+		{status, "ticket:A002", false},
+		{printer, AllPrinters, true},
+		{printer, PrinterTopic("k1", ""), true},
+		{printer, PrinterTopic("k2", "lobby"), false},
+		{admin, "counter:3", true},
+		{admin, "display", false},
+	}
+	for _, tt := range tests {
+		if got := tt.client.subscribed(tt.topic); got != tt.match {
+			t.Errorf("%s subscribed(%q) = %v, want %v", tt.client.ID, tt.topic, got, tt.match)
+		}
+	}
+}
+
+func TestClientSubscribedRoot(t *testing.T) {
+	status := testClient("s", ClientTypeStatus, TypeTopic("Umum"), TicketTopic("A001"))
+	all := testClient("a", ClientTypeAdmin, "*:*")
+
+	tests := []struct {
+		client *Client
+		root   string
+		match  bool
+	}{
+		{status, "type", true},
+		{status, "ticket", true},
+		{status, "counter", false},
+		{status, "display", false},
+		{all, "counter", true},
+		{all, "printer", true},
+	}
+	for _, tt := range tests {
+		if got := tt.client.subscribedRoot(tt.root); got != tt.match {
+			t.Errorf("%s subscribedRoot(%q) = %v, want %v", tt.client.ID, tt.root, got, tt.match)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// frame is a frame as seen on the wire, without the masking key.
+type frame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// clientFrame encodes a frame the way a browser sends it: masked unless
+// masked is false.
+func clientFrame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	var b []byte
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	b = append(b, first)
+
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xFFFF:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask[:]...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// readServerFrame decodes one frame written by the server, which must not
+// be masked.
+func readServerFrame(r io.Reader) (frame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, err
+	}
+	if header[1]&0x80 != 0 {
+		return frame{}, errors.New("server frame is masked")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return frame{}, err
+	}
+	return frame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0F, payload: payload}, nil
+}
+
+// peer is the client end of a Conn over an in-memory pipe. The frames the
+// server writes arrive on frames.
+type peer struct {
+	conn   net.Conn
+	frames chan frame
+}
+
+func newPipe(t *testing.T) (*Conn, *peer) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	p := &peer{conn: client, frames: make(chan frame, 16)}
+	go func() {
+		defer close(p.frames)
+		for {
+			f, err := readServerFrame(client)
+			if err != nil {
+				return
+			}
+			p.frames <- f
+		}
+	}()
+	return &Conn{conn: server, br: bufio.NewReader(server)}, p
+}
+
+// send writes frames to the server in the background; net.Pipe blocks a
+// write until the server reads it.
+func (p *peer) send(frames ...[]byte) {
+	go func() {
+		for _, f := range frames {
+			if _, err := p.conn.Write(f); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (p *peer) next(t *testing.T) frame {
+	t.Helper()
+	select {
+	case f, ok := <-p.frames:
+		if !ok {
+			t.Fatal("connection closed before the expected frame")
+		}
+		return f
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a frame")
+	}
+	return frame{}
+}
+
+// expectClose checks that the server closed the connection with code.
+func (p *peer) expectClose(t *testing.T, code uint16) {
+	t.Helper()
+	f := p.next(t)
+	if f.opcode != opClose {
+		t.Fatalf("got opcode %#x, want close", f.opcode)
+	}
+	if len(f.payload) < 2 || binary.BigEndian.Uint16(f.payload) != code {
+		t.Fatalf("got close payload %v, want code %d", f.payload, code)
+	}
+}
+
+func TestUpgradeHandshake(t *testing.T) {
+	var upgraded *Conn
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			t.Errorf("Upgrade: %v", err)
+			close(done)
+			return
+		}
+		upgraded = conn
+		close(done)
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The key and accept value from RFC 6455 section 1.3
+	req := "GET /ws HTTP/1.1\r\n" +
+		"Host: " + srv.Listener.Addr().String() + "\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Origin: http://" + srv.Listener.Addr().String() + "\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got Sec-WebSocket-Accept %q", got)
+	}
+
+	<-done
+	if upgraded == nil {
+		t.Fatal("no connection after the handshake")
+	}
+	defer upgraded.Close()
+	if err := upgraded.WriteText([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := readServerFrame(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.fin || f.opcode != opText || string(f.payload) != "hi" {
+		t.Fatalf("got frame %+v, want text \"hi\"", f)
+	}
+}
+
+func TestUpgradeRejects(t *testing.T) {
+	valid := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		return r
+	}
+	tests := []struct {
+		name   string
+		modify func(r *http.Request)
+		status int
+	}{
+		{"not an upgrade", func(r *http.Request) { r.Header.Del("Upgrade") }, http.StatusBadRequest},
+		{"POST", func(r *http.Request) { r.Method = http.MethodPost }, http.StatusBadRequest},
+		{"old version", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Version", "8") }, http.StatusUpgradeRequired},
+		{"missing key", func(r *http.Request) { r.Header.Del("Sec-WebSocket-Key") }, http.StatusBadRequest},
+		{"other origin", func(r *http.Request) { r.Header.Set("Origin", "http://evil.example") }, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid()
+			tt.modify(r)
+			w := httptest.NewRecorder()
+			if _, err := Upgrade(w, r); err == nil {
+				t.Fatal("Upgrade succeeded")
+			}
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestReadMaskedText(t *testing.T) {
+	conn, p := newPipe(t)
+	p.send(clientFrame(true, opText, []byte("hello"), true))
+
+	message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != "hello" {
+		t.Fatalf("got %q, want \"hello\"", message)
+	}
+}
+
+func TestReadExtendedLength(t *testing.T) {
+	conn, p := newPipe(t)
+	payload := bytes.Repeat([]byte("x"), 300)
+	p.send(clientFrame(true, opText, payload, true))
+
+	message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message, payload) {
+		t.Fatalf("got %d bytes, want %d", len(message), len(payload))
+	}
+}
+
+func TestReadFragmentedWithPing(t *testing.T) {
+	conn, p := newPipe(t)
+	p.send(
+		clientFrame(false, opText, []byte("hel"), true),
+		clientFrame(true, opPing, []byte("p"), true),
+		clientFrame(false, opContinuation, []byte("l"), true),
+		clientFrame(true, opContinuation, []byte("o"), true),
+	)
+
+	message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != "hello" {
+		t.Fatalf("got %q, want \"hello\"", message)
+	}
+	if f := p.next(t); f.opcode != opPong || string(f.payload) != "p" {
+		t.Fatalf("got frame %+v, want pong \"p\"", f)
+	}
+}
+
+func TestReadSkipsPong(t *testing.T) {
+	conn, p := newPipe(t)
+	p.send(
+		clientFrame(true, opPong, nil, true),
+		clientFrame(true, opText, []byte("after"), true),
+	)
+
+	message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != "after" {
+		t.Fatalf("got %q, want \"after\"", message)
+	}
+}
+
+func TestReadPeerClose(t *testing.T) {
+	conn, p := newPipe(t)
+	p.send(clientFrame(true, opClose, []byte{0x03, 0xE8}, true))
+
+	if _, err := conn.ReadMessage(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+	p.expectClose(t, 1000)
+	if err := conn.WriteText([]byte("late")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("write after close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestReadProtocolErrors(t *testing.T) {
+	tooLong := make([]byte, 0, 10)
+	tooLong = append(tooLong, 0x80|opText, 0x80|127)
+	tooLong = binary.BigEndian.AppendUint64(tooLong, maxMessageSize+1)
+
+	half := bytes.Repeat([]byte("x"), maxMessageSize/2+1)
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+		reason string
+	}{
+		{"unmasked", [][]byte{clientFrame(true, opText, []byte("hi"), false)}, "not masked"},
+		{"reserved bits", [][]byte{append([]byte{0xC0 | opText}, clientFrame(true, opText, []byte("hi"), true)[1:]...)}, "reserved bits"},
+		{"unexpected continuation", [][]byte{clientFrame(true, opContinuation, []byte("hi"), true)}, "unexpected continuation"},
+		{"text inside fragmented message", [][]byte{
+			clientFrame(false, opText, []byte("a"), true),
+			clientFrame(true, opText, []byte("b"), true),
+		}, "unexpected continuation"},
+		{"oversize frame", [][]byte{tooLong}, "frame too large"},
+		{"oversize message", [][]byte{
+			clientFrame(false, opText, half, true),
+			clientFrame(true, opContinuation, half, true),
+		}, "message too large"},
+		{"long control frame", [][]byte{clientFrame(true, opPing, bytes.Repeat([]byte("p"), 126), true)}, "invalid control frame"},
+		{"fragmented control frame", [][]byte{clientFrame(false, opPing, []byte("p"), true)}, "invalid control frame"},
+		{"unknown opcode", [][]byte{clientFrame(true, 0x3, []byte("?"), true)}, "unknown opcode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, p := newPipe(t)
+			p.send(tt.frames...)
+
+			_, err := conn.ReadMessage()
+			if err == nil || !strings.Contains(err.Error(), tt.reason) {
+				t.Fatalf("got %v, want an error about %q", err, tt.reason)
+			}
+			p.expectClose(t, 1002)
+		})
+	}
+}
+
+func TestWriteFrames(t *testing.T) {
+	conn, p := newPipe(t)
+	long := bytes.Repeat([]byte("y"), 70000)
+	go func() {
+		conn.WriteText([]byte("short"))
+		conn.WriteText(long)
+		conn.Ping()
+		conn.Close()
+	}()
+
+	if f := p.next(t); !f.fin || f.opcode != opText || string(f.payload) != "short" {
+		t.Fatalf("got frame %+v, want text \"short\"", f)
+	}
+	if f := p.next(t); f.opcode != opText || !bytes.Equal(f.payload, long) {
+		t.Fatalf("got opcode %#x with %d bytes, want text with %d", f.opcode, len(f.payload), len(long))
+	}
+	if f := p.next(t); f.opcode != opPing || len(f.payload) != 0 {
+		t.Fatalf("got frame %+v, want empty ping", f)
+	}
+	p.expectClose(t, 1000)
+}
@@ -18,6 +18,7 @@ import (
 	"queue-system/internal/config"
 	"queue-system/internal/database"
 	"queue-system/internal/handlers"
+	"queue-system/internal/models"
 	"queue-system/internal/sse"
 )
 
@@ -82,7 +83,7 @@ func main() {
 	log.Println("Database initialized successfully")
 
 	// Initialize SSE hub
-	hub := sse.NewHub()
+	hub := sse.NewHub(cfg.SSE)
 	log.Println("SSE hub initialized")
 
 	// Initialize handlers
@@ -131,22 +132,70 @@ func main() {
 		ticker := time.NewTicker(1 * time.Hour)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			if cfg.Queue.AutoCancelHours > 0 {
-				affected, err := db.CancelOldQueues(cfg.Queue.AutoCancelHours)
+		// Parked (no-show) queues and staff sessions expire on a minute scale
+		parkTicker := time.NewTicker(1 * time.Minute)
+		defer parkTicker.Stop()
+
+		// Print job leases last about a minute; requeue promptly so the
+		// ticket still prints while the visitor is at the kiosk
+		leaseTicker := time.NewTicker(10 * time.Second)
+		defer leaseTicker.Stop()
+
+		for {
+			select {
+			case <-leaseTicker.C:
+				h.SweepPrintAgents()
+				h.SweepPrintJobs()
+
+			case <-parkTicker.C:
+				// Expired sessions end their counter shifts too
+				released, err := db.DeleteExpiredSessions()
 				if err != nil {
-					log.Printf("Failed to cancel old queues: %v", err)
-				} else if affected > 0 {
-					log.Printf("Auto-cancelled %d old queues", affected)
+					log.Printf("Failed to sweep expired sessions: %v", err)
+				}
+				for _, counterID := range released {
+					hub.Publish(sse.CounterTopic(counterID), "operator_changed", nil)
+				}
+
+				if cfg.Queue.ParkWindowMins > 0 {
+					affected, queueTypes, err := db.CancelExpiredParkedQueues(cfg.Queue.ParkWindowMins)
+					if err != nil {
+						log.Printf("Failed to cancel expired parked queues: %v", err)
+					} else if affected > 0 {
+						log.Printf("Auto-cancelled %d parked queues", affected)
+						// Counters list parked queues; status pages show the ticket
+						waitingCount, _ := db.GetWaitingCount()
+						hub.Publish(sse.AllCounters, "queue_updated", models.CounterUpdateData{
+							WaitingCount: waitingCount,
+							Timestamp:    time.Now(),
+						})
+						hub.Publish(sse.TopicDisplay, "queue_updated", nil)
+						for _, queueType := range queueTypes {
+							hub.Publish(sse.TypeTopic(queueType), "status_changed", map[string]interface{}{
+								"queue_type": queueType,
+								"timestamp":  time.Now(),
+							})
+						}
+					}
 				}
-			}
 
-			// Cleanup old print jobs (completed/failed older than 24 hours)
-			affected, err := db.CleanupOldPrintJobs(24)
-			if err != nil {
-				log.Printf("Failed to cleanup old print jobs: %v", err)
-			} else if affected > 0 {
-				log.Printf("Cleaned up %d old print jobs", affected)
+			case <-ticker.C:
+				if cfg.Queue.AutoCancelHours > 0 {
+					affected, err := db.CancelOldQueues(cfg.Queue.AutoCancelHours)
+					if err != nil {
+						log.Printf("Failed to cancel old queues: %v", err)
+					} else if affected > 0 {
+						log.Printf("Auto-cancelled %d old queues", affected)
+					}
+				}
+
+				// Cleanup old print jobs (completed/failed older than 24 hours)
+				affected, err := db.CleanupOldPrintJobs(24)
+				if err != nil {
+					log.Printf("Failed to cleanup old print jobs: %v", err)
+				} else if affected > 0 {
+					log.Printf("Cleaned up %d old print jobs", affected)
+				}
 			}
 		}
 	}()
@@ -195,11 +244,11 @@ func loggingMiddleware(next http.Handler) http.Handler {
 
 		next.ServeHTTP(wrapped, r)
 
-		// Skip logging for static files and SSE
+		// Skip logging for static files, SSE and WebSocket streams
 		if len(r.URL.Path) > 7 && r.URL.Path[:7] == "/static" {
 			return
 		}
-		if len(r.URL.Path) > 8 && r.URL.Path[:8] == "/api/sse" {
+		if len(r.URL.Path) > 8 && (r.URL.Path[:8] == "/api/sse" || r.URL.Path[:7] == "/api/ws") {
 			return
 		}
 
@@ -222,3 +271,9 @@ func (w *responseWriter) Flush() {
 		f.Flush()
 	}
 }
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to hijack
+// it for a WebSocket.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
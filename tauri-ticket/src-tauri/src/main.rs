@@ -23,6 +23,8 @@ struct AppConfig {
     ticket_path: String,
     #[serde(default = "default_agent_id", rename = "agentId")]
     agent_id: String,
+    #[serde(default, rename = "apiKey")]
+    api_key: String,
     #[serde(default = "default_printer_name", rename = "printerName")]
     printer_name: String,
     #[serde(default = "default_retry_delay", rename = "retryDelay")]
@@ -268,11 +270,11 @@ fn save_server_url(
 ) -> Result<(), String> {
     let url = server_url.trim_end_matches('/').to_string();
 
-    // 1. Update in-memory config, capture ticket_path
-    let ticket_path = {
+    // 1. Update in-memory config, capture ticket_path and agent_id
+    let (ticket_path, agent_id) = {
         let mut cfg = config_state.config.lock().map_err(|e| e.to_string())?;
         cfg.server_url = url.clone();
-        cfg.ticket_path.clone()
+        (cfg.ticket_path.clone(), cfg.agent_id.clone())
     };
 
     // 2. Update navigation prefix so the guard allows the new origin
@@ -336,7 +338,7 @@ fn save_server_url(
     }
 
     // 6. Navigate webview to new server
-    let new_url_str = format!("{}{}", url, ticket_path);
+    let new_url_str = ticket_page_url(&url, &ticket_path, &agent_id);
     if let Some(window) = app.get_webview_window("main") {
         if let Ok(parsed) = new_url_str.parse::<url::Url>() {
             let _ = window.navigate(parsed);
@@ -358,12 +360,26 @@ fn find_sidecar() -> Option<PathBuf> {
     None
 }
 
+/// Per-user data directory for the print-agent spool. The install directory is
+/// read-only under Program Files and the temp dir may be cleaned between runs.
+fn agent_data_dir() -> PathBuf {
+    let dir = std::env::var_os("LOCALAPPDATA")
+        .or_else(|| std::env::var_os("APPDATA"))
+        .map(|base| PathBuf::from(base).join("com.kpp.antrian-ticket"))
+        .unwrap_or_else(std::env::temp_dir);
+    if fs::create_dir_all(&dir).is_err() {
+        return std::env::temp_dir();
+    }
+    dir
+}
+
 fn write_agent_yaml(config: &AppConfig) -> Result<String, Box<dyn std::error::Error>> {
     let yaml_path = std::env::temp_dir().join("antrian-ticket-agent.yaml");
+    let spool_path = agent_data_dir().join("print-agent-spool.json");
     let content = format!(
-        "agent_id: \"{}\"\nserver_url: \"{}\"\nprinter_name: \"{}\"\nretry_delay: {}\npaper_size: \"{}\"\nfeed_lines: {}\n",
-        config.agent_id, config.server_url, config.printer_name, config.retry_delay,
-        config.paper_size, config.feed_lines
+        "agent_id: \"{}\"\napi_key: \"{}\"\nserver_url: \"{}\"\nprinter_name: \"{}\"\nretry_delay: {}\npaper_size: \"{}\"\nfeed_lines: {}\nspool_path: '{}'\n",
+        config.agent_id, config.api_key, config.server_url, config.printer_name, config.retry_delay,
+        config.paper_size, config.feed_lines, spool_path.to_string_lossy().replace('\'', "''")
     );
     let mut file = fs::File::create(&yaml_path)?;
     file.write_all(content.as_bytes())?;
@@ -402,13 +418,19 @@ fn load_config() -> (AppConfig, Option<PathBuf>) {
     )
 }
 
+/// Ticket page URL; `agent` makes the server send this kiosk's tickets to
+/// its own print agent rather than whichever agent claims them first.
+fn ticket_page_url(server_url: &str, ticket_path: &str, agent_id: &str) -> String {
+    format!("{}{}?agent={}", server_url, ticket_path, agent_id)
+}
+
 // ── Entry point ───────────────────────────────────────────────────────────────
 
 fn main() {
     let (config, config_path) = load_config();
 
     // Capture values we need before moving `config` into state
-    let ticket_url    = format!("{}{}", config.server_url, config.ticket_path);
+    let ticket_url    = ticket_page_url(&config.server_url, &config.ticket_path, &config.agent_id);
     let server_prefix_arc = Arc::new(Mutex::new(config.server_url.clone()));
     let server_prefix_nav = Arc::clone(&server_prefix_arc);
     let sidecar_path = find_sidecar();
@@ -13,6 +13,7 @@ const pageTitles = {
     'display-settings': 'Pengaturan Display',
     'ticket-settings': 'Pengaturan Tiket',
     'system-settings': 'Pengaturan Sistem',
+    'users': 'Akun Petugas',
     'reports': 'Laporan & Statistik'
 };
 
@@ -116,6 +117,7 @@ document.addEventListener('DOMContentLoaded', function() {
     loadCounters();
     loadQueues();
     loadSettings();
+    loadCurrentUser();
 
     // Restore sidebar and page state
     restoreSidebarState();
@@ -265,6 +267,7 @@ async function loadCounters() {
                                 <span class="counter-status-badge ${counter.is_active ? 'active' : 'inactive'}">
                                     ${counter.is_active ? 'Aktif' : 'Nonaktif'}
                                 </span>
+                                ${counter.operator_name ? `<span class="counter-operator">${counter.operator_name}</span>` : ''}
                             </div>
                         </div>
                         <div class="counter-icon-actions">
@@ -902,7 +905,11 @@ function setupTicketPreview() {
         'ticket-show-type',
         'ticket-show-datetime',
         'ticket-show-footer',
-        'ticket-show-thanks'
+        'ticket-show-thanks',
+        'ticket-show-eta',
+        'ticket-show-logo',
+        'ticket-show-qr',
+        'ticket-show-barcode'
     ];
 
     checkboxes.forEach(id => {
@@ -956,18 +963,27 @@ function updateTicketPreview() {
     const showDatetime = document.getElementById('ticket-show-datetime').checked;
     const showFooter = document.getElementById('ticket-show-footer').checked;
     const showThanks = document.getElementById('ticket-show-thanks').checked;
+    const showETA = document.getElementById('ticket-show-eta').checked;
+    const showQR = document.getElementById('ticket-show-qr').checked;
+    const showLogo = document.getElementById('ticket-show-logo').checked;
+    const showBarcode = document.getElementById('ticket-show-barcode').checked;
 
     document.getElementById('preview-subheader').classList.toggle('hidden', !showSubheader);
     document.getElementById('preview-type-label').classList.toggle('hidden', !showType);
     document.getElementById('preview-datetime').classList.toggle('hidden', !showDatetime);
     document.getElementById('preview-footer').classList.toggle('hidden', !showFooter);
     document.getElementById('preview-thanks').classList.toggle('hidden', !showThanks);
+    document.getElementById('preview-eta').classList.toggle('hidden', !showETA);
+    document.getElementById('preview-qr').classList.toggle('hidden', !showQR);
+    const logoEl = document.getElementById('preview-logo');
+    logoEl.classList.toggle('hidden', !showLogo || !logoEl.getAttribute('src'));
+    document.getElementById('preview-barcode').classList.toggle('hidden', !showBarcode);
 }
 
 // Load ticket design settings
 async function loadTicketDesign() {
     try {
-        const response = await fetch('/api/settings?keys=ticket_header,ticket_subheader,ticket_title,ticket_footer1,ticket_footer2,ticket_thanks,ticket_show_subheader,ticket_show_type,ticket_show_datetime,ticket_show_footer,ticket_show_thanks,printer_paper_size,printer_feed_lines');
+        const response = await fetch('/api/settings?keys=ticket_header,ticket_subheader,ticket_title,ticket_footer1,ticket_footer2,ticket_thanks,ticket_show_subheader,ticket_show_type,ticket_show_datetime,ticket_show_footer,ticket_show_thanks,ticket_show_eta,ticket_show_logo,ticket_logo,ticket_show_qr,ticket_show_barcode,ticket_qr_content,ticket_qr_base_url,printer_paper_size,printer_feed_lines');
         const settings = await response.json();
 
         // Set text values
@@ -984,6 +1000,13 @@ async function loadTicketDesign() {
         document.getElementById('ticket-show-datetime').checked = settings.ticket_show_datetime !== 'false';
         document.getElementById('ticket-show-footer').checked = settings.ticket_show_footer !== 'false';
         document.getElementById('ticket-show-thanks').checked = settings.ticket_show_thanks !== 'false';
+        document.getElementById('ticket-show-eta').checked = settings.ticket_show_eta !== 'false';
+        document.getElementById('ticket-show-logo').checked = settings.ticket_show_logo !== 'false';
+        setTicketLogo(settings.ticket_logo);
+        document.getElementById('ticket-show-qr').checked = settings.ticket_show_qr === 'true';
+        document.getElementById('ticket-show-barcode').checked = settings.ticket_show_barcode === 'true';
+        document.getElementById('ticket-qr-content').value = settings.ticket_qr_content || 'url';
+        document.getElementById('ticket-qr-base-url').value = settings.ticket_qr_base_url || '';
 
         // Paper size
         const paperSize = settings.printer_paper_size || '80mm';
@@ -1022,6 +1045,12 @@ async function saveTicketDesign(event) {
         ticket_show_datetime: document.getElementById('ticket-show-datetime').checked.toString(),
         ticket_show_footer: document.getElementById('ticket-show-footer').checked.toString(),
         ticket_show_thanks: document.getElementById('ticket-show-thanks').checked.toString(),
+        ticket_show_eta: document.getElementById('ticket-show-eta').checked.toString(),
+        ticket_show_logo: document.getElementById('ticket-show-logo').checked.toString(),
+        ticket_show_qr: document.getElementById('ticket-show-qr').checked.toString(),
+        ticket_show_barcode: document.getElementById('ticket-show-barcode').checked.toString(),
+        ticket_qr_content: document.getElementById('ticket-qr-content').value,
+        ticket_qr_base_url: document.getElementById('ticket-qr-base-url').value.trim(),
         printer_paper_size: document.querySelector('input[name="printer-paper-size"]:checked')?.value || '80mm',
         printer_feed_lines: document.getElementById('printer-feed-lines')?.value || '1'
     };
@@ -1046,6 +1075,103 @@ async function saveTicketDesign(event) {
     }
 }
 
+// Ticket logo (stored server-side as a base64 PNG)
+function setTicketLogo(logo) {
+    const logoEl = document.getElementById('preview-logo');
+    if (logo) {
+        logoEl.src = `data:image/png;base64,${logo}`;
+    } else {
+        logoEl.removeAttribute('src');
+    }
+    document.getElementById('ticket-logo-remove').style.display = logo ? 'inline-block' : 'none';
+    updateTicketPreview();
+}
+
+async function uploadTicketLogo(input) {
+    if (!input.files.length) return;
+
+    const formData = new FormData();
+    formData.append('logo', input.files[0]);
+
+    try {
+        const response = await fetch('/api/settings/logo', {
+            method: 'POST',
+            body: formData
+        });
+        const result = await response.json();
+        if (!response.ok) {
+            throw new Error(result.error || 'Upload failed');
+        }
+        setTicketLogo(result.logo);
+        showToast('Logo berhasil disimpan!');
+    } catch (error) {
+        console.error('Failed to upload logo:', error);
+        alert('Gagal mengunggah logo: ' + error.message);
+    } finally {
+        input.value = '';
+    }
+}
+
+async function removeTicketLogo() {
+    if (!confirm('Hapus logo dari tiket?')) return;
+    try {
+        const response = await fetch('/api/settings/logo', { method: 'DELETE' });
+        if (!response.ok) throw new Error('Delete failed');
+        setTicketLogo('');
+        showToast('Logo dihapus');
+    } catch (error) {
+        console.error('Failed to remove logo:', error);
+        alert('Gagal menghapus logo.');
+    }
+}
+
+// Render the ticket as the printer would print it, using the unsaved form values
+async function previewPrintedTicket() {
+    const template = {
+        header: document.getElementById('ticket-header').value,
+        subheader: document.getElementById('ticket-subheader').value,
+        title: document.getElementById('ticket-title').value,
+        footer1: document.getElementById('ticket-footer1').value,
+        footer2: document.getElementById('ticket-footer2').value,
+        thanks: document.getElementById('ticket-thanks').value,
+        show_subheader: document.getElementById('ticket-show-subheader').checked,
+        show_type: document.getElementById('ticket-show-type').checked,
+        show_datetime: document.getElementById('ticket-show-datetime').checked,
+        show_footer: document.getElementById('ticket-show-footer').checked,
+        show_thanks: document.getElementById('ticket-show-thanks').checked,
+        show_eta: document.getElementById('ticket-show-eta').checked,
+        show_logo: document.getElementById('ticket-show-logo').checked,
+        show_qr: document.getElementById('ticket-show-qr').checked,
+        show_barcode: document.getElementById('ticket-show-barcode').checked,
+        qr_content: document.getElementById('ticket-qr-content').value,
+        paper_size: document.querySelector('input[name="printer-paper-size"]:checked')?.value || '80mm',
+        feed_lines: parseInt(document.getElementById('printer-feed-lines')?.value || '1', 10)
+    };
+    const baseURL = document.getElementById('ticket-qr-base-url').value.trim();
+    if (baseURL) template.qr_base_url = baseURL;
+
+    try {
+        const response = await fetch('/api/printer/preview', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify(template)
+        });
+        if (!response.ok) {
+            throw new Error('Preview failed');
+        }
+
+        const img = document.getElementById('print-preview-img');
+        if (img.src) URL.revokeObjectURL(img.src);
+        img.src = URL.createObjectURL(await response.blob());
+        document.getElementById('print-preview').classList.remove('hidden');
+    } catch (error) {
+        console.error('Failed to render print preview:', error);
+        alert('Gagal membuat preview cetak.');
+    }
+}
+
 // Test print ticket
 async function testPrintTicket() {
     try {
@@ -1065,6 +1191,433 @@ async function testPrintTicket() {
     }
 }
 
+// ===================================
+// Staff Accounts
+// ===================================
+
+const roleLabels = {
+    admin: 'Admin',
+    supervisor: 'Supervisor',
+    operator: 'Operator Loket'
+};
+
+// Account management is admin-only; supervisors don't see the page
+async function loadCurrentUser() {
+    try {
+        const response = await fetch('/api/me');
+        if (!response.ok) return;
+        const me = await response.json();
+
+        if (me.role === 'admin') {
+            loadUsers();
+            loadPrintAgents();
+            connectAdminEvents();
+        } else {
+            document.getElementById('nav-users').style.display = 'none';
+            if (currentAdminPage === 'users') showPage('dashboard');
+        }
+    } catch (error) {
+        console.error('Failed to load current user:', error);
+    }
+}
+
+async function loadUsers() {
+    try {
+        const response = await fetch('/api/users');
+        if (!response.ok) return;
+        const users = await response.json();
+
+        const tbody = document.getElementById('users-list');
+        if (users.length === 0) {
+            tbody.innerHTML = '<tr><td colspan="6" style="text-align: center; color: #6b7280;">Belum ada akun petugas</td></tr>';
+            return;
+        }
+
+        tbody.innerHTML = users.map(user => `
+            <tr>
+                <td><strong>${user.username}</strong></td>
+                <td>${user.full_name || '-'}</td>
+                <td>${roleLabels[user.role] || user.role}</td>
+                <td><span class="status-badge ${user.is_active ? 'status-completed' : 'status-cancelled'}">${user.is_active ? 'Aktif' : 'Nonaktif'}</span></td>
+                <td>${user.last_login_at ? formatDateTime(user.last_login_at) : '-'}</td>
+                <td style="text-align: right; white-space: nowrap;">
+                    <button class="btn btn-sm" onclick="showEditUserModal(${user.id})">Edit</button>
+                    <button class="btn btn-sm" onclick="revokeUserSessions(${user.id}, '${user.username}')">Keluarkan</button>
+                    <button class="btn btn-sm btn-danger" onclick="deleteUser(${user.id}, '${user.username}')">Hapus</button>
+                </td>
+            </tr>
+        `).join('');
+        loadSessions();
+    } catch (error) {
+        console.error('Failed to load users:', error);
+    }
+}
+
+function showAddUserModal() {
+    document.getElementById('user-form').reset();
+    document.getElementById('user-id').value = '';
+    document.getElementById('user-modal-title').textContent = 'Tambah Petugas';
+    document.getElementById('user-username').disabled = false;
+    document.getElementById('user-password').required = true;
+    document.getElementById('user-password-hint').textContent = 'Minimal 6 karakter';
+    document.getElementById('user-active-group').style.display = 'none';
+    showModal('user-modal');
+}
+
+async function showEditUserModal(id) {
+    try {
+        const response = await fetch('/api/users');
+        const users = await response.json();
+        const user = users.find(u => u.id === id);
+        if (!user) throw new Error('User not found');
+
+        document.getElementById('user-form').reset();
+        document.getElementById('user-id').value = user.id;
+        document.getElementById('user-modal-title').textContent = 'Edit Petugas';
+        document.getElementById('user-username').value = user.username;
+        document.getElementById('user-username').disabled = true;
+        document.getElementById('user-full-name').value = user.full_name;
+        document.getElementById('user-role').value = user.role;
+        document.getElementById('user-password').required = false;
+        document.getElementById('user-password-hint').textContent = 'Kosongkan jika tidak ingin mengubah password';
+        document.getElementById('user-active').checked = user.is_active;
+        document.getElementById('user-active-group').style.display = '';
+        showModal('user-modal');
+    } catch (error) {
+        console.error('Failed to load user:', error);
+        alert('Gagal memuat data petugas.');
+    }
+}
+
+async function saveUser(event) {
+    event.preventDefault();
+
+    const id = document.getElementById('user-id').value;
+    const body = {
+        full_name: document.getElementById('user-full-name').value.trim(),
+        role: document.getElementById('user-role').value
+    };
+    const password = document.getElementById('user-password').value;
+    if (password) body.password = password;
+
+    let url = '/api/users';
+    let method = 'POST';
+    if (id) {
+        url = `/api/users/${id}`;
+        method = 'PUT';
+        body.is_active = document.getElementById('user-active').checked;
+    } else {
+        body.username = document.getElementById('user-username').value.trim();
+    }
+
+    try {
+        const response = await fetch(url, {
+            method: method,
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify(body)
+        });
+        if (!response.ok) {
+            const result = await response.json();
+            throw new Error(result.error || 'Save failed');
+        }
+
+        closeModal('user-modal');
+        loadUsers();
+        showToast('Akun petugas disimpan');
+    } catch (error) {
+        console.error('Failed to save user:', error);
+        alert('Gagal menyimpan akun: ' + error.message);
+    }
+}
+
+async function deleteUser(id, username) {
+    if (!confirm(`Hapus akun "${username}"? Riwayat pelayanan tetap tersimpan.`)) return;
+    try {
+        const response = await fetch(`/api/users/${id}`, { method: 'DELETE' });
+        if (!response.ok) {
+            const result = await response.json();
+            throw new Error(result.error || 'Delete failed');
+        }
+        loadUsers();
+        showToast('Akun dihapus');
+    } catch (error) {
+        console.error('Failed to delete user:', error);
+        alert('Gagal menghapus akun: ' + error.message);
+    }
+}
+
+// Short browser and OS label for a session's user agent
+function describeDevice(userAgent) {
+    if (!userAgent) return '-';
+    const browser = /Edg\//.test(userAgent) ? 'Edge'
+        : /Chrome\//.test(userAgent) ? 'Chrome'
+        : /Firefox\//.test(userAgent) ? 'Firefox'
+        : /Safari\//.test(userAgent) ? 'Safari'
+        : 'Browser';
+    const os = /Windows/.test(userAgent) ? 'Windows'
+        : /Android/.test(userAgent) ? 'Android'
+        : /iPhone|iPad/.test(userAgent) ? 'iOS'
+        : /Mac OS/.test(userAgent) ? 'macOS'
+        : /Linux/.test(userAgent) ? 'Linux'
+        : '';
+    return os ? `${browser} (${os})` : browser;
+}
+
+async function loadSessions() {
+    try {
+        const response = await fetch('/api/sessions');
+        if (!response.ok) return;
+        const sessions = await response.json();
+
+        const tbody = document.getElementById('sessions-list');
+        if (sessions.length === 0) {
+            tbody.innerHTML = '<tr><td colspan="7" style="text-align: center; color: #6b7280;">Tidak ada sesi aktif</td></tr>';
+            return;
+        }
+
+        tbody.innerHTML = sessions.map(s => `
+            <tr>
+                <td><strong>${s.full_name || s.username}</strong><br><small>${roleLabels[s.role] || s.role}</small></td>
+                <td title="${s.user_agent}">${describeDevice(s.user_agent)}${s.current ? ' <span class="status-badge status-completed">Sesi ini</span>' : ''}</td>
+                <td>${s.ip_address || '-'}</td>
+                <td>${s.counter_id ? (s.counter_name || `#${s.counter_id}`) : '-'}</td>
+                <td>${formatDateTime(s.last_seen_at)}</td>
+                <td>${formatDateTime(s.expires_at)}</td>
+                <td style="text-align: right;">
+                    ${s.current ? '' : `<button class="btn btn-sm btn-danger" onclick="revokeSession(${s.id})">Cabut</button>`}
+                </td>
+            </tr>
+        `).join('');
+    } catch (error) {
+        console.error('Failed to load sessions:', error);
+    }
+}
+
+async function revokeSession(id) {
+    if (!confirm('Cabut sesi ini? Perangkat tersebut harus login ulang.')) return;
+    try {
+        const response = await fetch(`/api/sessions/${id}`, { method: 'DELETE' });
+        if (!response.ok) throw new Error('Revoke failed');
+        loadSessions();
+        showToast('Sesi dicabut');
+    } catch (error) {
+        console.error('Failed to revoke session:', error);
+        alert('Gagal mencabut sesi');
+    }
+}
+
+async function revokeUserSessions(id, username) {
+    if (!confirm(`Keluarkan "${username}" dari semua perangkat?`)) return;
+    try {
+        const response = await fetch(`/api/sessions?user_id=${id}`, { method: 'DELETE' });
+        if (!response.ok) throw new Error('Revoke failed');
+        loadSessions();
+        showToast('Semua sesi akun dicabut');
+    } catch (error) {
+        console.error('Failed to revoke user sessions:', error);
+        alert('Gagal mencabut sesi');
+    }
+}
+
+async function revokeOtherSessions() {
+    if (!confirm('Keluar dari semua perangkat lain yang memakai akun Anda?')) return;
+    try {
+        const response = await fetch('/api/me/sessions', { method: 'DELETE' });
+        if (!response.ok) throw new Error('Revoke failed');
+        loadSessions();
+        showToast('Perangkat lain telah dikeluarkan');
+    } catch (error) {
+        console.error('Failed to revoke other sessions:', error);
+        alert('Gagal mencabut sesi');
+    }
+}
+
+// ===================================
+// Print Agents
+// ===================================
+
+async function loadPrintAgents() {
+    try {
+        const response = await fetch('/api/print-agents');
+        if (!response.ok) return;
+        const agents = await response.json();
+        document.getElementById('print-agents-card').style.display = '';
+
+        const tbody = document.getElementById('print-agents-list');
+        if (agents.length === 0) {
+            tbody.innerHTML = '<tr><td colspan="8" style="text-align: center; color: #6b7280;">Belum ada print agent terdaftar</td></tr>';
+            return;
+        }
+
+        tbody.innerHTML = agents.map(agent => `
+            <tr>
+                <td><strong>${agent.agent_id}</strong></td>
+                <td>${agent.name || '-'}</td>
+                <td>${agent.printer_group || '-'}</td>
+                <td>${printAgentStatusBadge(agent)}</td>
+                <td>
+                    ${agent.printer_name || '-'}${agent.paper_size ? ` (${agent.paper_size})` : ''}
+                    ${printerStatusBadge(agent.printer_status)}
+                    <small style="display: block; color: #6b7280;">${[agent.hostname, agent.version && 'v' + agent.version].filter(Boolean).join(' · ')}</small>
+                </td>
+                <td>
+                    ${agent.jobs_printed} dicetak / ${agent.jobs_failed} gagal
+                    ${agent.last_error ? `<small style="display: block; color: #dc2626;" title="${agent.last_error}">${agent.last_error}</small>` : ''}
+                </td>
+                <td>${agent.last_seen_at ? formatDateTime(agent.last_seen_at) : '-'}</td>
+                <td style="text-align: right; white-space: nowrap;">
+                    <button class="btn btn-sm" onclick="updatePrintAgent(${agent.id}, { is_active: ${!agent.is_active} })">${agent.is_active ? 'Nonaktifkan' : 'Aktifkan'}</button>
+                    <button class="btn btn-sm" onclick="changePrintAgentGroup(${agent.id}, '${agent.printer_group}')">Grup</button>
+                    <button class="btn btn-sm" onclick="rotatePrintAgentKey(${agent.id}, '${agent.agent_id}')">Ganti Key</button>
+                    <button class="btn btn-sm btn-danger" onclick="deletePrintAgent(${agent.id}, '${agent.agent_id}')">Hapus</button>
+                </td>
+            </tr>
+        `).join('');
+    } catch (error) {
+        console.error('Failed to load print agents:', error);
+    }
+}
+
+function printAgentStatusBadge(agent) {
+    if (!agent.is_active) return '<span class="status-badge status-cancelled">Nonaktif</span>';
+    return agent.online
+        ? '<span class="status-badge status-completed">Online</span>'
+        : '<span class="status-badge status-waiting">Offline</span>';
+}
+
+// Printer hardware conditions reported by agents (DLE EOT)
+const printerStatusLabels = {
+    ok: 'Siap',
+    paper_near_end: 'Kertas hampir habis',
+    paper_out: 'Kertas habis',
+    cover_open: 'Penutup terbuka',
+    hardware_error: 'Gangguan printer',
+    offline: 'Printer offline'
+};
+
+function printerStatusBadge(code) {
+    if (!code) return '';
+    const cls = code === 'ok' ? 'status-completed' : code === 'paper_near_end' ? 'status-waiting' : 'status-cancelled';
+    return `<span class="status-badge ${cls}">${printerStatusLabels[code] || code}</span>`;
+}
+
+// Live print agent health for admins
+let adminEventSource = null;
+let adminLastEventId = '';
+
+function connectAdminEvents() {
+    if (adminEventSource) adminEventSource.close();
+
+    adminEventSource = new EventSource('/api/sse/admin' + (adminLastEventId ? `?last_event_id=${adminLastEventId}` : ''));
+    adminEventSource.addEventListener('connected', function(e) {
+        if (e.lastEventId) adminLastEventId = e.lastEventId;
+    });
+    adminEventSource.addEventListener('message', function(e) {
+        if (e.lastEventId) adminLastEventId = e.lastEventId;
+        try {
+            const event = JSON.parse(e.data);
+            switch (event.type) {
+                case 'print_agent_offline':
+                    showToast(`Print agent ${event.data.agent_id} terputus`);
+                    loadPrintAgents();
+                    break;
+                case 'print_agent_alert':
+                    showToast(`${event.data.name || event.data.agent_id}: ${printerStatusLabels[event.data.printer_status] || event.data.printer_status}`);
+                    loadPrintAgents();
+                    break;
+                case 'print_agent_online':
+                case 'print_agent_status':
+                case 'resync':
+                    loadPrintAgents();
+                    break;
+            }
+        } catch (err) {
+            console.error('Failed to parse admin event:', err);
+        }
+    });
+    adminEventSource.onerror = function() {
+        adminEventSource.close();
+        setTimeout(connectAdminEvents, 5000);
+    };
+}
+
+// The API key is only returned once, when it is issued
+function showPrintAgentKey(agentID, key) {
+    document.getElementById('agent-key-id').textContent = agentID;
+    document.getElementById('agent-key-value').textContent = key;
+    document.getElementById('agent-key-box').classList.remove('hidden');
+}
+
+async function registerPrintAgent(event) {
+    event.preventDefault();
+    const data = {
+        agent_id: document.getElementById('agent-id').value.trim(),
+        name: document.getElementById('agent-name').value.trim(),
+        printer_group: document.getElementById('agent-group').value.trim()
+    };
+    try {
+        const response = await fetch('/api/print-agents', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(data)
+        });
+        const result = await response.json();
+        if (!response.ok) throw new Error(result.error || 'Register failed');
+
+        event.target.reset();
+        showPrintAgentKey(result.agent.agent_id, result.api_key);
+        loadPrintAgents();
+        showToast('Print agent didaftarkan');
+    } catch (error) {
+        console.error('Failed to register print agent:', error);
+        alert('Gagal mendaftarkan print agent: ' + error.message);
+    }
+}
+
+async function updatePrintAgent(id, changes) {
+    try {
+        const response = await fetch(`/api/print-agents/${id}`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(changes)
+        });
+        const result = await response.json();
+        if (!response.ok) throw new Error(result.error || 'Update failed');
+
+        if (result.api_key) showPrintAgentKey(result.agent.agent_id, result.api_key);
+        loadPrintAgents();
+    } catch (error) {
+        console.error('Failed to update print agent:', error);
+        alert('Gagal memperbarui print agent: ' + error.message);
+    }
+}
+
+function changePrintAgentGroup(id, current) {
+    const group = prompt('Grup printer (kosongkan untuk tanpa grup):', current);
+    if (group === null) return;
+    updatePrintAgent(id, { printer_group: group.trim() });
+}
+
+function rotatePrintAgentKey(id, agentID) {
+    if (!confirm(`Buat API key baru untuk "${agentID}"? Key lama langsung tidak berlaku.`)) return;
+    updatePrintAgent(id, { rotate_key: true });
+}
+
+async function deletePrintAgent(id, agentID) {
+    if (!confirm(`Hapus print agent "${agentID}"?`)) return;
+    try {
+        const response = await fetch(`/api/print-agents/${id}`, { method: 'DELETE' });
+        if (!response.ok) throw new Error('Delete failed');
+        loadPrintAgents();
+        showToast('Print agent dihapus');
+    } catch (error) {
+        console.error('Failed to delete print agent:', error);
+        alert('Gagal menghapus print agent');
+    }
+}
+
 // ===================================
 // Ticket Appearance Settings
 // ===================================
@@ -4,6 +4,12 @@ let eventSource = null;
 let hasCurrentQueue = false;
 let selectedQueueType = null;
 let sseConnected = false;
+let lastEventId = ''; // sent on reconnect so the server replays missed events
+let socket = null; // WebSocket carrying events and commands, when available
+let socketFailed = false; // the WebSocket never opened (e.g. a proxy blocks it): use SSE
+let commandSeq = 0;
+const pendingCommands = new Map(); // command id -> resolve(ack)
+const COMMAND_TIMEOUT_MS = 10000; // a command without an acknowledgement by then has failed
 
 // Check if a date string is from today
 function isToday(dateStr) {
@@ -19,7 +25,13 @@ function isToday(dateStr) {
 document.addEventListener('DOMContentLoaded', function() {
     loadCounterData();
     loadStatsByType();
-    connectSSE();
+    loadParkedQueues();
+    connectEvents();
+
+    // Counters with assigned services may call next without choosing a type
+    if (AUTO_ROUTE) {
+        document.getElementById('btn-next').disabled = false;
+    }
 
     // Polling fallback - update every 3 seconds if SSE is disconnected
     setInterval(() => {
@@ -31,8 +43,13 @@ document.addEventListener('DOMContentLoaded', function() {
     }, 3000);
 });
 
-// Select queue type
+// Select queue type (selecting it again clears the selection when auto-routing)
 function selectQueueType(typeCode) {
+    if (AUTO_ROUTE && selectedQueueType === typeCode) {
+        selectedQueueType = null;
+        document.querySelector(`.queue-type-btn[data-type="${typeCode}"]`).classList.remove('selected');
+        return;
+    }
     selectedQueueType = typeCode;
 
     // Update button states
@@ -79,6 +96,7 @@ function updateCounterUI(counter) {
     const btnRecall = document.getElementById('btn-recall');
     const btnComplete = document.getElementById('btn-complete');
     const btnCancel = document.getElementById('btn-cancel');
+    const btnPark = document.getElementById('btn-park');
 
     // Check if current_queue exists (backend already handles the logic)
     if (counter.current_queue && counter.current_queue.queue_number) {
@@ -90,6 +108,7 @@ function updateCounterUI(counter) {
         btnRecall.disabled = false;
         btnComplete.disabled = false;
         btnCancel.disabled = false;
+        btnPark.disabled = false;
     } else {
         hasCurrentQueue = false;
         currentQueue.textContent = '---';
@@ -99,9 +118,99 @@ function updateCounterUI(counter) {
         btnRecall.disabled = true;
         btnComplete.disabled = true;
         btnCancel.disabled = true;
+        btnPark.disabled = true;
+    }
+}
+
+// Connect to the server's event stream: a WebSocket, which also carries the
+// counter's commands, or SSE when WebSockets are unavailable
+function connectEvents() {
+    if (window.WebSocket && !socketFailed) {
+        connectWebSocket();
+    } else {
+        connectSSE();
     }
 }
 
+// Connect to the counter WebSocket
+function connectWebSocket() {
+    const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    let opened = false;
+    socket = new WebSocket(`${protocol}//${location.host}/api/ws/counter/${COUNTER_ID}` + (lastEventId ? `?last_event_id=${lastEventId}` : ''));
+
+    socket.onopen = function() {
+        opened = true;
+        console.log('WebSocket connection opened');
+        updateConnectionStatus(true);
+    };
+
+    socket.onmessage = function(e) {
+        let message;
+        try {
+            message = JSON.parse(e.data);
+        } catch (err) {
+            console.error('Failed to parse WebSocket message:', err);
+            return;
+        }
+        if (message.type === 'ack') {
+            const resolve = pendingCommands.get(message.request_id);
+            if (resolve) {
+                pendingCommands.delete(message.request_id);
+                resolve(message);
+            }
+            return;
+        }
+        if (message.id) lastEventId = String(message.id);
+        if (message.type === 'connected') return;
+        handleEvent(message);
+    };
+
+    socket.onclose = function() {
+        socket = null;
+        updateConnectionStatus(false);
+        // Commands without an acknowledgement are reported as failed
+        pendingCommands.forEach(resolve => resolve(null));
+        pendingCommands.clear();
+        if (!opened) socketFailed = true;
+        // Reconnect after 3 seconds
+        setTimeout(connectEvents, 3000);
+    };
+}
+
+// Run a counter action (call-next, recall, complete, cancel, park) over the
+// WebSocket when it is open, otherwise as a POST. Resolves to the fetch
+// Response or an equivalent built from the command's acknowledgement.
+function counterAction(action, query) {
+    if (!socket || socket.readyState !== WebSocket.OPEN) {
+        const params = query ? '?' + new URLSearchParams(query) : '';
+        return fetch(`/api/counter/${COUNTER_ID}/${action}${params}`, { method: 'POST' });
+    }
+
+    const id = String(++commandSeq);
+    const sentOn = socket;
+    return new Promise(resolve => {
+        const timer = setTimeout(() => {
+            const pending = pendingCommands.get(id);
+            if (!pending) return;
+            // The connection has stalled: report the command as failed (the
+            // caller reloads the counter's state) and reconnect
+            console.warn(`No acknowledgement for ${action} after ${COMMAND_TIMEOUT_MS} ms`);
+            pendingCommands.delete(id);
+            pending(null);
+            if (socket === sentOn) sentOn.close();
+        }, COMMAND_TIMEOUT_MS);
+        pendingCommands.set(id, ack => {
+            clearTimeout(timer);
+            resolve({
+                status: ack ? ack.status : 0,
+                ok: !!(ack && ack.ok),
+                json: async () => ack ? ack.data : null
+            });
+        });
+        socket.send(JSON.stringify({ id: id, command: action, query: query || {} }));
+    });
+}
+
 // Connect to SSE
 function connectSSE() {
     if (eventSource) {
@@ -109,7 +218,7 @@ function connectSSE() {
     }
 
     try {
-        eventSource = new EventSource(`/api/sse/counter/${COUNTER_ID}`);
+        eventSource = new EventSource(`/api/sse/counter/${COUNTER_ID}` + (lastEventId ? `?last_event_id=${lastEventId}` : ''));
 
         eventSource.onopen = function(e) {
             console.log('SSE connection opened');
@@ -118,11 +227,13 @@ function connectSSE() {
 
         eventSource.addEventListener('connected', function(e) {
             console.log('SSE connected event:', e.data);
+            if (e.lastEventId) lastEventId = e.lastEventId;
             updateConnectionStatus(true);
         });
 
         eventSource.addEventListener('message', function(e) {
             console.log('SSE message:', e.data);
+            if (e.lastEventId) lastEventId = e.lastEventId;
             try {
                 const event = JSON.parse(e.data);
                 handleEvent(event);
@@ -136,7 +247,7 @@ function connectSSE() {
             updateConnectionStatus(false);
             eventSource.close();
             // Reconnect after 3 seconds
-            setTimeout(connectSSE, 3000);
+            setTimeout(connectEvents, 3000);
         };
     } catch (error) {
         console.error('Failed to create EventSource:', error);
@@ -165,15 +276,33 @@ function handleEvent(event) {
     switch (event.type) {
         case 'queue_updated':
         case 'queue_added':
+        case 'queue_transferred':
+        case 'resync': // missed events could not be replayed
             loadStatsByType();
             loadCounterData();
+            loadParkedQueues();
+            break;
+        case 'operator_changed':
+            // Another operator took over this counter (or our shift ended)
+            if (!event.data || event.data.operator_id !== OPERATOR_ID) {
+                window.location.reload();
+            }
             break;
     }
 }
 
+// The operator's session ended (logged out elsewhere, expired or replaced by
+// another operator): reload to show the login form.
+function sessionExpired(response) {
+    if (response.status !== 401) return false;
+    alert('Sesi petugas telah berakhir. Silakan login kembali.');
+    window.location.reload();
+    return true;
+}
+
 // Call next queue
 async function callNext() {
-    if (!selectedQueueType) {
+    if (!selectedQueueType && !AUTO_ROUTE) {
         alert('Silakan pilih jenis antrian terlebih dahulu.');
         return;
     }
@@ -182,17 +311,19 @@ async function callNext() {
     btn.disabled = true;
 
     try {
-        const response = await fetch(`/api/counter/${COUNTER_ID}/call-next?type=${selectedQueueType}`, {
-            method: 'POST'
-        });
+        const response = await counterAction('call-next', selectedQueueType ? { type: selectedQueueType } : null);
 
         if (response.status === 404) {
-            alert(`Tidak ada antrian jenis ${selectedQueueType} yang menunggu.`);
+            alert(selectedQueueType
+                ? `Tidak ada antrian jenis ${selectedQueueType} yang menunggu.`
+                : 'Tidak ada antrian yang menunggu untuk loket ini.');
             loadCounterData();
             loadStatsByType();
             return;
         }
 
+        if (sessionExpired(response)) return;
+
         if (!response.ok) {
             throw new Error('Failed to call next');
         }
@@ -209,7 +340,7 @@ async function callNext() {
         console.error('Failed to call next:', error);
         alert('Gagal memanggil antrian. Silakan coba lagi.');
     } finally {
-        btn.disabled = selectedQueueType === null;
+        btn.disabled = selectedQueueType === null && !AUTO_ROUTE;
         loadCounterData();
         loadStatsByType();
     }
@@ -223,9 +354,9 @@ async function recall() {
     btn.disabled = true;
 
     try {
-        const response = await fetch(`/api/counter/${COUNTER_ID}/recall`, {
-            method: 'POST'
-        });
+        const response = await counterAction('recall');
+
+        if (sessionExpired(response)) return;
 
         if (!response.ok) {
             throw new Error('Failed to recall');
@@ -252,9 +383,9 @@ async function complete() {
     btn.disabled = true;
 
     try {
-        const response = await fetch(`/api/counter/${COUNTER_ID}/complete`, {
-            method: 'POST'
-        });
+        const response = await counterAction('complete');
+
+        if (sessionExpired(response)) return;
 
         if (!response.ok) {
             throw new Error('Failed to complete');
@@ -285,9 +416,9 @@ async function cancel() {
     btn.disabled = true;
 
     try {
-        const response = await fetch(`/api/counter/${COUNTER_ID}/cancel`, {
-            method: 'POST'
-        });
+        const response = await counterAction('cancel');
+
+        if (sessionExpired(response)) return;
 
         if (!response.ok) {
             throw new Error('Failed to cancel');
@@ -306,6 +437,87 @@ async function cancel() {
     }
 }
 
+// Park current queue (no-show) so it can be reactivated later
+async function park() {
+    if (!hasCurrentQueue) return;
+
+    const btn = document.getElementById('btn-park');
+    btn.disabled = true;
+
+    try {
+        const response = await counterAction('park');
+
+        if (sessionExpired(response)) return;
+
+        if (!response.ok) {
+            throw new Error('Failed to park');
+        }
+
+        const result = await response.json();
+        updateCounterUI(result.counter);
+        if (result.queue.status === 'cancelled') {
+            alert(`Antrian ${result.queue.queue_number} sudah melebihi batas panggilan dan dibatalkan.`);
+        }
+
+    } catch (error) {
+        console.error('Failed to park:', error);
+        alert('Gagal menunda antrian. Silakan coba lagi.');
+    } finally {
+        btn.disabled = false;
+        loadCounterData();
+        loadStatsByType();
+        loadParkedQueues();
+    }
+}
+
+// Load parked queues of today
+async function loadParkedQueues() {
+    try {
+        const today = new Date().toLocaleDateString('en-CA');
+        const response = await fetch(`/api/queues?status=parked&date=${today}&per_page=100`);
+        const result = await response.json();
+        const queues = result.queues || [];
+
+        const section = document.getElementById('parked-section');
+        const list = document.getElementById('parked-list');
+        section.style.display = queues.length > 0 ? 'block' : 'none';
+        list.innerHTML = queues.map(q => `
+            <button class="parked-item" onclick="reactivate(${q.id}, '${q.queue_number}')">${q.queue_number}</button>
+        `).join('');
+    } catch (error) {
+        console.error('Failed to load parked queues:', error);
+    }
+}
+
+// Reactivate a parked queue (taxpayer showed up again)
+async function reactivate(queueId, queueNumber) {
+    if (!confirm(`Aktifkan kembali antrian ${queueNumber}?`)) {
+        return;
+    }
+
+    try {
+        const response = await fetch('/api/queues/reactivate', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ queue_id: queueId })
+        });
+
+        if (response.status === 410) {
+            alert(`Batas waktu tunda antrian ${queueNumber} sudah habis.`);
+        } else if (sessionExpired(response)) {
+            return;
+        } else if (!response.ok) {
+            throw new Error('Failed to reactivate');
+        }
+    } catch (error) {
+        console.error('Failed to reactivate:', error);
+        alert('Gagal mengaktifkan kembali antrian. Silakan coba lagi.');
+    } finally {
+        loadParkedQueues();
+        loadStatsByType();
+    }
+}
+
 // Add pulse animation
 const style = document.createElement('style');
 style.textContent = `
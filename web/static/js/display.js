@@ -5,6 +5,10 @@ let audioContext = null;
 let audioEnabled = false;
 let lastQueueCalled = null;
 let sseConnected = false;
+let lastEventId = ''; // sent on reconnect so the server replays missed calls
+let snapshotVersion = 0; // events up to this ID are already part of the last snapshot
+let snapshotCallIds = new Set(); // calls in the last snapshot, whatever their event ID
+let snapshotReceived = false;
 
 // Configuration (will be loaded from settings)
 let MAX_RECENT_CALLS = 6;       // Multi-call display cards
@@ -58,12 +62,8 @@ document.addEventListener("DOMContentLoaded", function () {
     updateDateTime();
     setInterval(updateDateTime, 1000);
 
-    // Load all initial data
-    loadInitialData();
+    // The rest of the initial state arrives as the SSE snapshot
     loadQueueTypes();
-    loadCounters();
-    loadSettings();
-    loadCalledQueues();
     connectSSE();
 
     // Auto-refresh stats every 5 seconds
@@ -131,6 +131,14 @@ async function loadCounters() {
     }
 }
 
+// Load the display state with separate requests, when no snapshot arrived
+function loadDisplayData() {
+    loadInitialData();
+    loadCounters();
+    loadSettings();
+    loadCalledQueues();
+}
+
 // Load currently called queues to initialize counter status (only today's queues)
 async function loadCalledQueues() {
     try {
@@ -261,10 +269,12 @@ async function loadQueueTypes() {
                 <div class="summary-card" data-type="${type.code}">
                     <div class="prefix">${type.prefix}</div>
                     <div class="count" id="summary-${type.code}">0 menunggu</div>
+                    <div class="eta" id="eta-${type.code}"></div>
                 </div>
             `).join('');
 
             loadQueueTypeCounts(types);
+            loadServiceETA();
         }
     } catch (error) {
         console.error("Failed to load queue types:", error);
@@ -279,21 +289,41 @@ async function loadQueueTypeCounts(types) {
 
         // Use /api/stats/by-type which already filters by today's date in backend
         const response = await fetch("/api/stats/by-type");
-        const counts = await response.json();
-
-        // Update UI for each queue type
-        types.forEach(type => {
-            const el = document.getElementById(`summary-${type.code}`);
-            if (el) {
-                const count = counts[type.code] || 0;
-                el.textContent = `${count} menunggu`;
-            }
-        });
+        renderQueueTypeCounts(await response.json(), types);
     } catch (error) {
         console.error("Failed to load queue counts:", error);
     }
 }
 
+function renderQueueTypeCounts(counts, types) {
+    (types || queueTypesCache).forEach(type => {
+        const el = document.getElementById(`summary-${type.code}`);
+        if (el) {
+            const count = counts[type.code] || 0;
+            el.textContent = `${count} menunggu`;
+        }
+    });
+}
+
+// Load estimated waiting time per queue type
+async function loadServiceETA() {
+    try {
+        const response = await fetch("/api/stats/eta");
+        renderServiceETA(await response.json());
+    } catch (error) {
+        console.error("Failed to load waiting time estimates:", error);
+    }
+}
+
+function renderServiceETA(etas) {
+    (etas || []).forEach(eta => {
+        const el = document.getElementById(`eta-${eta.queue_type}`);
+        if (el) {
+            el.textContent = eta.waiting_count > 0 ? `± ${Math.max(eta.wait_minutes, 1)} menit` : '';
+        }
+    });
+}
+
 // Load display settings
 async function loadSettings() {
     try {
@@ -332,7 +362,7 @@ function updateDisplaySettings(settings) {
         const newCount = parseInt(settings.display_history_count) || 15;
         if (newCount !== MAX_HISTORY) {
             MAX_HISTORY = newCount;
-            renderCallHistory();
+            renderHistory();
         }
     }
     if (settings.display_tts_rate) {
@@ -601,7 +631,7 @@ function connectSSE() {
     }
 
     try {
-        eventSource = new EventSource("/api/sse/display");
+        eventSource = new EventSource("/api/sse/display" + (lastEventId ? `?last_event_id=${lastEventId}` : ""));
 
         eventSource.onopen = function () {
             console.log("SSE connection opened");
@@ -611,11 +641,27 @@ function connectSSE() {
         eventSource.addEventListener("connected", function (e) {
             console.log("SSE connected:", e.data);
             sseConnected = true;
+            const id = Number(e.lastEventId) || 0;
+            if (id > (Number(lastEventId) || 0)) lastEventId = e.lastEventId;
         });
 
         eventSource.addEventListener("message", function (e) {
+            // Missed events are replayed after the snapshot, so the ID only moves forward
+            const id = Number(e.lastEventId) || 0;
+            if (id > (Number(lastEventId) || 0)) lastEventId = e.lastEventId;
             try {
                 const event = JSON.parse(e.data);
+                // A call committed while the snapshot was read is in it, but its
+                // event may still come after the snapshot's version
+                const inSnapshot = (id && id <= snapshotVersion) ||
+                    (event.type === "queue_called" && snapshotCallIds.has(event.data.call_id));
+                if (event.type !== "snapshot" && inSnapshot) {
+                    // Already part of the snapshot; a missed call is still announced
+                    if (event.type === "queue_called") {
+                        queueAudio(event.data.queue_number, event.data.counter_name, event.data.queue_type);
+                    }
+                    return;
+                }
                 handleEvent(event);
             } catch (err) {
                 console.error("Failed to parse SSE message:", err);
@@ -625,6 +671,7 @@ function connectSSE() {
         eventSource.onerror = function () {
             console.error("SSE error, reconnecting...");
             sseConnected = false;
+            if (!snapshotReceived) loadDisplayData();
             eventSource.close();
             setTimeout(connectSSE, 5000);
         };
@@ -673,20 +720,77 @@ async function pollForUpdates() {
 // Handle SSE events
 function handleEvent(event) {
     switch (event.type) {
+        case "snapshot":
+            applySnapshot(event.data);
+            break;
         case "queue_called":
             handleQueueCalled(event.data);
             break;
+        case "resync": // missed events could not be replayed
+            if (!snapshotReceived) loadDisplayData();
+            loadQueueTypeCounts();
+            break;
         case "queue_updated":
         case "queue_added":
+        case "queue_transferred":
             loadInitialData();
             loadQueueTypeCounts();
             break;
+        case "eta_updated":
+            renderServiceETA(event.data);
+            break;
         case "settings_updated":
             updateDisplaySettings(event.data);
             break;
     }
 }
 
+// Apply the display state the server sends when the connection opens
+function applySnapshot(snapshot) {
+    snapshotReceived = true;
+    snapshotVersion = snapshot.version || 0;
+
+    const stats = snapshot.stats || {};
+    document.getElementById("stat-waiting").textContent = stats.waiting_queues || 0;
+    document.getElementById("stat-called").textContent = stats.called_queues || 0;
+    document.getElementById("stat-completed").textContent = stats.completed_queues || 0;
+
+    // Counters come sorted by counter_number, with today's current queue
+    countersCache = snapshot.counters || [];
+    counterStatus = {};
+    countersCache.forEach(counter => {
+        const q = counter.current_queue;
+        if (q && q.status === 'called') {
+            counterStatus[counter.id] = {
+                queue_number: q.queue_number,
+                queue_type: q.queue_type,
+                called_at: q.called_at
+            };
+        }
+    });
+    renderCounterGrid();
+
+    renderQueueTypeCounts(snapshot.waiting_by_type || {});
+
+    displaySettings = snapshot.settings || {};
+    updateDisplaySettings(displaySettings);
+
+    // Recent calls, newest first
+    const calls = (snapshot.recent_calls || []).map(call => ({
+        queue_number: call.queue_number,
+        counter_name: call.counter_name,
+        counter_id: call.counter_id,
+        queue_type: call.queue_type,
+        timestamp: new Date(call.timestamp)
+    }));
+    snapshotCallIds = new Set((snapshot.recent_calls || []).map(call => call.call_id));
+    recentCalls = calls.slice(0, MAX_RECENT_CALLS);
+    callHistory = calls.slice(0, MAX_HISTORY);
+    if (calls.length > 0) lastQueueCalled = calls[0].queue_number;
+    renderRecentCalls();
+    renderHistory();
+}
+
 // Handle queue called event
 function handleQueueCalled(data) {
     const timestamp = new Date();
@@ -6,6 +6,7 @@ let selectedTypePrefix = null;
 let selectedCounterId  = null;
 let hasCurrentQueue    = false;
 let eventSource        = null;
+let lastEventId        = ''; // sent on reconnect so the server replays missed events
 
 // ── Init ──────────────────────────────────────────────────────
 
@@ -197,15 +198,19 @@ function updateControlUI(counter) {
 function connectSSE(counterId) {
     disconnectSSE();
     try {
-        eventSource = new EventSource('/api/sse/counter/' + counterId);
+        eventSource = new EventSource('/api/sse/counter/' + counterId + (lastEventId ? '?last_event_id=' + lastEventId : ''));
 
         eventSource.onopen = () => updateConnStatus(true);
-        eventSource.addEventListener('connected', () => updateConnStatus(true));
+        eventSource.addEventListener('connected', function (e) {
+            if (e.lastEventId) lastEventId = e.lastEventId;
+            updateConnStatus(true);
+        });
 
         eventSource.addEventListener('message', function (e) {
+            if (e.lastEventId) lastEventId = e.lastEventId;
             try {
                 const event = JSON.parse(e.data);
-                if (['queue_updated', 'queue_added', 'queue_reset'].includes(event.type)) {
+                if (['queue_updated', 'queue_added', 'queue_reset', 'resync'].includes(event.type)) {
                     loadCounterData();
                     loadStatsByType();
                     loadAllCounters();